@@ -58,6 +58,7 @@ Logging Options:
 JetStream Options:
     -js, --jetstream                 Enable JetStream functionality
     -sd, --store_dir <dir>           Set the storage directory
+        --js_restore <file>          Restore a stream from a backup on startup (can be repeated)
 
 Authorization Options:
         --user <user>                User required for connections
@@ -80,6 +81,9 @@ Cluster Options:
         --connect_retries <number>   For implicit routes, number of connect retries
         --cluster_listen <url>       Cluster url from which members can solicit routes
 
+Store Commands:
+        store <command> <dir>        Inspect, export or repair a stream offline (see "nats-server store -h")
+
 Profiling Options:
         --profile <port>             Profiling HTTP port
 
@@ -98,6 +102,14 @@ func usage() {
 func main() {
 	exe := "nats-server"
 
+	// Run the offline store tool if requested.
+	if len(os.Args) > 1 && os.Args[1] == "store" {
+		if err := server.RunStoreTool(os.Args[2:], os.Stdout); err != nil {
+			server.PrintAndDie(fmt.Sprintf("%s: %s", exe, err))
+		}
+		os.Exit(0)
+	}
+
 	// Create a FlagSet and sets the usage
 	fs := flag.NewFlagSet(exe, flag.ExitOnError)
 	fs.Usage = usage
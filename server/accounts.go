@@ -52,35 +52,36 @@ var maxSubLimitReportThreshold = defaultMaxSubLimitReportThreshold
 type Account struct {
 	stats
 	gwReplyMapping
-	Name         string
-	Nkey         string
-	Issuer       string
-	claimJWT     string
-	updated      time.Time
-	mu           sync.RWMutex
-	sqmu         sync.Mutex
-	sl           *Sublist
-	ic           *client
-	isid         uint64
-	etmr         *time.Timer
-	ctmr         *time.Timer
-	strack       map[string]sconns
-	nrclients    int32
-	sysclients   int32
-	nleafs       int32
-	nrleafs      int32
-	clients      map[*client]struct{}
-	rm           map[string]int32
-	lqws         map[string]int32
-	usersRevoked map[string]int64
-	mappings     []*mapping
-	lmu          sync.RWMutex
-	lleafs       []*client
-	leafClusters map[string]uint64
-	imports      importMap
-	exports      exportMap
-	js           *jsAccount
-	jsLimits     map[string]JetStreamAccountLimits
+	Name          string
+	Nkey          string
+	Issuer        string
+	claimJWT      string
+	updated       time.Time
+	mu            sync.RWMutex
+	sqmu          sync.Mutex
+	sl            *Sublist
+	ic            *client
+	isid          uint64
+	etmr          *time.Timer
+	ctmr          *time.Timer
+	strack        map[string]sconns
+	nrclients     int32
+	sysclients    int32
+	nleafs        int32
+	nrleafs       int32
+	clients       map[*client]struct{}
+	rm            map[string]int32
+	lqws          map[string]int32
+	usersRevoked  map[string]int64
+	mappings      []*mapping
+	lmu           sync.RWMutex
+	lleafs        []*client
+	leafClusters  map[string]uint64
+	imports       importMap
+	exports       exportMap
+	js            *jsAccount
+	jsLimits      map[string]JetStreamAccountLimits
+	jsAutoStreams []*AutoStreamConfig
 	limits
 	expired      bool
 	incomplete   bool
@@ -313,6 +314,7 @@ func (a *Account) shallowCopy(na *Account) {
 	}
 	// JetStream
 	na.jsLimits = a.jsLimits
+	na.jsAutoStreams = a.jsAutoStreams
 	// Server config account limits.
 	na.limits = a.limits
 }
@@ -772,6 +774,29 @@ func transformUntokenize(subject string) (string, []string) {
 	return strings.Join(nda, tsep), phs
 }
 
+// mappingDestinationToFilter will return a filter subject that covers everything the
+// mapping destination could produce. Wildcard and partition tokens become partial
+// wildcards, and since split and slice functions can produce a variable number of
+// tokens everything from such a token on becomes a full wildcard.
+func mappingDestinationToFilter(dest string) string {
+	var nda []string
+	for _, token := range strings.Split(dest, tsep) {
+		tt, _, _, _, err := indexPlaceHolders(token)
+		if err != nil {
+			return dest
+		}
+		switch tt {
+		case NoTransform:
+			nda = append(nda, token)
+		case Wildcard, Partition:
+			nda = append(nda, pwcs)
+		default:
+			return strings.Join(append(nda, fwcs), tsep)
+		}
+	}
+	return strings.Join(nda, tsep)
+}
+
 // RemoveMapping will remove an existing mapping.
 func (a *Account) RemoveMapping(src string) bool {
 	a.mu.Lock()
@@ -1564,6 +1589,37 @@ func (a *Account) checkServiceImportsForCycles(from string, visited map[string]b
 	return nil
 }
 
+// streamImportCovering returns our stream import from the given account whose
+// subject covers the given subject, as long as that account still approves it.
+// Lock should not be held.
+func (a *Account) streamImportCovering(account *Account, subject string) *streamImport {
+	var si *streamImport
+	a.mu.RLock()
+	for _, im := range a.imports.streams {
+		if im.acc == account && !im.invalid && subjectIsSubsetMatch(subject, im.from) {
+			si = im
+			break
+		}
+	}
+	a.mu.RUnlock()
+	if si == nil || !account.checkStreamImportAuthorized(a, subject, si.claim) {
+		return nil
+	}
+	return si
+}
+
+// mapSubject returns the subject a message published on subject in the
+// exporting account is delivered on in the importing account.
+func (si *streamImport) mapSubject(subject string) string {
+	if si.tr != nil {
+		to, _ := si.tr.transformSubject(subject)
+		return to
+	} else if si.usePub {
+		return subject
+	}
+	return si.to
+}
+
 func (a *Account) streamImportFormsCycle(dest *Account, to string) error {
 	return dest.checkStreamImportsForCycles(to, map[string]bool{a.Name: true})
 }
@@ -0,0 +1,184 @@
+// Copyright 2023 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/minio/highwayhash"
+)
+
+// backendStore wraps a stream store from a registered storage backend.
+// We maintain the metadata for the stream and its consumers so that the
+// upper layers can recover them like file based streams.
+type backendStore struct {
+	StreamStore
+	mu  sync.Mutex
+	st  StorageType
+	dir string
+	cfg FileStreamInfo
+}
+
+// backendConsumerStore wraps a consumer store from a storage backend.
+type backendConsumerStore struct {
+	ConsumerStore
+	mu   sync.Mutex
+	dir  string
+	hkey string
+	cfg  FileConsumerInfo
+}
+
+// Create the store for a stream using a registered storage backend.
+func newBackendStore(sb *storageBackend, dir string, cfg StreamConfig, created time.Time) (*backendStore, error) {
+	if err := os.MkdirAll(dir, defaultDirPerms); err != nil {
+		return nil, fmt.Errorf("could not create storage directory - %v", err)
+	}
+	// Keep our created time if we are recovering.
+	var fcfg FileStreamInfo
+	if buf, err := os.ReadFile(filepath.Join(dir, JetStreamMetaFile)); err == nil {
+		if json.Unmarshal(buf, &fcfg) == nil && !fcfg.Created.IsZero() {
+			created = fcfg.Created
+		}
+	}
+
+	ss, err := sb.backend.NewStreamStore(dir, cfg)
+	if err != nil {
+		return nil, err
+	}
+	if ss == nil {
+		return nil, fmt.Errorf("storage backend %q returned no store", sb.name)
+	}
+	bs := &backendStore{
+		StreamStore: ss,
+		st:          cfg.Storage,
+		dir:         dir,
+		cfg:         FileStreamInfo{Created: created, StreamConfig: cfg},
+	}
+	if err := writeMetaFile(dir, cfg.Name, &bs.cfg); err != nil {
+		ss.Stop()
+		return nil, err
+	}
+	return bs, nil
+}
+
+// Write out the metadata and its checksum for the upper layers to recover from.
+func writeMetaFile(dir, hkey string, v interface{}) error {
+	return writeMetaFileWithKey(dir, hkey, v, nil)
+}
+
+// Same as writeMetaFile but encrypts the metadata with aek if set, as file stores do.
+func writeMetaFileWithKey(dir, hkey string, v interface{}, aek cipher.AEAD) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if aek != nil {
+		b = sealPersisted(aek, b)
+	}
+	if err := os.WriteFile(filepath.Join(dir, JetStreamMetaFile), b, defaultFilePerms); err != nil {
+		return err
+	}
+	key := sha256.Sum256([]byte(hkey))
+	hh, err := highwayhash.New64(key[:])
+	if err != nil {
+		return err
+	}
+	hh.Write(b)
+	checksum := hex.EncodeToString(hh.Sum(nil))
+	return os.WriteFile(filepath.Join(dir, JetStreamMetaFileSum), []byte(checksum), defaultFilePerms)
+}
+
+// Type returns the storage type the backend was registered with.
+func (bs *backendStore) Type() StorageType {
+	return bs.st
+}
+
+// UpdateConfig will update the backend and our metadata.
+func (bs *backendStore) UpdateConfig(cfg *StreamConfig) error {
+	if err := bs.StreamStore.UpdateConfig(cfg); err != nil {
+		return err
+	}
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	bs.cfg.StreamConfig = *cfg
+	return writeMetaFile(bs.dir, cfg.Name, &bs.cfg)
+}
+
+// Delete will delete the backend's store and our directory.
+func (bs *backendStore) Delete() error {
+	err := bs.StreamStore.Delete()
+	if rerr := os.RemoveAll(bs.dir); err == nil {
+		err = rerr
+	}
+	return err
+}
+
+// ConsumerStore creates the consumer store with the backend, and writes our metadata for it.
+func (bs *backendStore) ConsumerStore(name string, cfg *ConsumerConfig) (ConsumerStore, error) {
+	odir := filepath.Join(bs.dir, consumerDir, name)
+	if err := os.MkdirAll(odir, defaultDirPerms); err != nil {
+		return nil, fmt.Errorf("could not create consumer directory - %v", err)
+	}
+	csi := FileConsumerInfo{Name: name, Created: time.Now().UTC(), ConsumerConfig: *cfg}
+	// Keep our created time if we are recovering.
+	if buf, err := os.ReadFile(filepath.Join(odir, JetStreamMetaFile)); err == nil {
+		var ocsi FileConsumerInfo
+		if json.Unmarshal(buf, &ocsi) == nil && !ocsi.Created.IsZero() {
+			csi.Created = ocsi.Created
+		}
+	}
+
+	cs, err := bs.StreamStore.ConsumerStore(name, cfg)
+	if err != nil {
+		return nil, err
+	}
+	bs.mu.Lock()
+	hkey := bs.cfg.Name + "/" + name
+	bs.mu.Unlock()
+
+	o := &backendConsumerStore{ConsumerStore: cs, dir: odir, hkey: hkey, cfg: csi}
+	if err := writeMetaFile(odir, hkey, &o.cfg); err != nil {
+		cs.Stop()
+		return nil, err
+	}
+	return o, nil
+}
+
+// UpdateConfig will update the backend and our metadata.
+func (o *backendConsumerStore) UpdateConfig(cfg *ConsumerConfig) error {
+	if err := o.ConsumerStore.UpdateConfig(cfg); err != nil {
+		return err
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.cfg.ConsumerConfig = *cfg
+	return writeMetaFile(o.dir, o.hkey, &o.cfg)
+}
+
+// Delete will delete the backend's consumer store and our directory.
+func (o *backendConsumerStore) Delete() error {
+	err := o.ConsumerStore.Delete()
+	if rerr := os.RemoveAll(o.dir); err == nil {
+		err = rerr
+	}
+	return err
+}
@@ -0,0 +1,249 @@
+// Copyright 2023 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"container/list"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// BlockArchive is where file based streams offload their sealed message blocks once
+// they are older than the stream's archive threshold. Archived blocks are fetched on
+// demand when they are read, while their indexes stay local. Keys are slash separated
+// paths that are unique to a block of a stream on a given server.
+//
+// A local directory implementation is provided by NewDirBlockArchive, and embedders can
+// register others, for instance for object storage, with RegisterBlockArchive.
+type BlockArchive interface {
+	// Put stores the contents of a block under key, replacing anything already there.
+	Put(key string, data []byte) error
+	// Get returns the contents of the block stored under key.
+	Get(key string) ([]byte, error)
+	// Delete removes the block stored under key. Deleting a missing key is not an error.
+	Delete(key string) error
+}
+
+// Registered block archives.
+var (
+	baMu       sync.RWMutex
+	baArchives = make(map[string]BlockArchive)
+)
+
+// RegisterBlockArchive registers a block archive under the given name, which can then be
+// selected with the JetStream archive backend option. This should be done before starting
+// any servers.
+func RegisterBlockArchive(name string, archive BlockArchive) error {
+	name = strings.ToLower(name)
+	if name == _EMPTY_ || archive == nil {
+		return errors.New("block archive requires a name and an archive")
+	}
+	baMu.Lock()
+	defer baMu.Unlock()
+	if _, ok := baArchives[name]; ok {
+		return fmt.Errorf("block archive %q already registered", name)
+	}
+	baArchives[name] = archive
+	return nil
+}
+
+// Returns the registered block archive with this name, nil if not one.
+func registeredBlockArchive(name string) BlockArchive {
+	baMu.RLock()
+	defer baMu.RUnlock()
+	return baArchives[strings.ToLower(name)]
+}
+
+// Default bytes of fetched blocks we keep locally.
+const defaultArchiveCacheSize = 64 * 1024 * 1024
+
+// cachedBlockArchive keeps the most recently fetched blocks of an archive locally, up to
+// a limit in bytes, so blocks that are read again do not have to be fetched again.
+type cachedBlockArchive struct {
+	BlockArchive
+	mu   sync.Mutex
+	max  int64
+	size int64
+	lru  *list.List
+	blks map[string]*list.Element
+}
+
+type cachedBlock struct {
+	key string
+	buf []byte
+}
+
+// Wrap ba with a cache of fetched blocks holding up to max bytes.
+func newCachedBlockArchive(ba BlockArchive, max int64) *cachedBlockArchive {
+	return &cachedBlockArchive{BlockArchive: ba, max: max, lru: list.New(), blks: make(map[string]*list.Element)}
+}
+
+// Get returns a copy of the block, fetching it from the archive if we do not have it.
+func (ca *cachedBlockArchive) Get(key string) ([]byte, error) {
+	if buf := ca.cached(key); buf != nil {
+		return buf, nil
+	}
+	buf, err := ca.BlockArchive.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	ca.add(key, buf)
+	return buf, nil
+}
+
+// Put drops anything we have for key before storing the block.
+func (ca *cachedBlockArchive) Put(key string, data []byte) error {
+	ca.remove(key)
+	return ca.BlockArchive.Put(key, data)
+}
+
+// Delete drops anything we have for key before removing the block.
+func (ca *cachedBlockArchive) Delete(key string) error {
+	ca.remove(key)
+	return ca.BlockArchive.Delete(key)
+}
+
+// Returns true if we have the block for key.
+func (ca *cachedBlockArchive) has(key string) bool {
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+	_, ok := ca.blks[key]
+	return ok
+}
+
+// Returns a copy of the block for key if we have it, nil otherwise.
+// Callers are free to modify it, for instance to decrypt it in place.
+func (ca *cachedBlockArchive) cached(key string) []byte {
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+	e, ok := ca.blks[key]
+	if !ok {
+		return nil
+	}
+	ca.lru.MoveToFront(e)
+	return append([]byte(nil), e.Value.(*cachedBlock).buf...)
+}
+
+// Keep a copy of a fetched block, dropping the least recently used ones when over our limit.
+func (ca *cachedBlockArchive) add(key string, buf []byte) {
+	sz := int64(len(buf))
+	if sz > ca.max {
+		return
+	}
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+	if _, ok := ca.blks[key]; ok {
+		return
+	}
+	for ca.size+sz > ca.max {
+		e := ca.lru.Back()
+		cb := ca.lru.Remove(e).(*cachedBlock)
+		delete(ca.blks, cb.key)
+		ca.size -= int64(len(cb.buf))
+	}
+	ca.blks[key] = ca.lru.PushFront(&cachedBlock{key, append([]byte(nil), buf...)})
+	ca.size += sz
+}
+
+// Drop the block for key if we have it.
+func (ca *cachedBlockArchive) remove(key string) {
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+	if e, ok := ca.blks[key]; ok {
+		cb := ca.lru.Remove(e).(*cachedBlock)
+		delete(ca.blks, key)
+		ca.size -= int64(len(cb.buf))
+	}
+}
+
+// dirBlockArchive keeps archived blocks in a local directory,
+// for instance on a large and slow volume.
+type dirBlockArchive struct {
+	dir string
+}
+
+// NewDirBlockArchive returns a block archive that keeps blocks in dir.
+func NewDirBlockArchive(dir string) (BlockArchive, error) {
+	if dir == _EMPTY_ {
+		return nil, errors.New("block archive requires a directory")
+	}
+	if err := os.MkdirAll(dir, defaultDirPerms); err != nil {
+		return nil, fmt.Errorf("could not create block archive directory - %v", err)
+	}
+	return &dirBlockArchive{dir: dir}, nil
+}
+
+// Returns the file for key, making sure it stays within our directory.
+func (da *dirBlockArchive) file(key string) (string, error) {
+	ckey := path.Clean("/" + key)
+	if ckey == "/" || ckey != "/"+key {
+		return _EMPTY_, fmt.Errorf("invalid block archive key %q", key)
+	}
+	return filepath.Join(da.dir, filepath.FromSlash(ckey[1:])), nil
+}
+
+// Put will write the block to a temporary file and rename it once synced.
+func (da *dirBlockArchive) Put(key string, data []byte) error {
+	fn, err := da.file(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(fn), defaultDirPerms); err != nil {
+		return err
+	}
+	tmp := fn + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, defaultFilePerms)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(data); err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, fn)
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
+
+// Get will read the block from its file.
+func (da *dirBlockArchive) Get(key string) ([]byte, error) {
+	fn, err := da.file(key)
+	if err != nil {
+		return nil, err
+	}
+	return os.ReadFile(fn)
+}
+
+// Delete will remove the block's file.
+func (da *dirBlockArchive) Delete(key string) error {
+	fn, err := da.file(key)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(fn); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
@@ -1550,6 +1550,28 @@ func TestConfigCheck(t *testing.T) {
                         `,
 			err: fmt.Errorf(`Duplicate 'store_dir' configuration`),
 		},
+		{
+			name: "store dirs without a directory",
+			config: `
+				jetstream {
+					store_dirs: { fast: "" }
+				}
+			`,
+			err:       fmt.Errorf(`Expected a directory for store directory "fast", got `),
+			errorLine: 3,
+			errorPos:  20,
+		},
+		{
+			name: "store dirs with invalid name",
+			config: `
+				jetstream {
+					store_dirs: { "fast.dir": "/nvme" }
+				}
+			`,
+			err:       fmt.Errorf(`Invalid store directory name "fast.dir"`),
+			errorLine: 3,
+			errorPos:  21,
+		},
 		{
 			name: "token not supported in cluster",
 			config: `
@@ -51,6 +51,7 @@ type ConsumerInfo struct {
 	NumPending     uint64          `json:"num_pending"`
 	Cluster        *ClusterInfo    `json:"cluster,omitempty"`
 	PushBound      bool            `json:"push_bound,omitempty"`
+	Stats          *ConsumerStats  `json:"stats,omitempty"`
 }
 
 type ConsumerConfig struct {
@@ -67,7 +68,9 @@ type ConsumerConfig struct {
 	BackOff         []time.Duration `json:"backoff,omitempty"`
 	FilterSubject   string          `json:"filter_subject,omitempty"`
 	ReplayPolicy    ReplayPolicy    `json:"replay_policy"`
-	RateLimit       uint64          `json:"rate_limit_bps,omitempty"` // Bits per sec
+	RateLimit       uint64          `json:"rate_limit_bps,omitempty"`  // Bits per sec
+	RateLimitMsgs   uint64          `json:"rate_limit_msgs,omitempty"` // Msgs per sec
+	RateLimitBurst  int             `json:"rate_limit_burst,omitempty"`
 	SampleFrequency string          `json:"sample_freq,omitempty"`
 	MaxWaiting      int             `json:"max_waiting,omitempty"`
 	MaxAckPending   int             `json:"max_ack_pending,omitempty"`
@@ -94,6 +97,15 @@ type ConsumerConfig struct {
 
 	// Don't add to general clients.
 	Direct bool `json:"direct,omitempty"`
+
+	// Ordered has the server keep delivery in order without gaps. On loss of interest
+	// delivery resumes after the last position confirmed through flow control.
+	Ordered bool `json:"ordered,omitempty"`
+
+	// Stats enables tracking of delivery and ack latencies and redelivery counts.
+	Stats bool `json:"stats,omitempty"`
+	// StatsInterval, if set, publishes the stats periodically as an advisory.
+	StatsInterval time.Duration `json:"stats_interval,omitempty"`
 }
 
 // SequenceInfo has both the consumer and the stream sequence and last activity.
@@ -249,6 +261,7 @@ type consumer struct {
 	qgroup            string
 	lss               *lastSeqSkipList
 	rlimit            *rate.Limiter
+	mrlimit           *rate.Limiter
 	reqSub            *subscription
 	ackSub            *subscription
 	ackReplyT         string
@@ -278,6 +291,12 @@ type consumer struct {
 	filterWC          bool
 	dtmr              *time.Timer
 	gwdtmr            *time.Timer
+	cptmr             *time.Timer
+	cps               []*consumerCheckpoint
+	stats             *consumerStats
+	sttmr             *time.Timer
+	ofc               SequencePair
+	olast             SequencePair
 	dthresh           time.Duration
 	mch               chan struct{}
 	qch               chan struct{}
@@ -332,6 +351,11 @@ const (
 	JsFlowControlMaxPending = 32 * 1024 * 1024
 	// JsDefaultMaxAckPending is set for consumers with explicit ack that do not set the max ack pending.
 	JsDefaultMaxAckPending = 1000
+	// JsOrderedHeartbeatDefault is the default idle heartbeat for ordered consumers.
+	JsOrderedHeartbeatDefault = 5 * time.Second
+	// JsOrderedInactiveThresholdDefault is the default inactive threshold for ordered consumers,
+	// which is long enough to survive reconnects.
+	JsOrderedInactiveThresholdDefault = 5 * time.Minute
 )
 
 // Helper function to set consumer config defaults from above.
@@ -344,6 +368,22 @@ func setConsumerConfigDefaults(config *ConsumerConfig, lim *JSLimitOpts, accLim
 	if config.AckWait == 0 && (config.AckPolicy == AckExplicit || config.AckPolicy == AckAll) {
 		config.AckWait = JsAckWaitDefault
 	}
+	// Ordered consumers are R1 memory based push consumers with flow control and no acks.
+	if config.Ordered {
+		if config.MaxDeliver == 0 {
+			config.MaxDeliver = 1
+		}
+		if config.Heartbeat == 0 {
+			config.Heartbeat = JsOrderedHeartbeatDefault
+		}
+		if config.InactiveThreshold == 0 {
+			config.InactiveThreshold = JsOrderedInactiveThresholdDefault
+		}
+		if config.Replicas == 0 {
+			config.Replicas = 1
+		}
+		config.FlowControl, config.MemoryStorage = true, true
+	}
 	// Setup default of -1, meaning no limit for MaxDeliver.
 	if config.MaxDeliver == 0 {
 		config.MaxDeliver = -1
@@ -398,6 +438,37 @@ func checkConsumerCfg(
 		}
 	}
 
+	if config.RateLimitBurst < 0 || (config.RateLimitBurst > 0 && config.RateLimitMsgs == 0) {
+		return NewJSConsumerRateLimitBurstInvalidError()
+	}
+
+	if config.StatsInterval < 0 {
+		return NewJSConsumerStatsIntervalNegativeError()
+	}
+
+	if config.Ordered {
+		var err error
+		switch {
+		case config.DeliverSubject == _EMPTY_:
+			err = errors.New("requires a deliver subject")
+		case config.DeliverGroup != _EMPTY_:
+			err = errors.New("can not have a deliver group")
+		case config.Durable != _EMPTY_:
+			err = errors.New("can not be durable")
+		case config.AckPolicy != AckNone:
+			err = errors.New("requires ack policy none")
+		case config.MaxDeliver != 1:
+			err = errors.New("requires max deliver of 1")
+		case config.Replicas != 1:
+			err = errors.New("requires a single replica")
+		case !config.FlowControl || !config.MemoryStorage:
+			err = errors.New("requires flow control and memory storage")
+		}
+		if err != nil {
+			return NewJSConsumerOrderedInvalidError(err)
+		}
+	}
+
 	// Check if we have a BackOff defined that MaxDeliver is within range etc.
 	if lbo := len(config.BackOff); lbo > 0 && config.MaxDeliver <= lbo {
 		return NewJSConsumerMaxDeliverBackoffError()
@@ -792,6 +863,10 @@ func (mset *stream) addConsumerWithAssignment(config *ConsumerConfig, oname stri
 		// Select starting sequence number
 		o.selectStartingSeqNo()
 	}
+	// Ordered consumers resume from here until the client confirms more.
+	if config.Ordered {
+		o.olast = SequencePair{Consumer: o.dseq - 1, Stream: o.sseq - 1}
+	}
 
 	// Now register with mset and create the ack subscription.
 	// Check if we already have this one registered.
@@ -855,6 +930,9 @@ func (mset *stream) addConsumerWithAssignment(config *ConsumerConfig, oname stri
 	if config.RateLimit != 0 {
 		o.setRateLimit(config.RateLimit)
 	}
+	if config.RateLimitMsgs != 0 {
+		o.setMsgRateLimit(config.RateLimitMsgs, config.RateLimitBurst)
+	}
 
 	mset.setConsumer(o)
 	mset.mu.Unlock()
@@ -1107,8 +1185,13 @@ func (o *consumer) setLeader(isLeader bool) {
 			o.pch = make(chan struct{}, 1)
 		}
 		pullMode := o.isPullMode()
+		// Start tracking stats if configured.
+		o.setupStats()
 		o.mu.Unlock()
 
+		// Start checkpointing our state if configured.
+		o.setupCheckpoints()
+
 		// Snapshot initial info.
 		o.infoWithSnap(true)
 
@@ -1141,6 +1224,9 @@ func (o *consumer) setLeader(isLeader bool) {
 		}
 		// Stop any inactivity timers. Should only be running on leaders.
 		stopAndClearTimer(&o.dtmr)
+		stopAndClearTimer(&o.cptmr)
+		stopAndClearTimer(&o.sttmr)
+		o.stats = nil
 
 		// Make sure to clear out any re-deliver queues
 		stopAndClearTimer(&o.ptmr)
@@ -1328,6 +1414,10 @@ func (o *consumer) updateDeliveryInterest(localInterest bool) bool {
 	if interest && !o.active {
 		o.signalNewMessages()
 	}
+	// Ordered consumers rewind to the last confirmed position when interest is lost.
+	if o.active && !interest && o.cfg.Ordered {
+		o.resetOrdered()
+	}
 	// Update active status, if not active clear any queue group we captured.
 	if o.active = interest; !o.active {
 		o.qgroup = _EMPTY_
@@ -1532,6 +1622,26 @@ func (o *consumer) setRateLimit(bps uint64) {
 	o.rlimit = rate.NewLimiter(rl, burst)
 }
 
+// Set the message count rate limiter. Burst defaults to a single message.
+// Lock should be held.
+func (o *consumer) setMsgRateLimit(mps uint64, burst int) {
+	if mps == 0 {
+		o.mrlimit = nil
+		return
+	}
+	if burst <= 0 {
+		burst = 1
+	}
+	// Keep existing tokens on an update.
+	if o.mrlimit != nil {
+		now := time.Now()
+		o.mrlimit.SetLimitAt(now, rate.Limit(mps))
+		o.mrlimit.SetBurstAt(now, burst)
+		return
+	}
+	o.mrlimit = rate.NewLimiter(rate.Limit(mps), burst)
+}
+
 // Check if new consumer config allowed vs old.
 func (acc *Account) checkNewConsumerConfig(cfg, ncfg *ConsumerConfig) error {
 	if reflect.DeepEqual(cfg, ncfg) {
@@ -1559,6 +1669,9 @@ func (acc *Account) checkNewConsumerConfig(cfg, ncfg *ConsumerConfig) error {
 	if cfg.FlowControl != ncfg.FlowControl {
 		return errors.New("flow control can not be updated")
 	}
+	if cfg.Ordered != ncfg.Ordered {
+		return errors.New("ordered can not be updated")
+	}
 	if cfg.MaxWaiting != ncfg.MaxWaiting {
 		return errors.New("max waiting can not be updated")
 	}
@@ -1622,6 +1735,9 @@ func (o *consumer) updateConfig(cfg *ConsumerConfig) error {
 		// We need both locks here so do in Go routine.
 		go o.setRateLimitNeedsLocks()
 	}
+	if cfg.RateLimitMsgs != o.cfg.RateLimitMsgs || cfg.RateLimitBurst != o.cfg.RateLimitBurst {
+		o.setMsgRateLimit(cfg.RateLimitMsgs, cfg.RateLimitBurst)
+	}
 	if cfg.SampleFrequency != o.cfg.SampleFrequency {
 		s := strings.TrimSuffix(cfg.SampleFrequency, "%")
 		// String has been already verified for validity up in the stack, so no
@@ -1659,8 +1775,14 @@ func (o *consumer) updateConfig(cfg *ConsumerConfig) error {
 
 	// Record new config for others that do not need special handling.
 	// Allowed but considered no-op, [Description, SampleFrequency, MaxWaiting, HeadersOnly]
+	statsChanged := cfg.Stats != o.cfg.Stats || cfg.StatsInterval != o.cfg.StatsInterval
 	o.cfg = *cfg
 
+	// Stats
+	if statsChanged {
+		o.setupStats()
+	}
+
 	// Re-calculate num pending on update.
 	o.streamNumPending()
 
@@ -2023,6 +2145,9 @@ func (o *consumer) processNak(sseq, dseq, dc uint64, nak []byte) {
 	if _, ok := o.pending[sseq]; !ok {
 		return
 	}
+	if o.stats != nil {
+		o.stats.rd.Nak++
+	}
 
 	// Deliver an advisory
 	e := JSConsumerDeliveryNakAdvisory{
@@ -2100,6 +2225,10 @@ func (o *consumer) processTerm(sseq, dseq, dc uint64) {
 	o.mu.Lock()
 	defer o.mu.Unlock()
 
+	if o.stats != nil {
+		o.stats.rd.Term++
+	}
+
 	// Deliver an advisory
 	e := JSConsumerDeliveryTerminatedAdvisory{
 		TypedEvent: TypedEvent{
@@ -2316,6 +2445,9 @@ func (o *consumer) infoWithSnapAndReply(snap bool, reply string) *ConsumerInfo {
 		NumPending:     o.checkNumPending(),
 		PushBound:      o.isPushMode() && o.active,
 	}
+	if o.stats != nil {
+		info.Stats = o.stats.report()
+	}
 
 	// If we are replicated and we are not the leader we need to pull certain data from our store.
 	if rg != nil && rg.node != nil && !o.isLeader() && o.store != nil {
@@ -2425,6 +2557,12 @@ func (o *consumer) processAckMsg(sseq, dseq, dc uint64, doSample bool) {
 	var sagap uint64
 	var needSignal bool
 
+	if doSample && o.stats != nil {
+		if p, ok := o.pending[sseq]; ok {
+			o.stats.ack.record(time.Duration(time.Now().UnixNano() - p.Timestamp))
+		}
+	}
+
 	switch o.cfg.AckPolicy {
 	case AckExplicit:
 		if p, ok := o.pending[sseq]; ok {
@@ -3569,10 +3707,17 @@ func (o *consumer) loopAndGatherMsgs(qch chan struct{}) {
 		lts = pmsg.ts
 
 		// If we have a rate limit set make sure we check that here.
-		if o.rlimit != nil {
+		if o.rlimit != nil || o.mrlimit != nil {
 			now := time.Now()
-			r := o.rlimit.ReserveN(now, sz)
-			delay := r.DelayFrom(now)
+			var delay time.Duration
+			if o.rlimit != nil {
+				delay = o.rlimit.ReserveN(now, sz).DelayFrom(now)
+			}
+			if o.mrlimit != nil {
+				if d := o.mrlimit.ReserveN(now, 1).DelayFrom(now); d > delay {
+					delay = d
+				}
+			}
 			if delay > 0 {
 				o.mu.Unlock()
 				select {
@@ -3635,9 +3780,9 @@ func (o *consumer) loopAndGatherMsgs(qch chan struct{}) {
 			o.mu.Unlock()
 		case <-hbc:
 			if o.isActive() {
-				o.mu.RLock()
+				o.mu.Lock()
 				o.sendIdleHeartbeat(odsubj)
-				o.mu.RUnlock()
+				o.mu.Unlock()
 			}
 			// Reset our idle heartbeat timer.
 			hb.Reset(hbd)
@@ -3656,6 +3801,21 @@ func (o *consumer) sendIdleHeartbeat(subj string) {
 		hdr = append(hdr[:len(hdr)-LEN_CR_LF], []byte(addOn)...)
 	}
 	o.outq.send(newJSPubMsg(subj, _EMPTY_, _EMPTY_, hdr, nil, nil, 0))
+
+	// Ordered consumers have the client confirm what was delivered while idle.
+	if o.cfg.Ordered && o.fcid == _EMPTY_ && o.sseq-1 > o.olast.Stream {
+		o.sendFlowControl()
+	}
+}
+
+// resetOrdered rewinds delivery to the last position confirmed by the client,
+// keeping the consumer sequence without gaps.
+// Lock should be held.
+func (o *consumer) resetOrdered() {
+	o.sseq, o.dseq = o.olast.Stream+1, o.olast.Consumer+1
+	o.adflr, o.asflr = o.olast.Consumer, o.olast.Stream
+	o.pbytes, o.fcid, o.fcsz = 0, _EMPTY_, 0
+	o.streamNumPending()
 }
 
 func (o *consumer) ackReply(sseq, dseq, dc uint64, ts int64, pending uint64) string {
@@ -3786,6 +3946,10 @@ func (o *consumer) deliverMsg(dsubj, ackReply string, pmsg *jsPubMsg, dc uint64,
 	// Send message.
 	o.outq.send(pmsg)
 
+	if o.stats != nil && dc == 1 {
+		o.stats.deliver.record(time.Duration(time.Now().UnixNano() - ts))
+	}
+
 	if ap == AckExplicit || ap == AckAll {
 		o.trackPending(seq, dseq)
 	} else if ap == AckNone {
@@ -3856,6 +4020,11 @@ func (o *consumer) processFlowControl(_ *subscription, c *client, _ *Account, su
 	}
 	o.fcid, o.fcsz = _EMPTY_, 0
 
+	// The client has everything up to the flow control request.
+	if o.cfg.Ordered {
+		o.olast = o.ofc
+	}
+
 	o.signalNewMessages()
 }
 
@@ -3885,6 +4054,9 @@ func (o *consumer) sendFlowControl() {
 	}
 	subj, rply := o.cfg.DeliverSubject, o.fcReply()
 	o.fcsz, o.fcid = o.pbytes, rply
+	if o.cfg.Ordered {
+		o.ofc = SequencePair{Consumer: o.dseq - 1, Stream: o.sseq - 1}
+	}
 	hdr := []byte("NATS/1.0 100 FlowControl Request\r\n\r\n")
 	o.outq.send(newJSPubMsg(subj, _EMPTY_, rply, hdr, nil, nil, 0))
 }
@@ -4083,6 +4255,9 @@ func (o *consumer) checkPending() {
 		// We need to sort.
 		sort.Slice(expired, func(i, j int) bool { return expired[i] < expired[j] })
 		o.addToRedeliverQueue(expired...)
+		if o.stats != nil {
+			o.stats.rd.AckTimeout += uint64(len(expired))
+		}
 		// Now we should update the timestamp here since we are redelivering.
 		// We will use an incrementing time to preserve order for any other redelivery.
 		off := now - o.pending[expired[0]].Timestamp
@@ -4492,6 +4667,8 @@ func (o *consumer) stopWithFlags(dflag, sdflag, doSignal, advisory bool) error {
 	stopAndClearTimer(&o.ptmr)
 	stopAndClearTimer(&o.dtmr)
 	stopAndClearTimer(&o.gwdtmr)
+	stopAndClearTimer(&o.cptmr)
+	stopAndClearTimer(&o.sttmr)
 	delivery := o.cfg.DeliverSubject
 	o.waiting = nil
 	// Break us out of the readLoop.
@@ -0,0 +1,200 @@
+// Copyright 2023 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/json"
+	"math/bits"
+	"time"
+
+	"github.com/nats-io/nuid"
+)
+
+// ConsumerStats are latency and redelivery statistics for a consumer.
+// They are tracked by the consumer leader since it became leader.
+type ConsumerStats struct {
+	// DeliverLatency is the time from a message being stored to its first delivery.
+	DeliverLatency LatencyStats `json:"deliver_latency"`
+	// AckLatency is the time from a delivery to its ack.
+	AckLatency   LatencyStats    `json:"ack_latency"`
+	Redeliveries RedeliveryStats `json:"redeliveries"`
+}
+
+// LatencyStats summarizes a latency distribution.
+type LatencyStats struct {
+	Count uint64        `json:"count"`
+	Min   time.Duration `json:"min"`
+	Max   time.Duration `json:"max"`
+	Mean  time.Duration `json:"mean"`
+	P50   time.Duration `json:"p50"`
+	P90   time.Duration `json:"p90"`
+	P99   time.Duration `json:"p99"`
+}
+
+// RedeliveryStats counts redeliveries by reason.
+type RedeliveryStats struct {
+	AckTimeout uint64 `json:"ack_timeout"`
+	Nak        uint64 `json:"nak"`
+	Term       uint64 `json:"term"`
+}
+
+// Number of linear sub buckets per power of two. Bounds the error of
+// the reported percentiles to 1/latencySubBuckets.
+const (
+	latencySubBits    = 3
+	latencySubBuckets = 1 << latencySubBits
+)
+
+// latencyHistogram is a log-linear histogram of durations in nanoseconds.
+type latencyHistogram struct {
+	counts   [64 * latencySubBuckets]uint64
+	n        uint64
+	sum      uint64
+	min, max int64
+}
+
+func latencyBucket(d int64) int {
+	if d < latencySubBuckets {
+		if d < 0 {
+			return 0
+		}
+		return int(d)
+	}
+	e := bits.Len64(uint64(d)) - 1
+	m := (d >> (e - latencySubBits)) & (latencySubBuckets - 1)
+	return (e-latencySubBits+1)*latencySubBuckets + int(m)
+}
+
+// Returns the largest value that falls into bucket i.
+func latencyBucketMax(i int) int64 {
+	if i < latencySubBuckets {
+		return int64(i)
+	}
+	e := i/latencySubBuckets + latencySubBits - 1
+	m := int64(i % latencySubBuckets)
+	shift := e - latencySubBits
+	return (latencySubBuckets+m)<<shift + (1 << shift) - 1
+}
+
+func (h *latencyHistogram) record(d time.Duration) {
+	v := int64(d)
+	if v < 0 {
+		v = 0
+	}
+	if h.n == 0 || v < h.min {
+		h.min = v
+	}
+	if v > h.max {
+		h.max = v
+	}
+	h.n++
+	h.sum += uint64(v)
+	h.counts[latencyBucket(v)]++
+}
+
+// Returns the value at quantile q, with q in (0, 1].
+func (h *latencyHistogram) quantile(q float64) int64 {
+	target := uint64(q*float64(h.n) + 0.5)
+	if target == 0 {
+		target = 1
+	}
+	var total uint64
+	for i, c := range h.counts {
+		if total += c; total >= target {
+			if v := latencyBucketMax(i); v < h.max {
+				return v
+			}
+			return h.max
+		}
+	}
+	return h.max
+}
+
+func (h *latencyHistogram) stats() LatencyStats {
+	if h.n == 0 {
+		return LatencyStats{}
+	}
+	return LatencyStats{
+		Count: h.n,
+		Min:   time.Duration(h.min),
+		Max:   time.Duration(h.max),
+		Mean:  time.Duration(h.sum / h.n),
+		P50:   time.Duration(h.quantile(0.50)),
+		P90:   time.Duration(h.quantile(0.90)),
+		P99:   time.Duration(h.quantile(0.99)),
+	}
+}
+
+// consumerStats is what a consumer leader tracks when stats are enabled.
+type consumerStats struct {
+	deliver latencyHistogram
+	ack     latencyHistogram
+	rd      RedeliveryStats
+}
+
+func (cs *consumerStats) report() *ConsumerStats {
+	return &ConsumerStats{
+		DeliverLatency: cs.deliver.stats(),
+		AckLatency:     cs.ack.stats(),
+		Redeliveries:   cs.rd,
+	}
+}
+
+// setupStats starts or stops stats tracking and the stats advisory timer
+// based on our config and leadership.
+// Lock should be held.
+func (o *consumer) setupStats() {
+	stopAndClearTimer(&o.sttmr)
+	if !o.cfg.Stats || o.closed || !o.isLeader() {
+		o.stats = nil
+		return
+	}
+	if o.stats == nil {
+		o.stats = &consumerStats{}
+	}
+	if o.cfg.StatsInterval > 0 {
+		o.sttmr = time.AfterFunc(o.cfg.StatsInterval, o.sendStatsAdvisory)
+	}
+}
+
+// sendStatsAdvisory publishes our current stats and rearms the timer.
+func (o *consumer) sendStatsAdvisory() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if o.stats == nil || o.sttmr == nil {
+		return
+	}
+	o.sttmr.Reset(o.cfg.StatsInterval)
+
+	e := JSConsumerStatsAdvisory{
+		TypedEvent: TypedEvent{
+			Type: JSConsumerStatsAdvisoryType,
+			ID:   nuid.Next(),
+			Time: time.Now().UTC(),
+		},
+		Stream:   o.stream,
+		Consumer: o.name,
+		Stats:    o.stats.report(),
+		Domain:   o.srv.getOpts().JetStreamDomain,
+	}
+
+	j, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+
+	subj := JSAdvisoryConsumerStatsPre + "." + o.stream + "." + o.name
+	o.sendAdvisory(subj, j)
+}
@@ -30,7 +30,9 @@ import (
 	"math"
 	"net"
 	"os"
+	"path"
 	"path/filepath"
+	"runtime"
 	"sort"
 	"sync"
 	"sync/atomic"
@@ -40,6 +42,7 @@ import (
 
 	"github.com/klauspost/compress/s2"
 	"github.com/minio/highwayhash"
+	"github.com/nats-io/nats-server/v2/server/stree"
 	"golang.org/x/crypto/chacha20"
 	"golang.org/x/crypto/chacha20poly1305"
 )
@@ -57,8 +60,146 @@ type FileStoreConfig struct {
 	AsyncFlush bool
 	// Cipher is the cipher to use when encrypting.
 	Cipher StoreCipher
+	// CompactInterval is how often we look for sparse blocks to compact in the background.
+	// Background compaction is off unless this is set.
+	CompactInterval time.Duration
+	// CompactThreshold is the live byte ratio below which a block will be compacted.
+	CompactThreshold float64
+	// CompactMinBytes is the minimum number of reclaimable bytes for a block to be compacted.
+	CompactMinBytes uint64
+	// CompactLimiter paces background compaction and can be shared between file stores.
+	// Nil is unlimited.
+	CompactLimiter *RateLimiter
+	// ScrubInterval is the pause between background passes verifying our block checksums.
+	// A negative value disables background scrubbing.
+	ScrubInterval time.Duration
+	// ScrubLimiter paces background scrubbing and can be shared between file stores.
+	// Nil paces this store alone at the default scrub rate.
+	ScrubLimiter *RateLimiter
+	// Archive is where we offload sealed blocks older than the stream's archive threshold.
+	Archive BlockArchive
+	// ArchivePrefix is prepended to the keys of our blocks in the archive.
+	ArchivePrefix string
+	// ArchiveInterval is the pause between background passes looking for blocks to archive.
+	ArchiveInterval time.Duration
+	// ReadAhead bounds the memory of block caches we load ahead of sequential readers.
+	// It can be shared between file stores, nil disables read-ahead.
+	ReadAhead *ReadAheadBudget
+	// ReadOnly opens an existing store for offline tools. Recovery does not repair, rewrite
+	// or remove anything on disk, no background tasks are started and writes are rejected.
+	ReadOnly bool
+}
+
+// ScrubStats reports the results of background checksum scrubbing.
+type ScrubStats struct {
+	LastScrub time.Time `json:"last_scrub,omitempty"`
+	Blocks    uint64    `json:"blocks"`
+	Bytes     uint64    `json:"bytes"`
+	Corrupt   uint64    `json:"corrupt"`
+}
+
+// ArchiveStats reports on the blocks of a file store offloaded to its block archive.
+type ArchiveStats struct {
+	Blocks  uint64 `json:"blocks"`
+	Bytes   uint64 `json:"bytes"`
+	Fetches uint64 `json:"fetches"`
+}
+
+// CacheStats reports on the message block caches of a file store.
+// Hits and misses count reads that found the cache of their block loaded or had to load it.
+type CacheStats struct {
+	Hits       uint64 `json:"hits"`
+	Misses     uint64 `json:"misses"`
+	ReadAheads uint64 `json:"read_aheads"`
+	Bytes      uint64 `json:"bytes"`
+}
+
+// ReadAheadBudget bounds the memory used by the caches of message blocks
+// loaded ahead of sequential readers, usually for the whole server.
+type ReadAheadBudget struct {
+	max  int64
+	used atomic.Int64
+}
+
+// NewReadAheadBudget returns a budget of max bytes for read-ahead caches.
+func NewReadAheadBudget(max int64) *ReadAheadBudget {
+	return &ReadAheadBudget{max: max}
+}
+
+// Used returns the bytes of read-ahead caches currently held.
+func (b *ReadAheadBudget) Used() int64 {
+	return b.used.Load()
+}
+
+// Reserve n bytes, returns false if that would exceed our budget.
+func (b *ReadAheadBudget) reserve(n int64) bool {
+	for {
+		used := b.used.Load()
+		if used+n > b.max {
+			return false
+		}
+		if b.used.CompareAndSwap(used, used+n) {
+			return true
+		}
+	}
+}
+
+func (b *ReadAheadBudget) release(n int64) {
+	b.used.Add(-n)
+}
+
+// RateLimiter paces background work on blocks, such as compaction, to a number
+// of bytes per second, usually for the whole server.
+type RateLimiter struct {
+	mu   sync.Mutex
+	rate uint64
+	next time.Time
+}
+
+// NewRateLimiter returns a limiter of rate bytes per second, zero is unlimited.
+func NewRateLimiter(rate uint64) *RateLimiter {
+	return &RateLimiter{rate: rate}
+}
+
+// Wait for our share of the rate after working on n bytes.
+// Returns false if qch was closed while waiting.
+func (rl *RateLimiter) wait(n uint64, qch chan struct{}) bool {
+	if rl == nil || rl.rate == 0 || n == 0 {
+		return true
+	}
+	rl.mu.Lock()
+	now := time.Now()
+	if rl.next.Before(now) {
+		rl.next = now
+	}
+	rl.next = rl.next.Add(time.Duration(float64(n) / float64(rl.rate) * float64(time.Second)))
+	d := rl.next.Sub(now)
+	rl.mu.Unlock()
+
+	select {
+	case <-qch:
+		return false
+	case <-time.After(d):
+		return true
+	}
+}
+
+// SyncStats reports the syncs to disk done for a file store and the time spent in them.
+type SyncStats struct {
+	Syncs     uint64        `json:"syncs"`
+	TotalTime time.Duration `json:"total_time"`
+	MaxTime   time.Duration `json:"max_time"`
 }
 
+// KeyRotationInfo reports progress re-encrypting blocks with a new encryption key.
+type KeyRotationInfo struct {
+	Blocks  int `json:"blocks"`
+	Pending int `json:"pending"`
+}
+
+// StoreCorruptionHandler is used to be notified of corrupt messages found by the scrubber.
+type StoreCorruptionHandler func(first, last uint64, err error)
+
 // FileStreamInfo allows us to remember created time.
 type FileStreamInfo struct {
 	Created time.Time
@@ -113,14 +254,31 @@ type fileStore struct {
 	scb         StorageUpdateHandler
 	ageChk      *time.Timer
 	syncTmr     *time.Timer
+	sbTmr       *time.Timer
+	sblks       []*msgBlock
+	syncs       SyncStats
+	cmpTmr      *time.Timer
+	scrubTmr    *time.Timer
+	scrub       ScrubStats
+	arcTmr      *time.Timer
+	arch        *cachedBlockArchive
+	afetches    atomic.Uint64
+	chits       atomic.Uint64
+	cmisses     atomic.Uint64
+	raloads     atomic.Uint64
+	rap         atomic.Bool
+	ccb         StoreCorruptionHandler
 	cfg         FileStreamInfo
 	fcfg        FileStoreConfig
 	prf         keyGen
+	oldprf      keyGen
+	rotTmr      *time.Timer
+	rotBlks     int
 	aek         cipher.AEAD
 	lmb         *msgBlock
 	blks        []*msgBlock
 	bim         map[uint32]*msgBlock
-	psim        map[string]*psi
+	psim        *stree.SubjectTree[psi]
 	hh          hash.Hash64
 	qch         chan struct{}
 	cfs         []ConsumerStore
@@ -128,6 +286,7 @@ type fileStore struct {
 	closed      bool
 	fip         bool
 	receivedAny bool
+	tiered      bool
 }
 
 // Represents a message store block and its data.
@@ -150,8 +309,10 @@ type msgBlock struct {
 	bytes   uint64 // User visible bytes count.
 	rbytes  uint64 // Total bytes (raw) including deleted. Used for rolling to new blk.
 	msgs    uint64 // User visible message count.
-	fss     map[string]*SimpleState
+	fss     *stree.SubjectTree[SimpleState]
 	sfn     string
+	hidx    headerIndex
+	hnames  []string // Headers we index, our header index is loaded on demand.
 	kfn     string
 	lwits   int64
 	lwts    int64
@@ -161,6 +322,7 @@ type msgBlock struct {
 	hh      hash.Hash64
 	cache   *cache
 	cloads  uint64
+	rab     int64 // Bytes of our cache reserved from the read-ahead budget.
 	cexp    time.Duration
 	ctmr    *time.Timer
 	werr    error
@@ -171,11 +333,15 @@ type msgBlock struct {
 	loading bool
 	flusher bool
 	noTrack bool
+	rekey   bool
 	closed  bool
+	arc     bool
+	akey    string
 
 	// To avoid excessive writes when expiring cache.
 	// These can be big.
-	fssNeedsWrite bool
+	fssNeedsWrite  bool
+	hidxNeedsWrite bool
 
 	// Used to mock write failures.
 	mockWriteErr bool
@@ -214,24 +380,44 @@ const (
 	blkScan = "%d.blk"
 	// used for compacted blocks that are staged.
 	newScan = "%d.new"
+	// used for compacting blocks in the background
+	cmpScan = "%d.cmp"
+	// used for re-encrypting blocks in the background.
+	rencScan = "%d.renc"
 	// used to scan index file names.
 	indexScan = "%d.idx"
 	// used to load per subject meta information.
 	fssScan = "%d.fss"
 	// used to store our block encryption key.
 	keyScan = "%d.key"
+	// used to stage a new block encryption key during key rotation.
+	rkeyScan = "%d.rkey"
+	// used to mark blocks that were offloaded to our archive.
+	arcScan = "%d.arc"
+	// used to stage our archive marker before it is renamed into place.
+	arcNewScan = "%d.narc"
+	// used to stage a block restored from our archive.
+	unarcScan = "%d.unarc"
+	// used to persist the index of the stream's indexed headers for a block.
+	hdxScan = "%d.hdx"
 	// to look for orphans
 	keyScanAll = "*.key"
 	// This is where we keep state on consumers.
 	consumerDir = "obs"
 	// Index file for a consumer.
 	consumerState = "o.dat"
+	// Checkpoints file for a consumer.
+	consumerCheckpoints = "o.cps"
 	// This is where we keep state on templates.
 	tmplsDir = "templates"
 	// Maximum size of a write buffer we may consider for re-use.
 	maxBufReuse = 2 * 1024 * 1024
 	// default cache buffer expiration
 	defaultCacheBufferExpiration = 5 * time.Second
+	// default server wide budget for caches loaded ahead of sequential readers.
+	defaultReadAheadBudget = 64 * 1024 * 1024
+	// number of blocks we load ahead of a sequential reader.
+	readAheadBlocks = 2
 	// default sync interval
 	defaultSyncInterval = 60 * time.Second
 	// default idle timeout to close FDs.
@@ -265,6 +451,18 @@ const (
 	maxBlockSize = defaultLargeBlockSize
 	// Compact minimum threshold.
 	compactMinimum = 2 * 1024 * 1024 // 2MB
+	// Default live byte ratio below which a block is compacted in the background.
+	defaultCompactThreshold = 0.5
+	// Default minimum reclaimable bytes for a block to be compacted in the background.
+	defaultCompactMinBytes = 256 * 1024 // 256KB
+	// Default pause between background scrubbing passes.
+	defaultScrubInterval = time.Hour
+	// Default rate limit for background scrubbing.
+	defaultScrubRate = 4 * 1024 * 1024 // 4MB/s
+	// Default pause between passes looking for blocks to archive.
+	defaultArchiveInterval = time.Minute
+	// How long to wait before retrying to re-encrypt blocks after a key rotation.
+	keyRotationRetry = time.Second
 	// FileStoreMinBlkSize is minimum size we will do for a blk size.
 	FileStoreMinBlkSize = 32 * 1000 // 32kib
 	// FileStoreMaxBlkSize is maximum size we will do for a blk size.
@@ -280,14 +478,15 @@ const (
 )
 
 func newFileStore(fcfg FileStoreConfig, cfg StreamConfig) (*fileStore, error) {
-	return newFileStoreWithCreated(fcfg, cfg, time.Now().UTC(), nil)
+	return newFileStoreWithCreated(fcfg, cfg, time.Now().UTC(), nil, nil)
 }
 
-func newFileStoreWithCreated(fcfg FileStoreConfig, cfg StreamConfig, created time.Time, prf keyGen) (*fileStore, error) {
+// The oldprf is our previous key generator during a key rotation and is only used to read.
+func newFileStoreWithCreated(fcfg FileStoreConfig, cfg StreamConfig, created time.Time, prf, oldprf keyGen) (*fileStore, error) {
 	if cfg.Name == _EMPTY_ {
 		return nil, fmt.Errorf("name required")
 	}
-	if cfg.Storage != FileStorage {
+	if cfg.Storage != FileStorage && cfg.Storage != HybridStorage {
 		return nil, fmt.Errorf("fileStore requires file storage type in config")
 	}
 	// Default values.
@@ -303,32 +502,57 @@ func newFileStoreWithCreated(fcfg FileStoreConfig, cfg StreamConfig, created tim
 	if fcfg.SyncInterval == 0 {
 		fcfg.SyncInterval = defaultSyncInterval
 	}
+	if fcfg.CompactThreshold <= 0 {
+		fcfg.CompactThreshold = defaultCompactThreshold
+	}
+	if fcfg.CompactMinBytes == 0 {
+		fcfg.CompactMinBytes = defaultCompactMinBytes
+	}
+	if fcfg.ScrubInterval == 0 {
+		fcfg.ScrubInterval = defaultScrubInterval
+	}
+	if fcfg.ScrubLimiter == nil {
+		fcfg.ScrubLimiter = NewRateLimiter(defaultScrubRate)
+	}
+	if fcfg.ArchiveInterval == 0 {
+		fcfg.ArchiveInterval = defaultArchiveInterval
+	}
+	// We keep fetched blocks locally, servers share one cache between their stores.
+	arch, ok := fcfg.Archive.(*cachedBlockArchive)
+	if !ok && fcfg.Archive != nil {
+		arch = newCachedBlockArchive(fcfg.Archive, defaultArchiveCacheSize)
+		fcfg.Archive = arch
+	}
 
 	// Check the directory
-	if stat, err := os.Stat(fcfg.StoreDir); os.IsNotExist(err) {
+	if stat, err := os.Stat(fcfg.StoreDir); os.IsNotExist(err) && !fcfg.ReadOnly {
 		if err := os.MkdirAll(fcfg.StoreDir, defaultDirPerms); err != nil {
 			return nil, fmt.Errorf("could not create storage directory - %v", err)
 		}
 	} else if stat == nil || !stat.IsDir() {
 		return nil, fmt.Errorf("storage directory is not a directory")
 	}
-	tmpfile, err := os.CreateTemp(fcfg.StoreDir, "_test_")
-	if err != nil {
-		return nil, fmt.Errorf("storage directory is not writable")
-	}
+	if !fcfg.ReadOnly {
+		tmpfile, err := os.CreateTemp(fcfg.StoreDir, "_test_")
+		if err != nil {
+			return nil, fmt.Errorf("storage directory is not writable")
+		}
 
-	tmpfile.Close()
-	<-dios
-	os.Remove(tmpfile.Name())
-	dios <- struct{}{}
+		tmpfile.Close()
+		<-dios
+		os.Remove(tmpfile.Name())
+		dios <- struct{}{}
+	}
 
 	fs := &fileStore{
-		fcfg: fcfg,
-		psim: make(map[string]*psi),
-		bim:  make(map[uint32]*msgBlock),
-		cfg:  FileStreamInfo{Created: created, StreamConfig: cfg},
-		prf:  prf,
-		qch:  make(chan struct{}),
+		fcfg:   fcfg,
+		psim:   stree.NewSubjectTree[psi](),
+		bim:    make(map[uint32]*msgBlock),
+		cfg:    FileStreamInfo{Created: created, StreamConfig: cfg},
+		prf:    prf,
+		oldprf: oldprf,
+		qch:    make(chan struct{}),
+		arch:   arch,
 	}
 
 	// Set flush in place to AsyncFlush which by default is false.
@@ -337,15 +561,18 @@ func newFileStoreWithCreated(fcfg FileStoreConfig, cfg StreamConfig, created tim
 	// Check if this is a new setup.
 	mdir := filepath.Join(fcfg.StoreDir, msgDir)
 	odir := filepath.Join(fcfg.StoreDir, consumerDir)
-	if err := os.MkdirAll(mdir, defaultDirPerms); err != nil {
-		return nil, fmt.Errorf("could not create message storage directory - %v", err)
-	}
-	if err := os.MkdirAll(odir, defaultDirPerms); err != nil {
-		return nil, fmt.Errorf("could not create consumer storage directory - %v", err)
+	if !fcfg.ReadOnly {
+		if err := os.MkdirAll(mdir, defaultDirPerms); err != nil {
+			return nil, fmt.Errorf("could not create message storage directory - %v", err)
+		}
+		if err := os.MkdirAll(odir, defaultDirPerms); err != nil {
+			return nil, fmt.Errorf("could not create consumer storage directory - %v", err)
+		}
 	}
 
 	// Create highway hash for message blocks. Use sha256 of directory as key.
 	key := sha256.Sum256([]byte(cfg.Name))
+	var err error
 	fs.hh, err = highwayhash.New64(key[:])
 	if err != nil {
 		return nil, fmt.Errorf("could not create hash: %v", err)
@@ -358,11 +585,36 @@ func newFileStoreWithCreated(fcfg FileStoreConfig, cfg StreamConfig, created tim
 			return nil, errNoMainKey
 		}
 	}
+	// If we are rotating keys make sure our main key is wrapped with our current key.
+	if fs.prf != nil && fs.oldprf != nil && !fcfg.ReadOnly {
+		if ekey, err := os.ReadFile(keyFile); err == nil {
+			if len(ekey) < minMetaKeySize {
+				return nil, errBadKeySize
+			}
+			if seed, nonce, old, err := fs.openKeySeed(fs.fcfg.Cipher, fs.cfg.Name, ekey); err == nil && old {
+				if err := fs.rewrapKeyFile(keyFile, fs.cfg.Name, seed, nonce); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
 
 	// Recover our message state.
 	if err := fs.recoverMsgs(); err != nil {
 		return nil, err
 	}
+	// Read only stores are only recovered, we do not write our meta data or start any timers.
+	if fcfg.ReadOnly {
+		return fs, nil
+	}
+
+	// If the stream has an initial sequence number and we have not stored
+	// anything up to that point, make sure our state starts there.
+	if cfg.FirstSeq > 0 && fs.state.Msgs == 0 && fs.state.LastSeq+1 < cfg.FirstSeq {
+		if _, err := fs.purge(cfg.FirstSeq); err != nil {
+			return nil, err
+		}
+	}
 
 	// Write our meta data if it does not exist or is zero'd out.
 	meta := filepath.Join(fcfg.StoreDir, JetStreamMetaFile)
@@ -384,6 +636,19 @@ func newFileStoreWithCreated(fcfg FileStoreConfig, cfg StreamConfig, created tim
 	}
 
 	fs.syncTmr = time.AfterFunc(fs.fcfg.SyncInterval, fs.syncBlocks)
+	if fs.fcfg.CompactInterval > 0 {
+		fs.cmpTmr = time.AfterFunc(fs.fcfg.CompactInterval, fs.compactBlocks)
+	}
+	if fs.fcfg.ScrubInterval > 0 {
+		fs.scrubTmr = time.AfterFunc(fs.fcfg.ScrubInterval, fs.scrubBlocks)
+	}
+	if fs.fcfg.Archive != nil && fs.fcfg.ArchiveInterval > 0 {
+		fs.arcTmr = time.AfterFunc(fs.fcfg.ArchiveInterval, fs.archiveBlocks)
+	}
+	// Re-encrypt any blocks still using our previous key.
+	if fs.rotBlks > 0 {
+		fs.rotTmr = time.AfterFunc(0, fs.reencryptBlocks)
+	}
 
 	return fs, nil
 }
@@ -394,6 +659,13 @@ func (fs *fileStore) registerServer(s *Server) {
 	fs.srv = s
 }
 
+// Register a callback for corrupt messages found by the scrubber.
+func (fs *fileStore) registerCorruptionHandler(cb StoreCorruptionHandler) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.ccb = cb
+}
+
 // Lock all existing message blocks.
 // Lock held on entry.
 func (fs *fileStore) lockAllMsgBlocks() {
@@ -414,10 +686,13 @@ func (fs *fileStore) UpdateConfig(cfg *StreamConfig) error {
 	if fs.isClosed() {
 		return ErrStoreClosed
 	}
+	if fs.fcfg.ReadOnly {
+		return errStoreReadOnly
+	}
 	if cfg.Name == _EMPTY_ {
 		return fmt.Errorf("name required")
 	}
-	if cfg.Storage != FileStorage {
+	if cfg.Storage != FileStorage && cfg.Storage != HybridStorage {
 		return fmt.Errorf("fileStore requires file storage type in config")
 	}
 
@@ -454,6 +729,20 @@ func (fs *fileStore) UpdateConfig(cfg *StreamConfig) error {
 	if fs.cfg.MaxMsgsPer > 0 && fs.cfg.MaxMsgsPer < old_cfg.MaxMsgsPer {
 		fs.enforceMsgPerSubjectLimit()
 	}
+
+	// Rebuild our header indexes in the background if the indexed headers changed.
+	// Lookups will regenerate the index of any block we did not get to yet on demand.
+	if !newHeaderIndex(old_cfg.IndexedHeaders).indexes(fs.cfg.IndexedHeaders) {
+		blks := append([]*msgBlock(nil), fs.blks...)
+		for _, mb := range blks {
+			mb.mu.Lock()
+			mb.hnames, mb.hidx, mb.hidxNeedsWrite = fs.cfg.IndexedHeaders, nil, false
+			mb.mu.Unlock()
+		}
+		if len(fs.cfg.IndexedHeaders) > 0 {
+			go fs.rebuildHeaderIndexes(blks, fs.qch)
+		}
+	}
 	fs.mu.Unlock()
 
 	if cfg.MaxAge != 0 {
@@ -514,6 +803,31 @@ func genEncryptionKey(sc StoreCipher, seed []byte) (ek cipher.AEAD, err error) {
 	return ek, err
 }
 
+// Generate a new metafile key for the context, returns the key and its encrypted seed to
+// be written as the key file. This is how file stores generate their keys, minus the block key.
+func genMetaKey(sc StoreCipher, prf keyGen, context string) (cipher.AEAD, []byte, error) {
+	rb, err := prf([]byte(context))
+	if err != nil {
+		return nil, nil, err
+	}
+	kek, err := genEncryptionKey(sc, rb)
+	if err != nil {
+		return nil, nil, err
+	}
+	const seedSize = 32
+	seed := make([]byte, seedSize)
+	if n, err := rand.Read(seed); err != nil || n != seedSize {
+		return nil, nil, err
+	}
+	aek, err := genEncryptionKey(sc, seed)
+	if err != nil {
+		return nil, nil, err
+	}
+	nonce := make([]byte, kek.NonceSize(), kek.NonceSize()+len(seed)+kek.Overhead())
+	mrand.Read(nonce)
+	return aek, kek.Seal(nonce, nonce, seed, nil), nil
+}
+
 // Generate an asset encryption key from the context and server PRF.
 func (fs *fileStore) genEncryptionKeys(context string) (aek cipher.AEAD, bek cipher.Stream, seed, encrypted []byte, err error) {
 	if fs.prf == nil {
@@ -556,6 +870,54 @@ func (fs *fileStore) genEncryptionKeys(context string) (aek cipher.AEAD, bek cip
 	return aek, bek, seed, kek.Seal(nonce, nonce, seed, nil), nil
 }
 
+// Open an encrypted key seed for the given context and return it with its nonce.
+// During a key rotation we fall back to our previous key, in which case old will be true.
+func (fs *fileStore) openKeySeed(sc StoreCipher, context string, ekey []byte) (seed, nonce []byte, old bool, err error) {
+	for i, prf := range []keyGen{fs.prf, fs.oldprf} {
+		if prf == nil {
+			continue
+		}
+		rb, err := prf([]byte(context))
+		if err != nil {
+			return nil, nil, false, err
+		}
+		kek, err := genEncryptionKey(sc, rb)
+		if err != nil {
+			return nil, nil, false, err
+		}
+		ns := kek.NonceSize()
+		if seed, err = kek.Open(nil, ekey[:ns], ekey[ns:], nil); err == nil {
+			return seed, ekey[:ns], i > 0, nil
+		}
+	}
+	return nil, nil, false, errNoEncryption
+}
+
+// Wrap the seed with our current key, keeping its nonce, and atomically replace the key file.
+func (fs *fileStore) rewrapKeyFile(keyFile, context string, seed, nonce []byte) error {
+	rb, err := fs.prf([]byte(context))
+	if err != nil {
+		return err
+	}
+	kek, err := genEncryptionKey(fs.fcfg.Cipher, rb)
+	if err != nil {
+		return err
+	}
+	encrypted := kek.Seal(append([]byte(nil), nonce...), nonce, seed, nil)
+
+	// We will write to a new file and mv/rename it in case of failure.
+	tmp := keyFile + ".tmp"
+	if err := os.WriteFile(tmp, encrypted, defaultFilePerms); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, keyFile); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
 // Will generate the block encryption key.
 func genBlockEncryptionKey(sc StoreCipher, seed, nonce []byte) (cipher.Stream, error) {
 	if sc == ChaCha {
@@ -617,6 +979,34 @@ func (fs *fileStore) writeStreamMeta() error {
 	return nil
 }
 
+// Encrypt state that we keep alongside our metadata if we are encrypted.
+func (fs *fileStore) encryptState(buf []byte) []byte {
+	fs.mu.RLock()
+	aek := fs.aek
+	fs.mu.RUnlock()
+	if aek == nil {
+		return buf
+	}
+	nonce := make([]byte, aek.NonceSize(), aek.NonceSize()+len(buf)+aek.Overhead())
+	mrand.Read(nonce)
+	return aek.Seal(nonce, nonce, buf, nil)
+}
+
+// Decrypt state that was encrypted with encryptState.
+func (fs *fileStore) decryptState(buf []byte) ([]byte, error) {
+	fs.mu.RLock()
+	aek := fs.aek
+	fs.mu.RUnlock()
+	if aek == nil {
+		return buf, nil
+	}
+	ns := aek.NonceSize()
+	if len(buf) < ns {
+		return nil, errors.New("encrypted state too short")
+	}
+	return aek.Open(nil, buf[:ns], buf[ns:], nil)
+}
+
 // Pools to recycle the blocks to help with memory pressure.
 var blkPoolBig sync.Pool    // 16MB
 var blkPoolMedium sync.Pool // 8MB
@@ -679,15 +1069,15 @@ const indexHdrSize = 7*binary.MaxVarintLen64 + hdrLen + checksumSize
 
 // Lock should be held.
 func (fs *fileStore) noTrackSubjects() bool {
-	return !(len(fs.psim) > 0 || len(fs.cfg.Subjects) > 0 || fs.cfg.Mirror != nil || len(fs.cfg.Sources) > 0)
+	return !(fs.psim.Size() > 0 || len(fs.cfg.Subjects) > 0 || fs.cfg.Mirror != nil || len(fs.cfg.Sources) > 0)
 }
 
 // Lock held on entry
-func (fs *fileStore) recoverMsgBlock(fi os.FileInfo, index uint32) (*msgBlock, error) {
+func (fs *fileStore) recoverMsgBlock(index uint32) (*msgBlock, error) {
 	mb := &msgBlock{fs: fs, index: index, cexp: fs.fcfg.CacheExpire, noTrack: fs.noTrackSubjects()}
 
 	mdir := filepath.Join(fs.fcfg.StoreDir, msgDir)
-	mb.mfn = filepath.Join(mdir, fi.Name())
+	mb.mfn = filepath.Join(mdir, fmt.Sprintf(blkScan, index))
 	mb.ifn = filepath.Join(mdir, fmt.Sprintf(indexScan, index))
 	mb.sfn = filepath.Join(mdir, fmt.Sprintf(fssScan, index))
 
@@ -696,42 +1086,51 @@ func (fs *fileStore) recoverMsgBlock(fi os.FileInfo, index uint32) (*msgBlock, e
 		mb.hh, _ = highwayhash.New64(key[:])
 	}
 
+	// Check if this block only lives in our archive.
+	alchk, err := mb.recoverArchiveMarker()
+	if err != nil {
+		return nil, err
+	}
+
 	var createdKeys bool
 
 	// Check if encryption is enabled.
 	if fs.prf != nil {
+		// Finish or undo a re-encryption with a new key that was interrupted.
+		rkey := mb.recoverRotatedKey()
+
 		ekey, err := os.ReadFile(filepath.Join(mdir, fmt.Sprintf(keyScan, mb.index)))
+		if rkey != nil {
+			ekey, err = rkey, nil
+		}
 		if err != nil {
 			// We do not seem to have keys even though we should. Could be a plaintext conversion.
-			// Create the keys and we will double check below.
-			if err := fs.genEncryptionKeysForBlock(mb); err != nil {
-				return nil, err
+			// Create the keys and we will double check below. Read only stores read it as is.
+			if !fs.fcfg.ReadOnly {
+				if err := fs.genEncryptionKeysForBlock(mb); err != nil {
+					return nil, err
+				}
+				createdKeys = true
 			}
-			createdKeys = true
 		} else {
 			if len(ekey) < minBlkKeySize {
 				return nil, errBadKeySize
 			}
 			// Recover key encryption key.
-			rb, err := fs.prf([]byte(fmt.Sprintf("%s:%d", fs.cfg.Name, mb.index)))
-			if err != nil {
-				return nil, err
-			}
-
 			sc := fs.fcfg.Cipher
-			kek, err := genEncryptionKey(sc, rb)
-			if err != nil {
-				return nil, err
-			}
-			ns := kek.NonceSize()
-			seed, err := kek.Open(nil, ekey[:ns], ekey[ns:], nil)
+			seed, nonce, old, err := fs.openKeySeed(sc, fmt.Sprintf("%s:%d", fs.cfg.Name, mb.index), ekey)
 			if err != nil {
 				// We may be here on a cipher conversion, so attempt to convert.
 				if err = mb.convertCipher(); err != nil {
 					return nil, err
 				}
 			} else {
-				mb.seed, mb.nonce = seed, ekey[:ns]
+				mb.seed, mb.nonce = seed, nonce
+				// Still using our previous key, so will be re-encrypted in the background.
+				if old {
+					mb.rekey = true
+					fs.rotBlks++
+				}
 			}
 			mb.aek, err = genEncryptionKey(sc, mb.seed)
 			if err != nil {
@@ -750,39 +1149,20 @@ func (fs *fileStore) recoverMsgBlock(fi os.FileInfo, index uint32) (*msgBlock, e
 		}
 	}
 
-	// Open up the message file, but we will try to recover from the index file.
-	// We will check that the last checksums match.
-	file, err := os.Open(mb.mfn)
-	if err != nil {
-		return nil, err
-	}
-	defer file.Close()
-
-	if fi, err := file.Stat(); fi != nil {
-		mb.rbytes = uint64(fi.Size())
-	} else {
-		return nil, err
-	}
-	// Grab last checksum from main block file.
+	// Grab last checksum from main block file, or what we recorded when archiving it.
 	var lchk [8]byte
-	if mb.rbytes >= checksumSize {
-		if mb.bek != nil {
-			if buf, _ := mb.loadBlock(nil); len(buf) >= checksumSize {
-				mb.bek.XORKeyStream(buf, buf)
-				copy(lchk[0:], buf[len(buf)-checksumSize:])
-			}
-		} else {
-			file.ReadAt(lchk[:], fi.Size()-checksumSize)
-		}
+	if mb.arc {
+		lchk = alchk
+	} else if lchk, err = mb.recoverLastChecksum(); err != nil {
+		return nil, err
 	}
 
-	file.Close()
-
 	// Read our index file. Use this as source of truth if possible.
 	if err := mb.readIndexInfo(); err == nil {
 		// Quick sanity check here.
 		// Note this only checks that the message blk file is not newer then this file, or is empty and we expect empty.
 		if (mb.rbytes == 0 && mb.msgs == 0) || bytes.Equal(lchk[:], mb.lchk[:]) {
+			mb.recoverHeaderIndex(fs.cfg.IndexedHeaders)
 			if mb.msgs > 0 && !mb.noTrack && fs.psim != nil {
 				fs.populateGlobalPerSubjectInfo(mb)
 				// Try to dump any state we needed on recovery.
@@ -797,6 +1177,7 @@ func (fs *fileStore) recoverMsgBlock(fi os.FileInfo, index uint32) (*msgBlock, e
 	if ld, _ := mb.rebuildState(); ld != nil {
 		fs.addLostData(ld)
 	}
+	mb.recoverHeaderIndex(fs.cfg.IndexedHeaders)
 
 	if mb.msgs > 0 && !mb.noTrack && fs.psim != nil {
 		fs.populateGlobalPerSubjectInfo(mb)
@@ -811,6 +1192,34 @@ func (fs *fileStore) recoverMsgBlock(fi os.FileInfo, index uint32) (*msgBlock, e
 	return mb, nil
 }
 
+// Open up the message file to grab its size and the last checksum, which we
+// will check against our index file.
+// Lock should be held.
+func (mb *msgBlock) recoverLastChecksum() (lchk [8]byte, err error) {
+	file, err := os.Open(mb.mfn)
+	if err != nil {
+		return lchk, err
+	}
+	defer file.Close()
+
+	fi, err := file.Stat()
+	if fi == nil {
+		return lchk, err
+	}
+	mb.rbytes = uint64(fi.Size())
+	if mb.rbytes >= checksumSize {
+		if mb.bek != nil {
+			if buf, _ := mb.loadBlock(nil); len(buf) >= checksumSize {
+				mb.bek.XORKeyStream(buf, buf)
+				copy(lchk[0:], buf[len(buf)-checksumSize:])
+			}
+		} else {
+			file.ReadAt(lchk[:], fi.Size()-checksumSize)
+		}
+	}
+	return lchk, nil
+}
+
 func (fs *fileStore) lostData() *LostStreamData {
 	fs.mu.RLock()
 	defer fs.mu.RUnlock()
@@ -865,6 +1274,12 @@ func (fs *fileStore) rebuildStateLocked(ld *LostStreamData) {
 
 // Attempt to convert the cipher used for this message block.
 func (mb *msgBlock) convertCipher() error {
+	if mb.readOnly() {
+		return errStoreReadOnly
+	}
+	if err := mb.unarchiveLocked(); err != nil {
+		return err
+	}
 	fs := mb.fs
 	sc := fs.fcfg.Cipher
 
@@ -932,53 +1347,214 @@ func (mb *msgBlock) convertCipher() error {
 	return nil
 }
 
-// Convert a plaintext block to encrypted.
-func (mb *msgBlock) convertToEncrypted() error {
-	if mb.bek == nil {
+// Check for a staged key from a re-encryption with a new key that was interrupted.
+// If our block was already rewritten with the new key we finish by moving it into
+// place, otherwise we remove it and the block will be re-encrypted again.
+// Read only stores can not move the staged key, so it is returned to be used instead.
+func (mb *msgBlock) recoverRotatedKey() []byte {
+	fs := mb.fs
+	mdir := filepath.Join(fs.fcfg.StoreDir, msgDir)
+	rkf := filepath.Join(mdir, fmt.Sprintf(rkeyScan, mb.index))
+	ekey, err := os.ReadFile(rkf)
+	if err != nil {
 		return nil
 	}
-	buf, err := mb.loadBlock(nil)
-	if err != nil {
-		return err
+	discard := func() {
+		if !fs.fcfg.ReadOnly {
+			os.Remove(rkf)
+		}
 	}
-	if err := mb.indexCacheBuf(buf); err != nil {
-		// This likely indicates this was already encrypted or corrupt.
-		mb.cache = nil
-		return err
+	sc := fs.fcfg.Cipher
+	seed, nonce, old, err := fs.openKeySeed(sc, fmt.Sprintf("%s:%d", fs.cfg.Name, mb.index), ekey)
+	if err != nil || old {
+		discard()
+		return nil
 	}
-	// Undo cache from above for later.
+	bek, err := genBlockEncryptionKey(sc, seed, nonce)
+	if err != nil {
+		discard()
+		return nil
+	}
+	buf, _ := mb.loadBlock(nil)
+	bek.XORKeyStream(buf, buf)
+	// Make sure we can parse with the new key.
+	err = mb.indexCacheBuf(buf)
 	mb.cache = nil
-	mb.bek.XORKeyStream(buf, buf)
-	if err := os.WriteFile(mb.mfn, buf, defaultFilePerms); err != nil {
-		return err
+	if err != nil {
+		discard()
+		return nil
 	}
-	if buf, err = os.ReadFile(mb.ifn); err == nil && len(buf) > 0 {
-		if err := checkHeader(buf); err != nil {
-			return err
-		}
-		buf = mb.aek.Seal(buf[:0], mb.nonce, buf, nil)
-		if err := os.WriteFile(mb.ifn, buf, defaultFilePerms); err != nil {
-			return err
-		}
+	if fs.fcfg.ReadOnly {
+		return ekey
+	}
+	if err := os.Rename(rkf, filepath.Join(mdir, fmt.Sprintf(keyScan, mb.index))); err != nil {
+		os.Remove(rkf)
+		return nil
 	}
+	// Our index was encrypted with the old key.
+	os.Remove(mb.ifn)
 	return nil
 }
 
-func (mb *msgBlock) rebuildState() (*LostStreamData, error) {
+// Re-encrypt this block with new keys generated from our current key.
+// We do not hold our lock while reading, re-encrypting and writing the block, so we
+// only switch to the new block and key if the block did not change in the meantime.
+// The new key is staged and synced first so we can recover if interrupted.
+// No locks should be held.
+func (mb *msgBlock) reencrypt(name string) error {
+	// Archived blocks need to be brought back locally first.
+	if err := mb.fetchArchived(); err != nil {
+		return err
+	}
 	mb.mu.Lock()
-	defer mb.mu.Unlock()
-	return mb.rebuildStateLocked()
-}
+	if !mb.rekey || mb.closed {
+		mb.mu.Unlock()
+		return nil
+	}
+	if buf, _ := mb.bytesPending(); len(buf) > 0 {
+		mb.mu.Unlock()
+		return errPendingData
+	}
+	if err := mb.unarchiveLocked(); err != nil {
+		mb.mu.Unlock()
+		return err
+	}
+	fs, index, mfn := mb.fs, mb.index, mb.mfn
+	rbytes, lchk, seed, nonce := mb.rbytes, mb.lchk, mb.seed, mb.nonce
+	mb.mu.Unlock()
 
-func (mb *msgBlock) rebuildStateLocked() (*LostStreamData, error) {
-	startLastSeq := mb.last.seq
+	buf, err := os.ReadFile(mfn)
+	if err != nil {
+		return err
+	}
+	if uint64(len(buf)) != rbytes {
+		return errBlockChanged
+	}
 
-	// Remove the .fss file and clear any cache we have set.
-	mb.clearCacheAndOffset()
-	mb.removePerSubjectInfoLocked()
+	// Decrypt with our existing keys.
+	sc := fs.fcfg.Cipher
+	obek, err := genBlockEncryptionKey(sc, seed, nonce)
+	if err != nil {
+		return err
+	}
+	obek.XORKeyStream(buf, buf)
 
-	buf, err := mb.loadBlock(nil)
-	if err != nil || len(buf) == 0 {
+	aek, bek, nseed, encrypted, err := fs.genEncryptionKeys(fmt.Sprintf("%s:%d", name, index))
+	if err != nil {
+		return err
+	}
+	bek.XORKeyStream(buf, buf)
+
+	mdir := filepath.Dir(mfn)
+	rkf := filepath.Join(mdir, fmt.Sprintf(rkeyScan, index))
+	tmp := filepath.Join(mdir, fmt.Sprintf(rencScan, index))
+	cleanup := func() {
+		os.Remove(tmp)
+		os.Remove(rkf)
+	}
+	if err := writeFileSynced(rkf, encrypted); err != nil {
+		cleanup()
+		return err
+	}
+	if err := writeFileSynced(tmp, buf); err != nil {
+		cleanup()
+		return err
+	}
+	if err := syncDirEntries(mdir); err != nil {
+		cleanup()
+		return err
+	}
+
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	if pending, _ := mb.bytesPending(); !mb.rekey || mb.closed || mb.arc || len(pending) > 0 ||
+		mb.rbytes != rbytes || mb.lchk != lchk || !bytes.Equal(mb.seed, seed) || !bytes.Equal(mb.nonce, nonce) {
+		cleanup()
+		return errBlockChanged
+	}
+
+	// Close FDs first.
+	mb.closeFDsLocked()
+
+	if err := os.Rename(tmp, mfn); err != nil {
+		cleanup()
+		return err
+	}
+	// Our block now requires the new key, so recovery will finish this if we fail here.
+	if err := syncDirEntries(mdir); err != nil {
+		return err
+	}
+	kfn := filepath.Join(mdir, fmt.Sprintf(keyScan, index))
+	if err := os.Rename(rkf, kfn); err != nil {
+		return err
+	}
+	if err := syncDirEntries(mdir); err != nil {
+		return err
+	}
+
+	// Our block encryption key is now positioned at the end of the block for future writes.
+	mb.aek, mb.bek, mb.seed, mb.nonce = aek, bek, nseed, encrypted[:aek.NonceSize()]
+	mb.kfn, mb.rekey = kfn, false
+
+	// Our index is encrypted so rewrite it with our new keys.
+	mb.removeIndexFileLocked()
+	return mb.writeIndexInfoLocked()
+}
+
+// Convert a plaintext block to encrypted.
+func (mb *msgBlock) convertToEncrypted() error {
+	if mb.bek == nil {
+		return nil
+	}
+	if err := mb.unarchiveLocked(); err != nil {
+		return err
+	}
+	buf, err := mb.loadBlock(nil)
+	if err != nil {
+		return err
+	}
+	if err := mb.indexCacheBuf(buf); err != nil {
+		// This likely indicates this was already encrypted or corrupt.
+		mb.cache = nil
+		return err
+	}
+	// Undo cache from above for later.
+	mb.cache = nil
+	mb.bek.XORKeyStream(buf, buf)
+	if err := os.WriteFile(mb.mfn, buf, defaultFilePerms); err != nil {
+		return err
+	}
+	if buf, err = os.ReadFile(mb.ifn); err == nil && len(buf) > 0 {
+		if err := checkHeader(buf); err != nil {
+			return err
+		}
+		buf = mb.aek.Seal(buf[:0], mb.nonce, buf, nil)
+		if err := os.WriteFile(mb.ifn, buf, defaultFilePerms); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (mb *msgBlock) rebuildState() (*LostStreamData, error) {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	return mb.rebuildStateLocked()
+}
+
+func (mb *msgBlock) rebuildStateLocked() (*LostStreamData, error) {
+	// Rebuild from a local copy, we do not want to declare lost data if our archive is unavailable.
+	if err := mb.unarchiveLocked(); err != nil {
+		return nil, err
+	}
+	startLastSeq := mb.last.seq
+
+	// Remove the .fss file and clear any cache we have set.
+	mb.clearCacheAndOffset()
+	mb.removePerSubjectInfoLocked()
+
+	buf, err := mb.loadBlock(nil)
+	if err != nil || len(buf) == 0 {
 		var ld *LostStreamData
 		// No data to rebuild from here.
 		if mb.msgs > 0 {
@@ -1027,6 +1603,10 @@ func (mb *msgBlock) rebuildStateLocked() (*LostStreamData, error) {
 	var le = binary.LittleEndian
 
 	truncate := func(index uint32) {
+		// Read only stores only report what would be lost.
+		if mb.readOnly() {
+			return
+		}
 		var fd *os.File
 		if mb.mfd != nil {
 			fd = mb.mfd
@@ -1108,7 +1688,8 @@ func (mb *msgBlock) rebuildStateLocked() (*LostStreamData, error) {
 			_, deleted = mb.dmap[seq]
 		}
 
-		// Always set last.
+		// Always set last, but remember the previous one in case this record is corrupt.
+		plseq, plts := mb.last.seq, mb.last.ts
 		mb.last.seq = seq
 		mb.last.ts = ts
 
@@ -1125,6 +1706,11 @@ func (mb *msgBlock) rebuildStateLocked() (*LostStreamData, error) {
 				}
 				checksum := hh.Sum(nil)
 				if !bytes.Equal(checksum, data[len(data)-recordHashSize:]) {
+					// This record is lost as well.
+					mb.last.seq, mb.last.ts = plseq, plts
+					if mb.msgs == 0 {
+						mb.last.seq = mb.first.seq - 1
+					}
 					truncate(index)
 					return gatherLost(lbuf - index), errBadMsg
 				}
@@ -1141,17 +1727,15 @@ func (mb *msgBlock) rebuildStateLocked() (*LostStreamData, error) {
 			// Rebuild per subject info if needed.
 			if slen > 0 {
 				if mb.fss == nil {
-					mb.fss = make(map[string]*SimpleState)
+					mb.fss = stree.NewSubjectTree[SimpleState]()
 				}
-				// For the lookup, we cast the byte slice and there won't be any copy
-				if ss := mb.fss[string(data[:slen])]; ss != nil {
+				// This will either use a subject from the config, or make a copy.
+				subj := mb.subjString(data[:slen])
+				if ss, ok := mb.fss.Find(subj); ok {
 					ss.Msgs++
 					ss.Last = seq
 				} else {
-					// This will either use a subject from the config, or make a copy
-					// so we don't reference the underlying buffer.
-					subj := mb.subjString(data[:slen])
-					mb.fss[subj] = &SimpleState{Msgs: 1, First: seq, Last: seq}
+					mb.fss.Insert(subj, SimpleState{Msgs: 1, First: seq, Last: seq})
 				}
 				mb.fssNeedsWrite = true
 			}
@@ -1166,7 +1750,7 @@ func (mb *msgBlock) rebuildStateLocked() (*LostStreamData, error) {
 	}
 
 	// Update our fss file if needed.
-	if len(mb.fss) > 0 {
+	if mb.fss.Size() > 0 {
 		mb.writePerSubjectInfo()
 	}
 
@@ -1178,12 +1762,14 @@ func (fs *fileStore) recoverMsgs() error {
 	defer fs.mu.Unlock()
 
 	// Check for any left over purged messages.
-	pdir := filepath.Join(fs.fcfg.StoreDir, purgeDir)
-	<-dios
-	if _, err := os.Stat(pdir); err == nil {
-		os.RemoveAll(pdir)
+	if !fs.fcfg.ReadOnly {
+		pdir := filepath.Join(fs.fcfg.StoreDir, purgeDir)
+		<-dios
+		if _, err := os.Stat(pdir); err == nil {
+			os.RemoveAll(pdir)
+		}
+		dios <- struct{}{}
 	}
-	dios <- struct{}{}
 
 	mdir := filepath.Join(fs.fcfg.StoreDir, msgDir)
 	fis, err := os.ReadDir(mdir)
@@ -1195,16 +1781,22 @@ func (fs *fileStore) recoverMsgs() error {
 	// These can come in a random order, so account for that.
 	for _, fi := range fis {
 		var index uint32
-		if n, err := fmt.Sscanf(fi.Name(), blkScan, &index); err == nil && n == 1 {
-			finfo, err := fi.Info()
-			if err != nil {
-				return err
+		n, err := fmt.Sscanf(fi.Name(), blkScan, &index)
+		if err != nil || n != 1 {
+			// Blocks that were archived only have their marker here, unless
+			// archiving was interrupted in which case we recover the local block.
+			if n, err = fmt.Sscanf(fi.Name(), arcScan, &index); err == nil && n == 1 {
+				if _, serr := os.Stat(filepath.Join(mdir, fmt.Sprintf(blkScan, index))); serr == nil {
+					n = 0
+				}
 			}
-			if mb, err := fs.recoverMsgBlock(finfo, index); err == nil && mb != nil {
+		}
+		if err == nil && n == 1 {
+			if mb, err := fs.recoverMsgBlock(index); err == nil && mb != nil {
 				// This is a truncate block with possibly no index. If the OS got shutdown
 				// out from underneath of us this is possible.
 				if mb.first.seq == 0 {
-					mb.dirtyCloseWithRemove(true)
+					mb.dirtyCloseWithRemove(!fs.fcfg.ReadOnly)
 					fs.removeMsgBlockFromList(mb)
 					continue
 				}
@@ -1231,6 +1823,10 @@ func (fs *fileStore) recoverMsgs() error {
 	} else {
 		_, err = fs.newMsgBlockForWrite()
 	}
+	// Read only stores keep what we found as is, including blocks emptied by lost data.
+	if fs.fcfg.ReadOnly {
+		return err
+	}
 
 	// Check if we encountered any lost data.
 	if fs.ld != nil {
@@ -1312,14 +1908,15 @@ func (fs *fileStore) expireMsgsOnRecover() {
 			mb.first.seq, mb.first.ts = mb.last.seq+1, 0
 			mb.closeAndKeepIndex(false)
 			// Clear any global subject state.
-			fs.psim = make(map[string]*psi)
+			fs.psim = stree.NewSubjectTree[psi]()
 			return false
 		}
 		// Make sure we do subject cleanup as well.
 		mb.ensurePerSubjectInfoLoaded()
-		for subj := range mb.fss {
-			fs.removePerSubject(subj)
-		}
+		mb.fss.Iter(func(subj []byte, _ *SimpleState) bool {
+			fs.removePerSubject(string(subj))
+			return true
+		})
 		mb.dirtyCloseWithRemove(true)
 		deleted++
 		return true
@@ -1403,6 +2000,7 @@ func (fs *fileStore) expireMsgsOnRecover() {
 			// Make sure we have fss loaded.
 			mb.removeSeqPerSubject(sm.subj, seq)
 			fs.removePerSubject(sm.subj)
+			mb.removeSeqPerHeader(sm.hdr, seq)
 		}
 		// Make sure we have a proper next first sequence.
 		if needNextFirst {
@@ -1509,52 +2107,46 @@ func (mb *msgBlock) firstMatching(filter string, wc bool, start uint64, sm *Stor
 		return nil, false, err
 	}
 
-	fseq, isAll, subs := start, filter == _EMPTY_ || filter == fwcs, []string{filter}
+	fseq, isAll := start, filter == _EMPTY_ || filter == fwcs
 
 	// If we only have 1 subject currently and it matches our filter we can also set isAll.
-	if !isAll && len(mb.fss) == 1 {
-		_, isAll = mb.fss[filter]
+	if !isAll && mb.fss.Size() == 1 {
+		_, isAll = mb.fss.Find(filter)
 	}
 	// Skip scan of mb.fss if number of messages in the block are less than
 	// 1/2 the number of subjects in mb.fss. Or we have a wc and lots of fss entries.
 	const linearScanMaxFSS = 32
-	doLinearScan := isAll || 2*int(mb.last.seq-start) < len(mb.fss) || (wc && len(mb.fss) > linearScanMaxFSS)
+	doLinearScan := isAll || 2*int(mb.last.seq-start) < mb.fss.Size() || (wc && mb.fss.Size() > linearScanMaxFSS)
 
 	if !doLinearScan {
-		// If we have a wildcard match against all tracked subjects we know about.
-		if wc {
-			subs = subs[:0]
-			for subj := range mb.fss {
-				if subjectIsSubsetMatch(subj, filter) {
-					subs = append(subs, subj)
-				}
-			}
-		}
+		// Find the lowest first sequence of all subjects matching our filter.
 		fseq = mb.last.seq + 1
-		for _, subj := range subs {
-			ss := mb.fss[subj]
-			if ss != nil && ss.firstNeedsUpdate {
-				mb.recalculateFirstForSubj(subj, ss.First, ss)
+		mb.fss.Match(filter, func(subj []byte, ss *SimpleState) bool {
+			if ss.firstNeedsUpdate {
+				mb.recalculateFirstForSubj(string(subj), ss.First, ss)
 			}
-			if ss == nil || start > ss.Last || ss.First >= fseq {
-				continue
+			if start > ss.Last || ss.First >= fseq {
+				return true
 			}
 			if ss.First < start {
 				fseq = start
 			} else {
 				fseq = ss.First
 			}
-		}
+			return true
+		})
 	}
 
 	if fseq > mb.last.seq {
 		return nil, false, ErrStoreMsgNotFound
 	}
+	// Let our caller fetch our block without holding any locks.
+	if mb.archiveNotLoaded() {
+		return nil, false, errArchiveNotLoaded
+	}
 
-	if mb.cacheNotLoaded() {
-		if err := mb.loadMsgsWithLock(); err != nil {
-			return nil, false, err
-		}
+	if err := mb.ensureCacheLoaded(); err != nil {
+		return nil, false, err
 	}
 
 	if sm == nil {
@@ -1568,21 +2160,13 @@ func (mb *msgBlock) firstMatching(filter string, wc bool, start uint64, sm *Stor
 			continue
 		}
 		expireOk := seq == mb.last.seq && mb.llseq == seq
-		if doLinearScan {
-			if isAll {
-				return fsm, expireOk, nil
-			}
-			if wc && subjectIsSubsetMatch(fsm.subj, filter) {
-				return fsm, expireOk, nil
-			} else if !wc && fsm.subj == filter {
-				return fsm, expireOk, nil
-			}
-		} else {
-			for _, subj := range subs {
-				if fsm.subj == subj {
-					return fsm, expireOk, nil
-				}
-			}
+		if isAll {
+			return fsm, expireOk, nil
+		}
+		if wc && subjectIsSubsetMatch(fsm.subj, filter) {
+			return fsm, expireOk, nil
+		} else if !wc && fsm.subj == filter {
+			return fsm, expireOk, nil
 		}
 		// If we are here we did not match, so put the llseq back.
 		mb.llseq = llseq
@@ -1591,6 +2175,14 @@ func (mb *msgBlock) firstMatching(filter string, wc bool, start uint64, sm *Stor
 	return nil, false, ErrStoreMsgNotFound
 }
 
+// Returns the filter to match against our subject trees, where empty means all.
+func fssFilter(filter string) string {
+	if filter == _EMPTY_ {
+		return fwcs
+	}
+	return filter
+}
+
 // This will traverse a message block and generate the filtered pending.
 func (mb *msgBlock) filteredPending(subj string, wc bool, seq uint64) (total, first, last uint64) {
 	mb.mu.Lock()
@@ -1639,20 +2231,19 @@ func (mb *msgBlock) filteredPendingLocked(filter string, wc bool, sseq uint64) (
 	}
 
 	var havePartial bool
-	for subj, ss := range mb.fss {
-		if isAll || isMatch(subj) {
-			if ss.firstNeedsUpdate {
-				mb.recalculateFirstForSubj(subj, ss.First, ss)
-			}
-			if sseq <= ss.First {
-				update(ss)
-			} else if sseq <= ss.Last {
-				// We matched but its a partial.
-				havePartial = true
-				break
-			}
+	mb.fss.Match(fssFilter(filter), func(subj []byte, ss *SimpleState) bool {
+		if ss.firstNeedsUpdate {
+			mb.recalculateFirstForSubj(string(subj), ss.First, ss)
 		}
-	}
+		if sseq <= ss.First {
+			update(ss)
+		} else if sseq <= ss.Last {
+			// We matched but its a partial.
+			havePartial = true
+			return false
+		}
+		return true
+	})
 
 	// If we did not encounter any partials we can return here.
 	if !havePartial {
@@ -1753,28 +2344,18 @@ func (fs *fileStore) numFilteredPending(filter string, ss *SimpleState) {
 		return
 	}
 
-	tsa := [32]string{}
-	fsa := [32]string{}
-	fts := tokenizeSubjectIntoSlice(fsa[:0], filter)
-
 	start, stop := uint32(math.MaxUint32), uint32(0)
-	for subj, psi := range fs.psim {
-		if isAll {
-			ss.Msgs += psi.total
-		} else {
-			tts := tokenizeSubjectIntoSlice(tsa[:0], subj)
-			if isSubsetMatchTokenized(tts, fts) {
-				ss.Msgs += psi.total
-				// Keep track of start and stop indexes for this subject.
-				if psi.fblk < start {
-					start = psi.fblk
-				}
-				if psi.lblk > stop {
-					stop = psi.lblk
-				}
-			}
+	fs.psim.Match(filter, func(_ []byte, psi *psi) bool {
+		ss.Msgs += psi.total
+		// Keep track of start and stop indexes for this subject.
+		if psi.fblk < start {
+			start = psi.fblk
 		}
-	}
+		if psi.lblk > stop {
+			stop = psi.lblk
+		}
+		return true
+	})
 	// If not collecting all we do need to figure out the first and last sequences.
 	if !isAll {
 		wc := subjectHasWildcard(filter)
@@ -1814,51 +2395,54 @@ func (fs *fileStore) SubjectsState(subject string) map[string]SimpleState {
 		return nil
 	}
 
-	start, stop := fs.blks[0], fs.lmb
-	// We can short circuit if not a wildcard using psim for start and stop.
-	if !subjectHasWildcard(subject) {
-		info := fs.psim[subject]
-		if info == nil {
+	start, stop := uint32(0), uint32(math.MaxUint32)
+	// We can short circuit using psim for start and stop.
+	if subject != _EMPTY_ && subject != fwcs {
+		start, stop = math.MaxUint32, 0
+		fs.psim.Match(subject, func(_ []byte, psi *psi) bool {
+			if psi.fblk < start {
+				start = psi.fblk
+			}
+			if psi.lblk > stop {
+				stop = psi.lblk
+			}
+			return true
+		})
+		if stop == 0 {
 			return nil
 		}
-		start, stop = fs.bim[info.fblk], fs.bim[info.lblk]
 	}
 
 	// Aggregate fss.
 	fss := make(map[string]SimpleState)
-	var startFound bool
 
 	for _, mb := range fs.blks {
-		if !startFound {
-			if mb != start {
-				continue
-			}
-			startFound = true
+		if mb.index < start {
+			continue
+		}
+		if mb.index > stop {
+			break
 		}
 
 		mb.mu.Lock()
 		// Make sure we have fss loaded.
 		mb.ensurePerSubjectInfoLoaded()
-		for subj, ss := range mb.fss {
-			if subject == _EMPTY_ || subject == fwcs || subjectIsSubsetMatch(subj, subject) {
-				if ss.firstNeedsUpdate {
-					mb.recalculateFirstForSubj(subj, ss.First, ss)
-				}
-				oss := fss[subj]
-				if oss.First == 0 { // New
-					fss[subj] = *ss
-				} else {
-					// Merge here.
-					oss.Last, oss.Msgs = ss.Last, oss.Msgs+ss.Msgs
-					fss[subj] = oss
-				}
+		mb.fss.Match(fssFilter(subject), func(bsubj []byte, ss *SimpleState) bool {
+			subj := string(bsubj)
+			if ss.firstNeedsUpdate {
+				mb.recalculateFirstForSubj(subj, ss.First, ss)
 			}
-		}
+			oss := fss[subj]
+			if oss.First == 0 { // New
+				fss[subj] = *ss
+			} else {
+				// Merge here.
+				oss.Last, oss.Msgs = ss.Last, oss.Msgs+ss.Msgs
+				fss[subj] = oss
+			}
+			return true
+		})
 		mb.mu.Unlock()
-
-		if mb == stop {
-			break
-		}
 	}
 
 	return fss
@@ -1891,8 +2475,8 @@ func (fs *fileStore) NumPending(sseq uint64, filter string, lastPerSubject bool)
 	wc := subjectHasWildcard(filter)
 
 	// See if filter was provided but its the only subject.
-	if !isAll && !wc && len(fs.psim) == 1 && fs.psim[filter] != nil {
-		isAll = true
+	if !isAll && !wc && fs.psim.Size() == 1 {
+		_, isAll = fs.psim.Find(filter)
 	}
 
 	// If we are isAll and have no deleted we can do a simpler calculation.
@@ -1930,12 +2514,13 @@ func (fs *fileStore) NumPending(sseq uint64, filter string, lastPerSubject bool)
 			if isAll && sseq <= mb.first.seq {
 				if lastPerSubject {
 					mb.ensurePerSubjectInfoLoaded()
-					for subj := range mb.fss {
-						if !seen[subj] {
+					mb.fss.Iter(func(subj []byte, _ *SimpleState) bool {
+						if !seen[string(subj)] {
 							total++
-							seen[subj] = true
+							seen[string(subj)] = true
 						}
-					}
+						return true
+					})
 				} else {
 					total += mb.msgs
 				}
@@ -1947,28 +2532,30 @@ func (fs *fileStore) NumPending(sseq uint64, filter string, lastPerSubject bool)
 			// Make sure we have fss loaded.
 			mb.ensurePerSubjectInfoLoaded()
 			var havePartial bool
-			for subj, ss := range mb.fss {
-				if !seen[subj] && isMatch(subj) {
-					if lastPerSubject {
-						// Can't have a partials with last by subject.
-						if sseq <= ss.Last {
-							t++
-							seen[subj] = true
-						}
-					} else {
-						if ss.firstNeedsUpdate {
-							mb.recalculateFirstForSubj(subj, ss.First, ss)
-						}
-						if sseq <= ss.First {
-							t += ss.Msgs
-						} else if sseq <= ss.Last {
-							// We matched but its a partial.
-							havePartial = true
-							break
-						}
+			mb.fss.Match(fssFilter(filter), func(subj []byte, ss *SimpleState) bool {
+				if seen[string(subj)] {
+					return true
+				}
+				if lastPerSubject {
+					// Can't have a partials with last by subject.
+					if sseq <= ss.Last {
+						t++
+						seen[string(subj)] = true
+					}
+				} else {
+					if ss.firstNeedsUpdate {
+						mb.recalculateFirstForSubj(string(subj), ss.First, ss)
+					}
+					if sseq <= ss.First {
+						t += ss.Msgs
+					} else if sseq <= ss.Last {
+						// We matched but its a partial.
+						havePartial = true
+						return false
 					}
 				}
-			}
+				return true
+			})
 			// See if we need to scan msgs here.
 			if havePartial {
 				// Clear on partial.
@@ -1999,24 +2586,23 @@ func (fs *fileStore) NumPending(sseq uint64, filter string, lastPerSubject bool)
 	// If we are here its better to calculate totals from psim and adjust downward by scanning less blocks.
 	// TODO(dlc) - Eventually when sublist uses generics, make this sublist driven instead.
 	start := uint32(math.MaxUint32)
-	for subj, psi := range fs.psim {
-		if isMatch(subj) {
-			if lastPerSubject {
-				total++
-				// Keep track of start index for this subject.
-				// Use last block in this case.
-				if psi.lblk < start {
-					start = psi.lblk
-				}
-			} else {
-				total += psi.total
-				// Keep track of start index for this subject.
-				if psi.fblk < start {
-					start = psi.fblk
-				}
+	fs.psim.Match(fssFilter(filter), func(_ []byte, psi *psi) bool {
+		if lastPerSubject {
+			total++
+			// Keep track of start index for this subject.
+			// Use last block in this case.
+			if psi.lblk < start {
+				start = psi.lblk
+			}
+		} else {
+			total += psi.total
+			// Keep track of start index for this subject.
+			if psi.fblk < start {
+				start = psi.fblk
 			}
 		}
-	}
+		return true
+	})
 	// See if we were asked for all, if so we are done.
 	if sseq <= fs.state.FirstSeq {
 		return total, validThrough
@@ -2060,15 +2646,14 @@ func (fs *fileStore) NumPending(sseq uint64, filter string, lastPerSubject bool)
 				// We will scan fss state vs messages themselves.
 				// Make sure we have fss loaded.
 				mb.ensurePerSubjectInfoLoaded()
-				for subj, ss := range mb.fss {
-					if isMatch(subj) {
-						if lastPerSubject {
-							adjust++
-						} else {
-							adjust += ss.Msgs
-						}
+				mb.fss.Match(fssFilter(filter), func(_ []byte, ss *SimpleState) bool {
+					if lastPerSubject {
+						adjust++
+					} else {
+						adjust += ss.Msgs
 					}
-				}
+					return true
+				})
 			}
 		} else {
 			// This is the last block. We need to scan per message here.
@@ -2112,30 +2697,15 @@ func (fs *fileStore) SubjectsTotals(filter string) map[string]uint64 {
 	fs.mu.RLock()
 	defer fs.mu.RUnlock()
 
-	if len(fs.psim) == 0 {
+	if fs.psim.Size() == 0 {
 		return nil
 	}
 
-	tsa := [32]string{}
-	fsa := [32]string{}
-	fts := tokenizeSubjectIntoSlice(fsa[:0], filter)
-	isAll := filter == _EMPTY_ || filter == fwcs
-	wc := subjectHasWildcard(filter)
-
-	isMatch := func(subj string) bool {
-		if !wc {
-			return subj == filter
-		}
-		tts := tokenizeSubjectIntoSlice(tsa[:0], subj)
-		return isSubsetMatchTokenized(tts, fts)
-	}
-
 	fst := make(map[string]uint64)
-	for subj, psi := range fs.psim {
-		if isAll || isMatch(subj) {
-			fst[subj] = psi.total
-		}
-	}
+	fs.psim.Match(fssFilter(filter), func(subj []byte, psi *psi) bool {
+		fst[string(subj)] = psi.total
+		return true
+	})
 	return fst
 }
 
@@ -2211,7 +2781,8 @@ func (fs *fileStore) newMsgBlockForWrite() (*msgBlock, error) {
 	// Lock should be held to quiet race detector.
 	mb.mu.Lock()
 	mb.setupWriteCache(rbuf)
-	mb.fss = make(map[string]*SimpleState)
+	mb.fss = stree.NewSubjectTree[SimpleState]()
+	mb.hidx, mb.hnames = newHeaderIndex(fs.cfg.IndexedHeaders), fs.cfg.IndexedHeaders
 	mb.mu.Unlock()
 
 	// Now do local hash.
@@ -2224,26 +2795,29 @@ func (fs *fileStore) newMsgBlockForWrite() (*msgBlock, error) {
 
 	mdir := filepath.Join(fs.fcfg.StoreDir, msgDir)
 	mb.mfn = filepath.Join(mdir, fmt.Sprintf(blkScan, mb.index))
-	mfd, err := os.OpenFile(mb.mfn, os.O_CREATE|os.O_RDWR, defaultFilePerms)
-	if err != nil {
-		mb.dirtyCloseWithRemove(true)
-		return nil, fmt.Errorf("Error creating msg block file [%q]: %v", mb.mfn, err)
-	}
-	mb.mfd = mfd
-
 	mb.ifn = filepath.Join(mdir, fmt.Sprintf(indexScan, mb.index))
-	ifd, err := os.OpenFile(mb.ifn, os.O_CREATE|os.O_RDWR, defaultFilePerms)
-	if err != nil {
-		mb.dirtyCloseWithRemove(true)
-		return nil, fmt.Errorf("Error creating msg index file [%q]: %v", mb.mfn, err)
-	}
-	mb.ifd = ifd
-
 	// For subject based info.
 	mb.sfn = filepath.Join(mdir, fmt.Sprintf(fssScan, mb.index))
 
+	// Read only stores only need an empty last block, so do not create its files.
+	if !fs.fcfg.ReadOnly {
+		mfd, err := os.OpenFile(mb.mfn, os.O_CREATE|os.O_RDWR, defaultFilePerms)
+		if err != nil {
+			mb.dirtyCloseWithRemove(true)
+			return nil, fmt.Errorf("Error creating msg block file [%q]: %v", mb.mfn, err)
+		}
+		mb.mfd = mfd
+
+		ifd, err := os.OpenFile(mb.ifn, os.O_CREATE|os.O_RDWR, defaultFilePerms)
+		if err != nil {
+			mb.dirtyCloseWithRemove(true)
+			return nil, fmt.Errorf("Error creating msg index file [%q]: %v", mb.mfn, err)
+		}
+		mb.ifd = ifd
+	}
+
 	// Check if encryption is enabled.
-	if fs.prf != nil {
+	if fs.prf != nil && !fs.fcfg.ReadOnly {
 		if err := fs.genEncryptionKeysForBlock(mb); err != nil {
 			return nil, err
 		}
@@ -2298,20 +2872,24 @@ func (fs *fileStore) storeRawMsg(subj string, hdr, msg []byte, seq uint64, ts in
 	if fs.closed {
 		return ErrStoreClosed
 	}
+	if fs.fcfg.ReadOnly {
+		return errStoreReadOnly
+	}
 
 	// Per subject max check needed.
 	mmp := uint64(fs.cfg.MaxMsgsPer)
 	var psmc uint64
 	psmax := mmp > 0 && len(subj) > 0
 	if psmax {
-		if info, ok := fs.psim[subj]; ok {
+		if info, ok := fs.psim.Find(subj); ok {
 			psmc = info.total
 		}
 	}
 
 	var fseq uint64
 	// Check if we are discarding new messages when we reach the limit.
-	if fs.cfg.Discard == DiscardNew {
+	// When we are the file tier of a hybrid store these are checked across both tiers.
+	if fs.cfg.Discard == DiscardNew && !fs.tiered {
 		var asl bool
 		if psmax && psmc >= mmp {
 			// If we are instructed to discard new per subject, this is an error.
@@ -2347,16 +2925,33 @@ func (fs *fileStore) storeRawMsg(subj string, hdr, msg []byte, seq uint64, ts in
 		return err
 	}
 
+	// Honor our sync policy.
+	switch fs.cfg.Sync {
+	case SyncAlways:
+		d, err := fs.lmb.syncToDisk()
+		fs.recordSync(d)
+		if err != nil {
+			return err
+		}
+	case SyncBatch:
+		if nb := len(fs.sblks); nb == 0 || fs.sblks[nb-1] != fs.lmb {
+			fs.sblks = append(fs.sblks, fs.lmb)
+		}
+		if fs.sbTmr == nil {
+			fs.sbTmr = time.AfterFunc(fs.cfg.SyncMaxLatency, fs.syncBatch)
+		}
+	}
+
 	// Adjust top level tracking of per subject msg counts.
 	if len(subj) > 0 {
 		index := fs.lmb.index
-		if info, ok := fs.psim[subj]; ok {
+		if info, ok := fs.psim.Find(subj); ok {
 			info.total++
 			if index > info.lblk {
 				info.lblk = index
 			}
 		} else {
-			fs.psim[subj] = &psi{total: 1, fblk: index, lblk: index}
+			fs.psim.Insert(subj, psi{total: 1, fblk: index, lblk: index})
 		}
 	}
 
@@ -2382,7 +2977,7 @@ func (fs *fileStore) storeRawMsg(subj string, hdr, msg []byte, seq uint64, ts in
 		if ok, _ := fs.removeMsgViaLimits(fseq); ok {
 			// Make sure we are below the limit.
 			if psmc--; psmc >= mmp {
-				for info, ok := fs.psim[subj]; ok && info.total > mmp; info, ok = fs.psim[subj] {
+				for info, ok := fs.psim.Find(subj); ok && info.total > mmp; info, ok = fs.psim.Find(subj) {
 					if seq, _ := fs.firstSeqForSubj(subj); seq > 0 {
 						if ok, _ := fs.removeMsgViaLimits(seq); !ok {
 							break
@@ -2542,7 +3137,7 @@ func (fs *fileStore) firstSeqForSubj(subj string) (uint64, error) {
 
 	// See if we can optimize where we start.
 	start, stop := fs.blks[0].index, fs.lmb.index
-	if info, ok := fs.psim[subj]; ok {
+	if info, ok := fs.psim.Find(subj); ok {
 		start, stop = info.fblk, info.lblk
 	}
 
@@ -2556,19 +3151,23 @@ func (fs *fileStore) firstSeqForSubj(subj string) (uint64, error) {
 			mb.mu.Unlock()
 			return 0, err
 		}
-		ss := mb.fss[subj]
+		ss, ok := mb.fss.Find(subj)
+		if ok && ss.firstNeedsUpdate {
+			mb.recalculateFirstForSubj(subj, ss.First, ss)
+		}
+		var first uint64
+		if ok {
+			first = ss.First
+		}
 		mb.mu.Unlock()
-		if ss != nil {
+		if ok {
 			// Adjust first if it was not where we thought it should be.
 			if i != start {
-				if info, ok := fs.psim[subj]; ok {
+				if info, ok := fs.psim.Find(subj); ok {
 					info.fblk = i
 				}
 			}
-			if ss.firstNeedsUpdate {
-				mb.recalculateFirstForSubj(subj, ss.First, ss)
-			}
-			return ss.First, nil
+			return first, nil
 		}
 	}
 	return 0, nil
@@ -2618,19 +3217,20 @@ func (fs *fileStore) enforceMsgPerSubjectLimit() {
 	var numMsgs uint64
 
 	// collect all that are not correct.
-	needAttention := make(map[string]*psi)
-	for subj, psi := range fs.psim {
+	needAttention := make(map[string]psi)
+	fs.psim.Iter(func(subj []byte, psi *psi) bool {
 		numMsgs += psi.total
 		if psi.total > maxMsgsPer {
-			needAttention[subj] = psi
+			needAttention[string(subj)] = *psi
 		}
-	}
+		return true
+	})
 
 	// We had an issue with a use case where psim (and hence fss) were correct but idx was not and was not properly being caught.
 	// So do a quick sanity check here. If we detect a skew do a rebuild then re-check.
 	if numMsgs != fs.state.Msgs {
 		// Clear any global subject state.
-		fs.psim = make(map[string]*psi)
+		fs.psim = stree.NewSubjectTree[psi]()
 		for _, mb := range fs.blks {
 			mb.removeIndexFile()
 			ld, err := mb.rebuildState()
@@ -2643,12 +3243,13 @@ func (fs *fileStore) enforceMsgPerSubjectLimit() {
 		// Rebuild fs state too.
 		fs.rebuildStateLocked(nil)
 		// Need to redo blocks that need attention.
-		needAttention = make(map[string]*psi)
-		for subj, psi := range fs.psim {
+		needAttention = make(map[string]psi)
+		fs.psim.Iter(func(subj []byte, psi *psi) bool {
 			if psi.total > maxMsgsPer {
-				needAttention[subj] = psi
+				needAttention[string(subj)] = *psi
 			}
-		}
+			return true
+		})
 	}
 
 	// Collect all the msgBlks we alter.
@@ -2669,15 +3270,23 @@ func (fs *fileStore) enforceMsgPerSubjectLimit() {
 			// Grab the ss entry for this subject in case sparse.
 			mb.mu.Lock()
 			mb.ensurePerSubjectInfoLoaded()
-			ss := mb.fss[subj]
-			if ss != nil && ss.firstNeedsUpdate {
+			ss, ok := mb.fss.Find(subj)
+			if ok && ss.firstNeedsUpdate {
 				mb.recalculateFirstForSubj(subj, ss.First, ss)
 			}
+			var first, last uint64
+			if ok {
+				first, last = ss.First, ss.Last
+				// We hold our lock, so load archived blocks here instead of firstMatching deferring to us.
+				if mb.archiveNotLoaded() {
+					mb.loadMsgsWithLock()
+				}
+			}
 			mb.mu.Unlock()
-			if ss == nil {
+			if !ok {
 				continue
 			}
-			for seq := ss.First; seq <= ss.Last && total > maxMsgsPer; {
+			for seq := first; seq <= last && total > maxMsgsPer; {
 				m, _, err := mb.firstMatching(subj, false, seq, &sm)
 				if err == nil {
 					seq = m.seq + 1
@@ -2715,10 +3324,16 @@ func (fs *fileStore) removeMsgViaLimits(seq uint64) (bool, error) {
 // RemoveMsg will remove the message from this store.
 // Will return the number of bytes removed.
 func (fs *fileStore) RemoveMsg(seq uint64) (bool, error) {
+	if err := fs.fetchArchivedFor(seq); err != nil {
+		return false, err
+	}
 	return fs.removeMsg(seq, false, false, true)
 }
 
 func (fs *fileStore) EraseMsg(seq uint64) (bool, error) {
+	if err := fs.fetchArchivedFor(seq); err != nil {
+		return false, err
+	}
 	return fs.removeMsg(seq, true, false, true)
 }
 
@@ -2730,10 +3345,10 @@ func (fs *fileStore) removePerSubject(subj string) {
 	}
 
 	// We do not update sense of fblk here but will do so when we resolve during lookup.
-	if info, ok := fs.psim[subj]; ok {
+	if info, ok := fs.psim.Find(subj); ok {
 		info.total--
 		if info.total == 0 {
-			delete(fs.psim, subj)
+			fs.psim.Delete(subj)
 		}
 	}
 }
@@ -2743,6 +3358,9 @@ func (fs *fileStore) removeMsg(seq uint64, secure, viaLimits, needFSLock bool) (
 	if seq == 0 {
 		return false, ErrStoreMsgNotFound
 	}
+	if fs.fcfg.ReadOnly {
+		return false, errStoreReadOnly
+	}
 	fsLock := func() {
 		if needFSLock {
 			fs.mu.Lock()
@@ -2876,6 +3494,7 @@ func (fs *fileStore) removeMsg(seq uint64, secure, viaLimits, needFSLock bool) (
 	// If we are tracking multiple subjects here make sure we update that accounting.
 	mb.removeSeqPerSubject(sm.subj, seq)
 	fs.removePerSubject(sm.subj)
+	mb.removeSeqPerHeader(sm.hdr, seq)
 
 	if secure {
 		// Grab record info.
@@ -3003,6 +3622,10 @@ func (fs *fileStore) removeMsg(seq uint64, secure, viaLimits, needFSLock bool) (
 // writing new messages. We will silently bail on any issues with the underlying block and let someone else detect.
 // Write lock needs to be held.
 func (mb *msgBlock) compact() {
+	// We do not rewrite archived blocks.
+	if mb.arc {
+		return
+	}
 	wasLoaded := mb.cacheAlreadyLoaded()
 	if !wasLoaded {
 		if err := mb.loadMsgsWithLock(); err != nil {
@@ -3259,6 +3882,10 @@ func (mb *msgBlock) flushLoop(fch, qch chan struct{}) {
 
 // Lock should be held.
 func (mb *msgBlock) eraseMsg(seq uint64, ri, rl int) error {
+	// Erased messages need to be gone from our archive as well.
+	if err := mb.unarchiveLocked(); err != nil {
+		return err
+	}
 	var le = binary.LittleEndian
 	var hdr [msgHdrSize]byte
 
@@ -3313,6 +3940,12 @@ func (mb *msgBlock) eraseMsg(seq uint64, ri, rl int) error {
 
 // Truncate this message block to the storedMsg.
 func (mb *msgBlock) truncate(sm *StoreMsg) (nmsgs, nbytes uint64, err error) {
+	mb.mu.Lock()
+	err = mb.unarchiveLocked()
+	mb.mu.Unlock()
+	if err != nil {
+		return 0, 0, err
+	}
 	// Make sure we are loaded to process messages etc.
 	if err := mb.loadMsgs(); err != nil {
 		return 0, 0, err
@@ -3382,8 +4015,9 @@ func (mb *msgBlock) truncate(sm *StoreMsg) (nmsgs, nbytes uint64, err error) {
 	// Clear our cache.
 	mb.clearCacheAndOffset()
 
-	// Redo per subject info for this block.
+	// Redo per subject info and our header index for this block.
 	mb.resetPerSubjectInfo()
+	mb.generateHeaderIndex()
 
 	mb.mu.Unlock()
 
@@ -3488,6 +4122,7 @@ func (mb *msgBlock) clearCache() {
 		mb.ctmr.Stop()
 		mb.ctmr = nil
 	}
+	mb.releaseReadAhead()
 
 	if mb.cache == nil {
 		return
@@ -3551,7 +4186,7 @@ func (mb *msgBlock) tryExpireWriteCache() []byte {
 
 // Lock should be held.
 func (mb *msgBlock) expireCacheLocked() {
-	if mb.cache == nil && mb.fss == nil {
+	if mb.cache == nil && mb.fss == nil && mb.hidx == nil {
 		if mb.ctmr != nil {
 			mb.ctmr.Stop()
 			mb.ctmr = nil
@@ -3582,6 +4217,7 @@ func (mb *msgBlock) expireCacheLocked() {
 
 	// If we are here we will at least expire the core msg buffer.
 	// We need to capture offset in case we do a write next before a full load.
+	mb.releaseReadAhead()
 	if mb.cache != nil {
 		mb.cache.off += len(mb.cache.buf)
 		if !mb.cache.nra {
@@ -3595,6 +4231,10 @@ func (mb *msgBlock) expireCacheLocked() {
 	// We used to hold onto the idx longer but removes need buf now so no point.
 	mb.writePerSubjectInfo()
 	mb.fss = nil
+	// Same for our header index once it is on disk.
+	if mb.writeHeaderIndex() == nil && len(mb.hnames) > 0 {
+		mb.hidx = nil
+	}
 	if mb.indexNeedsUpdateLocked() {
 		mb.writeIndexInfoLocked()
 	}
@@ -3692,7 +4332,7 @@ func (fs *fileStore) checkMsgs() *LostStreamData {
 	fs.checkAndFlushAllBlocks()
 
 	// Clear any global subject state.
-	fs.psim = make(map[string]*psi)
+	fs.psim = stree.NewSubjectTree[psi]()
 
 	for _, mb := range fs.blks {
 		if ld, err := mb.rebuildState(); err != nil && ld != nil {
@@ -3713,6 +4353,10 @@ func (mb *msgBlock) enableForWriting(fip bool) error {
 	if mb.mfd != nil {
 		return nil
 	}
+	// We only write to local blocks.
+	if err := mb.unarchiveLocked(); err != nil {
+		return err
+	}
 	mfd, err := os.OpenFile(mb.mfn, os.O_CREATE|os.O_RDWR, defaultFilePerms)
 	if err != nil {
 		return fmt.Errorf("error opening msg block file [%q]: %v", mb.mfn, err)
@@ -3751,15 +4395,23 @@ func (mb *msgBlock) writeMsgRecord(rl, seq uint64, subj string, mhdr, msg []byte
 		if err := mb.ensurePerSubjectInfoLoaded(); err != nil {
 			return err
 		}
-		if ss := mb.fss[subj]; ss != nil {
+		if ss, ok := mb.fss.Find(subj); ok {
 			ss.Msgs++
 			ss.Last = seq
 		} else {
-			mb.fss[subj] = &SimpleState{Msgs: 1, First: seq, Last: seq}
+			mb.fss.Insert(subj, SimpleState{Msgs: 1, First: seq, Last: seq})
 		}
 		mb.fssNeedsWrite = true
 	}
 
+	// Track by indexed headers.
+	if err := mb.ensureHeaderIndexLoaded(); err != nil {
+		return err
+	}
+	if mb.hidx != nil && mb.hidx.add(mhdr, seq) {
+		mb.hidxNeedsWrite = true
+	}
+
 	// Indexing
 	index := len(mb.cache.buf) + int(mb.cache.off)
 
@@ -3838,172 +4490,1130 @@ func (mb *msgBlock) writeMsgRecord(rl, seq uint64, subj string, mhdr, msg []byte
 		if err != nil {
 			return err
 		}
-		if writeIndex {
-			// If this fails still proceed on since the write above succeeded.
-			// We can recover this condition.
-			mb.writeIndexInfoLocked()
-		}
-	} else {
-		// Kick the flusher here.
-		kickFlusher(fch)
+		if writeIndex {
+			// If this fails still proceed on since the write above succeeded.
+			// We can recover this condition.
+			mb.writeIndexInfoLocked()
+		}
+	} else {
+		// Kick the flusher here.
+		kickFlusher(fch)
+	}
+
+	return nil
+}
+
+// How many bytes pending to be written for this message block.
+func (mb *msgBlock) pendingWriteSize() int {
+	if mb == nil {
+		return 0
+	}
+	var pending int
+	mb.mu.RLock()
+	if mb.mfd != nil && mb.cache != nil {
+		pending = len(mb.cache.buf) - int(mb.cache.wp)
+	}
+	mb.mu.RUnlock()
+	return pending
+}
+
+// Try to close our FDs if we can.
+func (mb *msgBlock) closeFDs() error {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	return mb.closeFDsLocked()
+}
+
+func (mb *msgBlock) closeFDsLocked() error {
+	if buf, _ := mb.bytesPending(); len(buf) > 0 {
+		return errPendingData
+	}
+	mb.closeFDsLockedNoCheck()
+	return nil
+}
+
+func (mb *msgBlock) closeFDsLockedNoCheck() {
+	if mb.mfd != nil {
+		mb.mfd.Close()
+		mb.mfd = nil
+	}
+	if mb.ifd != nil {
+		mb.ifd.Close()
+		mb.ifd = nil
+	}
+}
+
+// bytesPending returns the buffer to be used for writing to the underlying file.
+// This marks we are in flush and will return nil if asked again until cleared.
+// Lock should be held.
+func (mb *msgBlock) bytesPending() ([]byte, error) {
+	if mb == nil || mb.mfd == nil {
+		return nil, errNoPending
+	}
+	if mb.cache == nil {
+		return nil, errNoCache
+	}
+	if len(mb.cache.buf) <= mb.cache.wp {
+		return nil, errNoPending
+	}
+	buf := mb.cache.buf[mb.cache.wp:]
+	if len(buf) == 0 {
+		return nil, errNoPending
+	}
+	return buf, nil
+}
+
+// Returns the current blkSize including deleted msgs etc.
+func (mb *msgBlock) blkSize() uint64 {
+	mb.mu.RLock()
+	nb := mb.rbytes
+	mb.mu.RUnlock()
+	return nb
+}
+
+// Update accounting on a write msg.
+// Lock should be held.
+func (mb *msgBlock) updateAccounting(seq uint64, ts int64, rl uint64) {
+	isDeleted := seq&ebit != 0
+	if isDeleted {
+		seq = seq &^ ebit
+	}
+
+	if mb.first.seq == 0 || mb.first.ts == 0 {
+		mb.first.seq = seq
+		mb.first.ts = ts
+	}
+	// Need atomics here for selectMsgBlock speed.
+	atomic.StoreUint64(&mb.last.seq, seq)
+	mb.last.ts = ts
+	mb.rbytes += rl
+	// Only update this accounting if message is not a deleted message.
+	if !isDeleted {
+		mb.bytes += rl
+		mb.msgs++
+	}
+}
+
+// Lock should be held.
+func (fs *fileStore) writeMsgRecord(seq uint64, ts int64, subj string, hdr, msg []byte) (uint64, error) {
+	var err error
+
+	// Get size for this message.
+	rl := fileStoreMsgSize(subj, hdr, msg)
+	if rl&hbit != 0 {
+		return 0, ErrMsgTooLarge
+	}
+	// Grab our current last message block.
+	mb := fs.lmb
+	if mb == nil || mb.msgs > 0 && mb.blkSize()+rl > fs.fcfg.BlockSize {
+		if mb, err = fs.newMsgBlockForWrite(); err != nil {
+			return 0, err
+		}
+	}
+
+	// Ask msg block to store in write through cache.
+	err = mb.writeMsgRecord(rl, seq, subj, hdr, msg, ts, fs.fip)
+
+	return rl, err
+}
+
+// Sync msg and index files as needed. This is called from a timer.
+func (fs *fileStore) syncBlocks() {
+	fs.mu.RLock()
+	if fs.closed {
+		fs.mu.RUnlock()
+		return
+	}
+	blks := append([]*msgBlock(nil), fs.blks...)
+	fs.mu.RUnlock()
+
+	var synced []time.Duration
+	for _, mb := range blks {
+		// Flush anything that may be pending.
+		if mb.pendingWriteSize() > 0 {
+			mb.flushPendingMsgs()
+		}
+		if mb.indexNeedsUpdate() {
+			mb.writeIndexInfo()
+		}
+		// Do actual sync. Hold lock for consistency.
+		mb.mu.Lock()
+		if !mb.closed {
+			if mb.mfd != nil {
+				start := time.Now()
+				mb.mfd.Sync()
+				synced = append(synced, time.Since(start))
+			}
+			if mb.ifd != nil {
+				mb.ifd.Truncate(mb.liwsz)
+				mb.ifd.Sync()
+			}
+			// See if we can close FDs due to being idle.
+			if mb.ifd != nil || mb.mfd != nil && mb.sinceLastWriteActivity() > closeFDsIdle {
+				mb.dirtyCloseWithRemove(false)
+			}
+		}
+		mb.mu.Unlock()
+	}
+
+	fs.mu.Lock()
+	for _, d := range synced {
+		fs.recordSync(d)
+	}
+	fs.syncTmr = time.AfterFunc(fs.fcfg.SyncInterval, fs.syncBlocks)
+	fs.mu.Unlock()
+}
+
+// Sync the blocks written since our last batch. This is called from a timer
+// that is started by the first write of a batch with the batch sync policy.
+func (fs *fileStore) syncBatch() {
+	fs.mu.Lock()
+	if fs.closed {
+		fs.mu.Unlock()
+		return
+	}
+	blks := fs.sblks
+	fs.sblks, fs.sbTmr = nil, nil
+	fs.mu.Unlock()
+
+	synced := make([]time.Duration, 0, len(blks))
+	for _, mb := range blks {
+		d, _ := mb.syncToDisk()
+		synced = append(synced, d)
+	}
+
+	fs.mu.Lock()
+	for _, d := range synced {
+		fs.recordSync(d)
+	}
+	fs.mu.Unlock()
+}
+
+// Flush anything pending and sync our message block file to disk.
+// Returns the time spent syncing.
+func (mb *msgBlock) syncToDisk() (time.Duration, error) {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	if mb.closed {
+		return 0, nil
+	}
+	ld, err := mb.flushPendingMsgsLocked()
+	if ld != nil && mb.fs != nil {
+		// We do not know if fs is locked or not at this point.
+		// This should be an exceptional condition so do so in Go routine.
+		go mb.fs.rebuildState(ld)
+	}
+	if err != nil || mb.mfd == nil {
+		return 0, err
+	}
+	start := time.Now()
+	err = mb.mfd.Sync()
+	return time.Since(start), err
+}
+
+// Track a sync to disk that took the given time.
+// Lock should be held.
+func (fs *fileStore) recordSync(d time.Duration) {
+	if d <= 0 {
+		return
+	}
+	fs.syncs.Syncs++
+	fs.syncs.TotalTime += d
+	if d > fs.syncs.MaxTime {
+		fs.syncs.MaxTime = d
+	}
+}
+
+// Returns the syncs to disk we have done and the time spent in them.
+func (fs *fileStore) syncStats() SyncStats {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+	return fs.syncs
+}
+
+// Compact sparse blocks in the background. This is called from a timer.
+// Blocks whose live byte ratio fell below our threshold are rewritten
+// without their deleted messages, paced by our limiter.
+func (fs *fileStore) compactBlocks() {
+	fs.mu.RLock()
+	if fs.closed {
+		fs.mu.RUnlock()
+		return
+	}
+	blks := append([]*msgBlock(nil), fs.blks...)
+	threshold, minBytes, rl := fs.fcfg.CompactThreshold, fs.fcfg.CompactMinBytes, fs.fcfg.CompactLimiter
+	qch := fs.qch
+	fs.mu.RUnlock()
+
+	for _, mb := range blks {
+		fs.mu.RLock()
+		if fs.closed {
+			fs.mu.RUnlock()
+			return
+		}
+		// Never compact the last block since we are still writing to it,
+		// and skip blocks that were removed since we grabbed them.
+		sealed := mb != fs.lmb && fs.bim[mb.index] == mb
+		hkey := fs.hashKeyForBlock(mb.index)
+		fs.mu.RUnlock()
+
+		if !sealed {
+			continue
+		}
+		// Pace ourselves based on the bytes we just read and rewrote.
+		if n := mb.compactInBackground(threshold, minBytes, hkey); !rl.wait(n, qch) {
+			return
+		}
+	}
+
+	fs.mu.Lock()
+	if !fs.closed && fs.fcfg.CompactInterval > 0 {
+		fs.cmpTmr = time.AfterFunc(fs.fcfg.CompactInterval, fs.compactBlocks)
+	}
+	fs.mu.Unlock()
+}
+
+// Rewrite this block without its deleted messages if it is sparse enough.
+// We do not hold our lock while reading and rewriting the block, so we only
+// switch to the new file if the block did not change in the meantime.
+// Returns the bytes read and written.
+func (mb *msgBlock) compactInBackground(threshold float64, minBytes uint64, hkey []byte) uint64 {
+	mb.mu.RLock()
+	if mb.closed || mb.arc || mb.msgs == 0 || !mb.shouldCompact(threshold, minBytes) {
+		mb.mu.RUnlock()
+		return 0
+	}
+	if buf, _ := mb.bytesPending(); len(buf) > 0 {
+		mb.mu.RUnlock()
+		return 0
+	}
+	first, last, msgs, rbytes := mb.first.seq, mb.last.seq, mb.msgs, mb.rbytes
+	dmap := make(map[uint64]struct{}, len(mb.dmap))
+	for seq := range mb.dmap {
+		dmap[seq] = struct{}{}
+	}
+	encrypted, seed, nonce := mb.bek != nil, mb.seed, mb.nonce
+	sc, mfn := mb.fs.fcfg.Cipher, mb.mfn
+	tmp := filepath.Join(filepath.Dir(mfn), fmt.Sprintf(cmpScan, mb.index))
+	mb.mu.RUnlock()
+
+	buf, err := os.ReadFile(mfn)
+	if err != nil || uint64(len(buf)) != rbytes {
+		return uint64(len(buf))
+	}
+	if encrypted && len(buf) > 0 {
+		bek, err := genBlockEncryptionKey(sc, seed, nonce)
+		if err != nil {
+			return rbytes
+		}
+		bek.XORKeyStream(buf, buf)
+	}
+	key := sha256.Sum256(hkey)
+	hh, err := highwayhash.New64(key[:])
+	if err != nil {
+		return rbytes
+	}
+
+	var le = binary.LittleEndian
+	var firstSet bool
+	var smh [msgHdrSize]byte
+	nbuf := make([]byte, 0, len(buf))
+
+	for index, lbuf := uint32(0), uint32(len(buf)); index < lbuf; {
+		if index+msgHdrSize > lbuf {
+			return rbytes
+		}
+		hdr := buf[index : index+msgHdrSize]
+		rl, slen := le.Uint32(hdr[0:]), le.Uint16(hdr[20:])
+		rl &^= hbit
+		dlen := int(rl) - msgHdrSize
+		if dlen < 0 || int(slen) > dlen || dlen > int(rl) || rl > rlBadThresh || index+rl > lbuf {
+			return rbytes
+		}
+		seq := le.Uint64(hdr[4:])
+		_, deleted := dmap[seq]
+		if seq != 0 && seq&ebit == 0 && seq >= first && !deleted {
+			nbuf = append(nbuf, buf[index:index+rl]...)
+			firstSet = true
+		} else if firstSet {
+			// Keep a placeholder for interior deletes.
+			le.PutUint32(smh[0:], emptyRecordLen)
+			le.PutUint64(smh[4:], seq|ebit)
+			le.PutUint64(smh[12:], 0)
+			le.PutUint16(smh[20:], 0)
+			nbuf = append(nbuf, smh[:]...)
+			hh.Reset()
+			hh.Write(smh[4:20])
+			nbuf = append(nbuf, hh.Sum(nil)...)
+		}
+		index += rl
+	}
+	if len(nbuf) < checksumSize {
+		return rbytes
+	}
+	var lchk [8]byte
+	copy(lchk[0:], nbuf[len(nbuf)-checksumSize:])
+	if encrypted {
+		bek, err := genBlockEncryptionKey(sc, seed, nonce)
+		if err != nil {
+			return rbytes
+		}
+		bek.XORKeyStream(nbuf, nbuf)
+	}
+	n := rbytes + uint64(len(nbuf))
+
+	if err := writeFileSynced(tmp, nbuf); err != nil {
+		os.Remove(tmp)
+		return n
+	}
+
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	if pending, _ := mb.bytesPending(); mb.closed || mb.arc || len(pending) > 0 ||
+		mb.first.seq != first || mb.last.seq != last || mb.msgs != msgs || mb.rbytes != rbytes ||
+		!bytes.Equal(mb.seed, seed) || !bytes.Equal(mb.nonce, nonce) {
+		os.Remove(tmp)
+		return n
+	}
+	mb.closeFDsLocked()
+	if err := os.Rename(tmp, mfn); err != nil {
+		os.Remove(tmp)
+		return n
+	}
+	// Our messages, deletes and subject state are unchanged, only our layout is.
+	mb.clearCacheAndOffset()
+	mb.rbytes, mb.lchk = uint64(len(nbuf)), lchk
+	mb.writeIndexInfoLocked()
+	return n
+}
+
+// Sync the entries of a directory to disk, e.g. after creating or renaming files.
+// Directories can not be synced on Windows, so this is a no-op there.
+func syncDirEntries(dir string) error {
+	if runtime.GOOS == "windows" {
+		return nil
+	}
+	f, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	err = f.Sync()
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// Write the file and sync it to disk before closing it.
+func writeFileSynced(name string, buf []byte) error {
+	f, err := os.OpenFile(name, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, defaultFilePerms)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(buf); err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// Write the file to tmp, sync it and rename it into place, then sync the directory
+// so the file is durable when we return.
+func writeFileRenamedSynced(tmp, name string, buf []byte) error {
+	if err := writeFileSynced(tmp, buf); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, name); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return syncDirEntries(filepath.Dir(name))
+}
+
+// Verify the checksums of all our blocks in the background. This is called from a timer.
+// Blocks are read from disk, bypassing any cache, and paced by our limiter.
+func (fs *fileStore) scrubBlocks() {
+	fs.mu.RLock()
+	if fs.closed {
+		fs.mu.RUnlock()
+		return
+	}
+	blks := append([]*msgBlock(nil), fs.blks...)
+	rl, qch := fs.fcfg.ScrubLimiter, fs.qch
+	fs.mu.RUnlock()
+
+	for _, mb := range blks {
+		fs.mu.RLock()
+		if fs.closed {
+			fs.mu.RUnlock()
+			return
+		}
+		// Skip the last block since we are still writing to it,
+		// and blocks that were removed since we grabbed them.
+		sealed := mb != fs.lmb && fs.bim[mb.index] == mb
+		hkey := fs.hashKeyForBlock(mb.index)
+		fs.mu.RUnlock()
+
+		if !sealed {
+			continue
+		}
+		read, first, last, checked, err := mb.scrub(hkey)
+
+		if checked {
+			fs.mu.Lock()
+			fs.scrub.Blocks++
+			fs.scrub.Bytes += read
+			if err != nil {
+				fs.scrub.Corrupt++
+			}
+			cb := fs.ccb
+			fs.mu.Unlock()
+
+			if err != nil && cb != nil {
+				cb(first, last, err)
+			}
+		}
+
+		// Pace ourselves based on the bytes we just read.
+		if !rl.wait(read, qch) {
+			return
+		}
+	}
+
+	fs.mu.Lock()
+	fs.scrub.LastScrub = time.Now().UTC()
+	if !fs.closed && fs.fcfg.ScrubInterval > 0 {
+		fs.scrubTmr = time.AfterFunc(fs.fcfg.ScrubInterval, fs.scrubBlocks)
+	}
+	fs.mu.Unlock()
+}
+
+// Verify the record checksums of this block on disk, and that the records agree with our
+// index state. Returns the bytes read and the range of sequences found to be corrupt.
+// We do not hold our lock while reading and verifying, so checked is false if the block
+// changed in the meantime and we should look at it again on our next pass.
+func (mb *msgBlock) scrub(hkey []byte) (read, first, last uint64, checked bool, err error) {
+	mb.mu.RLock()
+	// Anything still pending will be checked on our next pass.
+	// Archived blocks are skipped since reading them would fetch them.
+	if pending, _ := mb.bytesPending(); mb.closed || mb.arc || len(pending) > 0 {
+		mb.mu.RUnlock()
+		return 0, 0, 0, false, nil
+	}
+	fseq, lseq, msgs, nbytes, rbytes, lchk := mb.first.seq, mb.last.seq, mb.msgs, mb.bytes, mb.rbytes, mb.lchk
+	dmap := make(map[uint64]struct{}, len(mb.dmap))
+	for seq := range mb.dmap {
+		dmap[seq] = struct{}{}
+	}
+	encrypted, seed, nonce := mb.bek != nil, mb.seed, mb.nonce
+	sc, mfn := mb.fs.fcfg.Cipher, mb.mfn
+	mb.mu.RUnlock()
+
+	unchanged := func() bool {
+		mb.mu.RLock()
+		defer mb.mu.RUnlock()
+		return !mb.closed && !mb.arc && mb.first.seq == fseq && mb.last.seq == lseq &&
+			mb.msgs == msgs && mb.rbytes == rbytes && mb.lchk == lchk && bytes.Equal(mb.seed, seed)
+	}
+
+	buf, err := os.ReadFile(mfn)
+	read = uint64(len(buf))
+	if err != nil {
+		return read, fseq, lseq, unchanged(), err
+	}
+	if encrypted && len(buf) > 0 {
+		bek, err := genBlockEncryptionKey(sc, seed, nonce)
+		if err != nil {
+			return read, fseq, lseq, unchanged(), err
+		}
+		bek.XORKeyStream(buf, buf)
+	}
+	key := sha256.Sum256(hkey)
+	hh, err := highwayhash.New64(key[:])
+	if err != nil {
+		return read, 0, 0, false, err
+	}
+
+	var le = binary.LittleEndian
+	var nmsgs, nb uint64
+	// The sequence after the last record we could read.
+	next := fseq
+
+	for index, lbuf := uint32(0), uint32(len(buf)); index < lbuf; {
+		if index+msgHdrSize > lbuf {
+			if first == 0 {
+				first = next
+			}
+			return read, first, lseq, unchanged(), errBadMsg
+		}
+		hdr := buf[index : index+msgHdrSize]
+		rl, slen := le.Uint32(hdr[0:]), le.Uint16(hdr[20:])
+		hasHeaders := rl&hbit != 0
+		rl &^= hbit
+		dlen := int(rl) - msgHdrSize
+		if dlen < 0 || int(slen) > (dlen-recordHashSize) || dlen > int(rl) || index+rl > lbuf || rl > rlBadThresh {
+			// We can not trust anything past this point.
+			if first == 0 {
+				first = next
+			}
+			return read, first, lseq, unchanged(), errBadMsg
+		}
+
+		seq := le.Uint64(hdr[4:])
+		if rseq := seq &^ ebit; rseq >= next {
+			next = rseq + 1
+		}
+		// Skip erased, deleted or tombstone records.
+		if seq == 0 || seq&ebit != 0 || seq < fseq {
+			index += rl
+			continue
+		}
+		if _, deleted := dmap[seq]; deleted {
+			index += rl
+			continue
+		}
+
+		data := buf[index+msgHdrSize : index+rl]
+		hh.Reset()
+		hh.Write(hdr[4:20])
+		hh.Write(data[:slen])
+		if hasHeaders {
+			hh.Write(data[slen+4 : dlen-recordHashSize])
+		} else {
+			hh.Write(data[slen : dlen-recordHashSize])
+		}
+		if !bytes.Equal(hh.Sum(nil), data[len(data)-recordHashSize:]) {
+			if first == 0 {
+				first = seq
+			}
+			last = seq
+		}
+		nmsgs++
+		nb += uint64(rl)
+		index += rl
+	}
+
+	if first > 0 {
+		return read, first, last, unchanged(), errBadMsg
+	}
+	// Make sure our index state agrees with what we found.
+	if nmsgs != msgs || nb != nbytes {
+		return read, fseq, lseq, unchanged(), errCorruptState
+	}
+	return read, 0, 0, unchanged(), nil
+}
+
+// Replace the messages from first to last of the block holding first with the given copies,
+// e.g. from a healthy replica after scrubbing found them corrupt. Sequences without a copy are
+// stored as deleted. All other records of the block are kept as they are.
+func (fs *fileStore) repairMsgs(first, last uint64, msgs map[uint64]*StoreMsg) error {
+	fs.mu.RLock()
+	if fs.closed {
+		fs.mu.RUnlock()
+		return ErrStoreClosed
+	}
+	// We only repair sealed blocks, like our scrubbing only checks those.
+	mb := fs.selectMsgBlock(first)
+	sealed := mb != nil && mb != fs.lmb
+	fs.mu.RUnlock()
+	if !sealed {
+		return ErrStoreMsgNotFound
+	}
+
+	mb.mu.Lock()
+	ld, err := mb.repairMsgs(first, last, msgs)
+	mb.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	fs.rebuildState(ld)
+	return nil
+}
+
+// Lock should be held.
+func (mb *msgBlock) repairMsgs(first, last uint64, msgs map[uint64]*StoreMsg) (*LostStreamData, error) {
+	if mb.closed || mb.arc {
+		return nil, errNoMsgBlk
+	}
+	if ld, err := mb.flushPendingMsgsLocked(); err != nil {
+		return ld, err
+	}
+	if last > mb.last.seq {
+		last = mb.last.seq
+	}
+	buf, err := mb.loadBlock(nil)
+	if err != nil {
+		return nil, err
+	}
+	defer recycleMsgBlockBuf(buf)
+	if mb.bek != nil && len(buf) > 0 {
+		bek, err := genBlockEncryptionKey(mb.fs.fcfg.Cipher, mb.seed, mb.nonce)
+		if err != nil {
+			return nil, err
+		}
+		bek.XORKeyStream(buf, buf)
+	}
+
+	var le = binary.LittleEndian
+	nbuf := make([]byte, 0, len(buf))
+
+	// Keep the records before and after our range. A corrupt record may not tell us
+	// where it ends, so past one we can not parse we only keep what we were given.
+	var tail []byte
+	for index, lbuf := uint32(0), uint32(len(buf)); index < lbuf; {
+		if index+msgHdrSize > lbuf {
+			break
+		}
+		hdr := buf[index : index+msgHdrSize]
+		rl := le.Uint32(hdr[0:]) &^ hbit
+		if rl < emptyRecordLen || rl > rlBadThresh || index+rl > lbuf {
+			break
+		}
+		seq := le.Uint64(hdr[4:]) &^ ebit
+		if seq > last {
+			tail = buf[index:]
+			break
+		}
+		if seq < first {
+			nbuf = append(nbuf, buf[index:index+rl]...)
+		}
+		index += rl
+	}
+
+	for seq := first; seq <= last; seq++ {
+		if sm := msgs[seq]; sm != nil {
+			nbuf = mb.appendMsgRecord(nbuf, seq, sm.subj, sm.hdr, sm.msg, sm.ts)
+			delete(mb.dmap, seq)
+			continue
+		}
+		nbuf = mb.appendMsgRecord(nbuf, seq|ebit, _EMPTY_, nil, nil, 0)
+		if seq >= mb.first.seq {
+			if mb.dmap == nil {
+				mb.dmap = make(map[uint64]struct{})
+			}
+			mb.dmap[seq] = struct{}{}
+		}
+	}
+	nbuf = append(nbuf, tail...)
+
+	if mb.bek != nil && len(nbuf) > 0 {
+		bek, err := genBlockEncryptionKey(mb.fs.fcfg.Cipher, mb.seed, mb.nonce)
+		if err != nil {
+			return nil, err
+		}
+		bek.XORKeyStream(nbuf, nbuf)
+	}
+
+	mb.closeFDsLocked()
+	tmp := filepath.Join(filepath.Dir(mb.mfn), fmt.Sprintf(newScan, mb.index))
+	if err := writeFileSynced(tmp, nbuf); err != nil {
+		os.Remove(tmp)
+		return nil, err
+	}
+	if err := os.Rename(tmp, mb.mfn); err != nil {
+		os.Remove(tmp)
+		return nil, err
+	}
+	mb.removeIndexFileLocked()
+	ld, err := mb.rebuildStateLocked()
+	if err != nil {
+		return ld, err
+	}
+	return ld, mb.writeIndexInfoLocked()
+}
+
+// Append a message record with its checksum to buf.
+// Lock should be held.
+func (mb *msgBlock) appendMsgRecord(buf []byte, seq uint64, subj string, mhdr, msg []byte, ts int64) []byte {
+	var le = binary.LittleEndian
+	var hdr [msgHdrSize]byte
+
+	l := uint32(fileStoreMsgSize(subj, mhdr, msg))
+	hasHeaders := len(mhdr) > 0
+	if hasHeaders {
+		l |= hbit
+	}
+	le.PutUint32(hdr[0:], l)
+	le.PutUint64(hdr[4:], seq)
+	le.PutUint64(hdr[12:], uint64(ts))
+	le.PutUint16(hdr[20:], uint16(len(subj)))
+
+	buf = append(buf, hdr[:]...)
+	buf = append(buf, subj...)
+	if hasHeaders {
+		var hlen [4]byte
+		le.PutUint32(hlen[0:], uint32(len(mhdr)))
+		buf = append(buf, hlen[:]...)
+		buf = append(buf, mhdr...)
+	}
+	buf = append(buf, msg...)
+
+	mb.hh.Reset()
+	mb.hh.Write(hdr[4:20])
+	mb.hh.Write([]byte(subj))
+	if hasHeaders {
+		mb.hh.Write(mhdr)
+	}
+	mb.hh.Write(msg)
+	return append(buf, mb.hh.Sum(nil)...)
+}
+
+// Re-encrypt blocks still using our previous key after a key rotation.
+// This is called from a timer and will reschedule itself for any blocks
+// that could not be re-encrypted, e.g. our last block with pending writes.
+func (fs *fileStore) reencryptBlocks() {
+	fs.mu.RLock()
+	if fs.closed {
+		fs.mu.RUnlock()
+		return
+	}
+	blks := append([]*msgBlock(nil), fs.blks...)
+	fs.mu.RUnlock()
+
+	var retry bool
+	for _, mb := range blks {
+		fs.mu.RLock()
+		if fs.closed {
+			fs.mu.RUnlock()
+			return
+		}
+		// Skip blocks that were removed since we grabbed them.
+		current, name := fs.bim[mb.index] == mb, fs.cfg.Name
+		fs.mu.RUnlock()
+
+		if current && mb.reencrypt(name) != nil {
+			retry = true
+		}
+	}
+
+	fs.mu.Lock()
+	if !fs.closed && retry {
+		fs.rotTmr = time.AfterFunc(keyRotationRetry, fs.reencryptBlocks)
+	}
+	fs.mu.Unlock()
+}
+
+// Returns our progress re-encrypting blocks after a key rotation.
+// Will return nil if none of our blocks needed to be re-encrypted.
+func (fs *fileStore) keyRotation() *KeyRotationInfo {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+	if fs.rotBlks == 0 {
+		return nil
+	}
+	ki := &KeyRotationInfo{Blocks: fs.rotBlks}
+	for _, mb := range fs.blks {
+		mb.mu.RLock()
+		if mb.rekey {
+			ki.Pending++
+		}
+		mb.mu.RUnlock()
+	}
+	return ki
+}
+
+// Returns our background scrubbing results.
+func (fs *fileStore) scrubStats() ScrubStats {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+	return fs.scrub
+}
+
+// Returns the blocks we have archived, nil if we do not have an archive.
+func (fs *fileStore) archiveStats() *ArchiveStats {
+	if fs.fcfg.Archive == nil {
+		return nil
+	}
+	stats := &ArchiveStats{Fetches: fs.afetches.Load()}
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+	for _, mb := range fs.blks {
+		mb.mu.RLock()
+		if mb.arc {
+			stats.Blocks++
+			stats.Bytes += mb.rbytes
+		}
+		mb.mu.RUnlock()
+	}
+	return stats
+}
+
+// Offload sealed blocks whose last message is older than our archive threshold
+// to our archive. This is called from a timer.
+func (fs *fileStore) archiveBlocks() {
+	fs.mu.RLock()
+	if fs.closed {
+		fs.mu.RUnlock()
+		return
+	}
+	blks := append([]*msgBlock(nil), fs.blks...)
+	after := fs.cfg.ArchiveAfter
+	fs.mu.RUnlock()
+
+	if after > 0 {
+		cutoff := time.Now().UnixNano() - int64(after)
+		for _, mb := range blks {
+			// Errors leave the block local, and we will try again on our next pass.
+			fs.archiveBlock(mb, cutoff)
+		}
+	}
+
+	fs.mu.Lock()
+	if !fs.closed && fs.fcfg.ArchiveInterval > 0 {
+		fs.arcTmr = time.AfterFunc(fs.fcfg.ArchiveInterval, fs.archiveBlocks)
+	}
+	fs.mu.Unlock()
+}
+
+// Archive this block if it is sealed and its last message is older than cutoff.
+// We do not hold any locks while putting the block into our archive, so we only
+// commit if the block did not change in the meantime.
+func (fs *fileStore) archiveBlock(mb *msgBlock, cutoff int64) error {
+	ba := fs.fcfg.Archive
+
+	fs.mu.RLock()
+	// Never archive the last block since we are still writing to it,
+	// and skip blocks that were removed since we grabbed them.
+	sealed := !fs.closed && mb != fs.lmb && fs.bim[mb.index] == mb
+	fs.mu.RUnlock()
+	if !sealed {
+		return nil
+	}
+
+	mb.mu.Lock()
+	if mb.closed || mb.arc || mb.msgs == 0 || mb.last.ts >= cutoff {
+		mb.mu.Unlock()
+		return nil
+	}
+	if buf, _ := mb.bytesPending(); len(buf) > 0 {
+		mb.mu.Unlock()
+		return nil
+	}
+	// Our index will be our source of truth once archived, so make sure it is current.
+	if mb.indexNeedsUpdateLocked() {
+		if err := mb.writeIndexInfoLocked(); err != nil {
+			mb.mu.Unlock()
+			return err
+		}
 	}
-
-	return nil
-}
-
-// How many bytes pending to be written for this message block.
-func (mb *msgBlock) pendingWriteSize() int {
-	if mb == nil {
-		return 0
+	buf, err := mb.loadBlock(nil)
+	if err != nil || uint64(len(buf)) != mb.rbytes {
+		mb.mu.Unlock()
+		return err
 	}
-	var pending int
-	mb.mu.RLock()
-	if mb.mfd != nil && mb.cache != nil {
-		pending = len(mb.cache.buf) - int(mb.cache.wp)
+	key := path.Join(fs.fcfg.ArchivePrefix, fmt.Sprintf("%d.%d.blk", mb.index, mb.first.seq))
+	msgs, rbytes, lchk := mb.msgs, mb.rbytes, mb.lchk
+	mb.mu.Unlock()
+
+	err = ba.Put(key, buf)
+	recycleMsgBlockBuf(buf)
+	if err != nil {
+		return err
 	}
-	mb.mu.RUnlock()
-	return pending
-}
 
-// Try to close our FDs if we can.
-func (mb *msgBlock) closeFDs() error {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
 	mb.mu.Lock()
 	defer mb.mu.Unlock()
-	return mb.closeFDsLocked()
-}
 
-func (mb *msgBlock) closeFDsLocked() error {
-	if buf, _ := mb.bytesPending(); len(buf) > 0 {
-		return errPendingData
+	if fs.closed || mb.closed || mb.arc || fs.bim[mb.index] != mb ||
+		mb.msgs != msgs || mb.rbytes != rbytes || mb.lchk != lchk {
+		ba.Delete(key)
+		return nil
+	}
+	// Write our marker first, if we do not get to remove our block we will keep using it.
+	// Our marker needs to be on disk before our block is gone.
+	afn := mb.archiveMarkerFile()
+	tmp := filepath.Join(filepath.Dir(afn), fmt.Sprintf(arcNewScan, mb.index))
+	if err := writeFileRenamedSynced(tmp, afn, mb.encodeArchiveMarker(key)); err != nil {
+		os.Remove(afn)
+		ba.Delete(key)
+		return err
 	}
 	mb.closeFDsLockedNoCheck()
+	if err := os.Remove(mb.mfn); err != nil {
+		os.Remove(mb.archiveMarkerFile())
+		ba.Delete(key)
+		return err
+	}
+	mb.arc, mb.akey = true, key
 	return nil
 }
 
-func (mb *msgBlock) closeFDsLockedNoCheck() {
-	if mb.mfd != nil {
-		mb.mfd.Close()
-		mb.mfd = nil
+// Returns the name of our archive marker file.
+func (mb *msgBlock) archiveMarkerFile() string {
+	return filepath.Join(mb.fs.fcfg.StoreDir, msgDir, fmt.Sprintf(arcScan, mb.index))
+}
+
+// Our archive marker holds our size and last checksum, which we would otherwise
+// get from our block file on recovery, and the key of our block in the archive.
+// Lock should be held.
+func (mb *msgBlock) encodeArchiveMarker(key string) []byte {
+	buf := make([]byte, 0, hdrLen+binary.MaxVarintLen64+checksumSize+len(key))
+	buf = append(buf, magic, version)
+	buf = binary.AppendUvarint(buf, mb.rbytes)
+	buf = append(buf, mb.lchk[:]...)
+	return append(buf, key...)
+}
+
+// Check for a marker showing this block was archived, and if so return the last checksum
+// we recorded. If we still have the block locally archiving it was interrupted, so we
+// keep using our local block.
+// Lock should be held.
+func (mb *msgBlock) recoverArchiveMarker() (lchk [8]byte, err error) {
+	afn := mb.archiveMarkerFile()
+	buf, err := os.ReadFile(afn)
+	if err != nil {
+		return lchk, nil
+	}
+	var rbytes uint64
+	var key string
+	if err = checkHeader(buf); err == nil {
+		var n int
+		if rbytes, n = binary.Uvarint(buf[hdrLen:]); n <= 0 || len(buf) <= hdrLen+n+checksumSize {
+			err = errCorruptState
+		} else {
+			copy(lchk[:], buf[hdrLen+n:])
+			key = string(buf[hdrLen+n+checksumSize:])
+		}
 	}
-	if mb.ifd != nil {
-		mb.ifd.Close()
-		mb.ifd = nil
+	ba := mb.fs.fcfg.Archive
+	if _, serr := os.Stat(mb.mfn); serr == nil {
+		if mb.readOnly() {
+			return [8]byte{}, nil
+		}
+		if err == nil && ba != nil {
+			ba.Delete(key)
+		}
+		os.Remove(afn)
+		return [8]byte{}, nil
+	}
+	if err != nil {
+		return lchk, err
+	}
+	if ba == nil {
+		return lchk, errNoArchive
 	}
+	mb.arc, mb.akey, mb.rbytes = true, key, rbytes
+	return lchk, nil
 }
 
-// bytesPending returns the buffer to be used for writing to the underlying file.
-// This marks we are in flush and will return nil if asked again until cleared.
+// Fetch our block from our archive. Readers fetch blocks into our cache of fetched blocks
+// with fetchArchived before taking any locks, so this is normally served from that cache.
 // Lock should be held.
-func (mb *msgBlock) bytesPending() ([]byte, error) {
-	if mb == nil || mb.mfd == nil {
-		return nil, errNoPending
-	}
-	if mb.cache == nil {
-		return nil, errNoCache
+func (mb *msgBlock) loadArchivedBlock() ([]byte, error) {
+	ba := mb.fs.arch
+	if ba == nil {
+		return nil, errNoArchive
 	}
-	if len(mb.cache.buf) <= mb.cache.wp {
-		return nil, errNoPending
+	buf := ba.cached(mb.akey)
+	if buf == nil {
+		var err error
+		if buf, err = mb.fs.getArchived(mb.akey); err != nil {
+			return nil, err
+		}
 	}
-	buf := mb.cache.buf[mb.cache.wp:]
-	if len(buf) == 0 {
-		return nil, errNoPending
+	if uint64(len(buf)) != mb.rbytes {
+		return nil, errCorruptState
 	}
 	return buf, nil
 }
 
-// Returns the current blkSize including deleted msgs etc.
-func (mb *msgBlock) blkSize() uint64 {
-	mb.mu.RLock()
-	nb := mb.rbytes
-	mb.mu.RUnlock()
-	return nb
+// Fetch a block from our archive into our cache of fetched blocks.
+func (fs *fileStore) getArchived(key string) ([]byte, error) {
+	fs.afetches.Add(1)
+	return fs.arch.Get(key)
 }
 
-// Update accounting on a write msg.
+// Returns true if we are archived and need to fetch our block before loading our cache.
 // Lock should be held.
-func (mb *msgBlock) updateAccounting(seq uint64, ts int64, rl uint64) {
-	isDeleted := seq&ebit != 0
-	if isDeleted {
-		seq = seq &^ ebit
-	}
+func (mb *msgBlock) archiveNotLoaded() bool {
+	return mb.arc && !mb.cacheAlreadyLoaded() && mb.fs.arch != nil && !mb.fs.arch.has(mb.akey)
+}
 
-	if mb.first.seq == 0 || mb.first.ts == 0 {
-		mb.first.seq = seq
-		mb.first.ts = ts
+// Fetch our block from our archive into our cache of fetched blocks if we will need it.
+// No locks should be held, this way reads and writes are not stalled by the archive.
+func (mb *msgBlock) fetchArchived() error {
+	mb.mu.RLock()
+	need, key := mb.archiveNotLoaded(), mb.akey
+	mb.mu.RUnlock()
+	if !need {
+		return nil
 	}
-	// Need atomics here for selectMsgBlock speed.
-	atomic.StoreUint64(&mb.last.seq, seq)
-	mb.last.ts = ts
-	mb.rbytes += rl
-	// Only update this accounting if message is not a deleted message.
-	if !isDeleted {
-		mb.bytes += rl
-		mb.msgs++
+	_, err := mb.fs.getArchived(key)
+	return err
+}
+
+// Fetch the archived block holding seq, if any, before we take our locks.
+func (fs *fileStore) fetchArchivedFor(seq uint64) error {
+	fs.mu.RLock()
+	mb := fs.selectMsgBlock(seq)
+	fs.mu.RUnlock()
+	if mb == nil {
+		return nil
 	}
+	return mb.fetchArchived()
 }
 
+// Bring an archived block back locally so it can be rewritten.
 // Lock should be held.
-func (fs *fileStore) writeMsgRecord(seq uint64, ts int64, subj string, hdr, msg []byte) (uint64, error) {
-	var err error
-
-	// Get size for this message.
-	rl := fileStoreMsgSize(subj, hdr, msg)
-	if rl&hbit != 0 {
-		return 0, ErrMsgTooLarge
+func (mb *msgBlock) unarchiveLocked() error {
+	if !mb.arc {
+		return nil
 	}
-	// Grab our current last message block.
-	mb := fs.lmb
-	if mb == nil || mb.msgs > 0 && mb.blkSize()+rl > fs.fcfg.BlockSize {
-		if mb, err = fs.newMsgBlockForWrite(); err != nil {
-			return 0, err
-		}
+	if mb.readOnly() {
+		return errStoreReadOnly
 	}
-
-	// Ask msg block to store in write through cache.
-	err = mb.writeMsgRecord(rl, seq, subj, hdr, msg, ts, fs.fip)
-
-	return rl, err
+	buf, err := mb.loadArchivedBlock()
+	if err != nil {
+		return err
+	}
+	// Our block needs to be on disk before we remove it from our archive.
+	tmp := filepath.Join(filepath.Dir(mb.mfn), fmt.Sprintf(unarcScan, mb.index))
+	if err := writeFileRenamedSynced(tmp, mb.mfn, buf); err != nil {
+		return err
+	}
+	mb.removeArchivedLocked()
+	return nil
 }
 
-// Sync msg and index files as needed. This is called from a timer.
-func (fs *fileStore) syncBlocks() {
-	fs.mu.RLock()
-	if fs.closed {
-		fs.mu.RUnlock()
+// Remove our block from our archive along with our marker.
+// Lock should be held.
+func (mb *msgBlock) removeArchivedLocked() {
+	if !mb.arc {
 		return
 	}
-	blks := append([]*msgBlock(nil), fs.blks...)
-	fs.mu.RUnlock()
+	os.Remove(mb.archiveMarkerFile())
+	if ba := mb.fs.fcfg.Archive; ba != nil {
+		ba.Delete(mb.akey)
+	}
+	mb.arc, mb.akey = false, _EMPTY_
+}
 
-	for _, mb := range blks {
-		// Flush anything that may be pending.
-		if mb.pendingWriteSize() > 0 {
-			mb.flushPendingMsgs()
-		}
-		if mb.indexNeedsUpdate() {
-			mb.writeIndexInfo()
-		}
-		// Do actual sync. Hold lock for consistency.
-		mb.mu.Lock()
-		if !mb.closed {
-			if mb.mfd != nil {
-				mb.mfd.Sync()
-			}
-			if mb.ifd != nil {
-				mb.ifd.Truncate(mb.liwsz)
-				mb.ifd.Sync()
-			}
-			// See if we can close FDs due to being idle.
-			if mb.ifd != nil || mb.mfd != nil && mb.sinceLastWriteActivity() > closeFDsIdle {
-				mb.dirtyCloseWithRemove(false)
-			}
-		}
-		mb.mu.Unlock()
+// Returns the bytes that compacting this block would reclaim.
+// Interior deletes are kept as tombstones so are not reclaimable.
+// Lock should be held.
+func (mb *msgBlock) reclaimableBytes() uint64 {
+	if used := mb.bytes + uint64(len(mb.dmap)*emptyRecordLen); mb.rbytes > used {
+		return mb.rbytes - used
 	}
+	return 0
+}
 
-	fs.mu.Lock()
-	fs.syncTmr = time.AfterFunc(fs.fcfg.SyncInterval, fs.syncBlocks)
-	fs.mu.Unlock()
+// Determines if this block is sparse enough to be compacted in the background.
+// Lock should be held.
+func (mb *msgBlock) shouldCompact(threshold float64, minBytes uint64) bool {
+	if mb.arc {
+		return false
+	}
+	rb := mb.reclaimableBytes()
+	if rb == 0 || rb < minBytes {
+		return false
+	}
+	return float64(mb.bytes) < threshold*float64(mb.bytes+rb)
 }
 
 // Select the message block where this message should be found.
@@ -4308,9 +5918,27 @@ func (mb *msgBlock) cacheNotLoaded() bool {
 	return !mb.cacheAlreadyLoaded()
 }
 
+// Loads our cache for a read if needed, tracking cache hits and misses.
+// Lock should be held.
+func (mb *msgBlock) ensureCacheLoaded() error {
+	if mb.cacheAlreadyLoaded() {
+		if mb.fs != nil {
+			mb.fs.chits.Add(1)
+		}
+		return nil
+	}
+	if mb.fs != nil {
+		mb.fs.cmisses.Add(1)
+	}
+	return mb.loadMsgsWithLock()
+}
+
 // Used to load in the block contents.
 // Lock should be held and all conditionals satisfied prior.
 func (mb *msgBlock) loadBlock(buf []byte) ([]byte, error) {
+	if mb.arc {
+		return mb.loadArchivedBlock()
+	}
 	f, err := os.Open(mb.mfn)
 	if err != nil {
 		return nil, err
@@ -4436,10 +6064,8 @@ func (mb *msgBlock) fetchMsg(seq uint64, sm *StoreMsg) (*StoreMsg, bool, error)
 	mb.mu.Lock()
 	defer mb.mu.Unlock()
 
-	if mb.cacheNotLoaded() {
-		if err := mb.loadMsgsWithLock(); err != nil {
-			return nil, false, err
-		}
+	if err := mb.ensureCacheLoaded(); err != nil {
+		return nil, false, err
 	}
 	fsm, err := mb.cacheLookup(seq, sm)
 	if err != nil {
@@ -4450,21 +6076,25 @@ func (mb *msgBlock) fetchMsg(seq uint64, sm *StoreMsg) (*StoreMsg, bool, error)
 }
 
 var (
-	errNoCache       = errors.New("no message cache")
-	errBadMsg        = errors.New("malformed or corrupt message")
-	errDeletedMsg    = errors.New("deleted message")
-	errPartialCache  = errors.New("partial cache")
-	errNoPending     = errors.New("message block does not have pending data")
-	errNotReadable   = errors.New("storage directory not readable")
-	errCorruptState  = errors.New("corrupt state file")
-	errPendingData   = errors.New("pending data still present")
-	errNoEncryption  = errors.New("encryption not enabled")
-	errBadKeySize    = errors.New("encryption bad key size")
-	errNoMsgBlk      = errors.New("no message block")
-	errMsgBlkTooBig  = errors.New("message block size exceeded int capacity")
-	errUnknownCipher = errors.New("unknown cipher")
-	errDIOStalled    = errors.New("IO is stalled")
-	errNoMainKey     = errors.New("encrypted store encountered with no main key")
+	errNoCache          = errors.New("no message cache")
+	errBadMsg           = errors.New("malformed or corrupt message")
+	errDeletedMsg       = errors.New("deleted message")
+	errPartialCache     = errors.New("partial cache")
+	errNoPending        = errors.New("message block does not have pending data")
+	errNotReadable      = errors.New("storage directory not readable")
+	errCorruptState     = errors.New("corrupt state file")
+	errPendingData      = errors.New("pending data still present")
+	errBlockChanged     = errors.New("message block changed")
+	errNoEncryption     = errors.New("encryption not enabled")
+	errBadKeySize       = errors.New("encryption bad key size")
+	errNoMsgBlk         = errors.New("no message block")
+	errMsgBlkTooBig     = errors.New("message block size exceeded int capacity")
+	errUnknownCipher    = errors.New("unknown cipher")
+	errDIOStalled       = errors.New("IO is stalled")
+	errNoMainKey        = errors.New("encrypted store encountered with no main key")
+	errNoArchive        = errors.New("message block is archived but no block archive is configured")
+	errArchiveNotLoaded = errors.New("archived message block needs to be fetched")
+	errStoreReadOnly    = errors.New("file store is read only")
 )
 
 // Used for marking messages that have had their checksums checked.
@@ -4580,7 +6210,12 @@ func (fs *fileStore) msgForSeq(seq uint64, sm *StoreMsg) (*StoreMsg, error) {
 		seq = fs.state.FirstSeq
 	}
 	// Make sure to snapshot here.
-	mb, lmb, lseq := fs.selectMsgBlock(seq), fs.lmb, fs.state.LastSeq
+	i, mb := fs.selectMsgBlockWithIndex(seq)
+	lmb, lseq := fs.lmb, fs.state.LastSeq
+	// Loading the first message of a block is likely a sequential read, e.g. catching up a replica.
+	if mb != nil && seq == atomic.LoadUint64(&mb.first.seq) {
+		fs.readAhead(i + 1)
+	}
 	fs.mu.RUnlock()
 
 	if mb == nil {
@@ -4591,6 +6226,9 @@ func (fs *fileStore) msgForSeq(seq uint64, sm *StoreMsg) (*StoreMsg, error) {
 		return nil, err
 	}
 
+	if err := mb.fetchArchived(); err != nil {
+		return nil, err
+	}
 	fsm, expireOk, err := mb.fetchMsg(seq, sm)
 	if err != nil {
 		return nil, err
@@ -4739,15 +6377,20 @@ func (fs *fileStore) loadLast(subj string, sm *StoreMsg) (lsm *StoreMsg, err err
 		return nil, ErrStoreMsgNotFound
 	}
 
-	start, stop := fs.lmb.index, fs.blks[0].index
 	wc := subjectHasWildcard(subj)
-	// If literal subject check for presence.
-	if !wc {
-		if info := fs.psim[subj]; info == nil {
-			return nil, ErrStoreMsgNotFound
-		} else {
-			start, stop = info.lblk, info.fblk
+	// Check for presence and narrow down the blocks to walk.
+	start, stop := uint32(0), uint32(math.MaxUint32)
+	fs.psim.Match(subj, func(_ []byte, psi *psi) bool {
+		if psi.lblk > start {
+			start = psi.lblk
 		}
+		if psi.fblk < stop {
+			stop = psi.fblk
+		}
+		return true
+	})
+	if start == 0 {
+		return nil, ErrStoreMsgNotFound
 	}
 
 	// Walk blocks backwards.
@@ -4764,7 +6407,7 @@ func (fs *fileStore) loadLast(subj string, sm *StoreMsg) (lsm *StoreMsg, err err
 		var l uint64
 		// Optimize if subject is not a wildcard.
 		if !wc {
-			if ss := mb.fss[subj]; ss != nil {
+			if ss, ok := mb.fss.Find(subj); ok {
 				l = ss.Last
 			}
 		}
@@ -4803,11 +6446,25 @@ func (fs *fileStore) LoadLastMsg(subject string, smv *StoreMsg) (sm *StoreMsg, e
 }
 
 func (fs *fileStore) LoadNextMsg(filter string, wc bool, start uint64, sm *StoreMsg) (*StoreMsg, uint64, error) {
+	for {
+		fsm, seq, amb, err := fs.loadNextMsg(filter, wc, start, sm)
+		if amb == nil {
+			return fsm, seq, err
+		}
+		// Fetch the archived block we need without holding any locks and try again.
+		if err := amb.fetchArchived(); err != nil {
+			return nil, 0, err
+		}
+	}
+}
+
+// Returns the archived block we need to fetch if we could not load the next message without it.
+func (fs *fileStore) loadNextMsg(filter string, wc bool, start uint64, sm *StoreMsg) (*StoreMsg, uint64, *msgBlock, error) {
 	fs.mu.RLock()
 	defer fs.mu.RUnlock()
 
 	if fs.closed {
-		return nil, 0, ErrStoreClosed
+		return nil, 0, nil, ErrStoreClosed
 	}
 	if start < fs.state.FirstSeq {
 		start = fs.state.FirstSeq
@@ -4816,18 +6473,100 @@ func (fs *fileStore) LoadNextMsg(filter string, wc bool, start uint64, sm *Store
 	if bi, _ := fs.selectMsgBlockWithIndex(start); bi >= 0 {
 		for i := bi; i < len(fs.blks); i++ {
 			mb := fs.blks[i]
+			first := atomic.LoadUint64(&mb.first.seq)
 			if sm, expireOk, err := mb.firstMatching(filter, wc, start, sm); err == nil {
 				if expireOk && mb != fs.lmb {
 					mb.tryForceExpireCache()
 				}
-				return sm, sm.seq, nil
+				// Reads entering a block from its start are likely sequential.
+				if start <= first {
+					fs.readAhead(i + 1)
+				}
+				return sm, sm.seq, nil, nil
+			} else if err == errArchiveNotLoaded {
+				return nil, 0, mb, err
 			} else if err != ErrStoreMsgNotFound {
-				return nil, 0, err
+				return nil, 0, nil, err
+			}
+		}
+	}
+
+	return nil, fs.state.LastSeq, nil, ErrStoreEOF
+}
+
+// LoadNextMsgByHeader will find the next message starting at the start sequence
+// that has the value for the indexed header.
+func (fs *fileStore) LoadNextMsgByHeader(name, value string, start uint64, sm *StoreMsg) (*StoreMsg, error) {
+	fs.mu.RLock()
+	if fs.closed {
+		fs.mu.RUnlock()
+		return nil, ErrStoreClosed
+	}
+	if !isIndexedHeader(fs.cfg.IndexedHeaders, name) {
+		fs.mu.RUnlock()
+		return nil, ErrHeaderNotIndexed
+	}
+	if start < fs.state.FirstSeq {
+		start = fs.state.FirstSeq
+	}
+	var blks []*msgBlock
+	if bi, _ := fs.selectMsgBlockWithIndex(start); bi >= 0 {
+		blks = append(blks, fs.blks[bi:]...)
+	}
+	// Loading or regenerating our header indexes can hit the disk or our archive,
+	// so do not hold our lock while doing so.
+	fs.mu.RUnlock()
+
+	for _, mb := range blks {
+		for {
+			fsm, err := mb.firstMatchingHeader(name, value, start, sm)
+			if err == nil {
+				return fsm, nil
+			}
+			if err != errArchiveNotLoaded {
+				break
+			}
+			// Fetch the archived block we need without holding any locks and try again.
+			if err := mb.fetchArchived(); err != nil {
+				return nil, err
 			}
 		}
 	}
-
-	return nil, fs.state.LastSeq, ErrStoreEOF
+	return nil, ErrStoreMsgNotFound
+}
+
+// Find the first message at or after start with the value for the indexed header.
+// Returns errArchiveNotLoaded if our block needs to be fetched from our archive first.
+func (mb *msgBlock) firstMatchingHeader(name, value string, start uint64, sm *StoreMsg) (*StoreMsg, error) {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+
+	if mb.closed {
+		return nil, ErrStoreMsgNotFound
+	}
+	// Regenerating our index needs our messages.
+	if mb.hidx == nil && len(mb.hnames) > 0 && mb.readHeaderIndex(mb.hnames) != nil && mb.archiveNotLoaded() {
+		return nil, errArchiveNotLoaded
+	}
+	if err := mb.ensureHeaderIndexLoaded(); err != nil {
+		return nil, err
+	}
+	seqs := mb.hidx.seqs(name, value, start)
+	if len(seqs) == 0 {
+		return nil, ErrStoreMsgNotFound
+	}
+	if mb.archiveNotLoaded() {
+		return nil, errArchiveNotLoaded
+	}
+	if err := mb.ensureCacheLoaded(); err != nil {
+		return nil, err
+	}
+	for _, seq := range seqs {
+		if fsm, err := mb.cacheLookup(seq, sm); err == nil {
+			return fsm, nil
+		}
+	}
+	return nil, ErrStoreMsgNotFound
 }
 
 // Type returns the type of the underlying store.
@@ -4838,7 +6577,7 @@ func (fs *fileStore) Type() StorageType {
 // Returns number of subjects in this store.
 // Lock should be held.
 func (fs *fileStore) numSubjects() int {
-	return len(fs.psim)
+	return fs.psim.Size()
 }
 
 // FastState will fill in state with only the following.
@@ -4920,6 +6659,18 @@ func (fs *fileStore) Utilization() (total, reported uint64, err error) {
 	return total, reported, nil
 }
 
+// Returns the bytes that compacting our blocks would reclaim on disk.
+func (fs *fileStore) reclaimableBytes() (total uint64) {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+	for _, mb := range fs.blks {
+		mb.mu.RLock()
+		total += mb.reclaimableBytes()
+		mb.mu.RUnlock()
+	}
+	return total
+}
+
 func fileStoreMsgSize(subj string, hdr, msg []byte) uint64 {
 	if len(hdr) == 0 {
 		// length of the message record (4bytes) + seq(8) + ts(8) + subj_len(2) + subj + msg + hash(8)
@@ -4970,6 +6721,9 @@ func (mb *msgBlock) writeIndexInfo() error {
 // Write index info to the appropriate file.
 // Filestore lock and mb lock should be held.
 func (mb *msgBlock) writeIndexInfoLocked() error {
+	if mb.readOnly() {
+		return nil
+	}
 	// HEADER: magic version msgs bytes fseq fts lseq lts ndel checksum
 	var hdr [indexHdrSize]byte
 
@@ -5051,7 +6805,7 @@ func (mb *msgBlock) readIndexInfo() error {
 	}
 
 	if err := checkHeader(buf); err != nil {
-		defer os.Remove(mb.ifn)
+		defer mb.removeBadIndexFile()
 		return fmt.Errorf("bad index file")
 	}
 
@@ -5093,13 +6847,13 @@ func (mb *msgBlock) readIndexInfo() error {
 
 	// Check if this is a short write index file.
 	if bi < 0 || bi+checksumSize > len(buf) {
-		os.Remove(mb.ifn)
+		mb.removeBadIndexFile()
 		return fmt.Errorf("short index file")
 	}
 
 	// Check for consistency if accounting. If something is off bail and we will rebuild.
 	if mb.msgs != (mb.last.seq-mb.first.seq+1)-dmapLen {
-		os.Remove(mb.ifn)
+		mb.removeBadIndexFile()
 		return fmt.Errorf("accounting inconsistent")
 	}
 
@@ -5162,6 +6916,75 @@ func (fs *fileStore) cacheLoads() uint64 {
 	return tl
 }
 
+// Will load the caches of the blocks following a sequential reader, starting
+// with the block at index i, in the background and within our read-ahead budget.
+// Lock should be held.
+func (fs *fileStore) readAhead(i int) {
+	if fs.fcfg.ReadAhead == nil || !fs.rap.CompareAndSwap(false, true) {
+		return
+	}
+	var blks []*msgBlock
+	for ; i < len(fs.blks) && len(blks) < readAheadBlocks; i++ {
+		// Our last block is where we write, so will be loaded already if active.
+		if mb := fs.blks[i]; mb != fs.lmb {
+			blks = append(blks, mb)
+		}
+	}
+	if len(blks) == 0 {
+		fs.rap.Store(false)
+		return
+	}
+	go fs.loadBlocksAhead(blks)
+}
+
+func (fs *fileStore) loadBlocksAhead(blks []*msgBlock) {
+	defer fs.rap.Store(false)
+
+	budget := fs.fcfg.ReadAhead
+	for _, mb := range blks {
+		if err := mb.fetchArchived(); err != nil {
+			continue
+		}
+		mb.mu.Lock()
+		if mb.closed || mb.loading || mb.cacheAlreadyLoaded() {
+			mb.mu.Unlock()
+			continue
+		}
+		sz := int64(mb.rbytes)
+		if !budget.reserve(sz) {
+			mb.mu.Unlock()
+			return
+		}
+		if err := mb.loadMsgsWithLock(); err != nil || mb.cacheNotLoaded() {
+			budget.release(sz)
+		} else {
+			mb.rab = sz
+			fs.raloads.Add(1)
+		}
+		mb.mu.Unlock()
+	}
+}
+
+// Returns the bytes of our cache to the read-ahead budget if we loaded it ahead.
+// Lock should be held.
+func (mb *msgBlock) releaseReadAhead() {
+	if mb.rab == 0 {
+		return
+	}
+	mb.fs.fcfg.ReadAhead.release(mb.rab)
+	mb.rab = 0
+}
+
+// Returns the hits and misses of our block caches and how many we loaded ahead of readers.
+func (fs *fileStore) cacheStats() CacheStats {
+	return CacheStats{
+		Hits:       fs.chits.Load(),
+		Misses:     fs.cmisses.Load(),
+		ReadAheads: fs.raloads.Load(),
+		Bytes:      fs.cacheSize(),
+	}
+}
+
 // Will return total number of cached bytes.
 func (fs *fileStore) cacheSize() uint64 {
 	var sz uint64
@@ -5210,6 +7033,9 @@ func compareFn(subject string) func(string, string) bool {
 // PurgeEx will remove messages based on subject filters, sequence and number of messages to keep.
 // Will return the number of purged messages.
 func (fs *fileStore) PurgeEx(subject string, sequence, keep uint64) (purged uint64, err error) {
+	if fs.fcfg.ReadOnly {
+		return 0, errStoreReadOnly
+	}
 	if subject == _EMPTY_ || subject == fwcs {
 		if keep == 0 && (sequence == 0 || sequence == 1) {
 			return fs.Purge()
@@ -5285,6 +7111,7 @@ func (fs *fileStore) PurgeEx(subject string, sequence, keep uint64) (purged uint
 				// FSS updates.
 				mb.removeSeqPerSubject(sm.subj, seq)
 				fs.removePerSubject(sm.subj)
+				mb.removeSeqPerHeader(sm.hdr, seq)
 
 				// Check for first message.
 				if seq == mb.first.seq {
@@ -5346,6 +7173,9 @@ func (fs *fileStore) Purge() (uint64, error) {
 }
 
 func (fs *fileStore) purge(fseq uint64) (uint64, error) {
+	if fs.fcfg.ReadOnly {
+		return 0, errStoreReadOnly
+	}
 	fs.mu.Lock()
 	if fs.closed {
 		fs.mu.Unlock()
@@ -5362,6 +7192,10 @@ func (fs *fileStore) purge(fseq uint64) (uint64, error) {
 	fs.state.Msgs = 0
 
 	for _, mb := range fs.blks {
+		// Archived blocks need to be removed from our archive as well.
+		mb.mu.Lock()
+		mb.removeArchivedLocked()
+		mb.mu.Unlock()
 		mb.dirtyClose()
 	}
 
@@ -5401,7 +7235,7 @@ func (fs *fileStore) purge(fseq uint64) (uint64, error) {
 	fs.lmb.writeIndexInfo()
 
 	// Clear any per subject tracking.
-	fs.psim = make(map[string]*psi)
+	fs.psim = stree.NewSubjectTree[psi]()
 
 	cb := fs.scb
 	fs.mu.Unlock()
@@ -5417,6 +7251,9 @@ func (fs *fileStore) purge(fseq uint64) (uint64, error) {
 // but not including the seq parameter.
 // Will return the number of purged messages.
 func (fs *fileStore) Compact(seq uint64) (uint64, error) {
+	if fs.fcfg.ReadOnly {
+		return 0, errStoreReadOnly
+	}
 	if seq == 0 {
 		return fs.purge(seq)
 	}
@@ -5447,9 +7284,10 @@ func (fs *fileStore) Compact(seq uint64) (uint64, error) {
 		bytes += mb.bytes
 		// Make sure we do subject cleanup as well.
 		mb.ensurePerSubjectInfoLoaded()
-		for subj := range mb.fss {
-			fs.removePerSubject(subj)
-		}
+		mb.fss.Iter(func(subj []byte, _ *SimpleState) bool {
+			fs.removePerSubject(string(subj))
+			return true
+		})
 		// Now close.
 		mb.dirtyCloseWithRemove(true)
 		mb.mu.Unlock()
@@ -5496,6 +7334,7 @@ func (fs *fileStore) Compact(seq uint64) (uint64, error) {
 			// Update fss
 			smb.removeSeqPerSubject(sm.subj, mseq)
 			fs.removePerSubject(sm.subj)
+			smb.removeSeqPerHeader(sm.hdr, mseq)
 		}
 	}
 
@@ -5516,7 +7355,7 @@ func (fs *fileStore) Compact(seq uint64) (uint64, error) {
 
 		// Check if we should reclaim the head space from this block.
 		// This will be optimistic only, so don't continue if we encounter any errors here.
-		if smb.rbytes > compactMinimum && smb.bytes*2 < smb.rbytes {
+		if smb.rbytes > compactMinimum && smb.bytes*2 < smb.rbytes && !smb.arc {
 			var moff uint32
 			moff, _, _, err = smb.slotInfo(int(smb.first.seq - smb.cache.fseq))
 			if err != nil || moff >= uint32(len(smb.cache.buf)) {
@@ -5630,7 +7469,7 @@ func (fs *fileStore) reset() error {
 	fs.blks, fs.lmb = nil, nil
 
 	// Reset subject mappings.
-	fs.psim = make(map[string]*psi)
+	fs.psim = stree.NewSubjectTree[psi]()
 	fs.bim = make(map[uint32]*msgBlock)
 
 	fs.mu.Unlock()
@@ -5644,10 +7483,16 @@ func (fs *fileStore) reset() error {
 
 // Truncate will truncate a stream store up to seq. Sequence needs to be valid.
 func (fs *fileStore) Truncate(seq uint64) error {
+	if fs.fcfg.ReadOnly {
+		return errStoreReadOnly
+	}
 	// Check for request to reset.
 	if seq == 0 {
 		return fs.reset()
 	}
+	if err := fs.fetchArchivedFor(seq); err != nil {
+		return err
+	}
 
 	fs.mu.Lock()
 
@@ -5751,13 +7596,25 @@ func (mb *msgBlock) removeIndexFileLocked() {
 		mb.ifd.Close()
 		mb.ifd = nil
 	}
-	if mb.ifn != _EMPTY_ {
+	if mb.ifn != _EMPTY_ && !mb.readOnly() {
+		os.Remove(mb.ifn)
+	}
+}
+
+// Returns true if our store was opened read only.
+func (mb *msgBlock) readOnly() bool {
+	return mb.fs != nil && mb.fs.fcfg.ReadOnly
+}
+
+// Remove an index file we could not read, we will rebuild it.
+func (mb *msgBlock) removeBadIndexFile() {
+	if !mb.readOnly() {
 		os.Remove(mb.ifn)
 	}
 }
 
 func (mb *msgBlock) removePerSubjectInfoLocked() {
-	if mb.sfn != _EMPTY_ {
+	if mb.sfn != _EMPTY_ && !mb.readOnly() {
 		os.Remove(mb.sfn)
 	}
 }
@@ -5852,6 +7709,9 @@ func (mb *msgBlock) dirtyCloseWithRemove(remove bool) {
 		}
 		mb.fss = nil
 	}
+	if !remove {
+		mb.writeHeaderIndex()
+	}
 	// Close cache
 	mb.clearCacheAndOffset()
 	// Quit our loops.
@@ -5883,6 +7743,8 @@ func (mb *msgBlock) dirtyCloseWithRemove(remove bool) {
 		if mb.kfn != _EMPTY_ {
 			os.Remove(mb.kfn)
 		}
+		mb.removeHeaderIndexLocked()
+		mb.removeArchivedLocked()
 	}
 }
 
@@ -5890,13 +7752,13 @@ func (mb *msgBlock) dirtyCloseWithRemove(remove bool) {
 // Lock should be held.
 func (mb *msgBlock) removeSeqPerSubject(subj string, seq uint64) {
 	mb.ensurePerSubjectInfoLoaded()
-	ss := mb.fss[subj]
-	if ss == nil {
+	ss, ok := mb.fss.Find(subj)
+	if !ok {
 		return
 	}
 
 	if ss.Msgs == 1 {
-		delete(mb.fss, subj)
+		mb.fss.Delete(subj)
 		mb.fssNeedsWrite = true // Mark dirty
 		return
 	}
@@ -5970,7 +7832,7 @@ func (mb *msgBlock) recalculateFirstForSubj(subj string, startSeq uint64, ss *Si
 // Lock should be held.
 func (fs *fileStore) resetGlobalPerSubjectInfo() {
 	// Clear any global subject state.
-	fs.psim = make(map[string]*psi)
+	fs.psim = stree.NewSubjectTree[psi]()
 	for _, mb := range fs.blks {
 		fs.populateGlobalPerSubjectInfo(mb)
 	}
@@ -6002,7 +7864,7 @@ func (mb *msgBlock) generatePerSubjectInfo(hasLock bool) error {
 	}
 
 	// Create new one regardless.
-	mb.fss = make(map[string]*SimpleState)
+	mb.fss = stree.NewSubjectTree[SimpleState]()
 
 	var smv StoreMsg
 	fseq, lseq := mb.first.seq, mb.last.seq
@@ -6019,17 +7881,17 @@ func (mb *msgBlock) generatePerSubjectInfo(hasLock bool) error {
 			return err
 		}
 		if sm != nil && len(sm.subj) > 0 {
-			if ss := mb.fss[sm.subj]; ss != nil {
+			if ss, ok := mb.fss.Find(sm.subj); ok {
 				ss.Msgs++
 				ss.Last = seq
 			} else {
-				mb.fss[sm.subj] = &SimpleState{Msgs: 1, First: seq, Last: seq}
+				mb.fss.Insert(sm.subj, SimpleState{Msgs: 1, First: seq, Last: seq})
 			}
 			mb.fssNeedsWrite = true
 		}
 	}
 
-	if len(mb.fss) > 0 {
+	if mb.fss.Size() > 0 {
 		// Make sure we run the cache expire timer.
 		mb.llts = time.Now().UnixNano()
 		mb.startCacheExpireTimer()
@@ -6076,7 +7938,7 @@ func (mb *msgBlock) ensurePerSubjectInfoLoaded() error {
 		return nil
 	}
 	if mb.msgs == 0 {
-		mb.fss = make(map[string]*SimpleState)
+		mb.fss = stree.NewSubjectTree[SimpleState]()
 		return nil
 	}
 	// Load from file.
@@ -6096,29 +7958,33 @@ func (fs *fileStore) populateGlobalPerSubjectInfo(mb *msgBlock) {
 	// Quick sanity check.
 	// TODO(dlc) - This is here to auto-clear a bug.
 	fssMsgs := uint64(0)
-	for subj, ss := range mb.fss {
+	mb.fss.Iter(func(subj []byte, ss *SimpleState) bool {
 		if len(subj) > 0 {
 			fssMsgs += ss.Msgs
 		}
-	}
+		return true
+	})
 	// If we are off rebuild.
 	if fssMsgs != mb.msgs {
 		mb.generatePerSubjectInfo(true)
 	}
 
 	// Now populate psim.
-	for subj, ss := range mb.fss {
-		if len(subj) > 0 {
-			if info, ok := fs.psim[subj]; ok {
-				info.total += ss.Msgs
-				if mb.index > info.lblk {
-					info.lblk = mb.index
-				}
-			} else {
-				fs.psim[subj] = &psi{total: ss.Msgs, fblk: mb.index, lblk: mb.index}
+	mb.fss.Iter(func(bsubj []byte, ss *SimpleState) bool {
+		if len(bsubj) == 0 {
+			return true
+		}
+		subj := string(bsubj)
+		if info, ok := fs.psim.Find(subj); ok {
+			info.total += ss.Msgs
+			if mb.index > info.lblk {
+				info.lblk = mb.index
 			}
+		} else {
+			fs.psim.Insert(subj, psi{total: ss.Msgs, fblk: mb.index, lblk: mb.index})
 		}
-	}
+		return true
+	})
 }
 
 // readPerSubjectInfo will attempt to restore the per subject information.
@@ -6148,7 +8014,7 @@ func (mb *msgBlock) readPerSubjectInfo(hasLock bool) error {
 	}
 
 	numEntries := readU64()
-	fss := make(map[string]*SimpleState, numEntries)
+	fss := stree.NewSubjectTree[SimpleState]()
 
 	if !hasLock {
 		mb.mu.Lock()
@@ -6159,13 +8025,13 @@ func (mb *msgBlock) readPerSubjectInfo(hasLock bool) error {
 		subj := mb.subjString(buf[bi : bi+int(lsubj)])
 		bi += int(lsubj)
 		msgs, first, last := readU64(), readU64(), readU64()
-		fss[subj] = &SimpleState{Msgs: msgs, First: first, Last: last}
+		fss.Insert(subj, SimpleState{Msgs: msgs, First: first, Last: last})
 	}
 	mb.fss = fss
 	mb.fssNeedsWrite = false
 
 	// Make sure we run the cache expire timer.
-	if len(mb.fss) > 0 {
+	if mb.fss.Size() > 0 {
 		mb.llts = time.Now().UnixNano()
 		mb.startCacheExpireTimer()
 	}
@@ -6181,28 +8047,29 @@ func (mb *msgBlock) readPerSubjectInfo(hasLock bool) error {
 // Lock should be held.
 func (mb *msgBlock) writePerSubjectInfo() error {
 	// Raft groups do not have any subjects.
-	if len(mb.fss) == 0 || len(mb.sfn) == 0 || !mb.fssNeedsWrite {
+	if mb.fss.Size() == 0 || len(mb.sfn) == 0 || !mb.fssNeedsWrite || mb.readOnly() {
 		return nil
 	}
 	var scratch [4 * binary.MaxVarintLen64]byte
 	var b bytes.Buffer
 	b.WriteByte(magic)
 	b.WriteByte(version)
-	n := binary.PutUvarint(scratch[0:], uint64(len(mb.fss)))
+	n := binary.PutUvarint(scratch[0:], uint64(mb.fss.Size()))
 	b.Write(scratch[0:n])
-	for subj, ss := range mb.fss {
+	mb.fss.Iter(func(subj []byte, ss *SimpleState) bool {
 		if ss.firstNeedsUpdate {
-			mb.recalculateFirstForSubj(subj, ss.First, ss)
+			mb.recalculateFirstForSubj(string(subj), ss.First, ss)
 		}
 		n := binary.PutUvarint(scratch[0:], uint64(len(subj)))
 		b.Write(scratch[0:n])
-		b.WriteString(subj)
+		b.Write(subj)
 		// Encode all three parts of our simple state into same scratch buffer.
 		n = binary.PutUvarint(scratch[0:], ss.Msgs)
 		n += binary.PutUvarint(scratch[n:], ss.First)
 		n += binary.PutUvarint(scratch[n:], ss.Last)
 		b.Write(scratch[0:n])
-	}
+		return true
+	})
 	// Calculate hash for this information.
 	mb.hh.Reset()
 	mb.hh.Write(b.Bytes())
@@ -6228,6 +8095,183 @@ func (mb *msgBlock) writePerSubjectInfo() error {
 	return err
 }
 
+// Returns the file we persist our header index in.
+func (mb *msgBlock) headerIndexFile() string {
+	return filepath.Join(mb.fs.fcfg.StoreDir, msgDir, fmt.Sprintf(hdxScan, mb.index))
+}
+
+// Recover our header index for these headers. Like our per subject info it is
+// only loaded when needed.
+// Lock should be held.
+func (mb *msgBlock) recoverHeaderIndex(names []string) {
+	mb.hnames, mb.hidx, mb.hidxNeedsWrite = names, nil, false
+}
+
+// Load our header index if needed, regenerating it from our messages if the file
+// is missing or does not match our block.
+// Lock should be held.
+func (mb *msgBlock) ensureHeaderIndexLoaded() error {
+	if mb.hidx != nil || len(mb.hnames) == 0 {
+		return nil
+	}
+	if mb.readHeaderIndex(mb.hnames) == nil {
+		return nil
+	}
+	return mb.resetHeaderIndex(mb.hnames)
+}
+
+// Reset our header index to track these headers and regenerate it from our messages.
+// Lock should be held.
+func (mb *msgBlock) resetHeaderIndex(names []string) error {
+	mb.removeHeaderIndexLocked()
+	mb.hidx, mb.hnames = newHeaderIndex(names), names
+	return mb.generateHeaderIndex()
+}
+
+// Rebuild the header indexes of these blocks after our indexed headers changed.
+func (fs *fileStore) rebuildHeaderIndexes(blks []*msgBlock, qch chan struct{}) {
+	for _, mb := range blks {
+		select {
+		case <-qch:
+			return
+		default:
+		}
+		if mb.fetchArchived() != nil {
+			continue
+		}
+		mb.mu.Lock()
+		if !mb.closed && mb.ensureHeaderIndexLoaded() == nil {
+			mb.writeHeaderIndex()
+		}
+		mb.mu.Unlock()
+	}
+}
+
+// generateHeaderIndex will generate our header index via the raw msg block.
+// Lock should be held.
+func (mb *msgBlock) generateHeaderIndex() error {
+	if mb.hidx == nil {
+		return nil
+	}
+	mb.hidx.reset()
+	mb.hidxNeedsWrite = true
+	if mb.msgs == 0 {
+		return nil
+	}
+
+	if mb.cacheNotLoaded() {
+		if err := mb.loadMsgsWithLock(); err != nil {
+			return err
+		}
+	}
+
+	var smv StoreMsg
+	for seq := mb.first.seq; seq <= mb.last.seq; seq++ {
+		sm, err := mb.cacheLookup(seq, &smv)
+		if err != nil {
+			// Since we are walking by sequence we can ignore some errors that are benign to rebuilding our index.
+			if err == ErrStoreMsgNotFound || err == errDeletedMsg {
+				continue
+			}
+			return err
+		}
+		mb.hidx.add(sm.hdr, seq)
+	}
+
+	// Make sure we run the cache expire timer.
+	mb.llts = time.Now().UnixNano()
+	mb.startCacheExpireTimer()
+	return nil
+}
+
+// Remove a seq from our header index.
+// Lock should be held.
+func (mb *msgBlock) removeSeqPerHeader(hdr []byte, seq uint64) {
+	if mb.ensureHeaderIndexLoaded() != nil {
+		return
+	}
+	if mb.hidx != nil && mb.hidx.remove(hdr, seq) {
+		mb.hidxNeedsWrite = true
+	}
+}
+
+// readHeaderIndex will attempt to restore our header index for these headers.
+// Lock should be held.
+func (mb *msgBlock) readHeaderIndex(names []string) error {
+	buf, err := os.ReadFile(mb.headerIndexFile())
+	if err != nil {
+		return err
+	}
+	// Decrypt if needed.
+	if mb.aek != nil {
+		if buf, err = mb.aek.Open(buf[:0], mb.nonce, buf, nil); err != nil {
+			return err
+		}
+	}
+	if len(buf) < hdrLen+2*checksumSize || checkHeader(buf) != nil {
+		return errors.New("short header index")
+	}
+	hi := len(buf) - 2*checksumSize
+
+	// Check that we did not have any bit flips.
+	mb.hh.Reset()
+	mb.hh.Write(buf[:hi])
+	if checksum := mb.hh.Sum(nil); !bytes.Equal(checksum, buf[hi:hi+checksumSize]) {
+		return errors.New("corrupt header index")
+	}
+	// Make sure it matches the last update recorded.
+	if !bytes.Equal(buf[hi+checksumSize:], mb.lchk[:]) {
+		return errors.New("outdated header index")
+	}
+
+	hidx, err := decodeHeaderIndex(buf[hdrLen:hi], names)
+	if err != nil {
+		return err
+	}
+	mb.hidx, mb.hidxNeedsWrite = hidx, false
+	return nil
+}
+
+// writeHeaderIndex will write out our header index if it changed.
+// HEADER: magic version index checksum lchk
+// Lock should be held.
+func (mb *msgBlock) writeHeaderIndex() error {
+	if mb.hidx == nil || !mb.hidxNeedsWrite || mb.fs == nil || mb.readOnly() {
+		return nil
+	}
+	buf := mb.hidx.encode([]byte{magic, version})
+	mb.hh.Reset()
+	mb.hh.Write(buf)
+	buf = mb.hh.Sum(buf)
+	// Now copy over checksum from the block itself, this allows us to know if we are in sync.
+	buf = append(buf, mb.lchk[:]...)
+
+	// Encrypt if needed.
+	if mb.aek != nil {
+		buf = mb.aek.Seal(buf[:0], mb.nonce, buf, nil)
+	}
+
+	// Like our per subject info this can be rebuilt on restart, so do not block.
+	var err error
+	select {
+	case <-dios:
+		if err = os.WriteFile(mb.headerIndexFile(), buf, defaultFilePerms); err == nil {
+			mb.hidxNeedsWrite = false
+		}
+		dios <- struct{}{}
+	default:
+		err = errDIOStalled
+	}
+	return err
+}
+
+// Lock should be held.
+func (mb *msgBlock) removeHeaderIndexLocked() {
+	if (mb.hidx != nil || len(mb.hnames) > 0) && mb.fs != nil && !mb.readOnly() {
+		os.Remove(mb.headerIndexFile())
+	}
+}
+
 // Close the message block.
 func (mb *msgBlock) close(sync bool) {
 	if mb == nil {
@@ -6248,11 +8292,12 @@ func (mb *msgBlock) close(sync bool) {
 	}
 
 	// Check if we are tracking by subject.
-	if len(mb.fss) > 0 && mb.fssNeedsWrite {
+	if mb.fss.Size() > 0 && mb.fssNeedsWrite {
 		mb.writePerSubjectInfo()
 	}
 	mb.fss = nil
 	mb.fssNeedsWrite = false
+	mb.writeHeaderIndex()
 
 	// Close cache
 	mb.clearCacheAndOffset()
@@ -6332,6 +8377,47 @@ func (fs *fileStore) cancelSyncTimer() {
 	}
 }
 
+// Lock should be held.
+func (fs *fileStore) cancelSyncBatchTimer() {
+	if fs.sbTmr != nil {
+		fs.sbTmr.Stop()
+		fs.sbTmr = nil
+	}
+	fs.sblks = nil
+}
+
+// Lock should be held.
+func (fs *fileStore) cancelCompactTimer() {
+	if fs.cmpTmr != nil {
+		fs.cmpTmr.Stop()
+		fs.cmpTmr = nil
+	}
+}
+
+// Lock should be held.
+func (fs *fileStore) cancelScrubTimer() {
+	if fs.scrubTmr != nil {
+		fs.scrubTmr.Stop()
+		fs.scrubTmr = nil
+	}
+}
+
+// Lock should be held.
+func (fs *fileStore) cancelArchiveTimer() {
+	if fs.arcTmr != nil {
+		fs.arcTmr.Stop()
+		fs.arcTmr = nil
+	}
+}
+
+// Lock should be held.
+func (fs *fileStore) cancelRotateTimer() {
+	if fs.rotTmr != nil {
+		fs.rotTmr.Stop()
+		fs.rotTmr = nil
+	}
+}
+
 func (fs *fileStore) Stop() error {
 	fs.mu.Lock()
 	if fs.closed {
@@ -6345,7 +8431,13 @@ func (fs *fileStore) Stop() error {
 	fs.closeAllMsgBlocks(false)
 
 	fs.cancelSyncTimer()
+	fs.cancelSyncBatchTimer()
+	fs.cancelCompactTimer()
+	fs.cancelScrubTimer()
+	fs.cancelArchiveTimer()
+	fs.cancelRotateTimer()
 	fs.cancelAgeChk()
+	close(fs.qch)
 
 	// We should update the upper usage layer on a stop.
 	cb, bytes := fs.scb, int64(fs.state.Bytes)
@@ -6544,6 +8636,11 @@ func (fs *fileStore) streamSnapshot(w io.WriteCloser, state *StreamState, includ
 			return
 		}
 		writeFile(filepath.Join(odirPre, consumerState), state)
+
+		// Checkpoints are written unencrypted like the state.
+		if cps, err := o.readCheckpoints(); err == nil && len(cps) > 0 {
+			writeFile(filepath.Join(odirPre, consumerCheckpoints), encodeConsumerCheckpoints(cps))
+		}
 	}
 }
 
@@ -6624,6 +8721,9 @@ func (fs *fileStore) ConsumerStore(name string, cfg *ConsumerConfig) (ConsumerSt
 	if fs.isClosed() {
 		return nil, ErrStoreClosed
 	}
+	if fs.fcfg.ReadOnly {
+		return nil, errStoreReadOnly
+	}
 	if cfg == nil || name == _EMPTY_ {
 		return nil, fmt.Errorf("bad consumer config")
 	}
@@ -6663,25 +8763,18 @@ func (fs *fileStore) ConsumerStore(name string, cfg *ConsumerConfig) (ConsumerSt
 				return nil, errBadKeySize
 			}
 			// Recover key encryption key.
-			rb, err := fs.prf([]byte(fs.cfg.Name + tsep + o.name))
-			if err != nil {
-				return nil, err
-			}
-
-			sc := fs.fcfg.Cipher
-			kek, err := genEncryptionKey(sc, rb)
-			if err != nil {
-				return nil, err
-			}
-			ns := kek.NonceSize()
-			nonce := ekey[:ns]
-			seed, err := kek.Open(nil, nonce, ekey[ns:], nil)
+			sc, context := fs.fcfg.Cipher, fs.cfg.Name+tsep+o.name
+			seed, nonce, old, err := fs.openKeySeed(sc, context, ekey)
 			if err != nil {
 				// We may be here on a cipher conversion, so attempt to convert.
 				if err = o.convertCipher(); err != nil {
 					return nil, err
 				}
-			} else {
+			} else if old {
+				// Still using our previous key so wrap with our current one.
+				err = fs.rewrapKeyFile(filepath.Join(odir, JetStreamMetaFileKey), context, seed, nonce)
+			}
+			if err == nil && seed != nil {
 				o.aek, err = genEncryptionKey(sc, seed)
 			}
 			if err != nil {
@@ -7189,6 +9282,47 @@ func (o *consumerFileStore) updateConfig(cfg ConsumerConfig) error {
 	return o.writeConsumerMeta()
 }
 
+// Write out the consumer checkpoints, encrypted if needed.
+func (o *consumerFileStore) writeCheckpoints(cps []*consumerCheckpoint) error {
+	buf := encodeConsumerCheckpoints(cps)
+	o.mu.Lock()
+	if o.closed {
+		o.mu.Unlock()
+		return ErrStoreClosed
+	}
+	buf = o.encryptState(buf)
+	fn := filepath.Join(o.odir, consumerCheckpoints)
+	o.mu.Unlock()
+
+	<-dios
+	err := os.WriteFile(fn, buf, defaultFilePerms)
+	dios <- struct{}{}
+	return err
+}
+
+// Read in the consumer checkpoints. These will not be encrypted when restored from a snapshot.
+func (o *consumerFileStore) readCheckpoints() ([]*consumerCheckpoint, error) {
+	o.mu.Lock()
+	aek, fn := o.aek, filepath.Join(o.odir, consumerCheckpoints)
+	o.mu.Unlock()
+
+	buf, err := os.ReadFile(fn)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if aek != nil {
+		if ns := aek.NonceSize(); len(buf) > ns {
+			if dbuf, err := aek.Open(nil, buf[:ns], buf[ns:], nil); err == nil {
+				buf = dbuf
+			}
+		}
+	}
+	return decodeConsumerCheckpoints(buf)
+}
+
 // Write out the consumer meta data, i.e. state.
 // Lock should be held.
 func (cfs *consumerFileStore) writeConsumerMeta() error {
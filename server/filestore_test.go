@@ -31,6 +31,8 @@ import (
 	"path/filepath"
 	"reflect"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -809,6 +811,7 @@ func TestFileStoreCompact(t *testing.T) {
 			StreamConfig{Name: "zzz", Storage: FileStorage},
 			time.Now(),
 			prf,
+			nil,
 		)
 		if err != nil {
 			t.Fatalf("Unexpected error: %v", err)
@@ -854,6 +857,7 @@ func TestFileStoreCompact(t *testing.T) {
 			StreamConfig{Name: "zzz", Storage: FileStorage},
 			time.Now(),
 			prf,
+			nil,
 		)
 		if err != nil {
 			t.Fatalf("Unexpected error: %v", err)
@@ -1001,6 +1005,7 @@ func TestFileStoreStreamTruncate(t *testing.T) {
 			StreamConfig{Name: "zzz", Subjects: []string{"*"}, Storage: FileStorage},
 			time.Now(),
 			prf,
+			nil,
 		)
 		if err != nil {
 			t.Fatalf("Unexpected error: %v", err)
@@ -1065,6 +1070,7 @@ func TestFileStoreStreamTruncate(t *testing.T) {
 			StreamConfig{Name: "zzz", Subjects: []string{"foo"}, Storage: FileStorage},
 			time.Now(),
 			prf,
+			nil,
 		)
 		if err != nil {
 			t.Fatalf("Unexpected error: %v", err)
@@ -3470,7 +3476,7 @@ func TestFileStoreSparseCompaction(t *testing.T) {
 			prf = nil
 		}
 
-		fs, err = newFileStoreWithCreated(fcfg, cfg, time.Now(), prf)
+		fs, err = newFileStoreWithCreated(fcfg, cfg, time.Now(), prf, nil)
 		if err != nil {
 			t.Fatalf("Unexpected error: %v", err)
 		}
@@ -3790,6 +3796,7 @@ func TestFileStoreCompactReclaimHeadSpace(t *testing.T) {
 			StreamConfig{Name: "TEST", Storage: FileStorage},
 			time.Now(),
 			prf,
+			nil,
 		)
 		require_NoError(t, err)
 		defer fs.Stop()
@@ -3820,6 +3827,7 @@ func TestFileStoreCompactReclaimHeadSpace(t *testing.T) {
 			StreamConfig{Name: "TEST", Storage: FileStorage},
 			time.Now(),
 			prf,
+			nil,
 		)
 		require_NoError(t, err)
 		defer fs.Stop()
@@ -3833,6 +3841,797 @@ func TestFileStoreCompactReclaimHeadSpace(t *testing.T) {
 	})
 }
 
+func TestFileStoreBackgroundCompaction(t *testing.T) {
+	testFileStoreAllPermutations(t, func(t *testing.T, fcfg FileStoreConfig) {
+		fcfg.BlockSize = 4096
+		fcfg.CompactMinBytes = 1024
+		fcfg.CompactLimiter = NewRateLimiter(64 * 1024 * 1024)
+
+		prf := func(context []byte) ([]byte, error) {
+			h := hmac.New(sha256.New, []byte("dlc22"))
+			if _, err := h.Write(context); err != nil {
+				return nil, err
+			}
+			return h.Sum(nil), nil
+		}
+		if fcfg.Cipher == NoCipher {
+			prf = nil
+		}
+		newFS := func() *fileStore {
+			t.Helper()
+			cfg := StreamConfig{Name: "zzz", Subjects: []string{"foo.*"}, Storage: FileStorage}
+			fs, err := newFileStoreWithCreated(fcfg, cfg, time.Now(), prf, nil)
+			require_NoError(t, err)
+			return fs
+		}
+		// Background compaction is off unless we ask for it, we will kick it ourselves.
+		fs := newFS()
+		defer fs.Stop()
+		fs.mu.RLock()
+		cmpTmr := fs.cmpTmr
+		fs.mu.RUnlock()
+		require_True(t, cmpTmr == nil)
+
+		msg := bytes.Repeat([]byte("Z"), 100)
+		for i := 0; i < 200; i++ {
+			_, _, err := fs.StoreMsg(fmt.Sprintf("foo.%d", i%5), nil, msg)
+			require_NoError(t, err)
+		}
+		// Remove all but every fourth message, leaving interior deletes everywhere.
+		for seq := uint64(1); seq <= 200; seq++ {
+			if seq%4 != 1 {
+				_, err := fs.RemoveMsg(seq)
+				require_NoError(t, err)
+			}
+		}
+		before := fs.State()
+		require_True(t, before.Msgs == 50)
+
+		rb := fs.reclaimableBytes()
+		require_True(t, rb > 0)
+		total, _, err := fs.Utilization()
+		require_NoError(t, err)
+
+		fs.compactBlocks()
+
+		// Everything but the last block should have been rewritten.
+		fs.mu.RLock()
+		lrb := fs.lmb.reclaimableBytes()
+		fs.mu.RUnlock()
+		require_True(t, fs.reclaimableBytes() == lrb)
+		ntotal, _, err := fs.Utilization()
+		require_NoError(t, err)
+		require_True(t, ntotal < total)
+		require_True(t, total-ntotal == rb-lrb)
+
+		checkState := func(fs *fileStore) {
+			t.Helper()
+			if state := fs.State(); !reflect.DeepEqual(state, before) {
+				t.Fatalf("Expected state %+v, got %+v", before, state)
+			}
+			for seq := uint64(1); seq <= 200; seq++ {
+				sm, err := fs.LoadMsg(seq, nil)
+				if seq%4 != 1 {
+					require_Error(t, err, ErrStoreMsgNotFound, errDeletedMsg)
+					continue
+				}
+				require_NoError(t, err)
+				require_True(t, sm.seq == seq)
+				require_True(t, sm.subj == fmt.Sprintf("foo.%d", (seq-1)%5))
+				require_True(t, bytes.Equal(sm.msg, msg))
+			}
+			require_True(t, fs.FilteredState(1, "foo.0").Msgs == 10)
+		}
+		checkState(fs)
+
+		// Nothing more to do a second time around.
+		fs.compactBlocks()
+		n, _, err := fs.Utilization()
+		require_NoError(t, err)
+		require_True(t, n == ntotal)
+
+		// Make sure we recover properly.
+		fs.Stop()
+		fs = newFS()
+		defer fs.Stop()
+		checkState(fs)
+
+		// Messages removed while we compact must stay removed.
+		fs.fcfg.CompactThreshold, fs.fcfg.CompactMinBytes = 0.9, 1
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			for seq := uint64(9); seq <= 200; seq += 8 {
+				fs.RemoveMsg(seq)
+			}
+		}()
+		fs.compactBlocks()
+		<-done
+		fs.compactBlocks()
+		for seq := uint64(9); seq <= 200; seq += 8 {
+			_, err := fs.LoadMsg(seq, nil)
+			require_Error(t, err, ErrStoreMsgNotFound, errDeletedMsg)
+		}
+		require_True(t, fs.State().Msgs == 26)
+		fs.mu.RLock()
+		lrb = fs.lmb.reclaimableBytes()
+		fs.mu.RUnlock()
+
+		// Now make sure the timer does this for us. Removing every other
+		// message leaves blocks half full so adjust our triggers.
+		fs.Stop()
+		fcfg.CompactInterval = 10 * time.Millisecond
+		fcfg.CompactThreshold = 0.9
+		fcfg.CompactMinBytes = 1
+		fs = newFS()
+		defer fs.Stop()
+		for seq := uint64(1); seq <= 100; seq += 8 {
+			_, err := fs.RemoveMsg(seq)
+			require_NoError(t, err)
+		}
+		require_True(t, fs.reclaimableBytes() > 0)
+		checkFor(t, 2*time.Second, 20*time.Millisecond, func() error {
+			if rb := fs.reclaimableBytes(); rb > lrb {
+				return fmt.Errorf("still %d reclaimable bytes", rb)
+			}
+			return nil
+		})
+	})
+}
+
+func TestFileStoreRateLimiterShared(t *testing.T) {
+	rl := NewRateLimiter(1024 * 1024)
+	qch := make(chan struct{})
+
+	// Two stores working at the same time share the rate.
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			require_True(t, rl.wait(100*1024, qch))
+		}()
+	}
+	wg.Wait()
+	if elapsed := time.Since(start); elapsed < 180*time.Millisecond {
+		t.Fatalf("Expected to be paced to our shared rate, took %v", elapsed)
+	}
+
+	// Quitting stops the wait.
+	close(qch)
+	require_False(t, rl.wait(10*1024*1024, qch))
+
+	// No limiter or no rate means no waiting.
+	var nrl *RateLimiter
+	require_True(t, nrl.wait(1024, nil))
+	require_True(t, NewRateLimiter(0).wait(1024, nil))
+}
+
+func TestFileStoreBackgroundScrubbing(t *testing.T) {
+	testFileStoreAllPermutations(t, func(t *testing.T, fcfg FileStoreConfig) {
+		fcfg.BlockSize = 4096
+		// Disable the timer, we will kick scrubbing ourselves.
+		fcfg.ScrubInterval = -1
+		fcfg.ScrubLimiter = NewRateLimiter(1024 * 1024 * 1024)
+
+		prf := func(context []byte) ([]byte, error) {
+			h := hmac.New(sha256.New, []byte("dlc22"))
+			if _, err := h.Write(context); err != nil {
+				return nil, err
+			}
+			return h.Sum(nil), nil
+		}
+		if fcfg.Cipher == NoCipher {
+			prf = nil
+		}
+		cfg := StreamConfig{Name: "zzz", Subjects: []string{"foo"}, Storage: FileStorage}
+		fs, err := newFileStoreWithCreated(fcfg, cfg, time.Now(), prf, nil)
+		require_NoError(t, err)
+		defer fs.Stop()
+
+		type corruption struct {
+			first, last uint64
+			err         error
+		}
+		var found []corruption
+		fs.registerCorruptionHandler(func(first, last uint64, err error) {
+			found = append(found, corruption{first, last, err})
+		})
+
+		msg := bytes.Repeat([]byte("Z"), 100)
+		for i := 0; i < 100; i++ {
+			_, _, err := fs.StoreMsg("foo", nil, msg)
+			require_NoError(t, err)
+		}
+		// Deleted messages should not be checked.
+		_, err = fs.RemoveMsg(3)
+		require_NoError(t, err)
+
+		fs.mu.RLock()
+		nblks := uint64(len(fs.blks))
+		mfn := fs.blks[0].mfn
+		lseq := fs.blks[0].last.seq
+		fs.mu.RUnlock()
+		require_True(t, nblks > 2)
+
+		// Good copies of the messages in our first block, as a healthy replica would have them.
+		copies := make(map[uint64]*StoreMsg)
+		for seq := uint64(1); seq <= lseq; seq++ {
+			if sm, err := fs.LoadMsg(seq, nil); err == nil {
+				copies[seq] = sm
+			}
+		}
+
+		fs.scrubBlocks()
+		require_True(t, len(found) == 0)
+		stats := fs.scrubStats()
+		require_True(t, stats.Blocks == nblks-1)
+		require_True(t, stats.Bytes > 0)
+		require_True(t, stats.Corrupt == 0)
+		require_False(t, stats.LastScrub.IsZero())
+
+		// Flip a byte in the payload of the second message.
+		buf, err := os.ReadFile(mfn)
+		require_NoError(t, err)
+		rl := fileStoreMsgSize("foo", nil, msg)
+		buf[rl+msgHdrSize+3+10] ^= 0xff
+		require_NoError(t, os.WriteFile(mfn, buf, defaultFilePerms))
+
+		fs.scrubBlocks()
+		require_True(t, len(found) == 1)
+		require_True(t, found[0].first == 2)
+		require_True(t, found[0].last == 2)
+		require_Error(t, found[0].err, errBadMsg)
+		stats = fs.scrubStats()
+		require_True(t, stats.Blocks == 2*(nblks-1))
+		require_True(t, stats.Corrupt == 1)
+
+		checkMsgs := func(missing uint64) {
+			t.Helper()
+			for seq := uint64(1); seq <= lseq; seq++ {
+				sm, err := fs.LoadMsg(seq, nil)
+				if seq == 3 || seq == missing {
+					require_Error(t, err, ErrStoreMsgNotFound, errDeletedMsg)
+					continue
+				}
+				require_NoError(t, err)
+				require_True(t, sm.ts == copies[seq].ts)
+				require_True(t, bytes.Equal(sm.msg, msg))
+			}
+		}
+
+		// Repairing only rewrites the corrupt message.
+		require_NoError(t, fs.repairMsgs(2, 2, map[uint64]*StoreMsg{2: copies[2]}))
+		fs.scrubBlocks()
+		require_True(t, len(found) == 1)
+		require_True(t, fs.State().Msgs == 99)
+		checkMsgs(0)
+
+		// Now break the length of the second record, we can not trust anything past it.
+		buf, err = os.ReadFile(mfn)
+		require_NoError(t, err)
+		buf[rl+2] ^= 0xff
+		require_NoError(t, os.WriteFile(mfn, buf, defaultFilePerms))
+
+		fs.scrubBlocks()
+		require_True(t, len(found) == 2)
+		require_True(t, found[1].first == 2)
+		require_True(t, found[1].last == lseq)
+
+		// Messages we have no copy of are stored as deleted.
+		delete(copies, 4)
+		require_NoError(t, fs.repairMsgs(found[1].first, found[1].last, copies))
+		fs.scrubBlocks()
+		require_True(t, len(found) == 2)
+		require_True(t, fs.State().Msgs == 98)
+		checkMsgs(4)
+
+		// Make sure we recover properly.
+		fs.Stop()
+		fs, err = newFileStoreWithCreated(fcfg, cfg, time.Now(), prf, nil)
+		require_NoError(t, err)
+		defer fs.Stop()
+		require_True(t, fs.State().Msgs == 98)
+		checkMsgs(4)
+	})
+}
+
+func TestFileStoreHeaderIndex(t *testing.T) {
+	testFileStoreAllPermutations(t, func(t *testing.T, fcfg FileStoreConfig) {
+		fcfg.BlockSize = 1024
+
+		prf := func(context []byte) ([]byte, error) {
+			h := hmac.New(sha256.New, []byte("dlc22"))
+			if _, err := h.Write(context); err != nil {
+				return nil, err
+			}
+			return h.Sum(nil), nil
+		}
+		if fcfg.Cipher == NoCipher {
+			prf = nil
+		}
+		cfg := StreamConfig{Name: "zzz", Subjects: []string{"foo"}, Storage: FileStorage, IndexedHeaders: []string{"Order-Id"}}
+		fs, err := newFileStoreWithCreated(fcfg, cfg, time.Now(), prf, nil)
+		require_NoError(t, err)
+		defer fs.Stop()
+
+		msg := bytes.Repeat([]byte("Z"), 100)
+		for i := 0; i < 100; i++ {
+			hdr := []byte(fmt.Sprintf("NATS/1.0\r\nOrder-Id: %d\r\n\r\n", i%25))
+			_, _, err := fs.StoreMsg("foo", hdr, msg)
+			require_NoError(t, err)
+		}
+		_, _, err = fs.StoreMsg("foo", nil, msg)
+		require_NoError(t, err)
+
+		checkLookup := func(value string, start, seq uint64) {
+			t.Helper()
+			sm, err := fs.LoadNextMsgByHeader("Order-Id", value, start, nil)
+			if seq == 0 {
+				require_Error(t, err, ErrStoreMsgNotFound)
+				return
+			}
+			require_NoError(t, err)
+			require_Equal(t, sm.seq, seq)
+			require_Equal(t, string(getHeader("Order-Id", sm.hdr)), value)
+		}
+		checkLookup("7", 0, 8)
+		checkLookup("7", 9, 33)
+		checkLookup("7", 84, 0)
+		checkLookup("100", 0, 0)
+
+		_, err = fs.LoadNextMsgByHeader("Customer", "7", 0, nil)
+		require_Error(t, err, ErrHeaderNotIndexed)
+
+		// Removals should be reflected.
+		_, err = fs.RemoveMsg(8)
+		require_NoError(t, err)
+		checkLookup("7", 0, 33)
+
+		// Our index is released with our cache like our per subject info and loaded again when needed.
+		fs.mu.RLock()
+		mb := fs.blks[1]
+		fs.mu.RUnlock()
+		mb.mu.Lock()
+		mb.lwts = 0
+		mb.tryForceExpireCacheLocked()
+		require_True(t, mb.hidx == nil)
+		mb.mu.Unlock()
+		checkLookup("7", 0, 33)
+		mb.mu.RLock()
+		require_True(t, mb.hidx != nil)
+		mb.mu.RUnlock()
+
+		// Make sure we recover our index, and that it is not stale.
+		fs.Stop()
+		fs, err = newFileStoreWithCreated(fcfg, cfg, time.Now(), prf, nil)
+		require_NoError(t, err)
+		defer fs.Stop()
+		checkLookup("7", 0, 33)
+		checkLookup("24", 0, 25)
+
+		// Now remove the index files and make sure they are regenerated.
+		fs.Stop()
+		hdxs, err := filepath.Glob(filepath.Join(fcfg.StoreDir, msgDir, "*.hdx"))
+		require_NoError(t, err)
+		require_True(t, len(hdxs) > 1)
+		for _, fn := range hdxs {
+			require_NoError(t, os.Remove(fn))
+		}
+		fs, err = newFileStoreWithCreated(fcfg, cfg, time.Now(), prf, nil)
+		require_NoError(t, err)
+		defer fs.Stop()
+		checkLookup("7", 0, 33)
+		checkLookup("7", 34, 58)
+
+		// Compact and truncate.
+		_, err = fs.Compact(40)
+		require_NoError(t, err)
+		checkLookup("7", 0, 58)
+		require_NoError(t, fs.Truncate(75))
+		checkLookup("24", 0, 50)
+		checkLookup("24", 51, 75)
+		checkLookup("7", 59, 0)
+
+		// Changing our indexed headers rebuilds the index in the background.
+		cfg.IndexedHeaders = []string{"Customer"}
+		require_NoError(t, fs.UpdateConfig(&cfg))
+		_, err = fs.LoadNextMsgByHeader("Order-Id", "7", 0, nil)
+		require_Error(t, err, ErrHeaderNotIndexed)
+		checkFor(t, 2*time.Second, 10*time.Millisecond, func() error {
+			fs.mu.RLock()
+			defer fs.mu.RUnlock()
+			for _, mb := range fs.blks {
+				mb.mu.RLock()
+				hidx := mb.hidx
+				mb.mu.RUnlock()
+				if hidx == nil || !hidx.indexes(cfg.IndexedHeaders) {
+					return fmt.Errorf("block %d not rebuilt", mb.index)
+				}
+			}
+			return nil
+		})
+		hdr := []byte("NATS/1.0\r\nCustomer: derek\r\n\r\n")
+		seq, _, err := fs.StoreMsg("foo", hdr, msg)
+		require_NoError(t, err)
+		sm, err := fs.LoadNextMsgByHeader("Customer", "derek", 0, nil)
+		require_NoError(t, err)
+		require_Equal(t, sm.seq, seq)
+
+		// Purge should clear everything.
+		_, err = fs.Purge()
+		require_NoError(t, err)
+		_, err = fs.LoadNextMsgByHeader("Customer", "derek", 0, nil)
+		require_Error(t, err, ErrStoreMsgNotFound)
+	})
+}
+
+func TestFileStoreArchiveBlocks(t *testing.T) {
+	testFileStoreAllPermutations(t, func(t *testing.T, fcfg FileStoreConfig) {
+		adir := t.TempDir()
+		ba, err := NewDirBlockArchive(adir)
+		require_NoError(t, err)
+		_, err = ba.Get("../foo")
+		require_Error(t, err)
+
+		fcfg.BlockSize = 4096
+		fcfg.Archive = ba
+		fcfg.ArchivePrefix = "S/A/zzz"
+		// Disable the timer, we will kick archiving ourselves.
+		fcfg.ArchiveInterval = -1
+
+		prf := func(context []byte) ([]byte, error) {
+			h := hmac.New(sha256.New, []byte("dlc22"))
+			if _, err := h.Write(context); err != nil {
+				return nil, err
+			}
+			return h.Sum(nil), nil
+		}
+		if fcfg.Cipher == NoCipher {
+			prf = nil
+		}
+		cfg := StreamConfig{Name: "zzz", Subjects: []string{"foo.*"}, Storage: FileStorage, ArchiveAfter: time.Hour}
+		fs, err := newFileStoreWithCreated(fcfg, cfg, time.Now(), prf, nil)
+		require_NoError(t, err)
+		defer fs.Stop()
+
+		msg := bytes.Repeat([]byte("Z"), 100)
+		for i := 0; i < 100; i++ {
+			_, _, err := fs.StoreMsg(fmt.Sprintf("foo.%d", i%5), nil, msg)
+			require_NoError(t, err)
+		}
+
+		archived := func() (n int) {
+			t.Helper()
+			fs.mu.RLock()
+			defer fs.mu.RUnlock()
+			for _, mb := range fs.blks {
+				mb.mu.RLock()
+				if mb.arc {
+					n++
+					_, err := os.Stat(mb.mfn)
+					require_True(t, os.IsNotExist(err))
+				}
+				mb.mu.RUnlock()
+			}
+			return n
+		}
+		archivedFiles := func() (n int) {
+			t.Helper()
+			filepath.WalkDir(adir, func(path string, d os.DirEntry, err error) error {
+				if err == nil && !d.IsDir() {
+					n++
+				}
+				return nil
+			})
+			return n
+		}
+
+		// Nothing is old enough yet.
+		fs.archiveBlocks()
+		require_True(t, archived() == 0)
+
+		require_NoError(t, fs.UpdateConfig(&StreamConfig{Name: "zzz", Subjects: []string{"foo.*"}, Storage: FileStorage, ArchiveAfter: time.Nanosecond}))
+		fs.archiveBlocks()
+		fs.mu.RLock()
+		nblks := len(fs.blks)
+		fs.mu.RUnlock()
+		require_True(t, nblks > 2)
+		// All but our last block.
+		require_True(t, archived() == nblks-1)
+		require_True(t, archivedFiles() == nblks-1)
+
+		checkMsgs := func(deleted ...uint64) {
+			t.Helper()
+			isDeleted := func(seq uint64) bool {
+				for _, dseq := range deleted {
+					if seq == dseq {
+						return true
+					}
+				}
+				return false
+			}
+			for seq := uint64(1); seq <= 100; seq++ {
+				sm, err := fs.LoadMsg(seq, nil)
+				if isDeleted(seq) {
+					require_Error(t, err)
+					continue
+				}
+				require_NoError(t, err)
+				require_True(t, sm.subj == fmt.Sprintf("foo.%d", (seq-1)%5))
+				require_True(t, bytes.Equal(sm.msg, msg))
+			}
+			state := fs.State()
+			require_True(t, state.Msgs == uint64(100-len(deleted)))
+			require_True(t, fs.SubjectsTotals("foo.*")["foo.1"] > 0)
+		}
+		checkMsgs()
+
+		// Removing messages leaves our blocks archived.
+		_, err = fs.RemoveMsg(3)
+		require_NoError(t, err)
+		require_True(t, archived() == nblks-1)
+		// Erasing them needs to rewrite the block, unless encrypted where erase is a remove.
+		_, err = fs.EraseMsg(40)
+		require_NoError(t, err)
+		narchived := nblks - 2
+		if prf != nil {
+			narchived = nblks - 1
+		}
+		require_True(t, archived() == narchived)
+		require_True(t, archivedFiles() == narchived)
+		checkMsgs(3, 40)
+		// Our markers and restored blocks are staged and renamed into place.
+		for _, scan := range []string{"*.narc", "*.unarc"} {
+			staged, err := filepath.Glob(filepath.Join(fcfg.StoreDir, msgDir, scan))
+			require_NoError(t, err)
+			require_True(t, len(staged) == 0)
+		}
+
+		// Make sure we recover archived blocks.
+		fs.Stop()
+		fs, err = newFileStoreWithCreated(fcfg, cfg, time.Now(), prf, nil)
+		require_NoError(t, err)
+		defer fs.Stop()
+		require_True(t, archived() == narchived)
+		checkMsgs(3, 40)
+
+		// Archived blocks are removed from the archive with the stream's messages.
+		_, err = fs.Compact(10)
+		require_NoError(t, err)
+		_, err = fs.Compact(50)
+		require_NoError(t, err)
+		require_True(t, archivedFiles() < narchived)
+		_, err = fs.Purge()
+		require_NoError(t, err)
+		require_True(t, archivedFiles() == 0)
+	})
+}
+
+// Blocks in Get while set so we can check what is held while fetching.
+type blockingArchive struct {
+	BlockArchive
+	block   atomic.Bool
+	gets    chan struct{}
+	release chan struct{}
+}
+
+func (ba *blockingArchive) Get(key string) ([]byte, error) {
+	if ba.block.Load() {
+		ba.gets <- struct{}{}
+		<-ba.release
+	}
+	return ba.BlockArchive.Get(key)
+}
+
+func TestFileStoreArchiveFetchWithoutLocks(t *testing.T) {
+	dba, err := NewDirBlockArchive(t.TempDir())
+	require_NoError(t, err)
+	ba := &blockingArchive{BlockArchive: dba, gets: make(chan struct{}), release: make(chan struct{})}
+
+	fcfg := FileStoreConfig{StoreDir: t.TempDir(), BlockSize: 4096, Archive: ba, ArchivePrefix: "S/A/zzz", ArchiveInterval: -1}
+	cfg := StreamConfig{Name: "zzz", Subjects: []string{"foo.*"}, Storage: FileStorage, ArchiveAfter: time.Nanosecond, IndexedHeaders: []string{"Order-Id"}}
+	fs, err := newFileStore(fcfg, cfg)
+	require_NoError(t, err)
+	defer fs.Stop()
+
+	msg := bytes.Repeat([]byte("Z"), 100)
+	for i := 0; i < 100; i++ {
+		hdr := []byte(fmt.Sprintf("NATS/1.0\r\nOrder-Id: %d\r\n\r\n", i%5))
+		_, _, err := fs.StoreMsg(fmt.Sprintf("foo.%d", i%5), hdr, msg)
+		require_NoError(t, err)
+	}
+	fs.archiveBlocks()
+
+	fs.mu.RLock()
+	mb := fs.blks[0]
+	fs.mu.RUnlock()
+	clearCache := func() {
+		mb.mu.Lock()
+		mb.clearCache()
+		mb.mu.Unlock()
+		fs.arch.remove(mb.akey)
+	}
+	// While a reader waits on the archive we can still get all of our locks.
+	checkFetch := func(load func() error) {
+		t.Helper()
+		clearCache()
+		ba.block.Store(true)
+		errCh := make(chan error, 1)
+		go func() { errCh <- load() }()
+		select {
+		case <-ba.gets:
+		case <-time.After(2 * time.Second):
+			t.Fatalf("Expected a fetch from the archive")
+		}
+		require_True(t, fs.mu.TryLock())
+		fs.mu.Unlock()
+		require_True(t, mb.mu.TryLock())
+		mb.mu.Unlock()
+		_, _, err := fs.StoreMsg("foo.22", nil, msg)
+		require_NoError(t, err)
+		ba.block.Store(false)
+		ba.release <- struct{}{}
+		require_NoError(t, <-errCh)
+	}
+	checkFetch(func() error {
+		_, err := fs.LoadMsg(1, nil)
+		return err
+	})
+	checkFetch(func() error {
+		sm, _, err := fs.LoadNextMsg("foo.1", true, 1, nil)
+		if err == nil && sm.seq != 2 {
+			err = fmt.Errorf("unexpected sequence %d", sm.seq)
+		}
+		return err
+	})
+	// Regenerating our header index needs our block as well.
+	mb.mu.Lock()
+	mb.removeHeaderIndexLocked()
+	mb.hidx = nil
+	mb.mu.Unlock()
+	checkFetch(func() error {
+		sm, err := fs.LoadNextMsgByHeader("Order-Id", "1", 1, nil)
+		if err == nil && sm.seq != 2 {
+			err = fmt.Errorf("unexpected sequence %d", sm.seq)
+		}
+		return err
+	})
+
+	// Fetched blocks are kept locally, so loading them again does not fetch them again.
+	fetches := fs.afetches.Load()
+	mb.mu.Lock()
+	mb.clearCache()
+	mb.mu.Unlock()
+	sm, err := fs.LoadMsg(3, nil)
+	require_NoError(t, err)
+	require_True(t, sm.subj == "foo.2")
+	require_Equal(t, fs.afetches.Load(), fetches)
+}
+
+func TestFileStoreKeyRotation(t *testing.T) {
+	testFileStoreAllPermutations(t, func(t *testing.T, fcfg FileStoreConfig) {
+		if fcfg.Cipher == NoCipher {
+			t.SkipNow()
+		}
+		fcfg.BlockSize = 4096
+
+		keyGen := func(key string) keyGen {
+			return func(context []byte) ([]byte, error) {
+				h := hmac.New(sha256.New, []byte(key))
+				if _, err := h.Write(context); err != nil {
+					return nil, err
+				}
+				return h.Sum(nil), nil
+			}
+		}
+		oldprf, prf := keyGen("dlc22"), keyGen("dlc23")
+
+		cfg := StreamConfig{Name: "zzz", Subjects: []string{"foo"}, Storage: FileStorage}
+		fs, err := newFileStoreWithCreated(fcfg, cfg, time.Now(), oldprf, nil)
+		require_NoError(t, err)
+		defer fs.Stop()
+
+		msg := bytes.Repeat([]byte("Z"), 100)
+		for i := 0; i < 100; i++ {
+			_, _, err := fs.StoreMsg("foo", nil, msg)
+			require_NoError(t, err)
+		}
+		o, err := fs.ConsumerStore("o22", &ConsumerConfig{})
+		require_NoError(t, err)
+		state := &ConsumerState{}
+		state.Delivered.Consumer, state.Delivered.Stream = 22, 22
+		state.AckFloor.Consumer, state.AckFloor.Stream = 11, 11
+		require_NoError(t, o.Update(state))
+		require_True(t, fs.keyRotation() == nil)
+
+		fs.mu.RLock()
+		nblks := len(fs.blks)
+		mb := fs.blks[0]
+		fs.mu.RUnlock()
+		mdir := filepath.Join(fcfg.StoreDir, msgDir)
+		kfn := filepath.Join(mdir, fmt.Sprintf(keyScan, mb.index))
+		rkf := filepath.Join(mdir, fmt.Sprintf(rkeyScan, mb.index))
+		okey, err := os.ReadFile(kfn)
+		require_NoError(t, err)
+		fs.Stop()
+
+		checkStore := func(fs *fileStore) {
+			t.Helper()
+			for seq := uint64(1); seq <= 100; seq++ {
+				sm, err := fs.LoadMsg(seq, nil)
+				require_NoError(t, err)
+				require_True(t, bytes.Equal(sm.msg, msg))
+			}
+			o, err := fs.ConsumerStore("o22", &ConsumerConfig{})
+			require_NoError(t, err)
+			rstate, err := o.State()
+			require_NoError(t, err)
+			if rstate.Delivered != state.Delivered || rstate.AckFloor != state.AckFloor {
+				t.Fatalf("Bad recovered consumer state, expected %+v got %+v", state, rstate)
+			}
+		}
+		waitForRotation := func(fs *fileStore) {
+			t.Helper()
+			checkFor(t, 2*time.Second, 10*time.Millisecond, func() error {
+				if ki := fs.keyRotation(); ki == nil || ki.Pending > 0 {
+					return fmt.Errorf("rotation not complete: %+v", ki)
+				}
+				return nil
+			})
+		}
+
+		// Our previous key can not be used by itself.
+		_, err = newFileStoreWithCreated(fcfg, cfg, time.Now(), prf, nil)
+		require_Error(t, err)
+
+		// Rotate to our new key.
+		fs, err = newFileStoreWithCreated(fcfg, cfg, time.Now(), prf, oldprf)
+		require_NoError(t, err)
+		defer fs.Stop()
+		require_True(t, fs.keyRotation().Blocks == nblks)
+		checkStore(fs)
+		waitForRotation(fs)
+		// Make sure we can still write.
+		_, _, err = fs.StoreMsg("foo", nil, msg)
+		require_NoError(t, err)
+		fs.Stop()
+
+		// Everything should now be readable with only our new key.
+		fs, err = newFileStoreWithCreated(fcfg, cfg, time.Now(), prf, nil)
+		require_NoError(t, err)
+		defer fs.Stop()
+		checkStore(fs)
+		require_True(t, fs.State().Msgs == 101)
+		require_True(t, fs.keyRotation() == nil)
+		fs.Stop()
+
+		// Simulate a crash after rewriting the first block but before moving its new key into place.
+		require_NoError(t, os.Rename(kfn, rkf))
+		require_NoError(t, os.WriteFile(kfn, okey, defaultFilePerms))
+		fs, err = newFileStoreWithCreated(fcfg, cfg, time.Now(), prf, oldprf)
+		require_NoError(t, err)
+		defer fs.Stop()
+		checkStore(fs)
+		require_True(t, fs.keyRotation() == nil)
+		_, err = os.Stat(rkf)
+		require_True(t, os.IsNotExist(err))
+		fs.Stop()
+
+		// Simulate a crash before rewriting the first block, our staged key should be ignored.
+		_, _, _, encrypted, err := fs.genEncryptionKeys(fmt.Sprintf("%s:%d", cfg.Name, mb.index))
+		require_NoError(t, err)
+		require_NoError(t, os.WriteFile(rkf, encrypted, defaultFilePerms))
+		fs, err = newFileStoreWithCreated(fcfg, cfg, time.Now(), prf, nil)
+		require_NoError(t, err)
+		defer fs.Stop()
+		checkStore(fs)
+		_, err = os.Stat(rkf)
+		require_True(t, os.IsNotExist(err))
+	})
+}
+
 func TestFileStoreRememberLastMsgTime(t *testing.T) {
 	testFileStoreAllPermutations(t, func(t *testing.T, fcfg FileStoreConfig) {
 		var fs *fileStore
@@ -4048,6 +4847,7 @@ func TestFileStoreShortIndexWriteBug(t *testing.T) {
 			StreamConfig{Name: "TEST", Storage: FileStorage, MaxAge: time.Second},
 			created,
 			prf,
+			nil,
 		)
 		require_NoError(t, err)
 		defer fs.Stop()
@@ -4084,6 +4884,7 @@ func TestFileStoreShortIndexWriteBug(t *testing.T) {
 			StreamConfig{Name: "TEST", Storage: FileStorage, MaxAge: time.Second},
 			created,
 			prf,
+			nil,
 		)
 		require_NoError(t, err)
 		defer fs.Stop()
@@ -4112,6 +4913,7 @@ func TestFileStoreDoubleCompactWithWriteInBetweenEncryptedBug(t *testing.T) {
 			StreamConfig{Name: "zzz", Storage: FileStorage},
 			time.Now(),
 			prf,
+			nil,
 		)
 		require_NoError(t, err)
 		defer fs.Stop()
@@ -4164,6 +4966,7 @@ func TestFileStoreEncryptedKeepIndexNeedBekResetBug(t *testing.T) {
 			StreamConfig{Name: "zzz", Storage: FileStorage, MaxAge: ttl},
 			time.Now(),
 			prf,
+			nil,
 		)
 		require_NoError(t, err)
 		defer fs.Stop()
@@ -4454,6 +5257,7 @@ func TestFileStoreEncrypted(t *testing.T) {
 			StreamConfig{Name: "zzz", Storage: FileStorage},
 			time.Now(),
 			prf,
+			nil,
 		)
 		require_NoError(t, err)
 		defer fs.Stop()
@@ -4481,6 +5285,7 @@ func TestFileStoreEncrypted(t *testing.T) {
 			StreamConfig{Name: "zzz", Storage: FileStorage},
 			time.Now(),
 			prf,
+			nil,
 		)
 		require_NoError(t, err)
 		defer fs.Stop()
@@ -4583,10 +5388,10 @@ func TestFileStoreNoFSSBugAfterRemoveFirst(t *testing.T) {
 		mb := fs.blks[0]
 		fs.mu.Unlock()
 		mb.mu.RLock()
-		ss := mb.fss["foo.bar.0"]
+		ss, ok := mb.fss.Find("foo.bar.0")
 		mb.mu.RUnlock()
 
-		if ss != nil {
+		if ok {
 			t.Fatalf("Expected no state for %q, but got %+v\n", "foo.bar.0", ss)
 		}
 	})
@@ -5552,6 +6357,7 @@ func TestFileStoreRestoreEncryptedWithNoKeyFuncFails(t *testing.T) {
 		fcfg, scfg,
 		time.Now(),
 		prf,
+		nil,
 	)
 	require_NoError(t, err)
 
@@ -5568,6 +6374,7 @@ func TestFileStoreRestoreEncryptedWithNoKeyFuncFails(t *testing.T) {
 		fcfg, scfg,
 		time.Now(),
 		nil,
+		nil,
 	)
 	require_Error(t, err, errNoMainKey)
 }
@@ -5623,3 +6430,394 @@ func TestFileStoreKeepWithDeletedMsgsBug(t *testing.T) {
 	require_NoError(t, err)
 	require_True(t, n == 3)
 }
+
+func TestFileStoreInitialFirstSeq(t *testing.T) {
+	sd := t.TempDir()
+	cfg := StreamConfig{Name: "zzz", Subjects: []string{"*"}, Storage: FileStorage, FirstSeq: 1000}
+	fs, err := newFileStore(FileStoreConfig{StoreDir: sd}, cfg)
+	require_NoError(t, err)
+	defer fs.Stop()
+
+	state := fs.State()
+	require_True(t, state.Msgs == 0)
+	require_True(t, state.FirstSeq == 1000)
+	require_True(t, state.LastSeq == 999)
+
+	seq, _, err := fs.StoreMsg("A", nil, []byte("OK"))
+	require_NoError(t, err)
+	require_True(t, seq == 1000)
+
+	seq, _, err = fs.StoreMsg("B", nil, []byte("OK"))
+	require_NoError(t, err)
+	require_True(t, seq == 1001)
+
+	// Make sure we do not reset our state on restart.
+	fs.Stop()
+	fs, err = newFileStore(FileStoreConfig{StoreDir: sd}, cfg)
+	require_NoError(t, err)
+	defer fs.Stop()
+
+	state = fs.State()
+	require_True(t, state.Msgs == 2)
+	require_True(t, state.FirstSeq == 1000)
+	require_True(t, state.LastSeq == 1001)
+}
+
+func TestFileStoreSyncPolicy(t *testing.T) {
+	testFileStoreAllPermutations(t, func(t *testing.T, fcfg FileStoreConfig) {
+		// Make sure the background sync does not interfere.
+		fcfg.SyncInterval = time.Hour
+
+		cfg := StreamConfig{Name: "zzz", Subjects: []string{"foo"}, Storage: FileStorage, Sync: SyncAlways}
+		fs, err := newFileStore(fcfg, cfg)
+		require_NoError(t, err)
+		defer fs.Stop()
+
+		msg := []byte("Hello World")
+		for i := 0; i < 10; i++ {
+			_, _, err := fs.StoreMsg("foo", nil, msg)
+			require_NoError(t, err)
+			// Should be on disk already.
+			fs.mu.RLock()
+			lmb := fs.lmb
+			fs.mu.RUnlock()
+			require_True(t, lmb.pendingWriteSize() == 0)
+		}
+		stats := fs.syncStats()
+		require_True(t, stats.Syncs == 10)
+		require_True(t, stats.MaxTime > 0 && stats.TotalTime >= stats.MaxTime)
+
+		// Now switch to batches.
+		cfg.Sync, cfg.SyncMaxLatency = SyncBatch, 50*time.Millisecond
+		require_NoError(t, fs.UpdateConfig(&cfg))
+
+		for i := 0; i < 10; i++ {
+			_, _, err := fs.StoreMsg("foo", nil, msg)
+			require_NoError(t, err)
+		}
+		// All writes should be covered by a single sync.
+		checkFor(t, time.Second, 10*time.Millisecond, func() error {
+			if syncs := fs.syncStats().Syncs; syncs != 11 {
+				return fmt.Errorf("Expected 11 syncs, got %d", syncs)
+			}
+			return nil
+		})
+		fs.mu.RLock()
+		lmb, pending := fs.lmb, fs.sbTmr != nil || len(fs.sblks) > 0
+		fs.mu.RUnlock()
+		require_False(t, pending)
+		require_True(t, lmb.pendingWriteSize() == 0)
+
+		// Back to the default should not sync on writes.
+		cfg.Sync, cfg.SyncMaxLatency = SyncInterval, 0
+		require_NoError(t, fs.UpdateConfig(&cfg))
+		_, _, err = fs.StoreMsg("foo", nil, msg)
+		require_NoError(t, err)
+		time.Sleep(100 * time.Millisecond)
+		require_True(t, fs.syncStats().Syncs == 11)
+	})
+}
+
+func TestFileStoreOfflineInspectExportAndRepair(t *testing.T) {
+	testFileStoreAllPermutations(t, func(t *testing.T, fcfg FileStoreConfig) {
+		fcfg.StoreDir = filepath.Join(fcfg.StoreDir, "ACC", "streams", "zzz")
+		fcfg.BlockSize = 4096
+		prf := newKeyGen("s3cr3t", "ACC")
+		if fcfg.Cipher == NoCipher {
+			prf = nil
+		}
+		cfg := StreamConfig{Name: "zzz", Subjects: []string{"foo.*"}, Storage: FileStorage}
+		fs, err := newFileStoreWithCreated(fcfg, cfg, time.Now(), prf, nil)
+		require_NoError(t, err)
+
+		msg := bytes.Repeat([]byte("Z"), 100)
+		for i := 0; i < 100; i++ {
+			_, _, err := fs.StoreMsg(fmt.Sprintf("foo.%d", i%5), nil, msg)
+			require_NoError(t, err)
+		}
+		// Record a limit we would enforce on recovery.
+		fs.mu.Lock()
+		fs.cfg.MaxMsgs = 10
+		require_NoError(t, fs.writeStreamMeta())
+		fs.mu.Unlock()
+		require_NoError(t, fs.Stop())
+
+		opts := &StoreToolOptions{Dir: fcfg.StoreDir}
+		if prf != nil {
+			// We need our key for encrypted streams.
+			_, err := InspectFileStore(opts)
+			require_Error(t, err)
+			opts.Key = "s3cr3t"
+		}
+
+		sr, err := InspectFileStore(opts)
+		require_NoError(t, err)
+		require_True(t, sr.Encrypted == (prf != nil))
+		require_True(t, sr.Config.MaxMsgs == 10)
+		// Our limits should not have been applied.
+		require_True(t, sr.State.Msgs == 100)
+		require_True(t, len(sr.Blocks) > 2)
+		require_True(t, len(sr.Subjects) == 5)
+		require_True(t, sr.Subjects["foo.3"] == 20)
+		require_True(t, len(sr.Corrupt) == 0)
+		first := sr.Blocks[0]
+
+		// Flip a byte in the payload of the 4th message of our first block.
+		const rl = msgHdrSize + 5 + 100 + recordHashSize
+		fn := filepath.Join(fcfg.StoreDir, msgDir, fmt.Sprintf(blkScan, first.Index))
+		buf, err := os.ReadFile(fn)
+		require_NoError(t, err)
+		buf[3*rl+msgHdrSize+5+10] ^= 0xff
+		require_NoError(t, os.WriteFile(fn, buf, defaultFilePerms))
+		// Recovery would rebuild the index of our last block.
+		last := sr.Blocks[len(sr.Blocks)-1]
+		require_NoError(t, os.Remove(filepath.Join(fcfg.StoreDir, msgDir, fmt.Sprintf(indexScan, last.Index))))
+
+		// Remember what the stream looks like on disk.
+		snapshotDir := func() map[string]string {
+			t.Helper()
+			files := make(map[string]string)
+			err := filepath.WalkDir(fcfg.StoreDir, func(path string, d os.DirEntry, err error) error {
+				if err != nil || d.IsDir() {
+					return err
+				}
+				fi, err := d.Info()
+				if err != nil {
+					return err
+				}
+				buf, err := os.ReadFile(path)
+				if err != nil {
+					return err
+				}
+				files[path] = fmt.Sprintf("%x %v", sha256.Sum256(buf), fi.ModTime())
+				return nil
+			})
+			require_NoError(t, err)
+			return files
+		}
+		before := snapshotDir()
+
+		sr, err = InspectFileStore(opts)
+		require_NoError(t, err)
+		require_True(t, len(sr.Corrupt) == 1)
+		require_True(t, sr.Corrupt[0].Block == first.Index)
+		require_True(t, sr.Corrupt[0].Offset == 3*rl)
+		require_True(t, sr.Corrupt[0].Seq == 4)
+
+		var out bytes.Buffer
+		exported, skipped, err := ExportFileStore(opts, &out, false)
+		require_NoError(t, err)
+		require_True(t, exported == 99)
+		require_True(t, skipped == 1)
+		lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+		require_True(t, len(lines) == 100)
+		var hdr StreamExportHeader
+		require_NoError(t, json.Unmarshal([]byte(lines[0]), &hdr))
+		require_True(t, hdr.Type == StreamExportType)
+		require_True(t, hdr.Config.Name == "zzz")
+		var sm StoredMsg
+		require_NoError(t, json.Unmarshal([]byte(lines[4]), &sm))
+		require_True(t, sm.Sequence == 5)
+		require_True(t, sm.Subject == "foo.4")
+		require_True(t, bytes.Equal(sm.Data, msg))
+
+		// A copy is recovered as the server would, which finds the same.
+		copts := *opts
+		copts.Copy = true
+		csr, err := InspectFileStore(&copts)
+		require_NoError(t, err)
+		require_True(t, csr.State.Msgs == sr.State.Msgs)
+		require_True(t, len(csr.Corrupt) == 1)
+
+		// Read only stores can not be written to.
+		rfcfg := fcfg
+		rfcfg.ReadOnly = true
+		rfs, err := newFileStoreWithCreated(rfcfg, cfg, time.Now(), prf, nil)
+		require_NoError(t, err)
+		_, _, err = rfs.StoreMsg("foo.1", nil, msg)
+		require_Error(t, err, errStoreReadOnly)
+		_, err = rfs.RemoveMsg(1)
+		require_Error(t, err, errStoreReadOnly)
+		_, err = rfs.Purge()
+		require_Error(t, err, errStoreReadOnly)
+		require_NoError(t, rfs.Stop())
+
+		// Inspecting and exporting should not have changed anything.
+		require_True(t, reflect.DeepEqual(snapshotDir(), before))
+
+		// Import the export as a new stream, the limits of the exported config apply.
+		iopts := &StoreToolOptions{Dir: filepath.Join(filepath.Dir(fcfg.StoreDir), "yyy"), Key: opts.Key, Cipher: fcfg.Cipher}
+		imported, err := ImportFileStore(iopts, &out, false)
+		require_NoError(t, err)
+		require_True(t, imported == 99)
+		_, err = ImportFileStore(iopts, strings.NewReader(lines[0]), false)
+		require_Error(t, err)
+		sr, err = InspectFileStore(iopts)
+		require_NoError(t, err)
+		require_True(t, sr.Config.Name == "yyy")
+		require_True(t, sr.Encrypted == (prf != nil))
+		require_True(t, sr.State.Msgs == 10)
+		require_True(t, sr.State.FirstSeq == 91 && sr.State.LastSeq == 100)
+
+		// Repair will truncate our first block at the bad record.
+		ld, err := RepairFileStore(opts)
+		require_NoError(t, err)
+		require_True(t, ld != nil)
+		require_True(t, len(ld.Msgs) == int(first.LastSeq-3))
+		require_True(t, ld.Msgs[0] == 4)
+
+		sr, err = InspectFileStore(opts)
+		require_NoError(t, err)
+		require_True(t, len(sr.Corrupt) == 0)
+		require_True(t, sr.State.Msgs == 100-uint64(len(ld.Msgs)))
+		require_True(t, sr.Blocks[0].LastSeq == 3)
+
+		// Make sure the server can recover the repaired stream.
+		fs, err = newFileStoreWithCreated(fcfg, StreamConfig{Name: "zzz", Subjects: []string{"foo.*"}, Storage: FileStorage}, time.Now(), prf, nil)
+		require_NoError(t, err)
+		defer fs.Stop()
+		state := fs.State()
+		require_True(t, state.Msgs == sr.State.Msgs)
+		_, err = fs.LoadMsg(3, nil)
+		require_NoError(t, err)
+		_, err = fs.LoadMsg(first.LastSeq+1, nil)
+		require_NoError(t, err)
+	})
+}
+
+func TestFileStoreReadAheadSequentialReads(t *testing.T) {
+	testFileStoreAllPermutations(t, func(t *testing.T, fcfg FileStoreConfig) {
+		fcfg.BlockSize = 256
+		budget := NewReadAheadBudget(1024 * 1024)
+		fcfg.ReadAhead = budget
+
+		fs, err := newFileStore(fcfg, StreamConfig{Name: "zzz", Subjects: []string{"foo.*"}, Storage: FileStorage})
+		require_NoError(t, err)
+		defer fs.Stop()
+
+		msg := []byte("Hello World")
+		for i := 0; i < 50; i++ {
+			_, _, err := fs.StoreMsg(fmt.Sprintf("foo.%d", i%5), nil, msg)
+			require_NoError(t, err)
+		}
+
+		clearCaches := func() {
+			t.Helper()
+			fs.mu.RLock()
+			defer fs.mu.RUnlock()
+			require_True(t, len(fs.blks) > 4)
+			for _, mb := range fs.blks {
+				if mb != fs.lmb {
+					mb.mu.Lock()
+					mb.clearCacheAndOffset()
+					mb.mu.Unlock()
+				}
+			}
+		}
+		cacheLoaded := func(i int) bool {
+			fs.mu.RLock()
+			mb := fs.blks[i]
+			fs.mu.RUnlock()
+			mb.mu.RLock()
+			defer mb.mu.RUnlock()
+			return mb.cacheAlreadyLoaded()
+		}
+		clearCaches()
+
+		// Entering the first block should load the next ones ahead.
+		var smv StoreMsg
+		sm, _, err := fs.LoadNextMsg(fwcs, true, 1, &smv)
+		require_NoError(t, err)
+		require_True(t, sm.seq == 1)
+		checkFor(t, time.Second, 10*time.Millisecond, func() error {
+			if !cacheLoaded(1) || !cacheLoaded(2) {
+				return fmt.Errorf("Expected next blocks to be loaded")
+			}
+			return nil
+		})
+		require_False(t, cacheLoaded(3))
+		stats := fs.cacheStats()
+		require_True(t, stats.Misses == 1 && stats.Hits == 0)
+		require_True(t, stats.ReadAheads == 2)
+		require_True(t, stats.Bytes > 0)
+		require_True(t, budget.Used() > 0)
+
+		// Reading on should hit the caches loaded ahead of us.
+		for seq := uint64(2); seq <= 20; seq++ {
+			sm, _, err := fs.LoadNextMsg(fwcs, true, seq, &smv)
+			require_NoError(t, err)
+			require_True(t, sm.seq == seq)
+			// Do not outrun the loads in the background.
+			checkFor(t, time.Second, time.Millisecond, func() error {
+				if fs.rap.Load() {
+					return fmt.Errorf("Still loading ahead")
+				}
+				return nil
+			})
+		}
+		stats = fs.cacheStats()
+		require_True(t, stats.Misses == 1)
+		require_True(t, stats.Hits == 19)
+		require_True(t, stats.ReadAheads > 2)
+
+		// Loading the first message of a block directly, like a catchup, reads ahead as well.
+		clearCaches()
+		fs.mu.RLock()
+		first := fs.blks[1].first.seq
+		fs.mu.RUnlock()
+		_, err = fs.LoadMsg(first, &smv)
+		require_NoError(t, err)
+		checkFor(t, time.Second, 10*time.Millisecond, func() error {
+			if !cacheLoaded(2) || !cacheLoaded(3) {
+				return fmt.Errorf("Expected next blocks to be loaded")
+			}
+			return nil
+		})
+
+		// Caches we loaded ahead are returned to the budget once gone.
+		fs.Stop()
+		require_True(t, budget.Used() == 0)
+	})
+}
+
+func TestFileStoreReadAheadBudget(t *testing.T) {
+	sd := t.TempDir()
+	// Not enough for a single block.
+	budget := NewReadAheadBudget(100)
+	fs, err := newFileStore(
+		FileStoreConfig{StoreDir: sd, BlockSize: 256, ReadAhead: budget},
+		StreamConfig{Name: "zzz", Subjects: []string{"foo"}, Storage: FileStorage})
+	require_NoError(t, err)
+	defer fs.Stop()
+
+	msg := []byte("Hello World")
+	for i := 0; i < 50; i++ {
+		_, _, err := fs.StoreMsg("foo", nil, msg)
+		require_NoError(t, err)
+	}
+	fs.mu.RLock()
+	for _, mb := range fs.blks {
+		mb.mu.Lock()
+		mb.clearCacheAndOffset()
+		mb.mu.Unlock()
+	}
+	fs.mu.RUnlock()
+
+	var smv StoreMsg
+	for seq := uint64(1); seq <= 50; seq++ {
+		_, _, err := fs.LoadNextMsg("foo", false, seq, &smv)
+		require_NoError(t, err)
+	}
+	// Make sure nothing is still loading ahead.
+	checkFor(t, time.Second, 10*time.Millisecond, func() error {
+		if fs.rap.Load() {
+			return fmt.Errorf("Still loading ahead")
+		}
+		return nil
+	})
+	stats := fs.cacheStats()
+	require_True(t, stats.ReadAheads == 0)
+	require_True(t, stats.Misses > 1)
+	require_True(t, stats.Hits+stats.Misses == 50)
+	require_True(t, budget.Used() == 0)
+}
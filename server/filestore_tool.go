@@ -0,0 +1,565 @@
+// Copyright 2023 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// StoreToolOptions describe a file based stream to open while the server is not running.
+type StoreToolOptions struct {
+	// Dir is the stream's directory, <store_dir>/jetstream/<account>/streams/<stream>.
+	Dir string
+	// Account is needed to decrypt encrypted streams, it defaults to the account in Dir.
+	Account string
+	// Key is the JetStream encryption key, required for encrypted streams.
+	Key string
+	// Cipher is tried first for encrypted streams, we fall back to the other cipher.
+	Cipher StoreCipher
+	// Copy makes inspect and export work on a temporary copy of the stream that is
+	// recovered the way the server would, instead of opening the stream read only.
+	Copy bool
+}
+
+// StoreReport is the result of inspecting a file based stream.
+type StoreReport struct {
+	Config    StreamConfig        `json:"config"`
+	Created   time.Time           `json:"created"`
+	Encrypted bool                `json:"encrypted"`
+	State     StreamState         `json:"state"`
+	Blocks    []*StoreBlockReport `json:"blocks"`
+	Subjects  map[string]uint64   `json:"subjects,omitempty"`
+	Corrupt   []*CorruptRecord    `json:"corrupt,omitempty"`
+}
+
+// StoreBlockReport describes a single message block of a file based stream.
+type StoreBlockReport struct {
+	Index    uint32 `json:"index"`
+	Msgs     uint64 `json:"msgs"`
+	Bytes    uint64 `json:"bytes"`
+	FirstSeq uint64 `json:"first_seq"`
+	LastSeq  uint64 `json:"last_seq"`
+	Deleted  int    `json:"num_deleted,omitempty"`
+	Size     uint64 `json:"size"`
+	Archived bool   `json:"archived,omitempty"`
+}
+
+// CorruptRecord is a record in a message block that failed its checks.
+// Seq will be zero when the record was too damaged to tell.
+type CorruptRecord struct {
+	Block  uint32 `json:"block"`
+	Offset uint32 `json:"offset"`
+	Seq    uint64 `json:"seq,omitempty"`
+	Error  string `json:"error"`
+}
+
+// Returns the key generator for our key, the account defaults to the one in dir.
+func (opts *StoreToolOptions) keyGen(dir string) keyGen {
+	acc := opts.Account
+	if acc == _EMPTY_ {
+		acc = filepath.Base(filepath.Dir(filepath.Dir(dir)))
+	}
+	return newKeyGen(opts.Key, acc)
+}
+
+// Open the stream offline from sdir, which is either its directory or a copy of it.
+// We disable limits and background tasks so that we never remove messages on our own.
+// Unless read only, recovery will still truncate blocks it needs to rebuild at their
+// first bad record and rewrite their index files, as the server would on startup.
+func openFileStoreOffline(opts *StoreToolOptions, sdir string, readOnly bool) (*fileStore, *FileStreamInfo, error) {
+	dir := filepath.Clean(opts.Dir)
+	buf, err := os.ReadFile(filepath.Join(sdir, JetStreamMetaFile))
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not read stream metafile: %v", err)
+	}
+
+	var prf keyGen
+	sc := opts.Cipher
+	if ekey, err := os.ReadFile(filepath.Join(sdir, JetStreamMetaFileKey)); err == nil {
+		if opts.Key == _EMPTY_ {
+			return nil, nil, errors.New("stream is encrypted, an encryption key is required")
+		}
+		prf = opts.keyGen(dir)
+		sname := filepath.Base(dir)
+		nbuf, err := decryptMetaWithKeyGen(sc, prf, nil, ekey, buf, sname)
+		if err != nil {
+			// See if we were using the other cipher.
+			if sc == ChaCha {
+				sc = AES
+			} else {
+				sc = ChaCha
+			}
+			if nbuf, err = decryptMetaWithKeyGen(sc, prf, nil, ekey, buf, sname); err != nil {
+				return nil, nil, fmt.Errorf("could not decrypt stream metafile: %v", err)
+			}
+		}
+		buf = nbuf
+	}
+
+	var fi FileStreamInfo
+	if err := json.Unmarshal(buf, &fi); err != nil {
+		return nil, nil, fmt.Errorf("could not decode stream metafile: %v", err)
+	}
+	if fi.Storage != FileStorage && fi.Storage != HybridStorage {
+		return nil, nil, fmt.Errorf("stream %q does not use file storage", fi.Name)
+	}
+
+	cfg := fi.StreamConfig
+	cfg.MaxMsgs, cfg.MaxBytes, cfg.MaxMsgsPer, cfg.MaxAge, cfg.FirstSeq = -1, -1, -1, 0, 0
+	fcfg := FileStoreConfig{StoreDir: sdir, Cipher: sc, CompactInterval: -1, ScrubInterval: -1, ReadOnly: readOnly}
+	fs, err := newFileStoreWithCreated(fcfg, cfg, fi.Created, prf, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	return fs, &fi, nil
+}
+
+// Open the stream offline without changing it. The stream is opened read only, unless
+// a copy was asked for in which case a private copy is made in the temporary directory.
+// The returned function stops the store and removes any copy.
+func openFileStoreUnchanged(opts *StoreToolOptions) (*fileStore, *FileStreamInfo, func(), error) {
+	if !opts.Copy {
+		fs, fi, err := openFileStoreOffline(opts, filepath.Clean(opts.Dir), true)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		return fs, fi, func() { fs.Stop() }, nil
+	}
+	tdir, err := os.MkdirTemp(_EMPTY_, "nats-store-")
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	dir := filepath.Clean(opts.Dir)
+	sdir := filepath.Join(tdir, filepath.Base(dir))
+	if _, err := syncDir(dir, sdir, time.Time{}); err != nil {
+		os.RemoveAll(tdir)
+		return nil, nil, nil, fmt.Errorf("could not copy stream directory: %v", err)
+	}
+	fs, fi, err := openFileStoreOffline(opts, sdir, false)
+	if err != nil {
+		os.RemoveAll(tdir)
+		return nil, nil, nil, err
+	}
+	return fs, fi, func() {
+		fs.Stop()
+		os.RemoveAll(tdir)
+	}, nil
+}
+
+// InspectFileStore reports on the state, blocks, subjects and corrupt records of a
+// file based stream while the server is not running. The stream is not changed.
+func InspectFileStore(opts *StoreToolOptions) (*StoreReport, error) {
+	fs, fi, done, err := openFileStoreUnchanged(opts)
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+
+	sr := &StoreReport{
+		Config:    fi.StreamConfig,
+		Created:   fi.Created,
+		Encrypted: fs.prf != nil,
+		State:     fs.State(),
+		Subjects:  make(map[string]uint64),
+	}
+
+	fs.mu.RLock()
+	blks := append([]*msgBlock(nil), fs.blks...)
+	fs.mu.RUnlock()
+
+	for _, mb := range blks {
+		mb.mu.Lock()
+		sr.Blocks = append(sr.Blocks, &StoreBlockReport{
+			Index:    mb.index,
+			Msgs:     mb.msgs,
+			Bytes:    mb.bytes,
+			FirstSeq: mb.first.seq,
+			LastSeq:  mb.last.seq,
+			Deleted:  len(mb.dmap),
+			Size:     mb.rbytes,
+			Archived: mb.arc,
+		})
+		// Archived blocks would need to be fetched, their archive checks them.
+		if !mb.arc {
+			crs, err := mb.corruptRecords()
+			if err != nil {
+				mb.mu.Unlock()
+				return nil, err
+			}
+			sr.Corrupt = append(sr.Corrupt, crs...)
+		}
+		mb.mu.Unlock()
+	}
+
+	for subj, ss := range fs.SubjectsState(fwcs) {
+		sr.Subjects[subj] = ss.Msgs
+	}
+	return sr, nil
+}
+
+// Check every record of this block on disk. Unlike scrubbing we report all corrupt
+// records, until we find one that is too damaged to find the next one.
+// Lock should be held.
+func (mb *msgBlock) corruptRecords() ([]*CorruptRecord, error) {
+	buf, err := mb.loadBlock(nil)
+	if err != nil {
+		return nil, err
+	}
+	defer recycleMsgBlockBuf(buf)
+
+	// Check if we need to decrypt. We do not replace our own
+	// block encryption key since that would reset its counter.
+	if mb.bek != nil && len(buf) > 0 {
+		bek, err := genBlockEncryptionKey(mb.fs.fcfg.Cipher, mb.seed, mb.nonce)
+		if err != nil {
+			return nil, err
+		}
+		bek.XORKeyStream(buf, buf)
+	}
+
+	var le = binary.LittleEndian
+	var crs []*CorruptRecord
+
+	for index, lbuf := uint32(0), uint32(len(buf)); index < lbuf; {
+		if index+msgHdrSize > lbuf {
+			return append(crs, &CorruptRecord{Block: mb.index, Offset: index, Error: "short record"}), nil
+		}
+		hdr := buf[index : index+msgHdrSize]
+		rl, slen := le.Uint32(hdr[0:]), le.Uint16(hdr[20:])
+		hasHeaders := rl&hbit != 0
+		rl &^= hbit
+		dlen := int(rl) - msgHdrSize
+		if dlen < 0 || int(slen) > (dlen-recordHashSize) || dlen > int(rl) || index+rl > lbuf || rl > rlBadThresh {
+			// We can not trust anything past this point.
+			return append(crs, &CorruptRecord{Block: mb.index, Offset: index, Error: "bad record length"}), nil
+		}
+
+		seq := le.Uint64(hdr[4:])
+		// Skip erased, deleted or tombstone records.
+		if seq == 0 || seq&ebit != 0 || seq < mb.first.seq {
+			index += rl
+			continue
+		}
+		if _, deleted := mb.dmap[seq]; deleted {
+			index += rl
+			continue
+		}
+
+		data := buf[index+msgHdrSize : index+rl]
+		mb.hh.Reset()
+		mb.hh.Write(hdr[4:20])
+		mb.hh.Write(data[:slen])
+		if hasHeaders {
+			mb.hh.Write(data[slen+4 : dlen-recordHashSize])
+		} else {
+			mb.hh.Write(data[slen : dlen-recordHashSize])
+		}
+		if !bytes.Equal(mb.hh.Sum(nil), data[len(data)-recordHashSize:]) {
+			crs = append(crs, &CorruptRecord{Block: mb.index, Offset: index, Seq: seq, Error: "checksum mismatch"})
+		}
+		index += rl
+	}
+	return crs, nil
+}
+
+// ExportFileStore writes the messages of a file based stream to w as a stream export while
+// the server is not running. Messages that can not be loaded are skipped and counted.
+// The stream is not changed.
+func ExportFileStore(opts *StoreToolOptions, w io.Writer, compress bool) (exported, skipped uint64, err error) {
+	fs, fi, done, err := openFileStoreUnchanged(opts)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer done()
+
+	hdr := &StreamExportHeader{Created: fi.Created, Config: fi.StreamConfig}
+	fs.FastState(&hdr.State)
+	return writeStreamExport(w, hdr, fs, hdr.State.LastSeq, compress)
+}
+
+// ImportFileStore creates a file based stream in a new stream directory from the export read
+// from r while the server is not running. The stream is named after its directory, and the
+// messages keep their sequences unless renumbered. Returns the number of messages imported.
+func ImportFileStore(opts *StoreToolOptions, r io.Reader, renumber bool) (uint64, error) {
+	dir := filepath.Clean(opts.Dir)
+	if _, err := os.Stat(filepath.Join(dir, JetStreamMetaFile)); err == nil {
+		return 0, fmt.Errorf("stream directory %q is already in use", dir)
+	}
+	er, err := newStreamExportReader(r)
+	if err != nil {
+		return 0, err
+	}
+
+	cfg := er.hdr.Config
+	cfg.Name = filepath.Base(dir)
+	if cfg.Storage != HybridStorage {
+		cfg.Storage = FileStorage
+	}
+	if renumber {
+		cfg.FirstSeq = 0
+	} else if fseq := er.hdr.State.FirstSeq; fseq > 1 && cfg.FirstSeq == 0 {
+		cfg.FirstSeq = fseq
+	}
+	var prf keyGen
+	if opts.Key != _EMPTY_ {
+		prf = opts.keyGen(dir)
+	}
+	fcfg := FileStoreConfig{StoreDir: dir, Cipher: opts.Cipher, CompactInterval: -1, ScrubInterval: -1}
+	fs, err := newFileStoreWithCreated(fcfg, cfg, er.hdr.Created, prf, nil)
+	if err != nil {
+		return 0, err
+	}
+	n, err := importStreamMsgs(fs, er, renumber, nil)
+	if err != nil {
+		fs.Delete()
+		return n, err
+	}
+	return n, fs.Stop()
+}
+
+// RepairFileStore rebuilds the index files of a file based stream from its message blocks
+// while the server is not running, truncating blocks at their first bad record.
+// Returns the messages that were lost, nil if none.
+func RepairFileStore(opts *StoreToolOptions) (*LostStreamData, error) {
+	fs, _, err := openFileStoreOffline(opts, filepath.Clean(opts.Dir), false)
+	if err != nil {
+		return nil, err
+	}
+	defer fs.Stop()
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	for _, mb := range fs.blks {
+		mb.mu.Lock()
+		// Archived blocks would need to be fetched, their local indexes are kept.
+		if mb.arc {
+			mb.mu.Unlock()
+			continue
+		}
+		ld, err := mb.rebuildStateLocked()
+		if err != nil && err != errBadMsg {
+			mb.mu.Unlock()
+			return nil, err
+		}
+		fs.addLostData(ld)
+		if err = mb.writeIndexInfoLocked(); err == nil {
+			if err = mb.generateHeaderIndex(); err == nil {
+				err = mb.writeHeaderIndex()
+			}
+		}
+		mb.mu.Unlock()
+		if err != nil {
+			return nil, err
+		}
+	}
+	fs.rebuildStateLocked(nil)
+
+	return fs.ld, nil
+}
+
+var storeToolUsage = `
+Usage: nats-server store <command> [options] <stream_dir>
+
+Inspect, export or repair a file based stream while the server is not running.
+The stream directory is <store_dir>/jetstream/<account>/streams/<stream>.
+Only repair changes the stream, inspect and export open it read only.
+
+Commands:
+    inspect                          Print state, blocks, subjects and corrupt records
+    export                           Write messages as a JSON lines stream export
+    import                           Create a stream in a new stream directory from a stream export
+    repair                           Rebuild index files, truncating blocks at their first bad record
+
+Options:
+    -c, --config <file>              Configuration file to read the encryption key from
+        --key <key>                  JetStream encryption key
+        --account <account>          Account of the stream (default: from the stream directory)
+    -o, --output <file>              File to export messages to (default: stdout)
+        --compress                   Compress the export with S2
+    -i, --input <file>               File to import messages from (default: stdin)
+        --renumber                   Renumber imported messages instead of keeping their sequences
+        --json                       Print the inspection as JSON
+        --copy                       Inspect or export a temporary copy recovered as the server would
+`
+
+// RunStoreTool runs the offline store tool with the given command line arguments,
+// writing its results to w.
+func RunStoreTool(args []string, w io.Writer) error {
+	fset := flag.NewFlagSet("store", flag.ContinueOnError)
+	fset.SetOutput(io.Discard)
+	fset.Usage = func() { fmt.Fprint(w, storeToolUsage) }
+
+	var opts StoreToolOptions
+	var configFile, output, input string
+	var asJSON, compress, renumber bool
+	fset.StringVar(&configFile, "c", _EMPTY_, "Configuration file to read the encryption key from.")
+	fset.StringVar(&configFile, "config", _EMPTY_, "Configuration file to read the encryption key from.")
+	fset.StringVar(&opts.Key, "key", _EMPTY_, "JetStream encryption key.")
+	fset.StringVar(&opts.Account, "account", _EMPTY_, "Account of the stream.")
+	fset.StringVar(&output, "o", _EMPTY_, "File to export messages to.")
+	fset.StringVar(&output, "output", _EMPTY_, "File to export messages to.")
+	fset.BoolVar(&compress, "compress", false, "Compress the export with S2.")
+	fset.StringVar(&input, "i", _EMPTY_, "File to import messages from.")
+	fset.StringVar(&input, "input", _EMPTY_, "File to import messages from.")
+	fset.BoolVar(&renumber, "renumber", false, "Renumber imported messages.")
+	fset.BoolVar(&asJSON, "json", false, "Print the inspection as JSON.")
+	fset.BoolVar(&opts.Copy, "copy", false, "Inspect or export a temporary copy of the stream.")
+
+	if len(args) == 0 || args[0] == "-h" || args[0] == "--help" {
+		fset.Usage()
+		return nil
+	}
+	cmd := args[0]
+	if err := fset.Parse(args[1:]); err != nil {
+		if err == flag.ErrHelp {
+			fset.Usage()
+			return nil
+		}
+		return err
+	}
+	if fset.NArg() != 1 {
+		return errors.New("a single stream directory is required")
+	}
+	opts.Dir = fset.Arg(0)
+
+	if configFile != _EMPTY_ {
+		sopts, err := ProcessConfigFile(configFile)
+		if err != nil {
+			return err
+		}
+		if opts.Key == _EMPTY_ {
+			opts.Key = sopts.JetStreamKey
+		}
+		opts.Cipher = sopts.JetStreamCipher
+	}
+
+	switch cmd {
+	case "inspect":
+		sr, err := InspectFileStore(&opts)
+		if err != nil {
+			return err
+		}
+		if asJSON {
+			b, err := json.MarshalIndent(sr, _EMPTY_, "  ")
+			if err != nil {
+				return err
+			}
+			_, err = fmt.Fprintf(w, "%s\n", b)
+			return err
+		}
+		printStoreReport(w, sr)
+	case "export":
+		out := w
+		if output != _EMPTY_ {
+			f, err := os.Create(output)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			out = f
+		}
+		exported, skipped, err := ExportFileStore(&opts, out, compress)
+		if err != nil {
+			return err
+		}
+		if output != _EMPTY_ {
+			fmt.Fprintf(w, "Exported %d messages to %q\n", exported, output)
+		}
+		if skipped > 0 {
+			fmt.Fprintf(os.Stderr, "Skipped %d messages that could not be loaded\n", skipped)
+		}
+	case "import":
+		in := io.Reader(os.Stdin)
+		if input != _EMPTY_ {
+			f, err := os.Open(input)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			in = f
+		}
+		imported, err := ImportFileStore(&opts, in, renumber)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "Imported %d messages to %q\n", imported, opts.Dir)
+	case "repair":
+		ld, err := RepairFileStore(&opts)
+		if err != nil {
+			return err
+		}
+		if ld == nil || len(ld.Msgs) == 0 {
+			fmt.Fprintln(w, "Repaired stream, no messages were lost")
+		} else {
+			fmt.Fprintf(w, "Repaired stream, lost %d messages (%s): %v\n", len(ld.Msgs), friendlyBytes(int64(ld.Bytes)), ld.Msgs)
+		}
+	default:
+		return fmt.Errorf("unknown store command %q", cmd)
+	}
+	return nil
+}
+
+// Print a human readable report.
+func printStoreReport(w io.Writer, sr *StoreReport) {
+	fmt.Fprintf(w, "Stream:     %s\n", sr.Config.Name)
+	fmt.Fprintf(w, "Created:    %v\n", sr.Created.Format(time.RFC3339))
+	fmt.Fprintf(w, "Encrypted:  %v\n", sr.Encrypted)
+	fmt.Fprintf(w, "Messages:   %d\n", sr.State.Msgs)
+	fmt.Fprintf(w, "Bytes:      %s\n", friendlyBytes(int64(sr.State.Bytes)))
+	fmt.Fprintf(w, "First Seq:  %d\n", sr.State.FirstSeq)
+	fmt.Fprintf(w, "Last Seq:   %d\n", sr.State.LastSeq)
+	if sr.State.Lost != nil && len(sr.State.Lost.Msgs) > 0 {
+		fmt.Fprintf(w, "Lost:       %d messages during recovery\n", len(sr.State.Lost.Msgs))
+	}
+
+	fmt.Fprintf(w, "\nBlocks (%d):\n", len(sr.Blocks))
+	for _, br := range sr.Blocks {
+		var arc string
+		if br.Archived {
+			arc = " (archived)"
+		}
+		fmt.Fprintf(w, "  %d.blk: %d msgs, seqs %d-%d, %d deleted, %s%s\n",
+			br.Index, br.Msgs, br.FirstSeq, br.LastSeq, br.Deleted, friendlyBytes(int64(br.Size)), arc)
+	}
+
+	subjs := make([]string, 0, len(sr.Subjects))
+	for subj := range sr.Subjects {
+		subjs = append(subjs, subj)
+	}
+	sort.Strings(subjs)
+	fmt.Fprintf(w, "\nSubjects (%d):\n", len(subjs))
+	for _, subj := range subjs {
+		fmt.Fprintf(w, "  %s: %d\n", subj, sr.Subjects[subj])
+	}
+
+	fmt.Fprintf(w, "\nCorrupt Records (%d):\n", len(sr.Corrupt))
+	for _, cr := range sr.Corrupt {
+		var seq string
+		if cr.Seq > 0 {
+			seq = fmt.Sprintf(" seq %d", cr.Seq)
+		}
+		fmt.Fprintf(w, "  %d.blk offset %d%s: %s\n", cr.Block, cr.Offset, seq, cr.Error)
+	}
+}
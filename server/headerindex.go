@@ -0,0 +1,208 @@
+// Copyright 2023 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/binary"
+	"errors"
+	"sort"
+)
+
+// headerIndex maps the values of a stream's indexed headers to the sequences of the
+// messages carrying them, in ascending order. Every indexed header has an entry, even
+// when no message carries it, so a nil index means we are not indexing any headers.
+type headerIndex map[string]map[string][]uint64
+
+// Create a header index for these headers, nil if there are none.
+func newHeaderIndex(names []string) headerIndex {
+	if len(names) == 0 {
+		return nil
+	}
+	hi := make(headerIndex, len(names))
+	for _, name := range names {
+		hi[name] = make(map[string][]uint64)
+	}
+	return hi
+}
+
+// Returns if name is one of the indexed headers.
+func isIndexedHeader(names []string, name string) bool {
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns if we index exactly these headers.
+func (hi headerIndex) indexes(names []string) bool {
+	if len(hi) != len(names) {
+		return false
+	}
+	for _, name := range names {
+		if _, ok := hi[name]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// Remove all sequences while keeping the headers we index.
+func (hi headerIndex) reset() {
+	for name := range hi {
+		hi[name] = make(map[string][]uint64)
+	}
+}
+
+// Add seq for the values of our headers in hdr.
+// Returns if anything was added.
+func (hi headerIndex) add(hdr []byte, seq uint64) (added bool) {
+	if len(hdr) == 0 {
+		return false
+	}
+	for name, vals := range hi {
+		val := getHeader(name, hdr)
+		if val == nil {
+			continue
+		}
+		seqs := vals[string(val)]
+		// Messages are almost always added in order.
+		if n := len(seqs); n == 0 || seqs[n-1] < seq {
+			vals[string(val)] = append(seqs, seq)
+		} else if i := sort.Search(n, func(i int) bool { return seqs[i] >= seq }); seqs[i] != seq {
+			seqs = append(seqs, 0)
+			copy(seqs[i+1:], seqs[i:])
+			seqs[i] = seq
+			vals[string(val)] = seqs
+		}
+		added = true
+	}
+	return added
+}
+
+// Remove seq from the values of our headers in hdr.
+// Returns if anything was removed.
+func (hi headerIndex) remove(hdr []byte, seq uint64) (removed bool) {
+	if len(hdr) == 0 {
+		return false
+	}
+	for name, vals := range hi {
+		val := getHeader(name, hdr)
+		if val == nil {
+			continue
+		}
+		seqs := vals[string(val)]
+		i := sort.Search(len(seqs), func(i int) bool { return seqs[i] >= seq })
+		if i == len(seqs) || seqs[i] != seq {
+			continue
+		}
+		if len(seqs) == 1 {
+			delete(vals, string(val))
+		} else {
+			vals[string(val)] = append(seqs[:i], seqs[i+1:]...)
+		}
+		removed = true
+	}
+	return removed
+}
+
+// Returns the sequences at or after start for messages with this value for the header.
+// The returned slice is a copy and safe to use without holding any locks.
+func (hi headerIndex) seqs(name, value string, start uint64) []uint64 {
+	seqs := hi[name][value]
+	i := sort.Search(len(seqs), func(i int) bool { return seqs[i] >= start })
+	if i == len(seqs) {
+		return nil
+	}
+	return append([]uint64(nil), seqs[i:]...)
+}
+
+// Encode our index as
+// num_headers [name_len name num_values [value_len value num_seqs first_seq [seq_delta...]...]...]
+func (hi headerIndex) encode(buf []byte) []byte {
+	putString := func(s string) {
+		buf = binary.AppendUvarint(buf, uint64(len(s)))
+		buf = append(buf, s...)
+	}
+	buf = binary.AppendUvarint(buf, uint64(len(hi)))
+	for name, vals := range hi {
+		putString(name)
+		buf = binary.AppendUvarint(buf, uint64(len(vals)))
+		for val, seqs := range vals {
+			putString(val)
+			buf = binary.AppendUvarint(buf, uint64(len(seqs)))
+			var last uint64
+			for _, seq := range seqs {
+				buf = binary.AppendUvarint(buf, seq-last)
+				last = seq
+			}
+		}
+	}
+	return buf
+}
+
+var errBadHeaderIndex = errors.New("bad header index")
+
+// Decode an index written with encode. We only accept it if it indexes the same headers.
+func decodeHeaderIndex(buf []byte, names []string) (headerIndex, error) {
+	bi := 0
+	readU64 := func() uint64 {
+		if bi < 0 {
+			return 0
+		}
+		num, n := binary.Uvarint(buf[bi:])
+		if n <= 0 {
+			bi = -1
+			return 0
+		}
+		bi += n
+		return num
+	}
+	readString := func() string {
+		l := readU64()
+		if bi < 0 || uint64(len(buf)-bi) < l {
+			bi = -1
+			return _EMPTY_
+		}
+		s := string(buf[bi : bi+int(l)])
+		bi += int(l)
+		return s
+	}
+
+	hi := make(headerIndex)
+	for nh := readU64(); nh > 0 && bi >= 0; nh-- {
+		name := readString()
+		vals := make(map[string][]uint64)
+		for nv := readU64(); nv > 0 && bi >= 0; nv-- {
+			val := readString()
+			ns := readU64()
+			if bi < 0 || ns > uint64(len(buf)-bi) {
+				return nil, errBadHeaderIndex
+			}
+			seqs := make([]uint64, 0, ns)
+			var last uint64
+			for ; ns > 0 && bi >= 0; ns-- {
+				last += readU64()
+				seqs = append(seqs, last)
+			}
+			vals[val] = seqs
+		}
+		hi[name] = vals
+	}
+	if bi != len(buf) || !hi.indexes(names) {
+		return nil, errBadHeaderIndex
+	}
+	return hi, nil
+}
@@ -0,0 +1,826 @@
+// Copyright 2023 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// hybridStore keeps new messages of a stream in a memory tier only. Once the memory tier holds
+// more than MemoryTierBytes, its oldest messages are moved to the file tier in the background.
+// The file tier only holds these spilled messages, and the memory tier all messages after them.
+// Limits are enforced across both tiers. The memory tier is reserved and accounted against memory
+// limits. It is spilled when the store is stopped, but messages not yet spilled are lost when the
+// server does not shut down cleanly.
+type hybridStore struct {
+	*fileStore
+	// Held for reading to see both tiers in step, and for writing when changing either.
+	tmu     sync.RWMutex
+	ms      *memStore
+	scfg    StreamConfig
+	ssm     StoreMsg
+	spillc  chan struct{}
+	sqch    chan struct{}
+	stopped bool
+	// Sequence removed from the file tier since it expired from the memory tier while spilled.
+	unspill atomic.Uint64
+	// Our registered storage updates handlers.
+	cbmu sync.RWMutex
+	hcb  StorageUpdateHandler
+	mcb  StorageUpdateHandler
+}
+
+// Create a hybrid store on top of the file store for the stream.
+func newHybridStore(fs *fileStore, cfg *StreamConfig) (*hybridStore, error) {
+	if cfg.Storage != HybridStorage {
+		return nil, fmt.Errorf("hybridStore requires hybrid storage type in config")
+	}
+	ms, err := newMemStore(hotTierConfig(cfg))
+	if err != nil {
+		return nil, err
+	}
+	hs := &hybridStore{
+		fileStore: fs,
+		ms:        ms,
+		scfg:      *cfg,
+		spillc:    make(chan struct{}, 1),
+		sqch:      make(chan struct{}),
+	}
+	// We check discard new limits across both tiers, so the file tier should not reject spilled messages.
+	fs.mu.Lock()
+	fs.tiered = true
+	fs.mu.Unlock()
+	// The memory tier starts empty, so align it with what we recovered.
+	var state StreamState
+	fs.FastState(&state)
+	hs.resetHotTier(state.LastSeq + 1)
+	ms.RegisterStorageUpdates(hs.memoryTierUpdates)
+	fs.RegisterStorageUpdates(hs.fileTierUpdates)
+	go hs.spillLoop()
+	return hs, nil
+}
+
+// The config for our memory tier. All limits other than age are enforced across both tiers by us.
+func hotTierConfig(cfg *StreamConfig) *StreamConfig {
+	return &StreamConfig{
+		Name:           cfg.Name,
+		Storage:        MemoryStorage,
+		MaxAge:         cfg.MaxAge,
+		IndexedHeaders: cfg.IndexedHeaders,
+	}
+}
+
+// Reset our memory tier so that the next message stored will have seq.
+func (hs *hybridStore) resetHotTier(seq uint64) {
+	hs.ms.reset()
+	if seq > 1 {
+		hs.ms.Compact(seq)
+	}
+}
+
+// Called for storage updates from the memory tier. The bytes are accounted as memory,
+// and changes to messages are passed through to the upper layers.
+func (hs *hybridStore) memoryTierUpdates(md, bd int64, seq uint64, subj string) {
+	hs.cbmu.RLock()
+	cb, mcb := hs.hcb, hs.mcb
+	hs.cbmu.RUnlock()
+	if mcb != nil && bd != 0 {
+		mcb(0, bd, 0, _EMPTY_)
+	}
+	if cb != nil && md != 0 {
+		cb(md, 0, seq, subj)
+	}
+}
+
+// Called for storage updates from the file tier. Messages are only stored there when spilled
+// from the memory tier, which reported them already, so for those we only pass through the bytes.
+func (hs *hybridStore) fileTierUpdates(md, bd int64, seq uint64, subj string) {
+	if md > 0 || (md < 0 && seq > 0 && seq == hs.unspill.Load()) {
+		md, seq, subj = 0, 0, _EMPTY_
+	}
+	hs.cbmu.RLock()
+	cb := hs.hcb
+	hs.cbmu.RUnlock()
+	if cb != nil && (md != 0 || bd != 0) {
+		cb(md, bd, seq, subj)
+	}
+}
+
+// RegisterStorageUpdates registers a callback for updates to storage changes.
+// Bytes reported are those of the file tier, the memory tier is reported separately.
+func (hs *hybridStore) RegisterStorageUpdates(cb StorageUpdateHandler) {
+	hs.cbmu.Lock()
+	hs.hcb = cb
+	hs.cbmu.Unlock()
+	// This will fire our handler with current usage.
+	hs.fileStore.RegisterStorageUpdates(hs.fileTierUpdates)
+}
+
+// Registers a callback for the bytes used by the memory tier.
+func (hs *hybridStore) registerMemoryTierUpdates(cb StorageUpdateHandler) {
+	hs.cbmu.Lock()
+	hs.mcb = cb
+	hs.cbmu.Unlock()
+}
+
+// Returns how many bytes the memory tier should hold.
+func (hs *hybridStore) memoryTierBytes() uint64 {
+	hs.tmu.RLock()
+	defer hs.tmu.RUnlock()
+	if hs.scfg.MemoryTierBytes <= 0 {
+		return 0
+	}
+	return uint64(hs.scfg.MemoryTierBytes)
+}
+
+// Spill the memory tier in the background when signaled.
+// Errors will be returned to publishers when spilling can not keep up, see checkHotTier.
+func (hs *hybridStore) spillLoop() {
+	for {
+		select {
+		case <-hs.spillc:
+			hs.spill(hs.memoryTierBytes())
+		case <-hs.sqch:
+			return
+		}
+	}
+}
+
+// Signal our spill loop if the memory tier holds more than it should.
+func (hs *hybridStore) kickSpill() {
+	var state StreamState
+	hs.ms.FastState(&state)
+	if state.Bytes <= hs.memoryTierBytes() {
+		return
+	}
+	select {
+	case hs.spillc <- struct{}{}:
+	default:
+	}
+}
+
+// If spilling in the background can not keep up with new messages, spill before
+// storing more so the memory tier stays bounded.
+func (hs *hybridStore) checkHotTier() error {
+	var state StreamState
+	hs.ms.FastState(&state)
+	if limit := hs.memoryTierBytes(); state.Bytes > 2*limit {
+		return hs.spill(limit)
+	}
+	return nil
+}
+
+// Move the oldest messages from the memory tier to the file tier until it holds at most limit bytes.
+// We only hold our lock for each message so publishers and readers are not held up.
+func (hs *hybridStore) spill(limit uint64) error {
+	for {
+		hs.tmu.Lock()
+		var state StreamState
+		hs.ms.FastState(&state)
+		if state.Msgs == 0 || state.Bytes <= limit {
+			hs.tmu.Unlock()
+			return nil
+		}
+		sm, _, err := hs.ms.LoadNextMsg(fwcs, true, state.FirstSeq, &hs.ssm)
+		if err == nil {
+			err = hs.spillMsg(sm)
+		}
+		hs.tmu.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// Move a message from the memory tier to the file tier.
+// Write lock should be held.
+func (hs *hybridStore) spillMsg(sm *StoreMsg) error {
+	if err := hs.alignFileTier(sm.seq); err != nil {
+		return err
+	}
+	if err := hs.fileStore.StoreRawMsg(sm.subj, sm.hdr, sm.msg, sm.seq, sm.ts); err != nil {
+		return err
+	}
+	if !hs.ms.removeMovedMsg(sm.seq) {
+		// This expired from the memory tier while we moved it, which was reported already.
+		hs.unspill.Store(sm.seq)
+		hs.fileStore.RemoveMsg(sm.seq)
+		hs.unspill.Store(0)
+	}
+	return nil
+}
+
+// Make sure the next message stored in the file tier will have seq, skipping
+// any sequences that were removed from the memory tier before being spilled.
+// Write lock should be held.
+func (hs *hybridStore) alignFileTier(seq uint64) error {
+	var state StreamState
+	hs.fileStore.FastState(&state)
+	if seq == state.LastSeq+1 {
+		return nil
+	}
+	if seq <= state.LastSeq {
+		return ErrSequenceMismatch
+	}
+	if state.Msgs == 0 {
+		_, err := hs.fileStore.Compact(seq)
+		return err
+	}
+	for ; state.LastSeq+1 < seq; state.LastSeq++ {
+		hs.fileStore.SkipMsg()
+	}
+	return nil
+}
+
+// Stop our spill loop.
+// Write lock should be held.
+func (hs *hybridStore) stopSpilling() {
+	if !hs.stopped {
+		hs.stopped = true
+		close(hs.sqch)
+	}
+}
+
+// StoreMsg stores a message in the memory tier.
+func (hs *hybridStore) StoreMsg(subj string, hdr, msg []byte) (uint64, int64, error) {
+	if err := hs.checkHotTier(); err != nil {
+		return 0, 0, err
+	}
+	hs.tmu.Lock()
+	seq, ts, err := hs.storeMsg(subj, hdr, msg, 0, 0)
+	hs.tmu.Unlock()
+	if err == nil {
+		hs.kickSpill()
+	}
+	return seq, ts, err
+}
+
+// StoreRawMsg stores a raw message with expected sequence number and timestamp in the memory tier.
+func (hs *hybridStore) StoreRawMsg(subj string, hdr, msg []byte, seq uint64, ts int64) error {
+	if err := hs.checkHotTier(); err != nil {
+		return err
+	}
+	hs.tmu.Lock()
+	_, _, err := hs.storeMsg(subj, hdr, msg, seq, ts)
+	hs.tmu.Unlock()
+	if err == nil {
+		hs.kickSpill()
+	}
+	return err
+}
+
+// Store a message in the memory tier and enforce our limits. A zero seq and
+// timestamp will store the message as the next one.
+// Write lock should be held.
+func (hs *hybridStore) storeMsg(subj string, hdr, msg []byte, seq uint64, ts int64) (uint64, int64, error) {
+	if err := hs.checkDiscardNew(subj, hdr, msg); err != nil {
+		return 0, 0, err
+	}
+	var err error
+	if seq == 0 && ts == 0 {
+		seq, ts, err = hs.ms.StoreMsg(subj, hdr, msg)
+	} else {
+		err = hs.ms.StoreRawMsg(subj, hdr, msg, seq, ts)
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+	if mmp := hs.scfg.MaxMsgsPer; mmp > 0 && len(subj) > 0 {
+		for n := hs.numMsgsForSubject(subj); n > uint64(mmp); n-- {
+			if !hs.removeFirstForSubject(subj) {
+				break
+			}
+		}
+	}
+	hs.enforceLimits()
+	return seq, ts, nil
+}
+
+// Check if we are discarding new messages since we reached a limit across both tiers.
+// Write lock should be held.
+func (hs *hybridStore) checkDiscardNew(subj string, hdr, msg []byte) error {
+	cfg := &hs.scfg
+	if cfg.Discard != DiscardNew {
+		return nil
+	}
+	// If we are at the limit per subject we will replace the first message for it.
+	var asl bool
+	if mmp := cfg.MaxMsgsPer; mmp > 0 && len(subj) > 0 && hs.numMsgsForSubject(subj) >= uint64(mmp) {
+		if cfg.DiscardNewPer {
+			return ErrMaxMsgsPerSubject
+		}
+		asl = true
+	}
+	var state StreamState
+	hs.fastState(&state)
+	if cfg.MaxMsgs > 0 && state.Msgs >= uint64(cfg.MaxMsgs) && !asl {
+		return ErrMaxMsgs
+	}
+	if cfg.MaxBytes > 0 && state.Bytes+uint64(len(msg)+len(hdr)) >= uint64(cfg.MaxBytes) && !asl {
+		return ErrMaxBytes
+	}
+	return nil
+}
+
+// Remove the oldest messages while we are over our limits for messages or bytes.
+// Write lock should be held.
+func (hs *hybridStore) enforceLimits() {
+	maxMsgs, maxBytes := hs.scfg.MaxMsgs, hs.scfg.MaxBytes
+	if maxMsgs <= 0 && maxBytes <= 0 {
+		return
+	}
+	var state StreamState
+	for hs.fastState(&state); (maxMsgs > 0 && state.Msgs > uint64(maxMsgs)) ||
+		(maxBytes > 0 && state.Bytes > uint64(maxBytes)); hs.fastState(&state) {
+		if !hs.removeFirst() {
+			return
+		}
+	}
+}
+
+// Remove the first message of the stream, which is in the file tier if it holds any.
+// Write lock should be held.
+func (hs *hybridStore) removeFirst() bool {
+	var state StreamState
+	if hs.fileStore.FastState(&state); state.Msgs > 0 {
+		removed, _ := hs.fileStore.RemoveMsg(state.FirstSeq)
+		return removed
+	}
+	if hs.ms.FastState(&state); state.Msgs > 0 {
+		removed, _ := hs.ms.RemoveMsg(state.FirstSeq)
+		return removed
+	}
+	return false
+}
+
+// Remove the first message for a subject.
+// Write lock should be held.
+func (hs *hybridStore) removeFirstForSubject(subj string) bool {
+	var store StreamStore = hs.ms
+	if hs.fileStore.SubjectsTotals(subj)[subj] > 0 {
+		store = hs.fileStore
+	}
+	sm, _, err := store.LoadNextMsg(subj, false, 0, nil)
+	if err != nil {
+		return false
+	}
+	removed, _ := store.RemoveMsg(sm.seq)
+	return removed
+}
+
+// Returns the number of messages for a literal subject across both tiers.
+func (hs *hybridStore) numMsgsForSubject(subj string) uint64 {
+	return hs.fileStore.SubjectsTotals(subj)[subj] + hs.ms.numMsgsForSubject(subj)
+}
+
+// SkipMsg will use the next sequence number but not store anything.
+func (hs *hybridStore) SkipMsg() uint64 {
+	hs.tmu.Lock()
+	defer hs.tmu.Unlock()
+	return hs.ms.SkipMsg()
+}
+
+// LoadMsg will load from the memory tier if present, otherwise the file tier.
+func (hs *hybridStore) LoadMsg(seq uint64, sm *StoreMsg) (*StoreMsg, error) {
+	hs.tmu.RLock()
+	defer hs.tmu.RUnlock()
+
+	if hsm, err := hs.ms.LoadMsg(seq, sm); err == nil {
+		return hsm, nil
+	}
+	return hs.fileStore.LoadMsg(seq, sm)
+}
+
+// LoadNextMsg will look in the file tier first, since it holds the older messages.
+func (hs *hybridStore) LoadNextMsg(filter string, wc bool, start uint64, sm *StoreMsg) (*StoreMsg, uint64, error) {
+	hs.tmu.RLock()
+	defer hs.tmu.RUnlock()
+
+	var state StreamState
+	hs.fileStore.FastState(&state)
+	if state.Msgs > 0 && start <= state.LastSeq {
+		fsm, seq, err := hs.fileStore.LoadNextMsg(filter, wc, start, sm)
+		if err != ErrStoreEOF {
+			return fsm, seq, err
+		}
+		start = state.LastSeq + 1
+	}
+	return hs.ms.LoadNextMsg(filter, wc, start, sm)
+}
+
+// LoadLastMsg will check the memory tier first, which holds the most recent messages.
+func (hs *hybridStore) LoadLastMsg(subject string, sm *StoreMsg) (*StoreMsg, error) {
+	hs.tmu.RLock()
+	defer hs.tmu.RUnlock()
+
+	if hsm, err := hs.ms.LoadLastMsg(subject, sm); err == nil {
+		return hsm, nil
+	}
+	return hs.fileStore.LoadLastMsg(subject, sm)
+}
+
+// LoadNextMsgByHeader will find the next message starting at the start sequence
+// that has the value for the indexed header, looking in the file tier first.
+func (hs *hybridStore) LoadNextMsgByHeader(name, value string, start uint64, sm *StoreMsg) (*StoreMsg, error) {
+	hs.tmu.RLock()
+	defer hs.tmu.RUnlock()
+
+	var state StreamState
+	hs.fileStore.FastState(&state)
+	if state.Msgs > 0 && start <= state.LastSeq {
+		if fsm, err := hs.fileStore.LoadNextMsgByHeader(name, value, start, sm); err != ErrStoreMsgNotFound {
+			return fsm, err
+		}
+	}
+	return hs.ms.LoadNextMsgByHeader(name, value, start, sm)
+}
+
+// RemoveMsg will remove the message from the tier holding it.
+func (hs *hybridStore) RemoveMsg(seq uint64) (bool, error) {
+	hs.tmu.Lock()
+	defer hs.tmu.Unlock()
+
+	if removed, _ := hs.ms.RemoveMsg(seq); removed {
+		return true, nil
+	}
+	return hs.fileStore.RemoveMsg(seq)
+}
+
+// EraseMsg will remove the message from the tier holding it and rewrite its contents.
+func (hs *hybridStore) EraseMsg(seq uint64) (bool, error) {
+	hs.tmu.Lock()
+	defer hs.tmu.Unlock()
+
+	if removed, _ := hs.ms.EraseMsg(seq); removed {
+		return true, nil
+	}
+	return hs.fileStore.EraseMsg(seq)
+}
+
+// Purge will remove all messages from both tiers.
+func (hs *hybridStore) Purge() (uint64, error) {
+	hs.tmu.Lock()
+	defer hs.tmu.Unlock()
+	return hs.purge()
+}
+
+// Write lock should be held.
+func (hs *hybridStore) purge() (uint64, error) {
+	purged, err := hs.fileStore.Purge()
+	if err != nil {
+		return purged, err
+	}
+	mpurged, _ := hs.ms.Purge()
+	return purged + mpurged, nil
+}
+
+// PurgeEx will remove messages based on subject filters, sequence and number of messages to keep.
+// Messages to keep are the most recent, so they are kept from the memory tier first.
+func (hs *hybridStore) PurgeEx(subject string, seq, keep uint64) (uint64, error) {
+	hs.tmu.Lock()
+	defer hs.tmu.Unlock()
+
+	if (subject == _EMPTY_ || subject == fwcs) && seq > 1 {
+		return hs.compact(seq)
+	}
+	var mpurged uint64
+	if mkeep := hs.ms.FilteredState(0, subject).Msgs; keep == 0 || mkeep > keep {
+		mpurged, _ = hs.ms.PurgeEx(subject, seq, keep)
+		keep = 0
+	} else {
+		// We keep all of the memory tier, and whatever is left to keep from the file tier.
+		if keep -= mkeep; keep == 0 && seq == 0 && (subject == _EMPTY_ || subject == fwcs) {
+			return hs.fileStore.Purge()
+		}
+	}
+	purged, err := hs.fileStore.PurgeEx(subject, seq, keep)
+	return purged + mpurged, err
+}
+
+// Compact will remove all messages from both tiers up to but not including seq.
+func (hs *hybridStore) Compact(seq uint64) (uint64, error) {
+	hs.tmu.Lock()
+	defer hs.tmu.Unlock()
+	return hs.compact(seq)
+}
+
+// Write lock should be held.
+func (hs *hybridStore) compact(seq uint64) (uint64, error) {
+	if seq == 0 {
+		return hs.purge()
+	}
+	var fstate, mstate StreamState
+	hs.fileStore.FastState(&fstate)
+	hs.ms.FastState(&mstate)
+
+	var purged uint64
+	if fstate.Msgs > 0 {
+		var err error
+		// The file tier can not move past the memory tier, so purge it if seq is past its end.
+		if seq <= fstate.LastSeq {
+			purged, err = hs.fileStore.Compact(seq)
+		} else {
+			purged, err = hs.fileStore.Purge()
+		}
+		if err != nil {
+			return purged, err
+		}
+	}
+	if seq > mstate.LastSeq {
+		// We are compacting past the end, so the next message stored will have seq.
+		mpurged, _ := hs.ms.Compact(seq)
+		return purged + mpurged, nil
+	}
+	for ; mstate.Msgs > 0 && mstate.FirstSeq < seq; hs.ms.FastState(&mstate) {
+		if removed, _ := hs.ms.RemoveMsg(mstate.FirstSeq); !removed {
+			break
+		}
+		purged++
+	}
+	return purged, nil
+}
+
+// Truncate will truncate the stream up to seq.
+func (hs *hybridStore) Truncate(seq uint64) error {
+	hs.tmu.Lock()
+	defer hs.tmu.Unlock()
+
+	if seq == 0 {
+		if err := hs.fileStore.Truncate(0); err != nil {
+			return err
+		}
+		hs.ms.reset()
+		return nil
+	}
+	var fstate, mstate StreamState
+	hs.fileStore.FastState(&fstate)
+	hs.ms.FastState(&mstate)
+	if seq > mstate.LastSeq {
+		return ErrInvalidSequence
+	}
+	if mstate.Msgs > 0 && seq >= mstate.FirstSeq {
+		if _, err := hs.ms.LoadMsg(seq, nil); err == nil {
+			return hs.ms.Truncate(seq)
+		}
+		// The memory tier can only be truncated to a message it holds,
+		// so move what we keep to the file tier and start over after seq.
+		for {
+			sm, _, err := hs.ms.LoadNextMsg(fwcs, true, 0, &hs.ssm)
+			if err != nil || sm.seq > seq {
+				break
+			}
+			if err := hs.spillMsg(sm); err != nil {
+				return err
+			}
+		}
+	} else if seq < fstate.LastSeq {
+		if err := hs.fileStore.Truncate(seq); err != nil {
+			return err
+		}
+	}
+	hs.resetHotTier(seq + 1)
+	return nil
+}
+
+// GetSeqFromTime looks for the first sequence number that has the message
+// with >= timestamp, looking in the file tier first.
+func (hs *hybridStore) GetSeqFromTime(t time.Time) uint64 {
+	hs.tmu.RLock()
+	defer hs.tmu.RUnlock()
+
+	var state StreamState
+	if hs.fileStore.FastState(&state); state.Msgs > 0 {
+		if seq := hs.fileStore.GetSeqFromTime(t); seq <= state.LastSeq {
+			return seq
+		}
+	}
+	return hs.ms.GetSeqFromTime(t)
+}
+
+// Merge the simple state of the memory tier into that of the file tier.
+func mergeTierSimpleStates(fss, mss SimpleState) SimpleState {
+	if fss.Msgs == 0 {
+		return mss
+	}
+	if mss.Msgs > 0 {
+		fss.Msgs += mss.Msgs
+		fss.Last = mss.Last
+	}
+	return fss
+}
+
+// FilteredState will return the SimpleState associated with the filtered subject and a proposed starting sequence.
+func (hs *hybridStore) FilteredState(sseq uint64, subj string) SimpleState {
+	hs.tmu.RLock()
+	defer hs.tmu.RUnlock()
+	return mergeTierSimpleStates(hs.fileStore.FilteredState(sseq, subj), hs.ms.FilteredState(sseq, subj))
+}
+
+// SubjectsState returns a map of SimpleState for all matching subjects across both tiers.
+func (hs *hybridStore) SubjectsState(filterSubject string) map[string]SimpleState {
+	hs.tmu.RLock()
+	defer hs.tmu.RUnlock()
+	return hs.subjectsState(filterSubject)
+}
+
+// Read lock should be held.
+func (hs *hybridStore) subjectsState(filterSubject string) map[string]SimpleState {
+	fss := hs.fileStore.SubjectsState(filterSubject)
+	for subj, ss := range hs.ms.SubjectsState(filterSubject) {
+		if fss == nil {
+			fss = make(map[string]SimpleState)
+		}
+		fss[subj] = mergeTierSimpleStates(fss[subj], ss)
+	}
+	return fss
+}
+
+// SubjectsTotals return message totals per subject across both tiers.
+func (hs *hybridStore) SubjectsTotals(filterSubject string) map[string]uint64 {
+	hs.tmu.RLock()
+	defer hs.tmu.RUnlock()
+	return hs.subjectsTotals(filterSubject)
+}
+
+// Read lock should be held.
+func (hs *hybridStore) subjectsTotals(filterSubject string) map[string]uint64 {
+	fst := hs.fileStore.SubjectsTotals(filterSubject)
+	for subj, n := range hs.ms.SubjectsTotals(filterSubject) {
+		if fst == nil {
+			fst = make(map[string]uint64)
+		}
+		fst[subj] += n
+	}
+	return fst
+}
+
+// NumPending will return the number of pending messages matching the filter subject starting at sequence.
+func (hs *hybridStore) NumPending(sseq uint64, filter string, lastPerSubject bool) (total, validThrough uint64) {
+	hs.tmu.RLock()
+	defer hs.tmu.RUnlock()
+
+	if lastPerSubject {
+		// Subjects can have messages in both tiers, so count each only once.
+		var state StreamState
+		hs.ms.FastState(&state)
+		for _, ss := range hs.subjectsState(filter) {
+			if sseq <= ss.Last {
+				total++
+			}
+		}
+		return total, state.LastSeq
+	}
+	ftotal, _ := hs.fileStore.NumPending(sseq, filter, false)
+	total, validThrough = hs.ms.NumPending(sseq, filter, false)
+	return ftotal + total, validThrough
+}
+
+// Merge the state of the memory tier into that of the file tier, which holds the messages before it.
+func mergeTierStates(state, mstate *StreamState) {
+	// Messages removed from the memory tier before they were spilled leave a gap between the tiers.
+	if state.Msgs > 0 && mstate.Msgs > 0 && mstate.FirstSeq > state.LastSeq+1 {
+		state.NumDeleted += int(mstate.FirstSeq - state.LastSeq - 1)
+	}
+	if state.Msgs == 0 {
+		state.FirstSeq, state.FirstTime = mstate.FirstSeq, mstate.FirstTime
+	}
+	if mstate.LastSeq > state.LastSeq {
+		state.LastSeq, state.LastTime = mstate.LastSeq, mstate.LastTime
+	}
+	state.Msgs += mstate.Msgs
+	state.Bytes += mstate.Bytes
+	state.NumDeleted += mstate.NumDeleted
+}
+
+// FastState will fill in state for both tiers with only the following.
+// Msgs, Bytes, First and Last Sequence and Time and NumDeleted.
+func (hs *hybridStore) FastState(state *StreamState) {
+	hs.tmu.RLock()
+	defer hs.tmu.RUnlock()
+	hs.fastState(state)
+}
+
+// Read lock should be held.
+func (hs *hybridStore) fastState(state *StreamState) {
+	var mstate StreamState
+	hs.fileStore.FastState(state)
+	hs.ms.FastState(&mstate)
+	mergeTierStates(state, &mstate)
+}
+
+// State returns the state of the stream across both tiers.
+func (hs *hybridStore) State() StreamState {
+	hs.tmu.RLock()
+	defer hs.tmu.RUnlock()
+
+	state, mstate := hs.fileStore.State(), hs.ms.State()
+	deleted := state.Deleted
+	if state.Msgs > 0 && mstate.Msgs > 0 {
+		for seq := state.LastSeq + 1; seq < mstate.FirstSeq; seq++ {
+			deleted = append(deleted, seq)
+		}
+	}
+	deleted = append(deleted, mstate.Deleted...)
+	mergeTierStates(&state, &mstate)
+	state.Deleted, state.NumDeleted = deleted, len(deleted)
+	state.NumSubjects = len(hs.subjectsTotals(fwcs))
+	return state
+}
+
+// UpdateConfig updates the config for both tiers and enforces any new limits across them.
+func (hs *hybridStore) UpdateConfig(cfg *StreamConfig) error {
+	if cfg.Storage != HybridStorage {
+		return fmt.Errorf("hybridStore requires hybrid storage type in config")
+	}
+	hs.tmu.Lock()
+	if err := hs.fileStore.UpdateConfig(cfg); err != nil {
+		hs.tmu.Unlock()
+		return err
+	}
+	if err := hs.ms.UpdateConfig(hotTierConfig(cfg)); err != nil {
+		hs.tmu.Unlock()
+		return err
+	}
+	ocfg := hs.scfg
+	hs.scfg = *cfg
+	if mmp := cfg.MaxMsgsPer; mmp > 0 && (ocfg.MaxMsgsPer <= 0 || mmp < ocfg.MaxMsgsPer) {
+		for subj, n := range hs.subjectsTotals(fwcs) {
+			for ; n > uint64(mmp); n-- {
+				if !hs.removeFirstForSubject(subj) {
+					break
+				}
+			}
+		}
+	}
+	hs.enforceLimits()
+	hs.tmu.Unlock()
+
+	// Spill right away in case the memory tier was made smaller.
+	return hs.spill(hs.memoryTierBytes())
+}
+
+// Type returns the type of the underlying store.
+func (hs *hybridStore) Type() StorageType {
+	return HybridStorage
+}
+
+// Snapshot will spill the memory tier so the snapshot of the file tier holds all messages.
+func (hs *hybridStore) Snapshot(deadline time.Duration, includeConsumers, checkMsgs bool) (*SnapshotResult, error) {
+	if err := hs.spill(0); err != nil {
+		return nil, err
+	}
+	return hs.fileStore.Snapshot(deadline, includeConsumers, checkMsgs)
+}
+
+// Stop will spill the memory tier so it is recovered with the file tier, and stop both tiers.
+func (hs *hybridStore) Stop() error {
+	hs.tmu.Lock()
+	hs.stopSpilling()
+	hs.tmu.Unlock()
+
+	err := hs.spill(0)
+	if ferr := hs.fileStore.Stop(); err == nil {
+		err = ferr
+	}
+	hs.ms.Stop()
+	return err
+}
+
+// Delete the file tier, and stop the memory tier.
+func (hs *hybridStore) Delete() error {
+	hs.tmu.Lock()
+	hs.stopSpilling()
+	hs.tmu.Unlock()
+
+	err := hs.fileStore.Delete()
+	hs.ms.Stop()
+	return err
+}
+
+// Returns the usage of each of our tiers.
+func (hs *hybridStore) tiers() *StorageTiers {
+	hs.tmu.RLock()
+	defer hs.tmu.RUnlock()
+
+	var mstate, fstate StreamState
+	hs.ms.FastState(&mstate)
+	hs.fileStore.FastState(&fstate)
+	return &StorageTiers{
+		Memory: TierState{Msgs: mstate.Msgs, Bytes: mstate.Bytes, FirstSeq: mstate.FirstSeq},
+		File:   TierState{Msgs: fstate.Msgs, Bytes: fstate.Bytes, FirstSeq: fstate.FirstSeq},
+	}
+}
@@ -0,0 +1,212 @@
+// Copyright 2023 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"sync/atomic"
+	"testing"
+)
+
+func newTestHybridStore(t *testing.T, dir string, cfg StreamConfig) *hybridStore {
+	t.Helper()
+	fs, err := newFileStore(FileStoreConfig{StoreDir: dir}, cfg)
+	require_NoError(t, err)
+	hs, err := newHybridStore(fs, &cfg)
+	require_NoError(t, err)
+	return hs
+}
+
+func TestHybridStoreOverflow(t *testing.T) {
+	dir := t.TempDir()
+	msg := bytes.Repeat([]byte("Z"), 100)
+	msz := memStoreMsgSize("foo.1", nil, msg)
+	cfg := StreamConfig{Name: "zzz", Subjects: []string{"foo.*"}, Storage: HybridStorage, MemoryTierBytes: int64(10 * msz)}
+
+	hs := newTestHybridStore(t, dir, cfg)
+	defer hs.Stop()
+
+	var updates, hot int64
+	hs.RegisterStorageUpdates(func(md, bd int64, seq uint64, subj string) { atomic.AddInt64(&updates, md) })
+	hs.registerMemoryTierUpdates(func(md, bd int64, seq uint64, subj string) { atomic.AddInt64(&hot, bd) })
+
+	for i := 1; i <= 100; i++ {
+		seq, _, err := hs.StoreMsg(fmt.Sprintf("foo.%d", i%5), nil, msg)
+		require_NoError(t, err)
+		require_True(t, seq == uint64(i))
+	}
+	require_NoError(t, hs.spill(hs.memoryTierBytes()))
+	// Spilling moves messages, so they are only reported once.
+	require_True(t, atomic.LoadInt64(&updates) == 100)
+	require_True(t, atomic.LoadInt64(&hot) == int64(10*msz))
+
+	// Only the most recent should be in memory, and the rest on disk.
+	tiers := hs.tiers()
+	require_True(t, tiers.Memory.Msgs == 10 && tiers.Memory.Bytes == 10*msz)
+	require_True(t, tiers.Memory.FirstSeq == 91)
+	require_True(t, tiers.File.Msgs == 90 && tiers.File.FirstSeq == 1)
+	state := hs.State()
+	require_True(t, state.Msgs == 100 && state.FirstSeq == 1 && state.LastSeq == 100)
+	require_True(t, state.NumSubjects == 5)
+
+	// We can load across both tiers.
+	for seq := uint64(1); seq <= 100; seq++ {
+		sm, err := hs.LoadMsg(seq, nil)
+		require_NoError(t, err)
+		require_True(t, sm.seq == seq)
+		require_True(t, sm.subj == fmt.Sprintf("foo.%d", seq%5))
+	}
+	var smv StoreMsg
+	var count int
+	for seq := uint64(1); ; {
+		sm, nseq, err := hs.LoadNextMsg("foo.3", false, seq, &smv)
+		if err == ErrStoreEOF {
+			break
+		}
+		require_NoError(t, err)
+		require_True(t, sm.subj == "foo.3")
+		count++
+		seq = nseq + 1
+	}
+	require_True(t, count == 20)
+	sm, err := hs.LoadLastMsg("foo.1", nil)
+	require_NoError(t, err)
+	require_True(t, sm.seq == 96)
+	ss := hs.FilteredState(1, "foo.3")
+	require_True(t, ss.Msgs == 20 && ss.First == 3 && ss.Last == 98)
+	total, _ := hs.NumPending(1, "foo.3", true)
+	require_True(t, total == 1)
+	total, _ = hs.NumPending(50, "foo.*", false)
+	require_True(t, total == 51)
+
+	// Removals apply to the tier holding the message.
+	removed, err := hs.RemoveMsg(100)
+	require_NoError(t, err)
+	require_True(t, removed)
+	_, err = hs.LoadMsg(100, nil)
+	require_Error(t, err)
+	sm, err = hs.LoadLastMsg("foo.4", nil)
+	require_NoError(t, err)
+	require_True(t, sm.seq == 99)
+	require_True(t, atomic.LoadInt64(&updates) == 99)
+
+	_, err = hs.PurgeEx("foo.4", 0, 0)
+	require_NoError(t, err)
+	_, err = hs.LoadMsg(94, nil)
+	require_Error(t, err)
+	_, err = hs.LoadMsg(4, nil)
+	require_Error(t, err)
+
+	_, err = hs.Compact(95)
+	require_NoError(t, err)
+	tiers = hs.tiers()
+	require_True(t, tiers.Memory.FirstSeq == 95 && tiers.File.Msgs == 0)
+
+	require_NoError(t, hs.Truncate(97))
+	tiers = hs.tiers()
+	require_True(t, tiers.Memory.Msgs == 3 && tiers.File.Msgs == 0)
+
+	// New messages continue after the truncated sequence.
+	seq, _, err := hs.StoreMsg("foo.1", nil, msg)
+	require_NoError(t, err)
+	require_True(t, seq == 98)
+	sm, err = hs.LoadMsg(98, nil)
+	require_NoError(t, err)
+	require_True(t, sm.subj == "foo.1")
+	require_True(t, hs.ms.State().LastSeq == 98)
+
+	// The memory tier is spilled when stopped, so it is recovered from the file tier.
+	hs.Stop()
+	hs = newTestHybridStore(t, dir, cfg)
+	defer hs.Stop()
+
+	tiers = hs.tiers()
+	require_True(t, tiers.Memory.Msgs == 0 && tiers.File.Msgs == 4)
+	sm, err = hs.LoadMsg(98, nil)
+	require_NoError(t, err)
+	require_True(t, sm.subj == "foo.1")
+	seq, _, err = hs.StoreMsg("foo.2", nil, msg)
+	require_NoError(t, err)
+	require_True(t, seq == 99)
+	tiers = hs.tiers()
+	require_True(t, tiers.Memory.Msgs == 1 && tiers.Memory.FirstSeq == 99 && tiers.File.Msgs == 4)
+
+	// Shrinking the memory tier should spill.
+	for i := 0; i < 5; i++ {
+		_, _, err := hs.StoreMsg("foo.2", nil, msg)
+		require_NoError(t, err)
+	}
+	cfg.MemoryTierBytes = int64(2 * msz)
+	require_NoError(t, hs.UpdateConfig(&cfg))
+	tiers = hs.tiers()
+	require_True(t, tiers.Memory.Msgs == 2 && tiers.File.Msgs == 8)
+	require_True(t, hs.State().Msgs == 10)
+}
+
+func TestHybridStoreLimits(t *testing.T) {
+	msg := bytes.Repeat([]byte("Z"), 100)
+	msz := memStoreMsgSize("foo.1", nil, msg)
+	cfg := StreamConfig{
+		Name: "zzz", Subjects: []string{"foo.*"}, Storage: HybridStorage,
+		MemoryTierBytes: int64(5 * msz), MaxMsgs: 20, MaxMsgsPer: 6,
+	}
+
+	hs := newTestHybridStore(t, t.TempDir(), cfg)
+	defer hs.Stop()
+
+	for i := 1; i <= 50; i++ {
+		_, _, err := hs.StoreMsg(fmt.Sprintf("foo.%d", i%4), nil, msg)
+		require_NoError(t, err)
+		require_NoError(t, hs.spill(hs.memoryTierBytes()))
+	}
+	// Limits hold across both tiers.
+	state := hs.State()
+	require_True(t, state.Msgs == 20 && state.FirstSeq == 31 && state.LastSeq == 50)
+	tiers := hs.tiers()
+	require_True(t, tiers.Memory.Msgs == 5 && tiers.File.Msgs == 15)
+
+	// Per subject limits remove from the file tier first.
+	cfg.MaxMsgsPer = 2
+	require_NoError(t, hs.UpdateConfig(&cfg))
+	for subj, n := range hs.SubjectsTotals("foo.*") {
+		require_True(t, n == 2)
+		ss := hs.FilteredState(1, subj)
+		require_True(t, ss.First > 42)
+	}
+	require_True(t, hs.State().Msgs == 8)
+
+	// Messages removed before being spilled leave a gap in the file tier.
+	_, err := hs.RemoveMsg(47)
+	require_NoError(t, err)
+	require_NoError(t, hs.spill(0))
+	tiers = hs.tiers()
+	require_True(t, tiers.Memory.Msgs == 0 && tiers.File.Msgs == 7)
+	_, err = hs.LoadMsg(47, nil)
+	require_Error(t, err)
+	seq, _, err := hs.StoreMsg("foo.1", nil, msg)
+	require_NoError(t, err)
+	require_True(t, seq == 51)
+	require_NoError(t, hs.spill(0))
+	sm, err := hs.LoadMsg(51, nil)
+	require_NoError(t, err)
+	require_True(t, sm.subj == "foo.1")
+
+	// Discard new is checked across both tiers.
+	cfg.Discard, cfg.MaxMsgsPer = DiscardNew, 0
+	cfg.MaxMsgs = int64(hs.State().Msgs)
+	require_NoError(t, hs.UpdateConfig(&cfg))
+	_, _, err = hs.StoreMsg("foo.2", nil, msg)
+	require_Error(t, err, ErrMaxMsgs)
+}
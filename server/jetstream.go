@@ -38,11 +38,12 @@ import (
 // JetStreamConfig determines this server's configuration.
 // MaxMemory and MaxStore are in bytes.
 type JetStreamConfig struct {
-	MaxMemory  int64  `json:"max_memory"`
-	MaxStore   int64  `json:"max_storage"`
-	StoreDir   string `json:"store_dir,omitempty"`
-	Domain     string `json:"domain,omitempty"`
-	CompressOK bool   `json:"compress_ok,omitempty"`
+	MaxMemory  int64             `json:"max_memory"`
+	MaxStore   int64             `json:"max_storage"`
+	StoreDir   string            `json:"store_dir,omitempty"`
+	StoreDirs  map[string]string `json:"store_dirs,omitempty"`
+	Domain     string            `json:"domain,omitempty"`
+	CompressOK bool              `json:"compress_ok,omitempty"`
 }
 
 // Statistics about JetStream for this server.
@@ -54,6 +55,14 @@ type JetStreamStats struct {
 	Accounts       int               `json:"accounts"`
 	HAAssets       int               `json:"ha_assets"`
 	API            JetStreamAPIStats `json:"api"`
+	// StoreDirs is the usage for each named store directory.
+	StoreDirs map[string]*StoreDirStats `json:"store_dirs,omitempty"`
+}
+
+// StoreDirStats is the storage used and reserved in a named store directory.
+type StoreDirStats struct {
+	Store         uint64 `json:"storage"`
+	ReservedStore uint64 `json:"reserved_storage"`
 }
 
 type JetStreamAccountLimits struct {
@@ -65,6 +74,8 @@ type JetStreamAccountLimits struct {
 	MemoryMaxStreamBytes int64 `json:"memory_max_stream_bytes"`
 	StoreMaxStreamBytes  int64 `json:"storage_max_stream_bytes"`
 	MaxBytesRequired     bool  `json:"max_bytes_required"`
+	// StoreDirs limits the storage used in each named store directory.
+	StoreDirs map[string]int64 `json:"store_dirs,omitempty"`
 }
 
 type JetStreamTier struct {
@@ -73,6 +84,8 @@ type JetStreamTier struct {
 	Streams   int                    `json:"streams"`
 	Consumers int                    `json:"consumers"`
 	Limits    JetStreamAccountLimits `json:"limits"`
+	// StoreDirs is the storage used in each named store directory on this server.
+	StoreDirs map[string]uint64 `json:"store_dirs,omitempty"`
 }
 
 // JetStreamAccountStats returns current statistics about the account's JetStream usage.
@@ -107,6 +120,10 @@ type jetStream struct {
 	accounts      map[string]*jsAccount
 	apiSubs       *Sublist
 	started       time.Time
+	archive       BlockArchive
+	readAhead     *ReadAheadBudget
+	cmpLimiter    *RateLimiter
+	scrubLimiter  *RateLimiter
 
 	// System level request to purge a stream move
 	accountPurge *subscription
@@ -136,14 +153,17 @@ type jsaStorage struct {
 // an internal sub for a stream, so we will direct link to the stream
 // and walk backwards as needed vs multiple hash lookups and locks, etc.
 type jsAccount struct {
-	mu        sync.RWMutex
-	js        *jetStream
-	account   *Account
-	storeDir  string
-	inflight  sync.Map
-	streams   map[string]*stream
+	mu       sync.RWMutex
+	js       *jetStream
+	account  *Account
+	storeDir string
+	inflight sync.Map
+	streams  map[string]*stream
+	// Subjects of streams being added but not registered yet, indexed by stream name.
+	reserved  map[string][]string
 	templates map[string]*streamTemplate
 	store     TemplateStore
+	auto      *autoStreams
 
 	// From server
 	sendq *ipQueue[*pubMsg]
@@ -156,6 +176,7 @@ type jsAccount struct {
 	limits     map[string]JetStreamAccountLimits // indexed by tierName
 	usage      map[string]*jsaStorage            // indexed by tierName
 	rusage     map[string]*remoteUsage           // indexed by node id
+	sdusage    map[string]map[string]int64       // local usage indexed by tierName and store directory name
 	apiTotal   uint64
 	apiErrors  uint64
 	usageApi   uint64
@@ -182,9 +203,11 @@ func (s *Server) EnableJetStream(config *JetStreamConfig) error {
 	s.Noticef("Starting JetStream")
 	if config == nil || config.MaxMemory <= 0 || config.MaxStore <= 0 {
 		var storeDir, domain string
+		var storeDirs map[string]string
 		var maxStore, maxMem int64
 		if config != nil {
 			storeDir, domain = config.StoreDir, config.Domain
+			storeDirs = config.StoreDirs
 			maxStore, maxMem = config.MaxStore, config.MaxMemory
 		}
 		config = s.dynJetStreamConfig(storeDir, maxStore, maxMem)
@@ -194,6 +217,7 @@ func (s *Server) EnableJetStream(config *JetStreamConfig) error {
 		if domain != _EMPTY_ {
 			config.Domain = domain
 		}
+		config.StoreDirs = storeDirs
 		s.Debugf("JetStream creating dynamic configuration - %s memory, %s disk", friendlyBytes(config.MaxMemory), friendlyBytes(config.MaxStore))
 	} else if config.StoreDir != _EMPTY_ {
 		config.StoreDir = filepath.Join(config.StoreDir, JetStreamStoreDir)
@@ -203,6 +227,14 @@ func (s *Server) EnableJetStream(config *JetStreamConfig) error {
 	if cfg.StoreDir == _EMPTY_ {
 		cfg.StoreDir = filepath.Join(os.TempDir(), JetStreamStoreDir)
 	}
+	// Our named store directories are laid out the same as our store directory.
+	if len(cfg.StoreDirs) > 0 {
+		sds := make(map[string]string, len(cfg.StoreDirs))
+		for name, dir := range cfg.StoreDirs {
+			sds[name] = filepath.Join(dir, JetStreamStoreDir)
+		}
+		cfg.StoreDirs = sds
+	}
 
 	// We will consistently place the 'jetstream' directory under the storedir that was handed to us. Prior to 2.2.3 though
 	// we could have a directory on disk without the 'jetstream' directory. This will check and fix if needed.
@@ -219,7 +251,17 @@ type keyGen func(context []byte) ([]byte, error)
 // Return a key generation function or nil if encryption not enabled.
 // keyGen defined in filestore.go - keyGen func(iv, context []byte) []byte
 func (s *Server) jsKeyGen(info string) keyGen {
-	if ek := s.getOpts().JetStreamKey; ek != _EMPTY_ {
+	return newKeyGen(s.getOpts().JetStreamKey, info)
+}
+
+// Return a key generation function for our previous key during a key rotation,
+// or nil if we do not have one. This is only used to read existing keys.
+func (s *Server) jsOldKeyGen(info string) keyGen {
+	return newKeyGen(s.getOpts().JetStreamOldKey, info)
+}
+
+func newKeyGen(ek, info string) keyGen {
+	if ek != _EMPTY_ {
 		return func(context []byte) ([]byte, error) {
 			h := hmac.New(sha256.New, []byte(ek))
 			if _, err := h.Write([]byte(info)); err != nil {
@@ -236,36 +278,49 @@ func (s *Server) jsKeyGen(info string) keyGen {
 
 // Decode the encrypted metafile.
 func (s *Server) decryptMeta(sc StoreCipher, ekey, buf []byte, acc, context string) ([]byte, error) {
+	return decryptMetaWithKeyGen(sc, s.jsKeyGen(acc), s.jsOldKeyGen(acc), ekey, buf, context)
+}
+
+// Decode the encrypted metafile with these key generators, the old one may be nil.
+func decryptMetaWithKeyGen(sc StoreCipher, prf, oldprf keyGen, ekey, buf []byte, context string) ([]byte, error) {
 	if len(ekey) < minMetaKeySize {
 		return nil, errBadKeySize
 	}
-	prf := s.jsKeyGen(acc)
 	if prf == nil {
 		return nil, errNoEncryption
 	}
-	rb, err := prf([]byte(context))
+	seed, err := openMetaKey(sc, prf, ekey, context)
+	// During a key rotation this may still be wrapped with our previous key.
+	if err != nil && oldprf != nil {
+		seed, err = openMetaKey(sc, oldprf, ekey, context)
+	}
 	if err != nil {
 		return nil, err
 	}
-
-	kek, err := genEncryptionKey(sc, rb)
+	aek, err := genEncryptionKey(sc, seed)
 	if err != nil {
 		return nil, err
 	}
-	ns := kek.NonceSize()
-	seed, err := kek.Open(nil, ekey[:ns], ekey[ns:], nil)
+	ns := aek.NonceSize()
+	plain, err := aek.Open(nil, buf[:ns], buf[ns:], nil)
 	if err != nil {
 		return nil, err
 	}
-	aek, err := genEncryptionKey(sc, seed)
+	return plain, nil
+}
+
+// Open the encrypted seed of a metafile key with the given key generator.
+func openMetaKey(sc StoreCipher, prf keyGen, ekey []byte, context string) ([]byte, error) {
+	rb, err := prf([]byte(context))
 	if err != nil {
 		return nil, err
 	}
-	plain, err := aek.Open(nil, buf[:ns], buf[ns:], nil)
+	kek, err := genEncryptionKey(sc, rb)
 	if err != nil {
 		return nil, err
 	}
-	return plain, nil
+	ns := kek.NonceSize()
+	return kek.Open(nil, ekey[:ns], ekey[ns:], nil)
 }
 
 // Check to make sure directory has the jetstream directory.
@@ -359,6 +414,44 @@ func (s *Server) enableJetStream(cfg JetStreamConfig) error {
 		tmpfile.Close()
 		os.Remove(tmpfile.Name())
 	}
+	for name, dir := range cfg.StoreDirs {
+		if err := os.MkdirAll(dir, defaultDirPerms); err != nil {
+			return fmt.Errorf("could not create store directory %q - %v", name, err)
+		}
+	}
+	ao := s.getOpts().JetStreamArchive
+	if ao.Dir != _EMPTY_ {
+		ba, err := NewDirBlockArchive(ao.Dir)
+		if err != nil {
+			return err
+		}
+		js.archive = ba
+	} else if ao.Backend != _EMPTY_ {
+		js.archive = registeredBlockArchive(ao.Backend)
+	}
+	// Our file stores share one cache of fetched blocks.
+	if js.archive != nil {
+		size := ao.Cache
+		if size <= 0 {
+			size = defaultArchiveCacheSize
+		}
+		js.archive = newCachedBlockArchive(js.archive, size)
+	}
+	// A negative budget disables read-ahead for file based streams.
+	if ra := s.getOpts().JetStreamReadAhead; ra >= 0 {
+		if ra == 0 {
+			ra = defaultReadAheadBudget
+		}
+		js.readAhead = NewReadAheadBudget(ra)
+	}
+	// Background compaction of all our file based streams shares one rate.
+	js.cmpLimiter = NewRateLimiter(uint64(s.getOpts().JetStreamCompact.Rate))
+	// As does scrubbing.
+	if rate := s.getOpts().JetStreamScrub.Rate; rate > 0 {
+		js.scrubLimiter = NewRateLimiter(uint64(rate))
+	} else {
+		js.scrubLimiter = NewRateLimiter(defaultScrubRate)
+	}
 
 	// JetStream is an internal service so we need to make sure we have a system account.
 	// This system account will export the JetStream service endpoints.
@@ -377,12 +470,23 @@ func (s *Server) enableJetStream(cfg JetStreamConfig) error {
 	s.Noticef("  Max Memory:      %s", friendlyBytes(cfg.MaxMemory))
 	s.Noticef("  Max Storage:     %s", friendlyBytes(cfg.MaxStore))
 	s.Noticef("  Store Directory: \"%s\"", cfg.StoreDir)
+	for name, dir := range cfg.StoreDirs {
+		s.Noticef("  Store Directory: \"%s\" (%s)", dir, name)
+	}
+	if ao.Dir != _EMPTY_ {
+		s.Noticef("  Archive:         \"%s\"", ao.Dir)
+	} else if ao.Backend != _EMPTY_ {
+		s.Noticef("  Archive:         %s", ao.Backend)
+	}
 	if cfg.Domain != _EMPTY_ {
 		s.Noticef("  Domain:          %s", cfg.Domain)
 	}
 	opts := s.getOpts()
 	if ek := opts.JetStreamKey; ek != _EMPTY_ {
 		s.Noticef("  Encryption:      %s", opts.JetStreamCipher)
+		if opts.JetStreamOldKey != _EMPTY_ {
+			s.Noticef("  Key Rotation:    re-encrypting with new key")
+		}
 	}
 	s.Noticef("-------------------------------------------")
 
@@ -413,14 +517,22 @@ func (s *Server) enableJetStream(cfg JetStreamConfig) error {
 
 	// If we are in clustered mode go ahead and start the meta controller.
 	if !standAlone || canExtend {
+		if len(opts.JetStreamRestore) > 0 {
+			s.Warnf("Restoring streams from backups is not supported in clustered mode")
+		}
 		if err := s.enableJetStreamClustering(); err != nil {
 			return err
 		}
+	} else if len(opts.JetStreamRestore) > 0 {
+		s.restoreStreamBackupsOnStartup(opts.JetStreamRestore)
 	}
 
 	// Mark when we are up and running.
 	js.setStarted()
 
+	// Start any scheduled backups.
+	s.startJetStreamBackups()
+
 	return nil
 }
 
@@ -456,6 +568,7 @@ func (s *Server) restartJetStream() error {
 	opts := s.getOpts()
 	cfg := JetStreamConfig{
 		StoreDir:  opts.StoreDir,
+		StoreDirs: opts.JetStreamStoreDirs,
 		MaxMemory: opts.JetStreamMaxMemory,
 		MaxStore:  opts.JetStreamMaxStore,
 		Domain:    opts.JetStreamDomain,
@@ -1173,11 +1286,17 @@ func (a *Account) EnableJetStream(limits map[string]JetStreamAccountLimits) erro
 	plaintext := true
 	sc := s.getOpts().JetStreamCipher
 
-	// Now recover the streams.
-	fis, _ := os.ReadDir(sdir)
-	for _, fi := range fis {
-		mdir := filepath.Join(sdir, fi.Name())
-		key := sha256.Sum256([]byte(fi.Name()))
+	// Now recover the streams, which can be in our store directory or any named store directory.
+	var mdirs []string
+	for _, dir := range js.accountStreamsDirs(a.Name) {
+		fis, _ := os.ReadDir(dir)
+		for _, fi := range fis {
+			mdirs = append(mdirs, filepath.Join(dir, fi.Name()))
+		}
+	}
+	for _, mdir := range mdirs {
+		sname := filepath.Base(mdir)
+		key := sha256.Sum256([]byte(sname))
 		hh, err := highwayhash.New64(key[:])
 		if err != nil {
 			return err
@@ -1223,15 +1342,15 @@ func (a *Account) EnableJetStream(limits map[string]JetStreamAccountLimits) erro
 				continue
 			}
 			// Decode the buffer before proceeding.
-			nbuf, err := s.decryptMeta(sc, keyBuf, buf, a.Name, fi.Name())
+			nbuf, err := s.decryptMeta(sc, keyBuf, buf, a.Name, sname)
 			if err != nil {
 				// See if we are changing ciphers.
 				switch sc {
 				case ChaCha:
-					nbuf, err = s.decryptMeta(AES, keyBuf, buf, a.Name, fi.Name())
+					nbuf, err = s.decryptMeta(AES, keyBuf, buf, a.Name, sname)
 					osc, convertingCiphers = AES, true
 				case AES:
-					nbuf, err = s.decryptMeta(ChaCha, keyBuf, buf, a.Name, fi.Name())
+					nbuf, err = s.decryptMeta(ChaCha, keyBuf, buf, a.Name, sname)
 					osc, convertingCiphers = ChaCha, true
 				}
 				if err != nil {
@@ -1255,6 +1374,9 @@ func (a *Account) EnableJetStream(limits map[string]JetStreamAccountLimits) erro
 			}
 		}
 
+		// Our storage could have been moved to another store directory before our metadata was updated.
+		cfg.StoreDir = js.storeDirName(a.Name, filepath.Dir(mdir))
+
 		// We had a bug that set a default de dupe window on mirror, despite that being not a valid config
 		fixCfgMirrorWithDedupWindow(&cfg.StreamConfig)
 
@@ -1293,7 +1415,10 @@ func (a *Account) EnableJetStream(limits map[string]JetStreamAccountLimits) erro
 			} else if convertingCiphers {
 				s.Noticef("  Converting from %s to %s for stream '%s > %s'", osc, sc, a.Name, cfg.StreamConfig.Name)
 				// Remove the key file to have system regenerate with the new cipher.
-				os.Remove(keyFile)
+				// Memory streams still need it to recover the state they persisted on shutdown.
+				if cfg.Storage != MemoryStorage {
+					os.Remove(keyFile)
+				}
 			}
 		}
 
@@ -1324,7 +1449,7 @@ func (a *Account) EnableJetStream(limits map[string]JetStreamAccountLimits) erro
 		}
 
 		// Now do the consumers.
-		odir := filepath.Join(sdir, fi.Name(), consumerDir)
+		odir := filepath.Join(mdir, consumerDir)
 		consumers = append(consumers, &ce{mset, odir})
 	}
 
@@ -1402,6 +1527,8 @@ func (a *Account) EnableJetStream(limits map[string]JetStreamAccountLimits) erro
 				s.Warnf("    Error restoring consumer %q state: %v", cfg.Name, err)
 			}
 		}
+		// Memory based streams only persist across a clean shutdown.
+		e.mset.removePersisted()
 	}
 
 	// Make sure to cleanup any old remaining snapshots.
@@ -1415,6 +1542,14 @@ func (a *Account) EnableJetStream(limits map[string]JetStreamAccountLimits) erro
 
 	s.Debugf("JetStream state for account %q recovered", a.Name)
 
+	// Setup any templates for creating streams on demand.
+	a.mu.RLock()
+	ascs := a.jsAutoStreams
+	a.mu.RUnlock()
+	if err := jsa.startAutoStreams(ascs); err != nil {
+		s.Warnf("Error setting up JetStream auto streams for account %q: %v", a.Name, err)
+	}
+
 	return nil
 }
 
@@ -1587,6 +1722,7 @@ func (a *Account) JetStreamUsage() JetStreamAccountStats {
 		jsa.mu.RLock()
 		jsa.usageMu.RLock()
 		stats.Memory, stats.Store = jsa.storageTotals()
+		stats.StoreDirs = jsa.storeDirUsage(_EMPTY_, true)
 		stats.Domain = js.config.Domain
 		stats.API = JetStreamAPIStats{
 			Total:  jsa.apiTotal,
@@ -1605,9 +1741,10 @@ func (a *Account) JetStreamUsage() JetStreamAccountStats {
 					skipped++
 				} else {
 					stats.Tiers[t] = JetStreamTier{
-						Memory: uint64(total.total.mem),
-						Store:  uint64(total.total.store),
-						Limits: jsa.limits[t],
+						Memory:    uint64(total.total.mem),
+						Store:     uint64(total.total.store),
+						StoreDirs: jsa.storeDirUsage(t, false),
+						Limits:    jsa.limits[t],
 					}
 				}
 			}
@@ -1837,8 +1974,13 @@ func (jsa *jsAccount) checkAndSyncUsage(tierName string, storeType StorageType)
 	var stores []StreamStore
 	for _, mset := range jsa.streams {
 		mset.mu.RLock()
-		if mset.tier == tierName && mset.stype == storeType && mset.store != nil {
-			stores = append(stores, mset.store)
+		if mset.tier == tierName && mset.store != nil {
+			if mset.stype == storeType {
+				stores = append(stores, mset.store)
+			} else if hs, ok := mset.store.(*hybridStore); ok && storeType == MemoryStorage {
+				// The memory tier of hybrid streams counts as memory.
+				stores = append(stores, hs.ms)
+			}
 		}
 		mset.mu.RUnlock()
 	}
@@ -2075,7 +2217,7 @@ func (jsa *jsAccount) storageTotals() (uint64, uint64) {
 	return mem, store
 }
 
-func (jsa *jsAccount) limitsExceeded(storeType StorageType, tierName string) (bool, *ApiError) {
+func (jsa *jsAccount) limitsExceeded(storeType StorageType, tierName, storeDir string) (bool, *ApiError) {
 	jsa.usageMu.RLock()
 	defer jsa.usageMu.RUnlock()
 
@@ -2083,6 +2225,11 @@ func (jsa *jsAccount) limitsExceeded(storeType StorageType, tierName string) (bo
 	if !ok {
 		return true, NewJSNoLimitsError()
 	}
+	if storeDir != _EMPTY_ {
+		if max, ok := selectedLimits.StoreDirs[storeDir]; ok && max >= 0 && jsa.sdusage[tierName][storeDir] > max {
+			return true, nil
+		}
+	}
 	inUse := jsa.usage[tierName]
 	if inUse == nil {
 		// Imply totals of 0
@@ -2145,7 +2292,7 @@ func (js *jetStream) checkBytesLimits(selectedLimits *JetStreamAccountLimits, ad
 	}
 	totalBytes := (addBytes * int64(replicas)) + maxBytesOffset
 
-	switch storage {
+	switch storage.limitsType() {
 	case MemoryStorage:
 		// Account limits defined.
 		if selectedLimits.MaxMemory >= 0 {
@@ -2204,8 +2351,14 @@ func (jsa *jsAccount) delete() {
 		ts = append(ts, t.Name)
 	}
 	jsa.templates = nil
+	auto := jsa.auto
+	jsa.auto = nil
 	jsa.mu.Unlock()
 
+	if auto != nil {
+		auto.stop()
+	}
+
 	for _, ms := range streams {
 		ms.stop(false, false)
 	}
@@ -2226,6 +2379,110 @@ func (js *jetStream) lookupAccount(a *Account) *jsAccount {
 	return jsa
 }
 
+// Returns the directory for a stream's storage. This will be in the named store
+// directory of the stream if it has one, otherwise in our store directory.
+func (js *jetStream) streamStoreDir(accName string, cfg *StreamConfig) string {
+	root := js.config.StoreDir
+	if dir, ok := js.config.StoreDirs[cfg.StoreDir]; ok && cfg.StoreDir != _EMPTY_ {
+		root = dir
+	}
+	return filepath.Join(root, accName, streamsDir, cfg.Name)
+}
+
+// Returns all of the streams directories for an account, for our store directory
+// and all named store directories.
+func (js *jetStream) accountStreamsDirs(accName string) []string {
+	dirs := []string{filepath.Join(js.config.StoreDir, accName, streamsDir)}
+	for _, dir := range js.config.StoreDirs {
+		dirs = append(dirs, filepath.Join(dir, accName, streamsDir))
+	}
+	return dirs
+}
+
+// Returns the name of the store directory for one of the streams directories of an account.
+// Our own store directory has no name.
+func (js *jetStream) storeDirName(accName, dir string) string {
+	for name, sdir := range js.config.StoreDirs {
+		if filepath.Join(sdir, accName, streamsDir) == dir {
+			return name
+		}
+	}
+	return _EMPTY_
+}
+
+// Updates the local usage of a tier for a named store directory.
+func (jsa *jsAccount) updateStoreDirUsage(tierName, name string, delta int64) {
+	jsa.usageMu.Lock()
+	if jsa.sdusage == nil {
+		jsa.sdusage = make(map[string]map[string]int64)
+	}
+	sdu := jsa.sdusage[tierName]
+	if sdu == nil {
+		sdu = make(map[string]int64)
+		jsa.sdusage[tierName] = sdu
+	}
+	sdu[name] += delta
+	jsa.usageMu.Unlock()
+}
+
+// Returns the local usage of a tier for each named store directory, or the totals of all tiers
+// if all is set. Lock for usageMu should be held.
+func (jsa *jsAccount) storeDirUsage(tierName string, all bool) map[string]uint64 {
+	var usage map[string]uint64
+	for tn, sdu := range jsa.sdusage {
+		if !all && tn != tierName {
+			continue
+		}
+		for name, used := range sdu {
+			if used <= 0 {
+				continue
+			}
+			if usage == nil {
+				usage = make(map[string]uint64)
+			}
+			usage[name] += uint64(used)
+		}
+	}
+	return usage
+}
+
+// Returns the bytes reserved by other streams of the tier in the named store directory of cfg.
+// Read lock should be held.
+func (jsa *jsAccount) storeDirReservation(tier string, cfg *StreamConfig) int64 {
+	var reservation int64
+	for _, sa := range jsa.streams {
+		if tier != _EMPTY_ && !isSameTier(&sa.cfg, cfg) {
+			continue
+		}
+		if sa.cfg.StoreDir == cfg.StoreDir && sa.cfg.Name != cfg.Name && sa.cfg.MaxBytes > 0 {
+			reservation += int64(sa.cfg.Replicas) * sa.cfg.MaxBytes
+		}
+	}
+	return reservation
+}
+
+// Check the reservations in the named store directory of a stream against the account limits for it.
+func checkStoreDirLimits(selected *JetStreamAccountLimits, cfg *StreamConfig, currentRes int64) error {
+	if cfg.StoreDir == _EMPTY_ {
+		return nil
+	}
+	max, ok := selected.StoreDirs[cfg.StoreDir]
+	if !ok || max < 0 {
+		return nil
+	}
+	replicas, addBytes := int64(cfg.Replicas), cfg.MaxBytes
+	if replicas < 1 {
+		replicas = 1
+	}
+	if addBytes < 0 {
+		addBytes = 1
+	}
+	if currentRes+addBytes*replicas > max {
+		return NewJSStorageResourcesExceededError()
+	}
+	return nil
+}
+
 // Report on JetStream stats and usage for this server.
 func (js *jetStream) usageStats() *JetStreamStats {
 	var stats JetStreamStats
@@ -2250,9 +2507,41 @@ func (js *jetStream) usageStats() *JetStreamStats {
 	}
 	stats.Store = uint64(used)
 	stats.HAAssets = s.numRaftNodes()
+	stats.StoreDirs = js.storeDirStats()
 	return &stats
 }
 
+// Report on the usage and reservations for each named store directory.
+func (js *jetStream) storeDirStats() map[string]*StoreDirStats {
+	js.mu.RLock()
+	defer js.mu.RUnlock()
+
+	if len(js.config.StoreDirs) == 0 {
+		return nil
+	}
+	stats := make(map[string]*StoreDirStats, len(js.config.StoreDirs))
+	for name := range js.config.StoreDirs {
+		stats[name] = &StoreDirStats{}
+	}
+	for _, jsa := range js.accounts {
+		jsa.mu.RLock()
+		for _, mset := range jsa.streams {
+			if sds := stats[mset.cfg.StoreDir]; sds != nil && mset.cfg.MaxBytes > 0 {
+				sds.ReservedStore += uint64(mset.cfg.MaxBytes)
+			}
+		}
+		jsa.usageMu.RLock()
+		for name, used := range jsa.storeDirUsage(_EMPTY_, true) {
+			if sds := stats[name]; sds != nil {
+				sds.Store += used
+			}
+		}
+		jsa.usageMu.RUnlock()
+		jsa.mu.RUnlock()
+	}
+	return stats
+}
+
 // Check to see if we have enough system resources for this account.
 // Lock should be held.
 func (js *jetStream) sufficientResources(limits map[string]JetStreamAccountLimits) error {
@@ -2310,19 +2599,44 @@ func (js *jetStream) sufficientResources(limits map[string]JetStreamAccountLimit
 	return nil
 }
 
+// Returns the bytes a stream reserves against limits of the given storage type.
+// Hybrid streams reserve their memory tier against memory limits as well.
+func streamReservation(cfg *StreamConfig, storage StorageType) int64 {
+	var reserved int64
+	if cfg.MaxBytes > 0 && cfg.Storage == storage {
+		reserved = cfg.MaxBytes
+	}
+	if storage == MemoryStorage && cfg.Storage == HybridStorage && cfg.MemoryTierBytes > 0 {
+		reserved += cfg.MemoryTierBytes
+	}
+	return reserved
+}
+
+// Returns the config to check the memory tier of a hybrid stream against memory limits.
+func memoryTierConfig(cfg *StreamConfig) *StreamConfig {
+	mcfg := *cfg
+	mcfg.Storage, mcfg.MaxBytes = MemoryStorage, cfg.MemoryTierBytes
+	return &mcfg
+}
+
 // This will reserve the stream resources requested.
-// This will spin off off of MaxBytes.
+// This will spin off off of MaxBytes, and the memory tier of hybrid streams.
 func (js *jetStream) reserveStreamResources(cfg *StreamConfig) {
-	if cfg == nil || cfg.MaxBytes <= 0 {
+	if cfg == nil || (cfg.MaxBytes <= 0 && cfg.MemoryTierBytes <= 0) {
 		return
 	}
 
 	js.mu.Lock()
-	switch cfg.Storage {
-	case MemoryStorage:
-		js.memReserved += cfg.MaxBytes
-	case FileStorage:
-		js.storeReserved += cfg.MaxBytes
+	if cfg.MaxBytes > 0 {
+		switch cfg.Storage.limitsType() {
+		case MemoryStorage:
+			js.memReserved += cfg.MaxBytes
+		case FileStorage:
+			js.storeReserved += cfg.MaxBytes
+		}
+	}
+	if cfg.Storage == HybridStorage && cfg.MemoryTierBytes > 0 {
+		js.memReserved += cfg.MemoryTierBytes
 	}
 	s, clustered := js.srv, !js.standAlone
 	js.mu.Unlock()
@@ -2334,16 +2648,21 @@ func (js *jetStream) reserveStreamResources(cfg *StreamConfig) {
 
 // Release reserved resources held by a stream.
 func (js *jetStream) releaseStreamResources(cfg *StreamConfig) {
-	if cfg == nil || cfg.MaxBytes <= 0 {
+	if cfg == nil || (cfg.MaxBytes <= 0 && cfg.MemoryTierBytes <= 0) {
 		return
 	}
 
 	js.mu.Lock()
-	switch cfg.Storage {
-	case MemoryStorage:
-		js.memReserved -= cfg.MaxBytes
-	case FileStorage:
-		js.storeReserved -= cfg.MaxBytes
+	if cfg.MaxBytes > 0 {
+		switch cfg.Storage.limitsType() {
+		case MemoryStorage:
+			js.memReserved -= cfg.MaxBytes
+		case FileStorage:
+			js.storeReserved -= cfg.MaxBytes
+		}
+	}
+	if cfg.Storage == HybridStorage && cfg.MemoryTierBytes > 0 {
+		js.memReserved -= cfg.MemoryTierBytes
 	}
 	s, clustered := js.srv, !js.standAlone
 	js.mu.Unlock()
@@ -2847,6 +3166,26 @@ func validateJetStreamOptions(o *Options) error {
 	if o.JetStreamMaxCatchup < 0 {
 		return fmt.Errorf("jetstream max catchup cannot be negative")
 	}
+	if co := o.JetStreamCompact; co.Threshold < 0 || co.Threshold > 1 {
+		return fmt.Errorf("jetstream compaction threshold must be between 0 and 1")
+	} else if co.MinBytes < 0 || co.Rate < 0 {
+		return fmt.Errorf("jetstream compaction min bytes and rate cannot be negative")
+	}
+	if o.JetStreamOldKey != _EMPTY_ {
+		if o.JetStreamKey == _EMPTY_ {
+			return fmt.Errorf("jetstream previous encryption key requires an encryption key")
+		} else if o.JetStreamOldKey == o.JetStreamKey {
+			return fmt.Errorf("jetstream previous encryption key must differ from the encryption key")
+		}
+	}
+	if o.JetStreamScrub.Rate < 0 {
+		return fmt.Errorf("jetstream scrubbing rate cannot be negative")
+	}
+	if ao := o.JetStreamArchive; ao.Dir != _EMPTY_ && ao.Backend != _EMPTY_ {
+		return fmt.Errorf("jetstream archive can not have both a directory and a backend")
+	} else if ao.Backend != _EMPTY_ && registeredBlockArchive(ao.Backend) == nil {
+		return fmt.Errorf("jetstream archive backend %q is not registered", ao.Backend)
+	}
 	return nil
 }
 
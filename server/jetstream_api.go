@@ -18,6 +18,7 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"math/rand"
 	"os"
 	"path/filepath"
@@ -107,6 +108,33 @@ const (
 	JSApiStreamRestore  = "$JS.API.STREAM.RESTORE.*"
 	JSApiStreamRestoreT = "$JS.API.STREAM.RESTORE.%s"
 
+	// JSApiStreamBackupRestore is the endpoint to restore a stream from a scheduled backup.
+	// Will return JSON response.
+	JSApiStreamBackupRestore  = "$JS.API.STREAM.BACKUP.RESTORE.*"
+	JSApiStreamBackupRestoreT = "$JS.API.STREAM.BACKUP.RESTORE.%s"
+
+	// JSApiStreamPointInTime is the endpoint to create a new stream from a stream as it was at a point in time.
+	// Will return JSON response.
+	JSApiStreamPointInTime  = "$JS.API.STREAM.PITR.*"
+	JSApiStreamPointInTimeT = "$JS.API.STREAM.PITR.%s"
+
+	// JSApiStreamExport is the endpoint to export the messages of a stream as JSON lines.
+	// Will return a stream of chunks with a nil chunk as EOF to
+	// the deliver subject. Caller should respond to each chunk
+	// with a nil body response for ack flow.
+	JSApiStreamExport  = "$JS.API.STREAM.EXPORT.*"
+	JSApiStreamExportT = "$JS.API.STREAM.EXPORT.%s"
+
+	// JSApiStreamImport is the endpoint to create a stream from a JSON lines export.
+	// Caller should wait for the response to each chunk before sending the next one.
+	JSApiStreamImport  = "$JS.API.STREAM.IMPORT.*"
+	JSApiStreamImportT = "$JS.API.STREAM.IMPORT.%s"
+
+	// JSApiStreamVerify is the endpoint to verify the replicas of a stream hold the same messages.
+	// Will return JSON response.
+	JSApiStreamVerify  = "$JS.API.STREAM.VERIFY.*"
+	JSApiStreamVerifyT = "$JS.API.STREAM.VERIFY.%s"
+
 	// JSApiMsgDelete is the endpoint to delete messages from a stream.
 	// Will return JSON response.
 	JSApiMsgDelete  = "$JS.API.STREAM.MSG.DELETE.*"
@@ -174,6 +202,9 @@ const (
 	jsSnapshotAckT    = "$JS.SNAPSHOT.ACK.%s.%s"
 	jsRestoreDeliverT = "$JS.SNAPSHOT.RESTORE.%s.%s"
 
+	// For stream imports, exports use the snapshot acks.
+	jsImportDeliverT = "$JS.IMPORT.%s.%s"
+
 	// JSApiStreamRemovePeer is the endpoint to remove a peer from a clustered stream and its consumers.
 	// Will return JSON response.
 	JSApiStreamRemovePeer  = "$JS.API.STREAM.PEER.REMOVE.*"
@@ -246,6 +277,9 @@ const (
 	// JSAdvisoryConsumerMsgTerminatedPre is a notification published when a message has been terminated.
 	JSAdvisoryConsumerMsgTerminatedPre = "$JS.EVENT.ADVISORY.CONSUMER.MSG_TERMINATED"
 
+	// JSAdvisoryConsumerStatsPre is a notification published periodically with consumer latency and redelivery stats.
+	JSAdvisoryConsumerStatsPre = "$JS.EVENT.ADVISORY.CONSUMER.STATS"
+
 	// JSAdvisoryStreamCreatedPre notification that a stream was created.
 	JSAdvisoryStreamCreatedPre = "$JS.EVENT.ADVISORY.STREAM.CREATED"
 
@@ -276,6 +310,9 @@ const (
 	// JSAdvisoryStreamLeaderElectedPre notification that a replicated stream has elected a leader.
 	JSAdvisoryStreamLeaderElectedPre = "$JS.EVENT.ADVISORY.STREAM.LEADER_ELECTED"
 
+	// JSAdvisoryStreamCorruptionPre notification that scrubbing found corrupt messages in a stream.
+	JSAdvisoryStreamCorruptionPre = "$JS.EVENT.ADVISORY.STREAM.CORRUPTION"
+
 	// JSAdvisoryStreamQuorumLostPre notification that a stream and its consumers are stalled.
 	JSAdvisoryStreamQuorumLostPre = "$JS.EVENT.ADVISORY.STREAM.QUORUM_LOST"
 
@@ -535,6 +572,128 @@ type JSApiStreamRestoreResponse struct {
 
 const JSApiStreamRestoreResponseType = "io.nats.jetstream.api.v1.stream_restore_response"
 
+// JSApiStreamBackupRestoreRequest is the optional request to restore a stream from a scheduled backup.
+type JSApiStreamBackupRestoreRequest struct {
+	// Backup to restore, the most recent one if empty.
+	Backup string `json:"backup,omitempty"`
+}
+
+// JSApiStreamBackupRestoreResponse is the response to restoring a stream from a scheduled backup.
+type JSApiStreamBackupRestoreResponse struct {
+	ApiResponse
+	*StreamInfo
+	Backup string `json:"backup,omitempty"`
+}
+
+const JSApiStreamBackupRestoreResponseType = "io.nats.jetstream.api.v1.stream_backup_restore_response"
+
+// JSApiStreamPointInTimeRequest is the request to create a new stream with the messages
+// a stream had stored at a point in time. The new stream has the configuration of the stream
+// without a max age, so restored messages do not expire, which can be changed by updating it.
+// Only supported without clustering, otherwise JSStreamPointInTimeClusteredErr is returned.
+type JSApiStreamPointInTimeRequest struct {
+	// Time to restore to, messages stored after it are left out.
+	Time time.Time `json:"time"`
+	// Name of the new stream, defaults to the name of the stream when restoring from a backup.
+	Name string `json:"name,omitempty"`
+	// Subjects for the new stream, defaults to the name of the new stream when it was renamed.
+	Subjects []string `json:"subjects,omitempty"`
+	// Backup to restore from instead of the live stream, use "latest" for the most recent one.
+	Backup string `json:"backup,omitempty"`
+	// Consumers to rewind to their checkpointed state at the time.
+	Consumers []string `json:"consumers,omitempty"`
+}
+
+// JSApiStreamPointInTimeResponse is the response to a point in time restore.
+type JSApiStreamPointInTimeResponse struct {
+	ApiResponse
+	*StreamInfo
+	Backup    string   `json:"backup,omitempty"`
+	Consumers []string `json:"consumers,omitempty"`
+}
+
+const JSApiStreamPointInTimeResponseType = "io.nats.jetstream.api.v1.stream_point_in_time_response"
+
+// JSApiStreamExportRequest is the request to export the messages of a stream.
+type JSApiStreamExportRequest struct {
+	// Subject to deliver the chunks of the export to.
+	DeliverSubject string `json:"deliver_subject"`
+	// Optional chunk size preference.
+	ChunkSize int `json:"chunk_size,omitempty"`
+	// Compress the export with S2.
+	Compress bool `json:"compress,omitempty"`
+}
+
+// JSApiStreamExportResponse is the direct response to the export request.
+type JSApiStreamExportResponse struct {
+	ApiResponse
+	// Configuration of the given stream.
+	Config *StreamConfig `json:"config,omitempty"`
+	// State of the given stream at the start of the export.
+	State *StreamState `json:"state,omitempty"`
+}
+
+const JSApiStreamExportResponseType = "io.nats.jetstream.api.v1.stream_export_response"
+
+// JSApiStreamImportRequest is the optional request to create a stream from an export.
+type JSApiStreamImportRequest struct {
+	// Configuration of the new stream, defaults to the one in the export.
+	Config *StreamConfig `json:"config,omitempty"`
+	// Store messages with new sequences from the start of the stream instead of their own.
+	Renumber bool `json:"renumber,omitempty"`
+}
+
+// JSApiStreamImportResponse is the direct response to the import request.
+type JSApiStreamImportResponse struct {
+	ApiResponse
+	// Subject to deliver the chunks of the export to.
+	DeliverSubject string `json:"deliver_subject"`
+}
+
+const JSApiStreamImportResponseType = "io.nats.jetstream.api.v1.stream_import_response"
+
+// JSApiStreamVerifyRequest is the optional request to verify the replicas of a stream.
+type JSApiStreamVerifyRequest struct {
+	// Range of sequences to verify, defaults to all messages of the leader.
+	StartSeq uint64 `json:"start_seq,omitempty"`
+	EndSeq   uint64 `json:"end_seq,omitempty"`
+	// Number of sequences checksummed together, mismatches are reported in these ranges.
+	// This is raised for long ranges to limit the number of chunks.
+	ChunkSize uint64 `json:"chunk_size,omitempty"`
+	// Reset replicas that do not match the leader, they will catch up from the leader.
+	Repair bool `json:"repair,omitempty"`
+}
+
+// JSApiStreamVerifyResponse is the response to verifying the replicas of a stream.
+type JSApiStreamVerifyResponse struct {
+	ApiResponse
+	Stream     string                `json:"stream,omitempty"`
+	StartSeq   uint64                `json:"start_seq,omitempty"`
+	EndSeq     uint64                `json:"end_seq,omitempty"`
+	ChunkSize  uint64                `json:"chunk_size,omitempty"`
+	Leader     string                `json:"leader,omitempty"`
+	Checksum   string                `json:"checksum,omitempty"`
+	Replicas   []*StreamReplicaCheck `json:"replicas,omitempty"`
+	Consistent bool                  `json:"consistent"`
+}
+
+// StreamReplicaCheck is the result of verifying a replica against the leader.
+type StreamReplicaCheck struct {
+	Name       string           `json:"name"`
+	Checksum   string           `json:"checksum,omitempty"`
+	Mismatches []*SequenceRange `json:"mismatches,omitempty"`
+	Error      string           `json:"error,omitempty"`
+	Repairing  bool             `json:"repairing,omitempty"`
+}
+
+// SequenceRange is an inclusive range of stream sequences.
+type SequenceRange struct {
+	First uint64 `json:"first"`
+	Last  uint64 `json:"last"`
+}
+
+const JSApiStreamVerifyResponseType = "io.nats.jetstream.api.v1.stream_verify_response"
+
 // JSApiStreamRemovePeerRequest is the required remove peer request.
 type JSApiStreamRemovePeerRequest struct {
 	// Server name of the peer to be removed.
@@ -621,6 +780,10 @@ type JSApiMsgGetRequest struct {
 	Seq     uint64 `json:"seq,omitempty"`
 	LastFor string `json:"last_by_subj,omitempty"`
 	NextFor string `json:"next_by_subj,omitempty"`
+	// Header and Value select the first message at or after Seq
+	// that has this value for one of the stream's indexed headers.
+	Header string `json:"header,omitempty"`
+	Value  string `json:"value,omitempty"`
 }
 
 type JSApiMsgGetResponse struct {
@@ -844,6 +1007,11 @@ func (s *Server) setJetStreamExportSubs() error {
 		{JSApiStreamPurge, s.jsStreamPurgeRequest},
 		{JSApiStreamSnapshot, s.jsStreamSnapshotRequest},
 		{JSApiStreamRestore, s.jsStreamRestoreRequest},
+		{JSApiStreamBackupRestore, s.jsStreamBackupRestoreRequest},
+		{JSApiStreamPointInTime, s.jsStreamPointInTimeRequest},
+		{JSApiStreamExport, s.jsStreamExportRequest},
+		{JSApiStreamImport, s.jsStreamImportRequest},
+		{JSApiStreamVerify, s.jsStreamVerifyRequest},
 		{JSApiStreamRemovePeer, s.jsStreamRemovePeerRequest},
 		{JSApiStreamLeaderStepDown, s.jsStreamLeaderStepDownRequest},
 		{JSApiConsumerLeaderStepDown, s.jsConsumerLeaderStepDownRequest},
@@ -1253,19 +1421,15 @@ func (jsa *jsAccount) tieredReservation(tier string, cfg *StreamConfig) int64 {
 	reservation := int64(0)
 	if tier == _EMPTY_ {
 		for _, sa := range jsa.streams {
-			if sa.cfg.MaxBytes > 0 {
-				if sa.cfg.Storage == cfg.Storage && sa.cfg.Name != cfg.Name {
-					reservation += (int64(sa.cfg.Replicas) * sa.cfg.MaxBytes)
-				}
+			if sa.cfg.Name != cfg.Name {
+				reservation += (int64(sa.cfg.Replicas) * streamReservation(&sa.cfg, cfg.Storage))
 			}
 		}
 	} else {
 		for _, sa := range jsa.streams {
 			if sa.cfg.Replicas == cfg.Replicas {
-				if sa.cfg.MaxBytes > 0 {
-					if isSameTier(&sa.cfg, cfg) && sa.cfg.Name != cfg.Name {
-						reservation += (int64(sa.cfg.Replicas) * sa.cfg.MaxBytes)
-					}
+				if isSameTier(&sa.cfg, cfg) && sa.cfg.Name != cfg.Name {
+					reservation += (int64(sa.cfg.Replicas) * streamReservation(&sa.cfg, cfg.Storage))
 				}
 			}
 		}
@@ -1346,6 +1510,14 @@ func (s *Server) jsStreamCreateRequest(sub *subscription, c *client, _ *Account,
 		return
 	}
 
+	// The account we republish into needs to import from us. Streams resolve this again
+	// when republishing, since it can fail while recovering before accounts are resolved.
+	if _, _, err := s.republishImport(acc, cfg.RePublish); err != nil {
+		resp.Error = NewJSStreamInvalidConfigError(err)
+		s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+		return
+	}
+
 	// Hand off to cluster for processing.
 	if s.JetStreamIsClustered() {
 		s.jsClusteredStreamRequest(ci, acc, subject, reply, rmsg, &cfg)
@@ -1682,12 +1854,16 @@ func (s *Server) jsStreamListRequest(sub *subscription, c *client, _ *Account, s
 	for _, mset := range msets[offset:] {
 		config := mset.config()
 		resp.Streams = append(resp.Streams, &StreamInfo{
-			Created: mset.createdTime(),
-			State:   mset.state(),
-			Config:  config,
-			Domain:  s.getOpts().JetStreamDomain,
-			Mirror:  mset.mirrorInfo(),
-			Sources: mset.sourcesInfo(),
+			Created:          mset.createdTime(),
+			State:            mset.state(),
+			Config:           config,
+			Domain:           s.getOpts().JetStreamDomain,
+			Mirror:           mset.mirrorInfo(),
+			Sources:          mset.sourcesInfo(),
+			Schema:           mset.schemaStats(),
+			Tiers:            mset.storageTiers(),
+			RePublishError:   mset.republishError(),
+			RePublishDropped: mset.republishDropped(),
 		})
 		if len(resp.Streams) >= JSApiListLimit {
 			break
@@ -1834,14 +2010,18 @@ func (s *Server) jsStreamInfoRequest(sub *subscription, c *client, a *Account, s
 	js, _ := s.getJetStreamCluster()
 
 	resp.StreamInfo = &StreamInfo{
-		Created:    mset.createdTime(),
-		State:      mset.stateWithDetail(details),
-		Config:     config,
-		Domain:     s.getOpts().JetStreamDomain,
-		Cluster:    js.clusterInfo(mset.raftGroup()),
-		Mirror:     mset.mirrorInfo(),
-		Sources:    mset.sourcesInfo(),
-		Alternates: js.streamAlternates(ci, config.Name),
+		Created:          mset.createdTime(),
+		State:            mset.stateWithDetail(details),
+		Config:           config,
+		Domain:           s.getOpts().JetStreamDomain,
+		Cluster:          js.clusterInfo(mset.raftGroup()),
+		Mirror:           mset.mirrorInfo(),
+		Sources:          mset.sourcesInfo(),
+		Alternates:       js.streamAlternates(ci, config.Name),
+		Schema:           mset.schemaStats(),
+		Tiers:            mset.storageTiers(),
+		RePublishError:   mset.republishError(),
+		RePublishDropped: mset.republishDropped(),
 	}
 	if clusterWideConsCount > 0 {
 		resp.StreamInfo.State.Consumers = clusterWideConsCount
@@ -3019,7 +3199,7 @@ func (s *Server) jsMsgGetRequest(sub *subscription, c *client, _ *Account, subje
 	}
 
 	// Check that we do not have both options set.
-	if req.Seq > 0 && req.LastFor != _EMPTY_ || req.Seq == 0 && req.LastFor == _EMPTY_ && req.NextFor == _EMPTY_ {
+	if req.Seq > 0 && req.LastFor != _EMPTY_ || req.Seq == 0 && req.LastFor == _EMPTY_ && req.NextFor == _EMPTY_ && req.Header == _EMPTY_ {
 		resp.Error = NewJSBadRequestError()
 		s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
 		return
@@ -3030,6 +3210,12 @@ func (s *Server) jsMsgGetRequest(sub *subscription, c *client, _ *Account, subje
 		s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
 		return
 	}
+	// Check that a header is not combined with a subject, and that a value has a header.
+	if req.Header != _EMPTY_ && (req.LastFor != _EMPTY_ || req.NextFor != _EMPTY_) || req.Header == _EMPTY_ && req.Value != _EMPTY_ {
+		resp.Error = NewJSBadRequestError()
+		s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+		return
+	}
 
 	mset, err := acc.lookupStream(stream)
 	if err != nil {
@@ -3041,13 +3227,20 @@ func (s *Server) jsMsgGetRequest(sub *subscription, c *client, _ *Account, subje
 	var svp StoreMsg
 	var sm *StoreMsg
 
-	if req.Seq > 0 && req.NextFor == _EMPTY_ {
+	if req.Header != _EMPTY_ {
+		sm, err = loadNextMsgByHeader(mset.store, req.Header, req.Value, req.Seq, &svp)
+	} else if req.Seq > 0 && req.NextFor == _EMPTY_ {
 		sm, err = mset.store.LoadMsg(req.Seq, &svp)
 	} else if req.NextFor != _EMPTY_ {
 		sm, _, err = mset.store.LoadNextMsg(req.NextFor, subjectHasWildcard(req.NextFor), req.Seq, &svp)
 	} else {
 		sm, err = mset.store.LoadLastMsg(req.LastFor, &svp)
 	}
+	if err == ErrHeaderNotIndexed {
+		resp.Error = NewJSStreamHeaderNotIndexedError(req.Header)
+		s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+		return
+	}
 	if err != nil {
 		resp.Error = NewJSNoMessageFoundError()
 		s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
@@ -3200,6 +3393,12 @@ func (acc *Account) jsNonClusteredStreamLimitsCheck(cfg *StreamConfig) *ApiError
 	if err := jsa.js.checkAllLimits(selectedLimits, cfg, reserved, 0); err != nil {
 		return NewJSStreamLimitsError(err, Unless(err))
 	}
+	if cfg.Storage == HybridStorage {
+		mcfg := memoryTierConfig(cfg)
+		if err := jsa.js.checkAllLimits(selectedLimits, mcfg, jsa.tieredReservation(tier, mcfg), 0); err != nil {
+			return NewJSStreamLimitsError(err, Unless(err))
+		}
+	}
 	return nil
 }
 
@@ -3604,19 +3803,21 @@ const defaultSnapshotWindowSize = 8 * 1024 * 1024 // 8MB
 
 // streamSnapshot will stream out our snapshot to the reply subject.
 func (s *Server) streamSnapshot(ci *ClientInfo, acc *Account, mset *stream, sr *SnapshotResult, req *JSApiStreamSnapshotRequest) {
-	chunkSize := req.ChunkSize
+	s.streamChunks(acc, mset, sr.Reader, req.DeliverSubject, req.ChunkSize)
+}
+
+// streamChunks will stream out the contents of the reader in chunks to the reply subject,
+// with a nil chunk as EOF, using acks from the receiver for flow control.
+func (s *Server) streamChunks(acc *Account, mset *stream, r io.ReadCloser, reply string, chunkSize int) {
 	if chunkSize == 0 {
 		chunkSize = defaultSnapshotChunkSize
 	}
-	// Setup for the chunk stream.
-	reply := req.DeliverSubject
-	r := sr.Reader
 	defer r.Close()
 
-	// Check interest for the snapshot deliver subject.
+	// Check interest for the deliver subject.
 	inch := make(chan bool, 1)
-	acc.sl.RegisterNotification(req.DeliverSubject, inch)
-	defer acc.sl.ClearNotification(req.DeliverSubject, inch)
+	acc.sl.RegisterNotification(reply, inch)
+	defer acc.sl.ClearNotification(reply, inch)
 	hasInterest := <-inch
 	if !hasInterest {
 		// Allow 2 seconds or so for interest to show up.
@@ -0,0 +1,693 @@
+// Copyright 2023 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AutoStreamConfig will have a stream created on demand for the first message
+// published on a subject matching Subject when no stream exists yet.
+// The stream name, subjects and description in Config can refer to the wildcard
+// tokens of the published subject with {{wildcard(n)}}. Streams that have not
+// received any messages for IdleTTL will be deleted again.
+type AutoStreamConfig struct {
+	Subject string        `json:"subject"`
+	Config  StreamConfig  `json:"config"`
+	IdleTTL time.Duration `json:"idle_ttl,omitempty"`
+}
+
+const (
+	// Queue group for the auto stream subscriptions, so only one server handles a message.
+	autoStreamsQueue = "_jsauto"
+	// Prefix for the API responses to auto stream requests.
+	autoStreamsReplyPrefix = "$JSC.AUTO"
+	// Prefix for messages held while a stream was created, followed by the stream name and subject.
+	// These are stored by the stream leader only, since others received them when published.
+	autoStreamsStorePrefix = "$JSC.AUTO.STORE"
+	// How many messages we hold per stream while it is being created.
+	autoStreamMaxPending = 1024
+	// How long we wait for a stream to be created and have interest.
+	autoStreamCreateTimeout = 10 * time.Second
+	// How many subjects we remember as already being stored by a stream.
+	autoStreamMaxKnown = 8192
+)
+
+// How often we check for pending creates and idle streams.
+var autoStreamsTick = time.Second
+
+var autoStreamWildcardRegEx = regexp.MustCompile(`{{\s*[wW]ildcard\s*\(\s*(\d+)\s*\)\s*}}`)
+
+// validateAutoStreamConfig checks the template without the full stream checks,
+// which happen when the stream is created.
+func validateAutoStreamConfig(asc *AutoStreamConfig) error {
+	if !IsValidSubject(asc.Subject) {
+		return fmt.Errorf("auto stream subject %q is not valid", asc.Subject)
+	}
+	if asc.Config.Name == _EMPTY_ {
+		return fmt.Errorf("auto stream for %q requires a stream name", asc.Subject)
+	}
+	if asc.Config.Mirror != nil {
+		return fmt.Errorf("auto stream for %q can not be a mirror", asc.Subject)
+	}
+	if asc.IdleTTL < 0 {
+		return fmt.Errorf("auto stream for %q has a negative idle ttl", asc.Subject)
+	}
+	var npwcs int
+	for _, t := range strings.Split(asc.Subject, tsep) {
+		if t == pwcs {
+			npwcs++
+		}
+	}
+	check := func(s string) error {
+		for _, m := range autoStreamWildcardRegEx.FindAllStringSubmatch(s, -1) {
+			if i, _ := strconv.Atoi(m[1]); i < 1 || i > npwcs {
+				return fmt.Errorf("auto stream for %q refers to wildcard %s which does not exist", asc.Subject, m[1])
+			}
+		}
+		return nil
+	}
+	if err := check(asc.Config.Name); err != nil {
+		return err
+	}
+	for _, subj := range asc.Config.Subjects {
+		if err := check(subj); err != nil {
+			return err
+		}
+	}
+	return check(asc.Config.Description)
+}
+
+// autoStreamTemplate is a compiled AutoStreamConfig.
+type autoStreamTemplate struct {
+	cfg    *AutoStreamConfig
+	tokens []string
+	// Matches the names of streams created from this template.
+	names *regexp.Regexp
+}
+
+func newAutoStreamTemplate(asc *AutoStreamConfig) (*autoStreamTemplate, error) {
+	if err := validateAutoStreamConfig(asc); err != nil {
+		return nil, err
+	}
+	var sb strings.Builder
+	sb.WriteByte('^')
+	name, last := asc.Config.Name, 0
+	for _, loc := range autoStreamWildcardRegEx.FindAllStringIndex(name, -1) {
+		sb.WriteString(regexp.QuoteMeta(name[last:loc[0]]))
+		sb.WriteString(".+")
+		last = loc[1]
+	}
+	sb.WriteString(regexp.QuoteMeta(name[last:]))
+	sb.WriteByte('$')
+	return &autoStreamTemplate{
+		cfg:    asc,
+		tokens: strings.Split(asc.Subject, tsep),
+		names:  regexp.MustCompile(sb.String()),
+	}, nil
+}
+
+// expand substitutes the wildcard references in s with the tokens from subject.
+func (t *autoStreamTemplate) expand(s string, wcs []string) string {
+	return autoStreamWildcardRegEx.ReplaceAllStringFunc(s, func(m string) string {
+		i, _ := strconv.Atoi(autoStreamWildcardRegEx.FindStringSubmatch(m)[1])
+		if i < 1 || i > len(wcs) {
+			return m
+		}
+		return wcs[i-1]
+	})
+}
+
+// wildcards returns the tokens of the subject matching our partial wildcards.
+func (t *autoStreamTemplate) wildcards(subject string) []string {
+	var wcs []string
+	for i, tk := range strings.Split(subject, tsep) {
+		if i < len(t.tokens) && t.tokens[i] == pwcs {
+			wcs = append(wcs, tk)
+		}
+	}
+	return wcs
+}
+
+// name returns the name of the stream for the subject.
+func (t *autoStreamTemplate) name(subject string) string {
+	return t.expand(t.cfg.Config.Name, t.wildcards(subject))
+}
+
+// streamConfig returns the stream config for the subject.
+func (t *autoStreamTemplate) streamConfig(subject string) *StreamConfig {
+	wcs := t.wildcards(subject)
+	cfg := t.cfg.Config
+	cfg.Name = t.expand(cfg.Name, wcs)
+	cfg.Description = t.expand(cfg.Description, wcs)
+	// Mark the stream as ours, so we will never expire streams created otherwise.
+	cfg.AutoStream = t.cfg.Subject
+	if len(cfg.Subjects) == 0 {
+		// Default is our subject with the wildcards filled in.
+		tokens := append([]string(nil), t.tokens...)
+		for i, j := 0, 0; i < len(tokens) && j < len(wcs); i++ {
+			if tokens[i] == pwcs {
+				tokens[i] = wcs[j]
+				j++
+			}
+		}
+		cfg.Subjects = []string{strings.Join(tokens, tsep)}
+	} else {
+		subjects := make([]string, 0, len(cfg.Subjects))
+		for _, subj := range cfg.Subjects {
+			subjects = append(subjects, t.expand(subj, wcs))
+		}
+		cfg.Subjects = subjects
+	}
+	return &cfg
+}
+
+// Holds the messages for a stream that is being created.
+type autoStreamPending struct {
+	msgs    []*inMsg
+	created bool
+	start   time.Time
+}
+
+// autoStreams creates streams on demand for an account and removes them again when idle.
+type autoStreams struct {
+	mu        sync.Mutex
+	srv       *Server
+	jsa       *jsAccount
+	acc       *Account
+	templates []*autoStreamTemplate
+	c         *client
+	subs      []*subscription
+	inbox     string
+	pending   map[string]*autoStreamPending
+	deleting  map[string]time.Time
+	// Subjects already stored by a stream, so publishes skip the lookups.
+	// Maps to the stream name and is re-checked by our loop.
+	known autoStreamKnown
+	msgs  *ipQueue[*inMsg]
+	resps *ipQueue[*inMsg]
+	qch   chan struct{}
+}
+
+// autoStreamKnown maps subjects already stored by a stream to the stream name.
+// Once full, the current subjects become the previous ones and subjects still
+// published to move back, so we keep working without growing any further.
+type autoStreamKnown struct {
+	mu   sync.RWMutex
+	cur  map[string]string
+	prev map[string]string
+}
+
+// get returns the stream name for the subject, if known.
+func (k *autoStreamKnown) get(subject string) (string, bool) {
+	k.mu.RLock()
+	name, ok := k.cur[subject]
+	if ok {
+		k.mu.RUnlock()
+		return name, true
+	}
+	name, ok = k.prev[subject]
+	k.mu.RUnlock()
+	if ok {
+		k.set(subject, name)
+	}
+	return name, ok
+}
+
+// set remembers the stream name for the subject.
+func (k *autoStreamKnown) set(subject, name string) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if _, ok := k.cur[subject]; !ok && len(k.cur) >= autoStreamMaxKnown/2 {
+		k.prev, k.cur = k.cur, nil
+	}
+	if k.cur == nil {
+		k.cur = make(map[string]string)
+	}
+	k.cur[subject] = name
+	delete(k.prev, subject)
+}
+
+// entries returns a copy of all known subjects with their stream names.
+func (k *autoStreamKnown) entries() map[string]string {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	m := make(map[string]string, len(k.cur)+len(k.prev))
+	for subject, name := range k.prev {
+		m[subject] = name
+	}
+	for subject, name := range k.cur {
+		m[subject] = name
+	}
+	return m
+}
+
+// remove forgets the subjects for which f returns true.
+func (k *autoStreamKnown) remove(f func(subject, name string) bool) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	for _, m := range []map[string]string{k.cur, k.prev} {
+		for subject, name := range m {
+			if f(subject, name) {
+				delete(m, subject)
+			}
+		}
+	}
+}
+
+// startAutoStreams will setup the auto stream templates for the account, if any.
+func (jsa *jsAccount) startAutoStreams(ascs []*AutoStreamConfig) error {
+	if len(ascs) == 0 {
+		return nil
+	}
+	jsa.mu.RLock()
+	s, acc := jsa.js.srv, jsa.account
+	jsa.mu.RUnlock()
+
+	if !s.EventsEnabled() {
+		return ErrNoSysAccount
+	}
+
+	as := &autoStreams{
+		srv:      s,
+		jsa:      jsa,
+		acc:      acc,
+		c:        s.createInternalJetStreamClient(),
+		inbox:    syncSubject(autoStreamsReplyPrefix),
+		pending:  make(map[string]*autoStreamPending),
+		deleting: make(map[string]time.Time),
+		qch:      make(chan struct{}),
+	}
+	for _, asc := range ascs {
+		t, err := newAutoStreamTemplate(asc)
+		if err != nil {
+			return err
+		}
+		as.templates = append(as.templates, t)
+	}
+	qpfx := fmt.Sprintf("[ACC:%s] auto streams ", acc.Name)
+	as.msgs = newIPQueue[*inMsg](s, qpfx+"messages")
+	as.resps = newIPQueue[*inMsg](s, qpfx+"responses")
+	as.c.registerWithAccount(acc)
+
+	sid := 1
+	for _, t := range as.templates {
+		sub, err := as.c.processSub([]byte(t.cfg.Subject), []byte(autoStreamsQueue), []byte(strconv.Itoa(sid)), as.processInboundMsg, false)
+		if err != nil {
+			as.stop()
+			return err
+		}
+		as.subs = append(as.subs, sub)
+		sid++
+	}
+	sub, err := as.c.processSub([]byte(as.inbox+".*"), nil, []byte(strconv.Itoa(sid)), as.processResponse, false)
+	if err != nil {
+		as.stop()
+		return err
+	}
+	as.subs = append(as.subs, sub)
+	sid++
+	sub, err = as.c.processSub([]byte(autoStreamsStorePrefix+".>"), nil, []byte(strconv.Itoa(sid)), as.processStore, false)
+	if err != nil {
+		as.stop()
+		return err
+	}
+	as.subs = append(as.subs, sub)
+
+	jsa.mu.Lock()
+	jsa.auto = as
+	jsa.mu.Unlock()
+
+	go as.loop()
+	return nil
+}
+
+// stop will remove our subscriptions and stop the loop.
+func (as *autoStreams) stop() {
+	as.mu.Lock()
+	defer as.mu.Unlock()
+	if as.c == nil {
+		return
+	}
+	for _, sub := range as.subs {
+		as.c.processUnsub(sub.sid)
+	}
+	as.c.closeConnection(ClientClosed)
+	as.c, as.subs = nil, nil
+	as.msgs.unregister()
+	as.resps.unregister()
+	close(as.qch)
+}
+
+// lookupTemplate returns the template and stream name for the subject if the stream does not exist.
+// If it exists, returns no template and the name of the stream, empty if created otherwise.
+func (as *autoStreams) lookupTemplate(subject string) (*autoStreamTemplate, string) {
+	if name, ok := as.known.get(subject); ok {
+		return nil, name
+	}
+	for _, t := range as.templates {
+		if !subjectIsSubsetMatch(subject, t.cfg.Subject) {
+			continue
+		}
+		name := t.name(subject)
+		if as.streamExists(name) {
+			as.known.set(subject, name)
+			return nil, name
+		}
+		return t, name
+	}
+	return nil, _EMPTY_
+}
+
+// forgetKnown removes the subjects of the stream from our known subjects.
+func (as *autoStreams) forgetKnown(name string) {
+	as.known.remove(func(_, sname string) bool { return sname == name })
+}
+
+// checkKnown removes subjects whose streams no longer exist, e.g. deleted by a user.
+func (as *autoStreams) checkKnown() {
+	gone := make(map[string]struct{})
+	for subject, name := range as.known.entries() {
+		if (name == _EMPTY_ || !as.streamExists(name)) && !as.subjectsTaken(subject) {
+			gone[subject] = struct{}{}
+		}
+	}
+	if len(gone) > 0 {
+		as.known.remove(func(subject, _ string) bool {
+			_, ok := gone[subject]
+			return ok
+		})
+	}
+}
+
+// streamExists checks if the stream exists, or in clustered mode has been assigned.
+func (as *autoStreams) streamExists(name string) bool {
+	js := as.jsa.js
+	if js.isClustered() {
+		js.mu.RLock()
+		sa := js.streamAssignment(as.acc.Name, name)
+		js.mu.RUnlock()
+		return sa != nil
+	}
+	_, err := as.acc.lookupStream(name)
+	return err == nil
+}
+
+// subjectsTaken returns true if any existing stream already stores messages for the subject.
+func (as *autoStreams) subjectsTaken(subject string) bool {
+	js := as.jsa.js
+	if js.isClustered() {
+		js.mu.RLock()
+		defer js.mu.RUnlock()
+		for _, sa := range js.cluster.streams[as.acc.Name] {
+			for _, subj := range sa.Config.Subjects {
+				if subjectIsSubsetMatch(subject, subj) {
+					return true
+				}
+			}
+		}
+		return false
+	}
+	for _, mset := range as.acc.streams() {
+		for _, subj := range mset.config().Subjects {
+			if subjectIsSubsetMatch(subject, subj) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// processInboundMsg is called for messages on our template subjects.
+// Messages for streams that do not exist yet are queued for our loop.
+func (as *autoStreams) processInboundMsg(_ *subscription, c *client, _ *Account, subject, reply string, rmsg []byte) {
+	if t, _ := as.lookupTemplate(subject); t == nil {
+		return
+	}
+	hdr, msg := c.msgParts(copyBytes(rmsg))
+	as.msgs.push(&inMsg{subj: subject, rply: reply, hdr: hdr, msg: msg})
+}
+
+// processStore is called for messages held while their stream was created.
+// Only the stream leader stores them, others will ignore them.
+func (as *autoStreams) processStore(_ *subscription, c *client, _ *Account, subject, reply string, rmsg []byte) {
+	rest := strings.TrimPrefix(subject, autoStreamsStorePrefix+tsep)
+	i := strings.IndexByte(rest, btsep)
+	if i < 0 {
+		return
+	}
+	mset, err := as.acc.lookupStream(rest[:i])
+	if err != nil || !mset.isLeader() {
+		return
+	}
+	hdr, msg := c.msgParts(rmsg)
+	mset.queueInboundMsg(rest[i+1:], reply, hdr, msg)
+}
+
+// store has the stream store a held message without delivering it to anyone else again.
+func (as *autoStreams) store(name string, im *inMsg) {
+	// We do not receive our own messages, so store directly if we are the leader.
+	if mset, err := as.acc.lookupStream(name); err == nil && mset.isLeader() {
+		mset.queueInboundMsg(im.subj, im.rply, im.hdr, im.msg)
+		return
+	}
+	as.send(fmt.Sprintf("%s.%s.%s", autoStreamsStorePrefix, name, im.subj), im.rply, im.hdr, im.msg)
+}
+
+// processResponse is called for API responses to our create and delete requests.
+func (as *autoStreams) processResponse(_ *subscription, c *client, _ *Account, subject, _ string, rmsg []byte) {
+	_, msg := c.msgParts(rmsg)
+	as.resps.push(&inMsg{subj: subject, msg: copyBytes(msg)})
+}
+
+func (as *autoStreams) loop() {
+	t := time.NewTicker(autoStreamsTick)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-as.qch:
+			return
+		case <-as.msgs.ch:
+			for _, im := range as.msgs.pop() {
+				as.queueMsg(im)
+			}
+			as.msgs.recycle(nil)
+		case <-as.resps.ch:
+			for _, im := range as.resps.pop() {
+				as.handleResponse(im)
+			}
+			as.resps.recycle(nil)
+		case <-t.C:
+			as.checkPending()
+			as.checkIdle()
+			as.checkKnown()
+		}
+	}
+}
+
+// queueMsg will hold on to the message and create the stream for it if needed.
+func (as *autoStreams) queueMsg(im *inMsg) {
+	t, name := as.lookupTemplate(im.subj)
+	if t == nil {
+		// Stream has been created since, so have it store the message.
+		if name != _EMPTY_ {
+			as.store(name, im)
+		}
+		return
+	}
+	if p := as.pending[name]; p != nil {
+		if len(p.msgs) < autoStreamMaxPending {
+			p.msgs = append(p.msgs, im)
+		} else {
+			as.respondError(im, NewJSStreamNotFoundError())
+		}
+		return
+	}
+	// If another stream already covers the subject it will store the message.
+	if as.subjectsTaken(im.subj) {
+		as.known.set(im.subj, _EMPTY_)
+		return
+	}
+
+	as.pending[name] = &autoStreamPending{msgs: []*inMsg{im}, start: time.Now()}
+
+	cfg := t.streamConfig(im.subj)
+	b, err := json.Marshal(cfg)
+	if err != nil {
+		delete(as.pending, name)
+		as.srv.RateLimitWarnf("JetStream could not create stream '%s > %s': %v", as.acc.Name, name, err)
+		as.respondError(im, NewJSStreamCreateError(err, Unless(err)))
+		return
+	}
+	as.send(fmt.Sprintf(JSApiStreamCreateT, name), fmt.Sprintf("%s.%s", as.inbox, name), nil, b)
+	as.srv.Debugf("JetStream creating stream '%s > %s' for subject %q", as.acc.Name, name, im.subj)
+}
+
+// handleResponse processes the API response for a stream create or delete.
+func (as *autoStreams) handleResponse(im *inMsg) {
+	name := tokenAt(im.subj, uint8(numTokens(im.subj)))
+	if _, ok := as.deleting[name]; ok {
+		delete(as.deleting, name)
+		var resp JSApiStreamDeleteResponse
+		if err := json.Unmarshal(im.msg, &resp); err != nil || resp.Error != nil {
+			as.srv.RateLimitWarnf("JetStream could not delete idle stream '%s > %s': %v", as.acc.Name, name, resp.Error)
+		}
+		return
+	}
+	p := as.pending[name]
+	if p == nil {
+		return
+	}
+	var resp JSApiStreamCreateResponse
+	if err := json.Unmarshal(im.msg, &resp); err != nil {
+		resp.Error = NewJSInvalidJSONError()
+	}
+	if resp.Error != nil && !IsNatsErr(resp.Error, JSStreamNameExistErr) {
+		delete(as.pending, name)
+		as.srv.RateLimitWarnf("JetStream could not create stream '%s > %s': %v", as.acc.Name, name, resp.Error)
+		for _, im := range p.msgs {
+			as.respondError(im, resp.Error)
+		}
+		return
+	}
+	p.created = true
+	as.flushPending(name, p)
+}
+
+// flushPending sends the held messages once the stream has interest.
+func (as *autoStreams) flushPending(name string, p *autoStreamPending) {
+	if len(p.msgs) > 0 && !as.hasStreamInterest(p.msgs[0].subj) {
+		return
+	}
+	delete(as.pending, name)
+	for _, im := range p.msgs {
+		as.store(name, im)
+	}
+}
+
+// hasStreamInterest checks for interest in the subject other than our own queue subscriptions.
+// In clustered mode the stream leader's subscription could still be propagating.
+func (as *autoStreams) hasStreamInterest(subject string) bool {
+	as.acc.mu.RLock()
+	sl := as.acc.sl
+	as.acc.mu.RUnlock()
+	if sl == nil {
+		return false
+	}
+	return len(sl.Match(subject).psubs) > 0
+}
+
+// checkPending will retry delivery for created streams and time out creates.
+func (as *autoStreams) checkPending() {
+	for name, p := range as.pending {
+		if p.created {
+			as.flushPending(name, p)
+		}
+		if _, ok := as.pending[name]; ok && time.Since(p.start) > autoStreamCreateTimeout {
+			delete(as.pending, name)
+			as.srv.RateLimitWarnf("JetStream timed out creating stream '%s > %s'", as.acc.Name, name)
+			for _, im := range p.msgs {
+				as.respondError(im, NewJSStreamNotFoundError())
+			}
+		}
+	}
+}
+
+// checkIdle will delete streams we lead that were created from a template and have been idle.
+func (as *autoStreams) checkIdle() {
+	for name, start := range as.deleting {
+		if time.Since(start) > autoStreamCreateTimeout {
+			delete(as.deleting, name)
+		}
+	}
+	for _, mset := range as.acc.streams() {
+		if !mset.isLeader() {
+			continue
+		}
+		mset.mu.RLock()
+		name, from := mset.cfg.Name, mset.cfg.AutoStream
+		mset.mu.RUnlock()
+		if _, ok := as.deleting[name]; ok || from == _EMPTY_ {
+			continue
+		}
+		var ttl time.Duration
+		for _, t := range as.templates {
+			if t.cfg.IdleTTL > 0 && t.cfg.Subject == from && t.names.MatchString(name) {
+				ttl = t.cfg.IdleTTL
+				break
+			}
+		}
+		if ttl == 0 {
+			continue
+		}
+		last := mset.createdTime()
+		if state := mset.state(); state.LastTime.After(last) {
+			last = state.LastTime
+		}
+		if time.Since(last) < ttl {
+			continue
+		}
+		as.deleting[name] = time.Now()
+		as.forgetKnown(name)
+		as.srv.Noticef("JetStream deleting idle stream '%s > %s'", as.acc.Name, name)
+		as.send(fmt.Sprintf(JSApiStreamDeleteT, name), fmt.Sprintf("%s.%s", as.inbox, name), nil, nil)
+	}
+}
+
+// respondError lets the publisher know we could not store the message.
+func (as *autoStreams) respondError(im *inMsg, err *ApiError) {
+	if im.rply == _EMPTY_ {
+		return
+	}
+	b, _ := json.Marshal(&JSPubAckResponse{Error: err})
+	as.send(im.rply, _EMPTY_, nil, b)
+}
+
+// send will publish through our internal client in the account.
+func (as *autoStreams) send(subject, reply string, hdr, msg []byte) {
+	as.mu.Lock()
+	defer as.mu.Unlock()
+	c := as.c
+	if c == nil {
+		return
+	}
+	c.pa.subject = []byte(subject)
+	if reply != _EMPTY_ {
+		c.pa.reply = []byte(reply)
+	} else {
+		c.pa.reply = nil
+	}
+	c.pa.size = len(hdr) + len(msg)
+	c.pa.szb = []byte(strconv.Itoa(c.pa.size))
+	if len(hdr) > 0 {
+		c.pa.hdr = len(hdr)
+		c.pa.hdb = []byte(strconv.Itoa(c.pa.hdr))
+	} else {
+		c.pa.hdr = -1
+		c.pa.hdb = nil
+	}
+	buf := make([]byte, 0, c.pa.size+len(_CRLF_))
+	buf = append(buf, hdr...)
+	buf = append(buf, msg...)
+	buf = append(buf, _CRLF_...)
+	c.processInboundClientMsg(buf)
+	c.pa.szb, c.pa.subject, c.pa.reply = nil, nil, nil
+}
@@ -0,0 +1,435 @@
+// Copyright 2023 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nuid"
+)
+
+// StreamBackupPolicy has the server write snapshots of the streams
+// matching Streams to Dir on a schedule.
+type StreamBackupPolicy struct {
+	// Account to backup streams for, all accounts if empty.
+	Account string
+	// Pattern for the stream names, using shell file name matching.
+	// Memory based streams can not be snapshotted and are skipped.
+	Streams string
+	// Schedule as given in the configuration.
+	Schedule string
+	// Interval between backups, runs are aligned to multiples of it.
+	Interval time.Duration
+	// Directory to write the backups to.
+	Dir string
+	// Number of backups to keep per stream, all if zero.
+	Retain int
+	// Do not include consumers.
+	NoConsumers bool
+}
+
+// StreamBackup is the manifest stored alongside the snapshot data of a backup.
+type StreamBackup struct {
+	ID        string       `json:"id"`
+	Account   string       `json:"account"`
+	Stream    string       `json:"stream"`
+	Config    StreamConfig `json:"config"`
+	State     StreamState  `json:"state"`
+	Created   time.Time    `json:"created"`
+	Consumers bool         `json:"consumers"`
+}
+
+const (
+	// Extensions for the backup manifest and snapshot data.
+	backupManifestExt = ".json"
+	backupDataExt     = ".tar.s2"
+	// Layout for backup ids, sorts by time.
+	backupIDLayout = "20060102T150405.000000000Z"
+)
+
+// parseBackupSchedule parses a cron-like schedule. This can be @hourly,
+// @daily, @weekly, @every <duration> or just a duration.
+func parseBackupSchedule(schedule string) (time.Duration, error) {
+	spec := strings.TrimSpace(schedule)
+	var d time.Duration
+	switch strings.ToLower(spec) {
+	case "@hourly":
+		d = time.Hour
+	case "@daily", "@midnight":
+		d = 24 * time.Hour
+	case "@weekly":
+		d = 7 * 24 * time.Hour
+	default:
+		var err error
+		if strings.HasPrefix(spec, "@every ") {
+			spec = strings.TrimSpace(strings.TrimPrefix(spec, "@every "))
+		}
+		if d, err = time.ParseDuration(spec); err != nil {
+			return 0, fmt.Errorf("invalid backup schedule %q", schedule)
+		}
+	}
+	if d <= 0 {
+		return 0, fmt.Errorf("invalid backup schedule %q", schedule)
+	}
+	return d, nil
+}
+
+// startJetStreamBackups will start the scheduled backups from our options.
+func (s *Server) startJetStreamBackups() {
+	for _, p := range s.getOpts().JetStreamBackups {
+		p := p
+		s.startGoRoutine(func() { s.runBackupPolicy(p) })
+	}
+}
+
+// runBackupPolicy runs the backups for the policy, aligned to its interval.
+func (s *Server) runBackupPolicy(p *StreamBackupPolicy) {
+	defer s.grWG.Done()
+
+	next := func() time.Duration {
+		now := time.Now().UTC()
+		return now.Truncate(p.Interval).Add(p.Interval).Sub(now)
+	}
+	t := time.NewTimer(next())
+	defer t.Stop()
+
+	for {
+		select {
+		case <-s.quitCh:
+			return
+		case <-t.C:
+			if !s.JetStreamEnabled() {
+				return
+			}
+			s.backupStreams(p)
+			t.Reset(next())
+		}
+	}
+}
+
+// backupStreams will backup all streams matching the policy we are the leader for.
+func (s *Server) backupStreams(p *StreamBackupPolicy) {
+	js := s.getJetStream()
+	if js == nil {
+		return
+	}
+	js.mu.RLock()
+	jsas := make([]*jsAccount, 0, len(js.accounts))
+	for _, jsa := range js.accounts {
+		jsas = append(jsas, jsa)
+	}
+	js.mu.RUnlock()
+
+	for _, jsa := range jsas {
+		acc := jsa.acc()
+		if p.Account != _EMPTY_ && acc.Name != p.Account {
+			continue
+		}
+		for _, mset := range acc.streams() {
+			if !mset.isLeader() {
+				continue
+			}
+			if ok, _ := filepath.Match(p.Streams, mset.name()); !ok {
+				continue
+			}
+			// Memory stores do not support snapshots.
+			if mset.config().Storage == MemoryStorage {
+				continue
+			}
+			if _, err := s.backupStream(mset, p); err != nil {
+				s.Warnf("Backup of stream '%s > %s' failed: %v", acc.Name, mset.name(), err)
+			}
+		}
+	}
+}
+
+// backupStream will write a snapshot of the stream to the policy's directory.
+func (s *Server) backupStream(mset *stream, p *StreamBackupPolicy) (*StreamBackup, error) {
+	acc, name := mset.account(), mset.name()
+	dir := filepath.Join(p.Dir, acc.Name, name)
+	if err := os.MkdirAll(dir, defaultDirPerms); err != nil {
+		return nil, err
+	}
+
+	start := time.Now().UTC()
+	sr, err := mset.snapshot(0, false, !p.NoConsumers)
+	if err != nil {
+		return nil, err
+	}
+	sb := &StreamBackup{
+		ID:        start.Format(backupIDLayout),
+		Account:   acc.Name,
+		Stream:    name,
+		Config:    mset.config(),
+		State:     sr.State,
+		Created:   start,
+		Consumers: !p.NoConsumers,
+	}
+
+	s.publishAdvisory(acc, JSAdvisoryStreamSnapshotCreatePre+"."+name, &JSSnapshotCreateAdvisory{
+		TypedEvent: TypedEvent{
+			Type: JSSnapshotCreatedAdvisoryType,
+			ID:   nuid.Next(),
+			Time: start,
+		},
+		Stream: name,
+		State:  sr.State,
+		Domain: s.getOpts().JetStreamDomain,
+	})
+
+	// Write the data first, the manifest makes the backup visible.
+	dfile := filepath.Join(dir, sb.ID+backupDataExt)
+	err = writeFileAtomic(dfile, func(f *os.File) error {
+		_, err := io.Copy(f, sr.Reader)
+		return err
+	})
+	sr.Reader.Close()
+	if err != nil {
+		return nil, err
+	}
+	b, _ := json.Marshal(sb)
+	err = writeFileAtomic(filepath.Join(dir, sb.ID+backupManifestExt), func(f *os.File) error {
+		_, err := f.Write(b)
+		return err
+	})
+	if err != nil {
+		os.Remove(dfile)
+		return nil, err
+	}
+
+	end := time.Now().UTC()
+	s.publishAdvisory(acc, JSAdvisoryStreamSnapshotCompletePre+"."+name, &JSSnapshotCompleteAdvisory{
+		TypedEvent: TypedEvent{
+			Type: JSSnapshotCompleteAdvisoryType,
+			ID:   nuid.Next(),
+			Time: end,
+		},
+		Stream: name,
+		Start:  start,
+		End:    end,
+		Domain: s.getOpts().JetStreamDomain,
+	})
+
+	s.Noticef("Completed backup of %s for stream '%s > %s' to %q in %v",
+		friendlyBytes(int64(sr.State.Bytes)), acc.Name, name, dfile, end.Sub(start))
+
+	if p.Retain > 0 {
+		ids := backupIDs(dir)
+		for len(ids) > p.Retain {
+			os.Remove(filepath.Join(dir, ids[0]+backupDataExt))
+			os.Remove(filepath.Join(dir, ids[0]+backupManifestExt))
+			ids = ids[1:]
+		}
+	}
+	return sb, nil
+}
+
+// writeFileAtomic writes to a temporary file that is renamed once synced.
+func writeFileAtomic(name string, write func(f *os.File) error) error {
+	tmp := name + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, defaultFilePerms)
+	if err != nil {
+		return err
+	}
+	if err = write(f); err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, name)
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
+
+// backupIDs returns the ids of the complete backups in dir, oldest first.
+func backupIDs(dir string) []string {
+	fis, _ := os.ReadDir(dir)
+	var ids []string
+	for _, fi := range fis {
+		if id := strings.TrimSuffix(fi.Name(), backupManifestExt); id != fi.Name() {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// readStreamBackup reads the manifest for the backup file, which can be
+// either the manifest or the snapshot data.
+func readStreamBackup(file string) (*StreamBackup, string, error) {
+	base := strings.TrimSuffix(strings.TrimSuffix(file, backupManifestExt), backupDataExt)
+	b, err := os.ReadFile(base + backupManifestExt)
+	if err != nil {
+		return nil, _EMPTY_, err
+	}
+	var sb StreamBackup
+	if err := json.Unmarshal(b, &sb); err != nil {
+		return nil, _EMPTY_, err
+	}
+	return &sb, base + backupDataExt, nil
+}
+
+// findStreamBackup looks for the backup in our policy directories.
+// With an empty id the most recent backup will be returned.
+func (s *Server) findStreamBackup(acc *Account, stream, id string) (string, error) {
+	var found, foundID string
+	for _, p := range s.getOpts().JetStreamBackups {
+		if p.Account != _EMPTY_ && p.Account != acc.Name {
+			continue
+		}
+		dir := filepath.Join(p.Dir, acc.Name, stream)
+		for _, bid := range backupIDs(dir) {
+			if (id == _EMPTY_ || bid == id) && bid > foundID {
+				found, foundID = filepath.Join(dir, bid+backupManifestExt), bid
+			}
+		}
+	}
+	if found == _EMPTY_ {
+		return _EMPTY_, NewJSStreamBackupNotFoundError()
+	}
+	return found, nil
+}
+
+// restoreStreamBackup will restore the stream from the backup file.
+func (s *Server) restoreStreamBackup(file string) (*stream, *StreamBackup, error) {
+	sb, dfile, err := readStreamBackup(file)
+	if err != nil {
+		return nil, nil, err
+	}
+	acc, err := s.LookupAccount(sb.Account)
+	if err != nil {
+		return nil, nil, err
+	}
+	f, err := os.Open(dfile)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+
+	cfg := sb.Config
+	mset, err := acc.RestoreStream(&cfg, f)
+	if err != nil {
+		return nil, nil, err
+	}
+	return mset, sb, nil
+}
+
+// restoreStreamBackupsOnStartup restores the backups given on the command line.
+// Streams that already exist will not be touched.
+func (s *Server) restoreStreamBackupsOnStartup(files []string) {
+	for _, file := range files {
+		sb, _, err := readStreamBackup(file)
+		if err != nil {
+			s.Warnf("Could not read stream backup %q: %v", file, err)
+			continue
+		}
+		if acc, err := s.LookupAccount(sb.Account); err == nil {
+			if _, err := acc.lookupStream(sb.Stream); err == nil {
+				s.Noticef("Stream '%s > %s' exists, not restoring from backup %q", sb.Account, sb.Stream, file)
+				continue
+			}
+		}
+		if _, _, err := s.restoreStreamBackup(file); err != nil {
+			s.Warnf("Could not restore stream '%s > %s' from backup %q: %v", sb.Account, sb.Stream, file, err)
+			continue
+		}
+		s.Noticef("Restored stream '%s > %s' from backup %q", sb.Account, sb.Stream, file)
+	}
+}
+
+// Request to restore a stream from a scheduled backup.
+func (s *Server) jsStreamBackupRestoreRequest(sub *subscription, c *client, _ *Account, subject, reply string, rmsg []byte) {
+	if c == nil || !s.JetStreamEnabled() {
+		return
+	}
+	ci, acc, _, msg, err := s.getRequestInfo(c, rmsg)
+	if err != nil {
+		s.Warnf(badAPIRequestT, msg)
+		return
+	}
+
+	var resp = JSApiStreamBackupRestoreResponse{ApiResponse: ApiResponse{Type: JSApiStreamBackupRestoreResponseType}}
+
+	// Backups are local to a server, so only supported for non-clustered mode.
+	if s.JetStreamIsClustered() {
+		if s.JetStreamIsLeader() {
+			resp.Error = NewJSStreamBackupRestoreClusteredError()
+			s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+		}
+		return
+	}
+	if !acc.JetStreamEnabled() {
+		resp.Error = NewJSNotEnabledForAccountError()
+		s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+		return
+	}
+
+	var req JSApiStreamBackupRestoreRequest
+	if !isEmptyRequest(msg) {
+		if err := json.Unmarshal(msg, &req); err != nil {
+			resp.Error = NewJSInvalidJSONError()
+			s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+			return
+		}
+	}
+
+	stream := tokenAt(subject, 6)
+	if _, err := acc.lookupStream(stream); err == nil {
+		resp.Error = NewJSStreamNameExistRestoreFailedError()
+		s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+		return
+	}
+	file, err := s.findStreamBackup(acc, stream, req.Backup)
+	if err != nil {
+		resp.Error = NewJSStreamBackupNotFoundError()
+		s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+		return
+	}
+
+	// Restoring can take a while.
+	go func() {
+		mset, sb, err := s.restoreStreamBackup(file)
+		if err != nil {
+			var apiErr *ApiError
+			if errors.As(err, &apiErr) {
+				resp.Error = apiErr
+			} else {
+				resp.Error = NewJSStreamBackupRestoreError(err, Unless(err))
+			}
+			s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+			return
+		}
+		s.Noticef("Restored stream '%s > %s' from backup %q", acc.Name, stream, sb.ID)
+		resp.Backup = sb.ID
+		resp.StreamInfo = &StreamInfo{
+			Created: mset.createdTime(),
+			State:   mset.state(),
+			Config:  mset.config(),
+		}
+		s.sendAPIResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+	}()
+}
@@ -754,6 +754,7 @@ func (js *jetStream) setupMetaGroup() error {
 		StreamConfig{Name: defaultMetaGroupName, Storage: FileStorage},
 		time.Now().UTC(),
 		s.jsKeyGen(defaultMetaGroupName),
+		s.jsOldKeyGen(defaultMetaGroupName),
 	)
 	if err != nil {
 		s.Errorf("Error creating filestore: %v", err)
@@ -1909,7 +1910,8 @@ func (rg *raftGroup) setPreferred() {
 }
 
 // createRaftGroup is called to spin up this raft group if needed.
-func (js *jetStream) createRaftGroup(accName string, rg *raftGroup, storage StorageType) error {
+// The stream config is used by streams so their WAL honors their sync policy, and can be nil.
+func (js *jetStream) createRaftGroup(accName string, rg *raftGroup, storage StorageType, scfg *StreamConfig) error {
 	js.mu.Lock()
 	s, cc := js.srv, js.cluster
 	if cc == nil || cc.meta == nil {
@@ -1953,12 +1955,25 @@ func (js *jetStream) createRaftGroup(accName string, rg *raftGroup, storage Stor
 
 	storeDir := filepath.Join(js.config.StoreDir, sysAcc.Name, defaultStoreDirName, rg.Name)
 	var store StreamStore
-	if storage == FileStorage {
+	if sb := storage.backend(); sb != nil {
+		ss, err := sb.backend.NewStreamStore(storeDir, StreamConfig{Name: rg.Name, Storage: storage})
+		if err != nil {
+			s.Errorf("Error creating %s WAL: %v", sb.name, err)
+			return err
+		}
+		store = ss
+	} else if storage == FileStorage || storage == HybridStorage {
+		// The WAL follows the durability policy of the stream it backs.
+		wcfg := StreamConfig{Name: rg.Name, Storage: FileStorage}
+		if scfg != nil {
+			wcfg.Sync, wcfg.SyncMaxLatency = scfg.Sync, scfg.SyncMaxLatency
+		}
 		fs, err := newFileStoreWithCreated(
 			FileStoreConfig{StoreDir: storeDir, BlockSize: defaultMediumBlockSize, AsyncFlush: false, SyncInterval: 5 * time.Minute},
-			StreamConfig{Name: rg.Name, Storage: FileStorage},
+			wcfg,
 			time.Now().UTC(),
 			s.jsKeyGen(rg.Name),
+			s.jsOldKeyGen(rg.Name),
 		)
 		if err != nil {
 			s.Errorf("Error creating filestore WAL: %v", err)
@@ -2019,6 +2034,29 @@ func (mset *stream) raftNode() RaftNode {
 	return mset.node
 }
 
+// updateWALSyncPolicy applies the durability policy of the stream to our raft WAL,
+// which only picks it up when the raft group is created.
+func (mset *stream) updateWALSyncPolicy(cfg *StreamConfig) error {
+	n, ok := mset.raftNode().(*raft)
+	if !ok {
+		return nil
+	}
+	n.RLock()
+	fs, ok := n.wal.(*fileStore)
+	n.RUnlock()
+	if !ok {
+		return nil
+	}
+	fs.mu.RLock()
+	wcfg := fs.cfg.StreamConfig
+	fs.mu.RUnlock()
+	if wcfg.Sync == cfg.Sync && wcfg.SyncMaxLatency == cfg.SyncMaxLatency {
+		return nil
+	}
+	wcfg.Sync, wcfg.SyncMaxLatency = cfg.Sync, cfg.SyncMaxLatency
+	return fs.UpdateConfig(&wcfg)
+}
+
 func (mset *stream) removeNode() {
 	mset.mu.Lock()
 	defer mset.mu.Unlock()
@@ -2590,7 +2628,7 @@ func (mset *stream) isMigrating() bool {
 func (mset *stream) resetClusteredState(err error) bool {
 	mset.mu.RLock()
 	s, js, jsa, sa, acc, node := mset.srv, mset.js, mset.jsa, mset.sa, mset.acc, mset.node
-	stype, isLeader, tierName := mset.cfg.Storage, mset.isLeader(), mset.tier
+	stype, isLeader, tierName, sdir := mset.cfg.Storage, mset.isLeader(), mset.tier, mset.sdir
 	mset.mu.RUnlock()
 
 	// Stepdown regardless if we are the leader here.
@@ -2611,7 +2649,7 @@ func (mset *stream) resetClusteredState(err error) bool {
 	}
 
 	// Account
-	if exceeded, _ := jsa.limitsExceeded(stype, tierName); exceeded {
+	if exceeded, _ := jsa.limitsExceeded(stype, tierName, sdir); exceeded {
 		s.Warnf("stream '%s > %s' errored, account resources exceeded", acc, mset.name())
 		return false
 	}
@@ -2621,8 +2659,9 @@ func (mset *stream) resetClusteredState(err error) bool {
 		node.Delete()
 	}
 
-	// Preserve our current state and messages unless we have a first sequence mismatch.
-	shouldDelete := err == errFirstSequenceMismatch
+	// Preserve our current state and messages unless we have a first sequence mismatch,
+	// or our messages did not match the leader's.
+	shouldDelete := err == errFirstSequenceMismatch || err == errReplicaMismatch
 
 	// Need to do the rest in a separate Go routine.
 	go func() {
@@ -3304,7 +3343,7 @@ func (js *jetStream) processClusterUpdateStream(acc *Account, osa, sa *streamAss
 		if !alreadyRunning && numReplicas > 1 {
 			if needsNode {
 				mset.setLeader(false)
-				js.createRaftGroup(acc.GetName(), rg, storage)
+				js.createRaftGroup(acc.GetName(), rg, storage, cfg)
 			}
 			mset.monitorWg.Add(1)
 			// Start monitoring..
@@ -3323,6 +3362,8 @@ func (js *jetStream) processClusterUpdateStream(acc *Account, osa, sa *streamAss
 		// Call update.
 		if err = mset.updateWithAdvisory(cfg, !recovering); err != nil {
 			s.Warnf("JetStream cluster error updating stream %q for account %q: %v", cfg.Name, acc.Name, err)
+		} else if err := mset.updateWALSyncPolicy(cfg); err != nil {
+			s.Warnf("JetStream cluster error updating WAL sync policy for stream %q for account %q: %v", cfg.Name, acc.Name, err)
 		}
 		// Set the new stream assignment.
 		mset.setStreamAssignment(sa)
@@ -3404,7 +3445,7 @@ func (js *jetStream) processClusterCreateStream(acc *Account, sa *streamAssignme
 	js.mu.RUnlock()
 
 	// Process the raft group and make sure it's running if needed.
-	err := js.createRaftGroup(acc.GetName(), rg, storage)
+	err := js.createRaftGroup(acc.GetName(), rg, storage, sa.Config)
 
 	// If we are restoring, create the stream if we are R>1 and not the preferred who handles the
 	// receipt of the snapshot itself.
@@ -3468,7 +3509,7 @@ func (js *jetStream) processClusterCreateStream(acc *Account, sa *streamAssignme
 				s.Warnf("JetStream cluster error updating stream %q for account %q: %v", sa.Config.Name, acc.Name, err)
 				if osa != nil {
 					// Process the raft group and make sure it's running if needed.
-					js.createRaftGroup(acc.GetName(), osa.Group, storage)
+					js.createRaftGroup(acc.GetName(), osa.Group, storage, osa.Config)
 					mset.setStreamAssignment(osa)
 				}
 				if rg.node != nil {
@@ -3724,6 +3765,13 @@ func (js *jetStream) processClusterDeleteStream(sa *streamAssignment, isMember,
 	// no op if not empty
 	os.Remove(streamDir)
 	os.Remove(accDir)
+	// Same for a named store directory.
+	if sa.Config.StoreDir != _EMPTY_ {
+		sdir := js.streamStoreDir(sa.Client.serviceAccount(), sa.Config)
+		os.RemoveAll(sdir)
+		os.Remove(filepath.Dir(sdir))
+		os.Remove(filepath.Dir(filepath.Dir(sdir)))
+	}
 
 	// Normally we want only the leader to respond here, but if we had no leader then all members will respond to make
 	// sure we get feedback to the user.
@@ -3974,7 +4022,7 @@ func (js *jetStream) processClusterCreateConsumer(ca *consumerAssignment, state
 			storage = MemoryStorage
 		}
 		// No-op if R1.
-		js.createRaftGroup(accName, rg, storage)
+		js.createRaftGroup(accName, rg, storage, nil)
 	} else {
 		// If we are clustered update the known peers.
 		js.mu.RLock()
@@ -5421,7 +5469,7 @@ func (cc *jetStreamCluster) selectPeerGroup(r int, cluster string, cfg *StreamCo
 		var available uint64
 		var ha int
 		if ni.stats != nil {
-			switch cfg.Storage {
+			switch cfg.Storage.limitsType() {
 			case MemoryStorage:
 				used := ni.stats.ReservedMemory
 				if ni.stats.Memory > used {
@@ -5515,6 +5563,24 @@ func groupName(prefix string, peers []string, storage StorageType) string {
 	return fmt.Sprintf("%s-R%d%s-%s", prefix, len(peers), storage.String()[:1], gns)
 }
 
+// returns the reservation size for this tier in the named store directory of cfg (not including reservations for cfg)
+// jetStream read lock should be held
+func storeDirReservationCount(asa map[string]*streamAssignment, tier string, cfg *StreamConfig) int64 {
+	reservation := int64(0)
+	if cfg.StoreDir == _EMPTY_ {
+		return reservation
+	}
+	for _, sa := range asa {
+		if tier != _EMPTY_ && !isSameTier(sa.Config, cfg) {
+			continue
+		}
+		if sa.Config.StoreDir == cfg.StoreDir && sa.Config.Name != cfg.Name && sa.Config.MaxBytes > 0 {
+			reservation += (int64(sa.Config.Replicas) * sa.Config.MaxBytes)
+		}
+	}
+	return reservation
+}
+
 // returns stream count for this tier as well as applicable reservation size (not including reservations for cfg)
 // jetStream read lock should be held
 func tieredStreamAndReservationCount(asa map[string]*streamAssignment, tier string, cfg *StreamConfig) (int, int64) {
@@ -5522,10 +5588,8 @@ func tieredStreamAndReservationCount(asa map[string]*streamAssignment, tier stri
 	reservation := int64(0)
 	if tier == _EMPTY_ {
 		for _, sa := range asa {
-			if sa.Config.MaxBytes > 0 && sa.Config.Name != cfg.Name {
-				if sa.Config.Storage == cfg.Storage {
-					reservation += (int64(sa.Config.Replicas) * sa.Config.MaxBytes)
-				}
+			if sa.Config.Name != cfg.Name {
+				reservation += (int64(sa.Config.Replicas) * streamReservation(sa.Config, cfg.Storage))
 			}
 		}
 	} else {
@@ -5533,10 +5597,8 @@ func tieredStreamAndReservationCount(asa map[string]*streamAssignment, tier stri
 		for _, sa := range asa {
 			if isSameTier(sa.Config, cfg) {
 				numStreams++
-				if sa.Config.MaxBytes > 0 {
-					if sa.Config.Storage == cfg.Storage && sa.Config.Name != cfg.Name {
-						reservation += (int64(sa.Config.Replicas) * sa.Config.MaxBytes)
-					}
+				if sa.Config.Name != cfg.Name {
+					reservation += (int64(sa.Config.Replicas) * streamReservation(sa.Config, cfg.Storage))
 				}
 			}
 		}
@@ -5617,6 +5679,16 @@ func (js *jetStream) jsClusteredStreamLimitsCheck(acc *Account, cfg *StreamConfi
 	if err := js.checkAccountLimits(selectedLimits, cfg, reservations); err != nil {
 		return NewJSStreamLimitsError(err, Unless(err))
 	}
+	if cfg.Storage == HybridStorage {
+		mcfg := memoryTierConfig(cfg)
+		_, memReservations := tieredStreamAndReservationCount(asa, tier, mcfg)
+		if err := js.checkAccountLimits(selectedLimits, mcfg, memReservations); err != nil {
+			return NewJSStreamLimitsError(err, Unless(err))
+		}
+	}
+	if err := checkStoreDirLimits(selectedLimits, cfg, storeDirReservationCount(asa, tier, cfg)); err != nil {
+		return NewJSStreamLimitsError(err, Unless(err))
+	}
 	return nil
 }
 
@@ -5846,6 +5918,33 @@ func (s *Server) jsClusteredStreamUpdateRequest(ci *ClientInfo, acc *Account, su
 		return
 	}
 
+	// A new first sequence needs the stream leader's state to validate, do this before we propose.
+	if firstSeqChanged(osa.Config, newCfg) {
+		// Need to release js lock.
+		js.mu.Unlock()
+		si, err := sysRequest[StreamInfo](s, clusterStreamInfoT, ci.serviceAccount(), cfg.Name)
+		js.mu.Lock()
+		if err == nil && si == nil {
+			err = errors.New("no stream info received")
+		}
+		if err == nil {
+			err = checkFirstSeqUpdate(newCfg, &si.State)
+		} else {
+			err = NewJSStreamInvalidConfigError(fmt.Errorf("stream configuration update could not verify first sequence: %v", err))
+		}
+		if err != nil {
+			resp.Error = NewJSStreamUpdateError(err, Unless(err))
+			s.sendAPIErrResponse(ci, acc, subject, reply, string(rmsg), s.jsonResponse(&resp))
+			return
+		}
+		// Stream could have been removed while we released the lock.
+		if osa = js.streamAssignment(acc.Name, cfg.Name); osa == nil {
+			resp.Error = NewJSStreamNotFoundError()
+			s.sendAPIErrResponse(ci, acc, subject, reply, string(rmsg), s.jsonResponse(&resp))
+			return
+		}
+	}
+
 	// Make copy so to not change original.
 	rg := osa.copyGroup().Group
 
@@ -7842,7 +7941,7 @@ func (mset *stream) processCatchupMsg(msg []byte) (uint64, error) {
 	mset.mu.Lock()
 	st := mset.cfg.Storage
 	ddloaded := mset.ddloaded
-	tierName := mset.tier
+	tierName, sdir := mset.tier, mset.sdir
 
 	if mset.hasAllPreAcks(seq, subj) {
 		mset.clearAllPreAcks(seq)
@@ -7853,7 +7952,7 @@ func (mset *stream) processCatchupMsg(msg []byte) (uint64, error) {
 
 	if mset.js.limitsExceeded(st) {
 		return 0, NewJSInsufficientResourcesError()
-	} else if exceeded, apiErr := mset.jsa.limitsExceeded(st, tierName); apiErr != nil {
+	} else if exceeded, apiErr := mset.jsa.limitsExceeded(st, tierName, sdir); apiErr != nil {
 		return 0, apiErr
 	} else if exceeded {
 		return 0, NewJSInsufficientResourcesError()
@@ -8072,12 +8171,16 @@ func (mset *stream) processClusterStreamInfoRequest(reply string) {
 	}
 
 	si := &StreamInfo{
-		Created: mset.createdTime(),
-		State:   mset.state(),
-		Config:  config,
-		Cluster: js.clusterInfo(mset.raftGroup()),
-		Sources: mset.sourcesInfo(),
-		Mirror:  mset.mirrorInfo(),
+		Created:          mset.createdTime(),
+		State:            mset.state(),
+		Config:           config,
+		Cluster:          js.clusterInfo(mset.raftGroup()),
+		Sources:          mset.sourcesInfo(),
+		Mirror:           mset.mirrorInfo(),
+		Schema:           mset.schemaStats(),
+		Tiers:            mset.storageTiers(),
+		RePublishError:   mset.republishError(),
+		RePublishDropped: mset.republishDropped(),
 	}
 
 	// Check for out of band catchups.
@@ -8401,6 +8504,7 @@ func syncSubject(pre string) string {
 
 const (
 	clusterStreamInfoT   = "$JSC.SI.%s.%s"
+	clusterStreamVerifyT = "$JSC.SV.%s.%s"
 	clusterConsumerInfoT = "$JSC.CI.%s.%s.%s"
 	jsaUpdatesSubT       = "$JSC.ARU.%s.*"
 	jsaUpdatesPubT       = "$JSC.ARU.%s.%s"
@@ -5651,6 +5651,7 @@ func TestJetStreamClusterStreamRepublish(t *testing.T) {
 		require_NoError(t, err)
 		// Grab info from Header
 		require_True(t, m.Header.Get(JSStream) == "RP")
+		require_True(t, m.Header.Get(JSCluster) == "JSC")
 		// Make sure sequence is correct.
 		seq, err := strconv.Atoi(m.Header.Get(JSSequence))
 		require_NoError(t, err)
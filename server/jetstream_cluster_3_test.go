@@ -5296,3 +5296,615 @@ func TestJetStreamClusterConsumerMaxDeliveryNumAckPendingBug(t *testing.T) {
 	cia.Created, cib.Created = now, now
 	checkConsumerInfo(cia, cib)
 }
+
+func TestJetStreamClusterStreamInitialFirstSeq(t *testing.T) {
+	c := createJetStreamClusterExplicit(t, "R3S", 3)
+	defer c.shutdown()
+
+	nc, js := jsClientConnect(t, c.randomServer())
+	defer nc.Close()
+
+	cfg := &StreamConfig{
+		Name:     "TEST",
+		Subjects: []string{"foo"},
+		Storage:  FileStorage,
+		Replicas: 3,
+		FirstSeq: 1000,
+	}
+	req, err := json.Marshal(cfg)
+	require_NoError(t, err)
+	rmsg, err := nc.Request(fmt.Sprintf(JSApiStreamCreateT, cfg.Name), req, time.Second)
+	require_NoError(t, err)
+	var resp JSApiStreamCreateResponse
+	require_NoError(t, json.Unmarshal(rmsg.Data, &resp))
+	if resp.Error != nil {
+		t.Fatalf("Unexpected error: %+v", resp.Error)
+	}
+	c.waitOnStreamLeader(globalAccountName, "TEST")
+
+	for i := 0; i < 10; i++ {
+		pa, err := js.Publish("foo", []byte("OK"))
+		require_NoError(t, err)
+		require_True(t, pa.Sequence == uint64(1000+i))
+	}
+
+	// All replicas should agree on the starting sequence.
+	checkFor(t, 5*time.Second, 100*time.Millisecond, func() error {
+		for _, s := range c.servers {
+			mset, err := s.GlobalAccount().lookupStream("TEST")
+			if err != nil {
+				return err
+			}
+			if state := mset.state(); state.Msgs != 10 || state.FirstSeq != 1000 || state.LastSeq != 1009 {
+				return fmt.Errorf("Server %s has unexpected state: %+v", s, state)
+			}
+		}
+		return nil
+	})
+
+	// Make sure a new leader continues from the same place.
+	_, err = nc.Request(fmt.Sprintf(JSApiStreamLeaderStepDownT, "TEST"), nil, time.Second)
+	require_NoError(t, err)
+	c.waitOnStreamLeader(globalAccountName, "TEST")
+
+	pa, err := js.Publish("foo", []byte("OK"))
+	require_NoError(t, err)
+	require_True(t, pa.Sequence == 1010)
+
+	// Changing the first sequence on a non empty stream should be rejected before it is proposed.
+	cfg.FirstSeq = 5000
+	req, err = json.Marshal(cfg)
+	require_NoError(t, err)
+	rmsg, err = nc.Request(fmt.Sprintf(JSApiStreamUpdateT, cfg.Name), req, time.Second)
+	require_NoError(t, err)
+	var uresp JSApiStreamUpdateResponse
+	require_NoError(t, json.Unmarshal(rmsg.Data, &uresp))
+	require_True(t, uresp.Error != nil)
+	require_True(t, strings.Contains(uresp.Error.Description, "first sequence"))
+
+	// The meta layer should still have the original config.
+	sl := c.streamLeader(globalAccountName, "TEST")
+	sjs := sl.getJetStream()
+	sjs.mu.RLock()
+	sa := sjs.streamAssignment(globalAccountName, "TEST")
+	sjs.mu.RUnlock()
+	require_True(t, sa != nil)
+	require_Equal(t, sa.Config.FirstSeq, uint64(1000))
+}
+
+func TestJetStreamClusterStreamSchemaValidation(t *testing.T) {
+	c := createJetStreamClusterExplicit(t, "R3S", 3)
+	defer c.shutdown()
+
+	nc, js := jsClientConnect(t, c.randomServer())
+	defer nc.Close()
+
+	cfg := &StreamConfig{
+		Name:     "TEST",
+		Subjects: []string{"foo"},
+		Storage:  FileStorage,
+		Replicas: 3,
+		Schemas:  []*StreamSchema{{Subject: "foo", Schema: json.RawMessage(`{"type":"object","required":["id"]}`)}},
+	}
+	req, err := json.Marshal(cfg)
+	require_NoError(t, err)
+	rmsg, err := nc.Request(fmt.Sprintf(JSApiStreamCreateT, cfg.Name), req, time.Second)
+	require_NoError(t, err)
+	var resp JSApiStreamCreateResponse
+	require_NoError(t, json.Unmarshal(rmsg.Data, &resp))
+	if resp.Error != nil {
+		t.Fatalf("Unexpected error: %+v", resp.Error)
+	}
+	c.waitOnStreamLeader(globalAccountName, "TEST")
+
+	for i := 0; i < 10; i++ {
+		_, err := js.Publish("foo", []byte(`{"id": 1}`))
+		require_NoError(t, err)
+		_, err = js.Publish("foo", []byte(`{"name": "derek"}`))
+		require_Error(t, err)
+	}
+
+	// Invalid messages are never proposed, so all replicas stay in sync.
+	checkFor(t, 5*time.Second, 100*time.Millisecond, func() error {
+		for _, s := range c.servers {
+			mset, err := s.GlobalAccount().lookupStream("TEST")
+			if err != nil {
+				return err
+			}
+			if state := mset.state(); state.Msgs != 10 || state.LastSeq != 10 {
+				return fmt.Errorf("Server %s has unexpected state: %+v", s, state)
+			}
+		}
+		return nil
+	})
+
+	rmsg, err = nc.Request(fmt.Sprintf(JSApiStreamInfoT, "TEST"), nil, time.Second)
+	require_NoError(t, err)
+	var sir JSApiStreamInfoResponse
+	require_NoError(t, json.Unmarshal(rmsg.Data, &sir))
+	require_True(t, sir.StreamInfo != nil && sir.StreamInfo.Schema != nil)
+	require_True(t, sir.StreamInfo.Schema.Validated == 10)
+	require_True(t, sir.StreamInfo.Schema.Failed == 10)
+}
+
+func TestJetStreamClusterAutoStreams(t *testing.T) {
+	tick := autoStreamsTick
+	autoStreamsTick = 100 * time.Millisecond
+	defer func() { autoStreamsTick = tick }()
+
+	tmpl := strings.Replace(jsClusterAccountsTempl, "ONE { users = [ { user: \"one\", pass: \"p\" } ]; jetstream: enabled }",
+		`ONE {
+			users = [ { user: "one", pass: "p" } ]
+			jetstream: {
+				auto_streams: [
+					{subject: "iot.*.>", idle_ttl: "2s", config: {name: "IOT_{{wildcard(1)}}", num_replicas: 3}}
+				]
+			}
+		}`, 1)
+	c := createJetStreamClusterWithTemplate(t, tmpl, "R3S", 3)
+	defer c.shutdown()
+
+	nc, js := jsClientConnect(t, c.randomServer())
+	defer nc.Close()
+
+	// Plain subscribers, on any server, get messages held while the stream is created only once.
+	var subs []*nats.Subscription
+	for _, srv := range c.servers {
+		snc, _ := jsClientConnect(t, srv)
+		defer snc.Close()
+		sub, err := snc.SubscribeSync("iot.>")
+		require_NoError(t, err)
+		require_NoError(t, snc.Flush())
+		subs = append(subs, sub)
+	}
+	for _, srv := range c.servers {
+		checkSubInterest(t, srv, "ONE", "iot.acme.temp", time.Second)
+	}
+
+	pa, err := js.Publish("iot.acme.temp", []byte("22"))
+	require_NoError(t, err)
+	require_True(t, pa.Stream == "IOT_acme" && pa.Sequence == 1)
+	time.Sleep(250 * time.Millisecond)
+	for _, sub := range subs {
+		checkSubsPending(t, sub, 1)
+	}
+
+	for i := 2; i <= 10; i++ {
+		pa, err = js.Publish("iot.acme.temp", []byte("22"))
+		require_NoError(t, err)
+		require_True(t, pa.Sequence == uint64(i))
+	}
+
+	si, err := js.StreamInfo("IOT_acme")
+	require_NoError(t, err)
+	require_True(t, si.Config.Replicas == 3)
+	require_True(t, si.State.Msgs == 10)
+
+	// Removed again through the meta layer once idle.
+	checkFor(t, 10*time.Second, 250*time.Millisecond, func() error {
+		if _, err := js.StreamInfo("IOT_acme"); err != nats.ErrStreamNotFound {
+			return fmt.Errorf("Expected stream to be removed, got %v", err)
+		}
+		return nil
+	})
+}
+
+func TestJetStreamClusterStreamPointInTimeNotSupported(t *testing.T) {
+	c := createJetStreamClusterExplicit(t, "R3S", 3)
+	defer c.shutdown()
+
+	nc, js := jsClientConnect(t, c.randomServer())
+	defer nc.Close()
+
+	_, err := js.AddStream(&nats.StreamConfig{Name: "TEST", Subjects: []string{"foo"}, Replicas: 3})
+	require_NoError(t, err)
+
+	b, _ := json.Marshal(&JSApiStreamPointInTimeRequest{Time: time.Now(), Name: "TEST_T1"})
+	rmsg, err := nc.Request(fmt.Sprintf(JSApiStreamPointInTimeT, "TEST"), b, 5*time.Second)
+	require_NoError(t, err)
+	var resp JSApiStreamPointInTimeResponse
+	require_NoError(t, json.Unmarshal(rmsg.Data, &resp))
+	require_True(t, resp.Error != nil && resp.Error.ErrCode == uint16(JSStreamPointInTimeClusteredErr))
+}
+
+func TestJetStreamClusterStreamVerifyReplicas(t *testing.T) {
+	c := createJetStreamClusterExplicit(t, "R3S", 3)
+	defer c.shutdown()
+
+	nc, js := jsClientConnect(t, c.randomServer())
+	defer nc.Close()
+
+	_, err := js.AddStream(&nats.StreamConfig{Name: "TEST", Subjects: []string{"foo"}, Replicas: 3})
+	require_NoError(t, err)
+	for i := 0; i < 100; i++ {
+		_, err := js.Publish("foo", []byte(fmt.Sprintf("msg-%d", i)))
+		require_NoError(t, err)
+	}
+
+	verify := func(req string) *JSApiStreamVerifyResponse {
+		t.Helper()
+		rmsg, err := nc.Request(fmt.Sprintf(JSApiStreamVerifyT, "TEST"), []byte(req), 15*time.Second)
+		require_NoError(t, err)
+		var resp JSApiStreamVerifyResponse
+		require_NoError(t, json.Unmarshal(rmsg.Data, &resp))
+		require_True(t, resp.Error == nil)
+		return &resp
+	}
+
+	resp := verify(`{"chunk_size": 10}`)
+	require_True(t, resp.Consistent)
+	require_True(t, resp.StartSeq == 1 && resp.EndSeq == 100)
+	require_True(t, len(resp.Replicas) == 2)
+	for _, rc := range resp.Replicas {
+		require_True(t, rc.Checksum == resp.Checksum)
+	}
+
+	// Have a replica diverge by removing a message behind the back of the stream.
+	sl := c.randomNonStreamLeader(globalAccountName, "TEST")
+	mset, err := sl.GlobalAccount().lookupStream("TEST")
+	require_NoError(t, err)
+	_, err = mset.store.RemoveMsg(55)
+	require_NoError(t, err)
+
+	resp = verify(`{"chunk_size": 10}`)
+	require_False(t, resp.Consistent)
+	for _, rc := range resp.Replicas {
+		if rc.Name != sl.Name() {
+			require_True(t, len(rc.Mismatches) == 0)
+			continue
+		}
+		require_True(t, len(rc.Mismatches) == 1)
+		require_True(t, rc.Mismatches[0].First == 51 && rc.Mismatches[0].Last == 60)
+		require_False(t, rc.Repairing)
+	}
+
+	// Ranges outside of the mismatch are fine.
+	resp = verify(`{"start_seq": 61, "end_seq": 100}`)
+	require_True(t, resp.Consistent)
+
+	// Now repair, the replica will be reset and catch up from the leader.
+	resp = verify(`{"repair": true}`)
+	require_False(t, resp.Consistent)
+	for _, rc := range resp.Replicas {
+		require_True(t, rc.Repairing == (rc.Name == sl.Name()))
+	}
+	checkFor(t, 20*time.Second, 500*time.Millisecond, func() error {
+		rmsg, err := nc.Request(fmt.Sprintf(JSApiStreamVerifyT, "TEST"), nil, 15*time.Second)
+		if err != nil {
+			return err
+		}
+		var resp JSApiStreamVerifyResponse
+		if err := json.Unmarshal(rmsg.Data, &resp); err != nil {
+			return err
+		}
+		if !resp.Consistent {
+			return fmt.Errorf("Expected replicas to be consistent: %+v", resp.Replicas[0])
+		}
+		return nil
+	})
+
+	// Messages removed from the front on one side only, as limits or interest could
+	// while checksumming, are not compared.
+	sl = c.randomNonStreamLeader(globalAccountName, "TEST")
+	mset, err = sl.GlobalAccount().lookupStream("TEST")
+	require_NoError(t, err)
+	for seq := uint64(1); seq <= 10; seq++ {
+		_, err = mset.store.RemoveMsg(seq)
+		require_NoError(t, err)
+	}
+	resp = verify(`{"chunk_size": 10}`)
+	require_True(t, resp.Consistent)
+	require_True(t, resp.StartSeq == 11 && resp.EndSeq == 100)
+
+	// A replica that is behind is reported as such and never reset.
+	lseq := mset.lastSeq()
+	mset.setLastSeq(lseq - 1)
+	resp = verify(`{"repair": true}`)
+	mset.setLastSeq(lseq)
+	require_False(t, resp.Consistent)
+	for _, rc := range resp.Replicas {
+		require_False(t, rc.Repairing)
+		if rc.Name == sl.Name() {
+			require_True(t, strings.Contains(rc.Error, "behind"))
+		}
+	}
+
+	// Only one verification per stream at a time.
+	lmset, err := c.streamLeader(globalAccountName, "TEST").GlobalAccount().lookupStream("TEST")
+	require_NoError(t, err)
+	lmset.mu.Lock()
+	lmset.verifying = true
+	lmset.mu.Unlock()
+	rmsg, err := nc.Request(fmt.Sprintf(JSApiStreamVerifyT, "TEST"), nil, 15*time.Second)
+	require_NoError(t, err)
+	var vresp JSApiStreamVerifyResponse
+	require_NoError(t, json.Unmarshal(rmsg.Data, &vresp))
+	require_True(t, vresp.Error != nil && strings.Contains(vresp.Error.Description, "already in progress"))
+	lmset.mu.Lock()
+	lmset.verifying = false
+	lmset.mu.Unlock()
+
+	// Small chunks are raised to limit the number of chunks for long ranges.
+	for i := 0; i < 2*maxVerifyChunks; i++ {
+		_, err := js.PublishAsync("foo", []byte("OK"))
+		require_NoError(t, err)
+	}
+	select {
+	case <-js.PublishAsyncComplete():
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Did not receive completion signal")
+	}
+	resp = verify(`{"chunk_size": 1}`)
+	require_True(t, resp.Consistent)
+	require_True(t, resp.ChunkSize == 3)
+	for _, rc := range resp.Replicas {
+		require_True(t, rc.Error == _EMPTY_ && len(rc.Mismatches) == 0)
+	}
+}
+
+func TestJetStreamClusterStreamSyncPolicyUpdatesWAL(t *testing.T) {
+	c := createJetStreamClusterExplicit(t, "R3S", 3)
+	defer c.shutdown()
+
+	nc, _ := jsClientConnect(t, c.randomServer())
+	defer nc.Close()
+
+	cfg := &StreamConfig{Name: "TEST", Subjects: []string{"foo"}, Storage: FileStorage, Replicas: 3}
+	addStream(t, nc, cfg)
+	c.waitOnStreamLeader(globalAccountName, "TEST")
+
+	walSync := func(s *Server) (SyncPolicy, error) {
+		mset, err := s.GlobalAccount().lookupStream("TEST")
+		if err != nil {
+			return 0, err
+		}
+		n := mset.raftNode().(*raft)
+		n.RLock()
+		fs := n.wal.(*fileStore)
+		n.RUnlock()
+		fs.mu.RLock()
+		defer fs.mu.RUnlock()
+		return fs.cfg.Sync, nil
+	}
+	for _, s := range c.servers {
+		sp, err := walSync(s)
+		require_NoError(t, err)
+		require_True(t, sp != SyncAlways)
+	}
+
+	// Updating the policy should also apply to the WAL.
+	cfg.Sync = SyncAlways
+	updateStream(t, nc, cfg)
+	checkFor(t, 5*time.Second, 100*time.Millisecond, func() error {
+		for _, s := range c.servers {
+			sp, err := walSync(s)
+			if err != nil {
+				return err
+			}
+			if sp != SyncAlways {
+				return fmt.Errorf("Expected WAL on %s to sync always, got %v", s, sp)
+			}
+		}
+		return nil
+	})
+}
+
+func TestJetStreamClusterStorageBackend(t *testing.T) {
+	st := registerTestMemBackend(t)
+
+	c := createJetStreamClusterExplicit(t, "R3S", 3)
+	defer c.shutdown()
+
+	nc, js := jsClientConnect(t, c.randomServer())
+	defer nc.Close()
+
+	req := []byte(`{"name":"TEST","subjects":["foo"],"storage":"testmem","num_replicas":3}`)
+	resp, err := nc.Request(fmt.Sprintf(JSApiStreamCreateT, "TEST"), req, 5*time.Second)
+	require_NoError(t, err)
+	var scResp JSApiStreamCreateResponse
+	require_NoError(t, json.Unmarshal(resp.Data, &scResp))
+	require_True(t, scResp.Error == nil)
+	c.waitOnStreamLeader(globalAccountName, "TEST")
+
+	for i := 0; i < 10; i++ {
+		_, err := js.Publish("foo", []byte("OK"))
+		require_NoError(t, err)
+	}
+
+	// All replicas and their raft logs should be using the backend.
+	checkFor(t, 5*time.Second, 100*time.Millisecond, func() error {
+		for _, s := range c.servers {
+			mset, err := s.GlobalAccount().lookupStream("TEST")
+			if err != nil {
+				return err
+			}
+			if mset.store.Type() != st {
+				return fmt.Errorf("Expected storage backend on %s, got %v", s, mset.store.Type())
+			}
+			n := mset.raftNode().(*raft)
+			n.RLock()
+			_, ok := n.wal.(*testMemBackendStore)
+			n.RUnlock()
+			if !ok {
+				return fmt.Errorf("Expected WAL from our backend on %s", s)
+			}
+			if msgs := mset.state().Msgs; msgs != 10 {
+				return fmt.Errorf("Expected 10 msgs on %s, got %d", s, msgs)
+			}
+		}
+		return nil
+	})
+}
+
+func TestJetStreamClusterMemoryStreamPersistOnShutdown(t *testing.T) {
+	c := createJetStreamClusterExplicit(t, "R3S", 3)
+	defer c.shutdown()
+
+	nc, js := jsClientConnect(t, c.randomServer())
+	defer nc.Close()
+
+	req := []byte(`{"name":"TEST","subjects":["foo"],"storage":"memory","num_replicas":3,"persist_on_shutdown":true}`)
+	resp, err := nc.Request(fmt.Sprintf(JSApiStreamCreateT, "TEST"), req, 5*time.Second)
+	require_NoError(t, err)
+	var scResp JSApiStreamCreateResponse
+	require_NoError(t, json.Unmarshal(resp.Data, &scResp))
+	require_True(t, scResp.Error == nil)
+	c.waitOnStreamLeader(globalAccountName, "TEST")
+
+	for i := 0; i < 100; i++ {
+		_, err := js.Publish("foo", []byte("OK"))
+		require_NoError(t, err)
+	}
+
+	checkMsgs := func(expected uint64) {
+		t.Helper()
+		checkFor(t, 10*time.Second, 100*time.Millisecond, func() error {
+			for _, s := range c.servers {
+				mset, err := s.GlobalAccount().lookupStream("TEST")
+				if err != nil {
+					return err
+				}
+				if state := mset.state(); state.Msgs != expected || state.LastSeq != expected {
+					return fmt.Errorf("Expected %d msgs on %s, got %d", expected, s, state.Msgs)
+				}
+			}
+			return nil
+		})
+	}
+	checkMsgs(100)
+
+	// A restarted follower should reload its messages locally.
+	rs := c.randomNonStreamLeader(globalAccountName, "TEST")
+	rs.Shutdown()
+	rs = c.restartServer(rs)
+	mset, err := rs.GlobalAccount().lookupStream("TEST")
+	require_NoError(t, err)
+	require_True(t, mset.state().Msgs == 100)
+	c.waitOnServerCurrent(rs)
+
+	// Even the whole cluster restarting should keep our messages.
+	nc.Close()
+	c.stopAll()
+	c.restartAll()
+	c.waitOnStreamLeader(globalAccountName, "TEST")
+	checkMsgs(100)
+
+	nc, js = jsClientConnect(t, c.randomServer())
+	defer nc.Close()
+	pa, err := js.Publish("foo", []byte("OK"))
+	require_NoError(t, err)
+	require_True(t, pa.Sequence == 101)
+	checkMsgs(101)
+}
+
+func TestJetStreamClusterStreamImportNotSupported(t *testing.T) {
+	c := createJetStreamClusterExplicit(t, "R3S", 3)
+	defer c.shutdown()
+
+	nc, _ := jsClientConnect(t, c.randomServer())
+	defer nc.Close()
+
+	rmsg, err := nc.Request(fmt.Sprintf(JSApiStreamImportT, "TEST"), nil, time.Second)
+	require_NoError(t, err)
+	var resp JSApiStreamImportResponse
+	require_NoError(t, json.Unmarshal(rmsg.Data, &resp))
+	require_True(t, IsNatsErr(resp.Error, JSStreamImportClusteredErr))
+}
+
+func TestJetStreamClusterStreamRepairCorruptMsgs(t *testing.T) {
+	c := createJetStreamClusterExplicit(t, "R3S", 3)
+	defer c.shutdown()
+
+	nc, js := jsClientConnect(t, c.randomServer())
+	defer nc.Close()
+
+	_, err := js.AddStream(&nats.StreamConfig{Name: "TEST", Subjects: []string{"foo"}, Replicas: 3})
+	require_NoError(t, err)
+
+	publish := func() {
+		t.Helper()
+		for i := 0; i < 10; i++ {
+			_, err := js.Publish("foo", []byte(fmt.Sprintf("MSG-%d", i)))
+			require_NoError(t, err)
+		}
+	}
+	storeFor := func(s *Server) (*stream, *fileStore) {
+		t.Helper()
+		mset, err := s.GlobalAccount().lookupStream("TEST")
+		require_NoError(t, err)
+		return mset, mset.store.(*fileStore)
+	}
+	checkState := func() {
+		t.Helper()
+		checkFor(t, 5*time.Second, 100*time.Millisecond, func() error {
+			for _, s := range c.servers {
+				_, fs := storeFor(s)
+				if state := fs.State(); state.Msgs != 20 {
+					return fmt.Errorf("Expected 20 msgs on %s, got %d", s, state.Msgs)
+				}
+			}
+			return nil
+		})
+	}
+
+	// Seal the first block of every replica so it gets scrubbed.
+	publish()
+	checkFor(t, 5*time.Second, 100*time.Millisecond, func() error {
+		for _, s := range c.servers {
+			if _, fs := storeFor(s); fs.State().Msgs != 10 {
+				return fmt.Errorf("Expected 10 msgs on %s", s)
+			}
+		}
+		return nil
+	})
+	for _, s := range c.servers {
+		_, fs := storeFor(s)
+		fs.mu.Lock()
+		_, err := fs.newMsgBlockForWrite()
+		fs.mu.Unlock()
+		require_NoError(t, err)
+	}
+	publish()
+	checkState()
+
+	corrupt := func(s *Server) {
+		t.Helper()
+		_, fs := storeFor(s)
+		fs.mu.RLock()
+		mfn := fs.blks[0].mfn
+		fs.mu.RUnlock()
+		buf, err := os.ReadFile(mfn)
+		require_NoError(t, err)
+		buf[len(buf)-recordHashSize-1] ^= 0xff
+		require_NoError(t, os.WriteFile(mfn, buf, defaultFilePerms))
+
+		fs.scrubBlocks()
+		require_True(t, fs.scrubStats().Corrupt == 1)
+	}
+	checkRepaired := func(s *Server) {
+		t.Helper()
+		_, fs := storeFor(s)
+		fs.scrubBlocks()
+		require_True(t, fs.scrubStats().Corrupt == 1)
+		sm, err := fs.LoadMsg(10, nil)
+		require_NoError(t, err)
+		require_True(t, string(sm.msg) == "MSG-9")
+	}
+
+	// A replica only rewrites its corrupt messages with the leader's copies.
+	rs := c.randomNonStreamLeader(globalAccountName, "TEST")
+	corrupt(rs)
+	mset, _ := storeFor(rs)
+	mset.repairCorruptMsgs(10, 10)
+	checkRepaired(rs)
+	checkState()
+
+	// The leader steps down first and repairs from the new leader.
+	sl := c.streamLeader(globalAccountName, "TEST")
+	corrupt(sl)
+	mset, _ = storeFor(sl)
+	mset.repairCorruptMsgs(10, 10)
+	require_False(t, mset.isLeader())
+	checkRepaired(sl)
+	checkState()
+}
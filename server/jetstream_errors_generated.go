@@ -140,6 +140,9 @@ const (
 	// JSConsumerNameTooLongErrF consumer name is too long, maximum allowed is {max}
 	JSConsumerNameTooLongErrF ErrorIdentifier = 10102
 
+	// JSConsumerNoCheckpointErrF consumer {consumer} has no checkpoint at or before the requested time
+	JSConsumerNoCheckpointErrF ErrorIdentifier = 10143
+
 	// JSConsumerNotFoundErr consumer not found
 	JSConsumerNotFoundErr ErrorIdentifier = 10014
 
@@ -149,6 +152,9 @@ const (
 	// JSConsumerOnMappedErr consumer direct on a mapped consumer
 	JSConsumerOnMappedErr ErrorIdentifier = 10092
 
+	// JSConsumerOrderedInvalidErrF invalid ordered consumer configuration: {err}
+	JSConsumerOrderedInvalidErrF ErrorIdentifier = 10144
+
 	// JSConsumerPullNotDurableErr consumer in pull mode requires a durable name
 	JSConsumerPullNotDurableErr ErrorIdentifier = 10085
 
@@ -161,6 +167,9 @@ const (
 	// JSConsumerPushMaxWaitingErr consumer in push mode can not set max waiting
 	JSConsumerPushMaxWaitingErr ErrorIdentifier = 10080
 
+	// JSConsumerRateLimitBurstInvalidErr consumer rate limit burst requires a message rate and can not be negative
+	JSConsumerRateLimitBurstInvalidErr ErrorIdentifier = 10146
+
 	// JSConsumerReplacementWithDifferentNameErr consumer replacement durable config not the same
 	JSConsumerReplacementWithDifferentNameErr ErrorIdentifier = 10106
 
@@ -173,6 +182,9 @@ const (
 	// JSConsumerSmallHeartbeatErr consumer idle heartbeat needs to be >= 100ms
 	JSConsumerSmallHeartbeatErr ErrorIdentifier = 10083
 
+	// JSConsumerStatsIntervalNegativeErr consumer stats interval can not be negative
+	JSConsumerStatsIntervalNegativeErr ErrorIdentifier = 10145
+
 	// JSConsumerStoreFailedErrF error creating store for consumer: {err}
 	JSConsumerStoreFailedErrF ErrorIdentifier = 10104
 
@@ -212,6 +224,9 @@ const (
 	// JSMirrorMaxMessageSizeTooBigErr stream mirror must have max message size >= source
 	JSMirrorMaxMessageSizeTooBigErr ErrorIdentifier = 10030
 
+	// JSMirrorWithFirstSeqErr stream mirrors can not have first sequence configured
+	JSMirrorWithFirstSeqErr ErrorIdentifier = 10135
+
 	// JSMirrorWithSourcesErr stream mirrors can not also contain other sources
 	JSMirrorWithSourcesErr ErrorIdentifier = 10031
 
@@ -272,6 +287,15 @@ const (
 	// JSStreamAssignmentErrF Generic stream assignment error string ({err})
 	JSStreamAssignmentErrF ErrorIdentifier = 10048
 
+	// JSStreamBackupNotFoundErr stream backup not found
+	JSStreamBackupNotFoundErr ErrorIdentifier = 10138
+
+	// JSStreamBackupRestoreClusteredErr restore from backup not supported in clustered mode
+	JSStreamBackupRestoreClusteredErr ErrorIdentifier = 10140
+
+	// JSStreamBackupRestoreErrF restore from backup failed: {err}
+	JSStreamBackupRestoreErrF ErrorIdentifier = 10139
+
 	// JSStreamCreateErrF Generic stream creation error string ({err})
 	JSStreamCreateErrF ErrorIdentifier = 10049
 
@@ -290,6 +314,15 @@ const (
 	// JSStreamHeaderExceedsMaximumErr header size exceeds maximum allowed of 64k
 	JSStreamHeaderExceedsMaximumErr ErrorIdentifier = 10097
 
+	// JSStreamHeaderNotIndexedErrF header {header} is not indexed
+	JSStreamHeaderNotIndexedErrF ErrorIdentifier = 10147
+
+	// JSStreamImportClusteredErr stream import not supported in clustered mode
+	JSStreamImportClusteredErr ErrorIdentifier = 10149
+
+	// JSStreamImportErrF stream import failed: {err}
+	JSStreamImportErrF ErrorIdentifier = 10148
+
 	// JSStreamInfoMaxSubjectsErr subject details would exceed maximum allowed
 	JSStreamInfoMaxSubjectsErr ErrorIdentifier = 10117
 
@@ -350,6 +383,12 @@ const (
 	// JSStreamOfflineErr stream is offline
 	JSStreamOfflineErr ErrorIdentifier = 10118
 
+	// JSStreamPointInTimeClusteredErr Point in time restores copy the stream on a single server and are only supported without clustering (point in time restore not supported in clustered mode)
+	JSStreamPointInTimeClusteredErr ErrorIdentifier = 10142
+
+	// JSStreamPointInTimeErrF point in time restore failed: {err}
+	JSStreamPointInTimeErrF ErrorIdentifier = 10141
+
 	// JSStreamPurgeFailedF Generic stream purge failure error string ({err})
 	JSStreamPurgeFailedF ErrorIdentifier = 10110
 
@@ -365,6 +404,12 @@ const (
 	// JSStreamRollupFailedF Generic stream rollup failure error string ({err})
 	JSStreamRollupFailedF ErrorIdentifier = 10111
 
+	// JSStreamSchemaUnavailableErrF schema for subject {subject} not available: {err}
+	JSStreamSchemaUnavailableErrF ErrorIdentifier = 10137
+
+	// JSStreamSchemaValidationErrF message failed schema validation at {path}: {err}
+	JSStreamSchemaValidationErrF ErrorIdentifier = 10136
+
 	// JSStreamSealedErr invalid operation on sealed stream
 	JSStreamSealedErr ErrorIdentifier = 10109
 
@@ -452,17 +497,21 @@ var (
 		JSConsumerNameContainsPathSeparatorsErr:    {Code: 400, ErrCode: 10127, Description: "Consumer name can not contain path separators"},
 		JSConsumerNameExistErr:                     {Code: 400, ErrCode: 10013, Description: "consumer name already in use"},
 		JSConsumerNameTooLongErrF:                  {Code: 400, ErrCode: 10102, Description: "consumer name is too long, maximum allowed is {max}"},
+		JSConsumerNoCheckpointErrF:                 {Code: 400, ErrCode: 10143, Description: "consumer {consumer} has no checkpoint at or before the requested time"},
 		JSConsumerNotFoundErr:                      {Code: 404, ErrCode: 10014, Description: "consumer not found"},
 		JSConsumerOfflineErr:                       {Code: 500, ErrCode: 10119, Description: "consumer is offline"},
 		JSConsumerOnMappedErr:                      {Code: 400, ErrCode: 10092, Description: "consumer direct on a mapped consumer"},
+		JSConsumerOrderedInvalidErrF:               {Code: 400, ErrCode: 10144, Description: "invalid ordered consumer configuration: {err}"},
 		JSConsumerPullNotDurableErr:                {Code: 400, ErrCode: 10085, Description: "consumer in pull mode requires a durable name"},
 		JSConsumerPullRequiresAckErr:               {Code: 400, ErrCode: 10084, Description: "consumer in pull mode requires ack policy"},
 		JSConsumerPullWithRateLimitErr:             {Code: 400, ErrCode: 10086, Description: "consumer in pull mode can not have rate limit set"},
 		JSConsumerPushMaxWaitingErr:                {Code: 400, ErrCode: 10080, Description: "consumer in push mode can not set max waiting"},
+		JSConsumerRateLimitBurstInvalidErr:         {Code: 400, ErrCode: 10146, Description: "consumer rate limit burst requires a message rate and can not be negative"},
 		JSConsumerReplacementWithDifferentNameErr:  {Code: 400, ErrCode: 10106, Description: "consumer replacement durable config not the same"},
 		JSConsumerReplicasExceedsStream:            {Code: 400, ErrCode: 10126, Description: "consumer config replica count exceeds parent stream"},
 		JSConsumerReplicasShouldMatchStream:        {Code: 400, ErrCode: 10134, Description: "consumer config replicas must match interest retention stream's replicas"},
 		JSConsumerSmallHeartbeatErr:                {Code: 400, ErrCode: 10083, Description: "consumer idle heartbeat needs to be >= 100ms"},
+		JSConsumerStatsIntervalNegativeErr:         {Code: 400, ErrCode: 10145, Description: "consumer stats interval can not be negative"},
 		JSConsumerStoreFailedErrF:                  {Code: 500, ErrCode: 10104, Description: "error creating store for consumer: {err}"},
 		JSConsumerWQConsumerNotDeliverAllErr:       {Code: 400, ErrCode: 10101, Description: "consumer must be deliver all on workqueue stream"},
 		JSConsumerWQConsumerNotUniqueErr:           {Code: 400, ErrCode: 10100, Description: "filtered consumer not unique on workqueue stream"},
@@ -476,6 +525,7 @@ var (
 		JSMemoryResourcesExceededErr:               {Code: 500, ErrCode: 10028, Description: "insufficient memory resources available"},
 		JSMirrorConsumerSetupFailedErrF:            {Code: 500, ErrCode: 10029, Description: "{err}"},
 		JSMirrorMaxMessageSizeTooBigErr:            {Code: 400, ErrCode: 10030, Description: "stream mirror must have max message size >= source"},
+		JSMirrorWithFirstSeqErr:                    {Code: 400, ErrCode: 10135, Description: "stream mirrors can not have first sequence configured"},
 		JSMirrorWithSourcesErr:                     {Code: 400, ErrCode: 10031, Description: "stream mirrors can not also contain other sources"},
 		JSMirrorWithStartSeqAndTimeErr:             {Code: 400, ErrCode: 10032, Description: "stream mirrors can not have both start seq and start time configured"},
 		JSMirrorWithSubjectFiltersErr:              {Code: 400, ErrCode: 10033, Description: "stream mirrors can not contain filtered subjects"},
@@ -496,12 +546,18 @@ var (
 		JSSourceMaxMessageSizeTooBigErr:            {Code: 400, ErrCode: 10046, Description: "stream source must have max message size >= target"},
 		JSStorageResourcesExceededErr:              {Code: 500, ErrCode: 10047, Description: "insufficient storage resources available"},
 		JSStreamAssignmentErrF:                     {Code: 500, ErrCode: 10048, Description: "{err}"},
+		JSStreamBackupNotFoundErr:                  {Code: 404, ErrCode: 10138, Description: "stream backup not found"},
+		JSStreamBackupRestoreClusteredErr:          {Code: 400, ErrCode: 10140, Description: "restore from backup not supported in clustered mode"},
+		JSStreamBackupRestoreErrF:                  {Code: 500, ErrCode: 10139, Description: "restore from backup failed: {err}"},
 		JSStreamCreateErrF:                         {Code: 500, ErrCode: 10049, Description: "{err}"},
 		JSStreamDeleteErrF:                         {Code: 500, ErrCode: 10050, Description: "{err}"},
 		JSStreamExternalApiOverlapErrF:             {Code: 400, ErrCode: 10021, Description: "stream external api prefix {prefix} must not overlap with {subject}"},
 		JSStreamExternalDelPrefixOverlapsErrF:      {Code: 400, ErrCode: 10022, Description: "stream external delivery prefix {prefix} overlaps with stream subject {subject}"},
 		JSStreamGeneralErrorF:                      {Code: 500, ErrCode: 10051, Description: "{err}"},
 		JSStreamHeaderExceedsMaximumErr:            {Code: 400, ErrCode: 10097, Description: "header size exceeds maximum allowed of 64k"},
+		JSStreamHeaderNotIndexedErrF:               {Code: 400, ErrCode: 10147, Description: "header {header} is not indexed"},
+		JSStreamImportClusteredErr:                 {Code: 400, ErrCode: 10149, Description: "stream import not supported in clustered mode"},
+		JSStreamImportErrF:                         {Code: 500, ErrCode: 10148, Description: "stream import failed: {err}"},
 		JSStreamInfoMaxSubjectsErr:                 {Code: 500, ErrCode: 10117, Description: "subject details would exceed maximum allowed"},
 		JSStreamInvalidConfigF:                     {Code: 500, ErrCode: 10052, Description: "{err}"},
 		JSStreamInvalidErr:                         {Code: 500, ErrCode: 10096, Description: "stream not valid"},
@@ -522,11 +578,15 @@ var (
 		JSStreamNotFoundErr:                        {Code: 404, ErrCode: 10059, Description: "stream not found"},
 		JSStreamNotMatchErr:                        {Code: 400, ErrCode: 10060, Description: "expected stream does not match"},
 		JSStreamOfflineErr:                         {Code: 500, ErrCode: 10118, Description: "stream is offline"},
+		JSStreamPointInTimeClusteredErr:            {Code: 400, ErrCode: 10142, Description: "point in time restore not supported in clustered mode"},
+		JSStreamPointInTimeErrF:                    {Code: 500, ErrCode: 10141, Description: "point in time restore failed: {err}"},
 		JSStreamPurgeFailedF:                       {Code: 500, ErrCode: 10110, Description: "{err}"},
 		JSStreamReplicasNotSupportedErr:            {Code: 500, ErrCode: 10074, Description: "replicas > 1 not supported in non-clustered mode"},
 		JSStreamReplicasNotUpdatableErr:            {Code: 400, ErrCode: 10061, Description: "Replicas configuration can not be updated"},
 		JSStreamRestoreErrF:                        {Code: 500, ErrCode: 10062, Description: "restore failed: {err}"},
 		JSStreamRollupFailedF:                      {Code: 500, ErrCode: 10111, Description: "{err}"},
+		JSStreamSchemaUnavailableErrF:              {Code: 503, ErrCode: 10137, Description: "schema for subject {subject} not available: {err}"},
+		JSStreamSchemaValidationErrF:               {Code: 400, ErrCode: 10136, Description: "message failed schema validation at {path}: {err}"},
 		JSStreamSealedErr:                          {Code: 400, ErrCode: 10109, Description: "invalid operation on sealed stream"},
 		JSStreamSequenceNotMatchErr:                {Code: 503, ErrCode: 10063, Description: "expected stream sequence does not match"},
 		JSStreamSnapshotErrF:                       {Code: 500, ErrCode: 10064, Description: "snapshot failed: {err}"},
@@ -1063,6 +1123,22 @@ func NewJSConsumerNameTooLongError(max interface{}, opts ...ErrorOption) *ApiErr
 	}
 }
 
+// NewJSConsumerNoCheckpointError creates a new JSConsumerNoCheckpointErrF error: "consumer {consumer} has no checkpoint at or before the requested time"
+func NewJSConsumerNoCheckpointError(consumer interface{}, opts ...ErrorOption) *ApiError {
+	eopts := parseOpts(opts)
+	if ae, ok := eopts.err.(*ApiError); ok {
+		return ae
+	}
+
+	e := ApiErrors[JSConsumerNoCheckpointErrF]
+	args := e.toReplacerArgs([]interface{}{"{consumer}", consumer})
+	return &ApiError{
+		Code:        e.Code,
+		ErrCode:     e.ErrCode,
+		Description: strings.NewReplacer(args...).Replace(e.Description),
+	}
+}
+
 // NewJSConsumerNotFoundError creates a new JSConsumerNotFoundErr error: "consumer not found"
 func NewJSConsumerNotFoundError(opts ...ErrorOption) *ApiError {
 	eopts := parseOpts(opts)
@@ -1093,6 +1169,22 @@ func NewJSConsumerOnMappedError(opts ...ErrorOption) *ApiError {
 	return ApiErrors[JSConsumerOnMappedErr]
 }
 
+// NewJSConsumerOrderedInvalidError creates a new JSConsumerOrderedInvalidErrF error: "invalid ordered consumer configuration: {err}"
+func NewJSConsumerOrderedInvalidError(err error, opts ...ErrorOption) *ApiError {
+	eopts := parseOpts(opts)
+	if ae, ok := eopts.err.(*ApiError); ok {
+		return ae
+	}
+
+	e := ApiErrors[JSConsumerOrderedInvalidErrF]
+	args := e.toReplacerArgs([]interface{}{"{err}", err})
+	return &ApiError{
+		Code:        e.Code,
+		ErrCode:     e.ErrCode,
+		Description: strings.NewReplacer(args...).Replace(e.Description),
+	}
+}
+
 // NewJSConsumerPullNotDurableError creates a new JSConsumerPullNotDurableErr error: "consumer in pull mode requires a durable name"
 func NewJSConsumerPullNotDurableError(opts ...ErrorOption) *ApiError {
 	eopts := parseOpts(opts)
@@ -1133,6 +1225,16 @@ func NewJSConsumerPushMaxWaitingError(opts ...ErrorOption) *ApiError {
 	return ApiErrors[JSConsumerPushMaxWaitingErr]
 }
 
+// NewJSConsumerRateLimitBurstInvalidError creates a new JSConsumerRateLimitBurstInvalidErr error: "consumer rate limit burst requires a message rate and can not be negative"
+func NewJSConsumerRateLimitBurstInvalidError(opts ...ErrorOption) *ApiError {
+	eopts := parseOpts(opts)
+	if ae, ok := eopts.err.(*ApiError); ok {
+		return ae
+	}
+
+	return ApiErrors[JSConsumerRateLimitBurstInvalidErr]
+}
+
 // NewJSConsumerReplacementWithDifferentNameError creates a new JSConsumerReplacementWithDifferentNameErr error: "consumer replacement durable config not the same"
 func NewJSConsumerReplacementWithDifferentNameError(opts ...ErrorOption) *ApiError {
 	eopts := parseOpts(opts)
@@ -1173,6 +1275,16 @@ func NewJSConsumerSmallHeartbeatError(opts ...ErrorOption) *ApiError {
 	return ApiErrors[JSConsumerSmallHeartbeatErr]
 }
 
+// NewJSConsumerStatsIntervalNegativeError creates a new JSConsumerStatsIntervalNegativeErr error: "consumer stats interval can not be negative"
+func NewJSConsumerStatsIntervalNegativeError(opts ...ErrorOption) *ApiError {
+	eopts := parseOpts(opts)
+	if ae, ok := eopts.err.(*ApiError); ok {
+		return ae
+	}
+
+	return ApiErrors[JSConsumerStatsIntervalNegativeErr]
+}
+
 // NewJSConsumerStoreFailedError creates a new JSConsumerStoreFailedErrF error: "error creating store for consumer: {err}"
 func NewJSConsumerStoreFailedError(err error, opts ...ErrorOption) *ApiError {
 	eopts := parseOpts(opts)
@@ -1315,6 +1427,16 @@ func NewJSMirrorMaxMessageSizeTooBigError(opts ...ErrorOption) *ApiError {
 	return ApiErrors[JSMirrorMaxMessageSizeTooBigErr]
 }
 
+// NewJSMirrorWithFirstSeqError creates a new JSMirrorWithFirstSeqErr error: "stream mirrors can not have first sequence configured"
+func NewJSMirrorWithFirstSeqError(opts ...ErrorOption) *ApiError {
+	eopts := parseOpts(opts)
+	if ae, ok := eopts.err.(*ApiError); ok {
+		return ae
+	}
+
+	return ApiErrors[JSMirrorWithFirstSeqErr]
+}
+
 // NewJSMirrorWithSourcesError creates a new JSMirrorWithSourcesErr error: "stream mirrors can not also contain other sources"
 func NewJSMirrorWithSourcesError(opts ...ErrorOption) *ApiError {
 	eopts := parseOpts(opts)
@@ -1545,6 +1667,42 @@ func NewJSStreamAssignmentError(err error, opts ...ErrorOption) *ApiError {
 	}
 }
 
+// NewJSStreamBackupNotFoundError creates a new JSStreamBackupNotFoundErr error: "stream backup not found"
+func NewJSStreamBackupNotFoundError(opts ...ErrorOption) *ApiError {
+	eopts := parseOpts(opts)
+	if ae, ok := eopts.err.(*ApiError); ok {
+		return ae
+	}
+
+	return ApiErrors[JSStreamBackupNotFoundErr]
+}
+
+// NewJSStreamBackupRestoreClusteredError creates a new JSStreamBackupRestoreClusteredErr error: "restore from backup not supported in clustered mode"
+func NewJSStreamBackupRestoreClusteredError(opts ...ErrorOption) *ApiError {
+	eopts := parseOpts(opts)
+	if ae, ok := eopts.err.(*ApiError); ok {
+		return ae
+	}
+
+	return ApiErrors[JSStreamBackupRestoreClusteredErr]
+}
+
+// NewJSStreamBackupRestoreError creates a new JSStreamBackupRestoreErrF error: "restore from backup failed: {err}"
+func NewJSStreamBackupRestoreError(err error, opts ...ErrorOption) *ApiError {
+	eopts := parseOpts(opts)
+	if ae, ok := eopts.err.(*ApiError); ok {
+		return ae
+	}
+
+	e := ApiErrors[JSStreamBackupRestoreErrF]
+	args := e.toReplacerArgs([]interface{}{"{err}", err})
+	return &ApiError{
+		Code:        e.Code,
+		ErrCode:     e.ErrCode,
+		Description: strings.NewReplacer(args...).Replace(e.Description),
+	}
+}
+
 // NewJSStreamCreateError creates a new JSStreamCreateErrF error: "{err}"
 func NewJSStreamCreateError(err error, opts ...ErrorOption) *ApiError {
 	eopts := parseOpts(opts)
@@ -1635,6 +1793,48 @@ func NewJSStreamHeaderExceedsMaximumError(opts ...ErrorOption) *ApiError {
 	return ApiErrors[JSStreamHeaderExceedsMaximumErr]
 }
 
+// NewJSStreamHeaderNotIndexedError creates a new JSStreamHeaderNotIndexedErrF error: "header {header} is not indexed"
+func NewJSStreamHeaderNotIndexedError(header interface{}, opts ...ErrorOption) *ApiError {
+	eopts := parseOpts(opts)
+	if ae, ok := eopts.err.(*ApiError); ok {
+		return ae
+	}
+
+	e := ApiErrors[JSStreamHeaderNotIndexedErrF]
+	args := e.toReplacerArgs([]interface{}{"{header}", header})
+	return &ApiError{
+		Code:        e.Code,
+		ErrCode:     e.ErrCode,
+		Description: strings.NewReplacer(args...).Replace(e.Description),
+	}
+}
+
+// NewJSStreamImportClusteredError creates a new JSStreamImportClusteredErr error: "stream import not supported in clustered mode"
+func NewJSStreamImportClusteredError(opts ...ErrorOption) *ApiError {
+	eopts := parseOpts(opts)
+	if ae, ok := eopts.err.(*ApiError); ok {
+		return ae
+	}
+
+	return ApiErrors[JSStreamImportClusteredErr]
+}
+
+// NewJSStreamImportError creates a new JSStreamImportErrF error: "stream import failed: {err}"
+func NewJSStreamImportError(err error, opts ...ErrorOption) *ApiError {
+	eopts := parseOpts(opts)
+	if ae, ok := eopts.err.(*ApiError); ok {
+		return ae
+	}
+
+	e := ApiErrors[JSStreamImportErrF]
+	args := e.toReplacerArgs([]interface{}{"{err}", err})
+	return &ApiError{
+		Code:        e.Code,
+		ErrCode:     e.ErrCode,
+		Description: strings.NewReplacer(args...).Replace(e.Description),
+	}
+}
+
 // NewJSStreamInfoMaxSubjectsError creates a new JSStreamInfoMaxSubjectsErr error: "subject details would exceed maximum allowed"
 func NewJSStreamInfoMaxSubjectsError(opts ...ErrorOption) *ApiError {
 	eopts := parseOpts(opts)
@@ -1865,6 +2065,32 @@ func NewJSStreamOfflineError(opts ...ErrorOption) *ApiError {
 	return ApiErrors[JSStreamOfflineErr]
 }
 
+// NewJSStreamPointInTimeClusteredError creates a new JSStreamPointInTimeClusteredErr error: "point in time restore not supported in clustered mode"
+func NewJSStreamPointInTimeClusteredError(opts ...ErrorOption) *ApiError {
+	eopts := parseOpts(opts)
+	if ae, ok := eopts.err.(*ApiError); ok {
+		return ae
+	}
+
+	return ApiErrors[JSStreamPointInTimeClusteredErr]
+}
+
+// NewJSStreamPointInTimeError creates a new JSStreamPointInTimeErrF error: "point in time restore failed: {err}"
+func NewJSStreamPointInTimeError(err error, opts ...ErrorOption) *ApiError {
+	eopts := parseOpts(opts)
+	if ae, ok := eopts.err.(*ApiError); ok {
+		return ae
+	}
+
+	e := ApiErrors[JSStreamPointInTimeErrF]
+	args := e.toReplacerArgs([]interface{}{"{err}", err})
+	return &ApiError{
+		Code:        e.Code,
+		ErrCode:     e.ErrCode,
+		Description: strings.NewReplacer(args...).Replace(e.Description),
+	}
+}
+
 // NewJSStreamPurgeFailedError creates a new JSStreamPurgeFailedF error: "{err}"
 func NewJSStreamPurgeFailedError(err error, opts ...ErrorOption) *ApiError {
 	eopts := parseOpts(opts)
@@ -1933,6 +2159,38 @@ func NewJSStreamRollupFailedError(err error, opts ...ErrorOption) *ApiError {
 	}
 }
 
+// NewJSStreamSchemaUnavailableError creates a new JSStreamSchemaUnavailableErrF error: "schema for subject {subject} not available: {err}"
+func NewJSStreamSchemaUnavailableError(err error, subject interface{}, opts ...ErrorOption) *ApiError {
+	eopts := parseOpts(opts)
+	if ae, ok := eopts.err.(*ApiError); ok {
+		return ae
+	}
+
+	e := ApiErrors[JSStreamSchemaUnavailableErrF]
+	args := e.toReplacerArgs([]interface{}{"{err}", err, "{subject}", subject})
+	return &ApiError{
+		Code:        e.Code,
+		ErrCode:     e.ErrCode,
+		Description: strings.NewReplacer(args...).Replace(e.Description),
+	}
+}
+
+// NewJSStreamSchemaValidationError creates a new JSStreamSchemaValidationErrF error: "message failed schema validation at {path}: {err}"
+func NewJSStreamSchemaValidationError(err error, path interface{}, opts ...ErrorOption) *ApiError {
+	eopts := parseOpts(opts)
+	if ae, ok := eopts.err.(*ApiError); ok {
+		return ae
+	}
+
+	e := ApiErrors[JSStreamSchemaValidationErrF]
+	args := e.toReplacerArgs([]interface{}{"{err}", err, "{path}", path})
+	return &ApiError{
+		Code:        e.Code,
+		ErrCode:     e.ErrCode,
+		Description: strings.NewReplacer(args...).Replace(e.Description),
+	}
+}
+
 // NewJSStreamSealedError creates a new JSStreamSealedErr error: "invalid operation on sealed stream"
 func NewJSStreamSealedError(opts ...ErrorOption) *ApiError {
 	eopts := parseOpts(opts)
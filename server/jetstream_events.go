@@ -140,6 +140,18 @@ type JSConsumerDeliveryTerminatedAdvisory struct {
 // JSConsumerDeliveryTerminatedAdvisoryType is the schema type for JSConsumerDeliveryTerminatedAdvisory
 const JSConsumerDeliveryTerminatedAdvisoryType = "io.nats.jetstream.advisory.v1.terminated"
 
+// JSConsumerStatsAdvisory is an advisory published periodically by consumers that track stats
+type JSConsumerStatsAdvisory struct {
+	TypedEvent
+	Stream   string         `json:"stream"`
+	Consumer string         `json:"consumer"`
+	Stats    *ConsumerStats `json:"stats"`
+	Domain   string         `json:"domain,omitempty"`
+}
+
+// JSConsumerStatsAdvisoryType is the schema type for JSConsumerStatsAdvisory
+const JSConsumerStatsAdvisoryType = "io.nats.jetstream.advisory.v1.consumer_stats"
+
 // JSSnapshotCreateAdvisory is an advisory sent after a snapshot is successfully started
 type JSSnapshotCreateAdvisory struct {
 	TypedEvent
@@ -190,6 +202,22 @@ type JSRestoreCompleteAdvisory struct {
 // JSRestoreCompleteAdvisoryType is the schema type for JSSnapshotCreateAdvisory
 const JSRestoreCompleteAdvisoryType = "io.nats.jetstream.advisory.v1.restore_complete"
 
+// JSStreamCorruptionAdvisory is an advisory sent when background scrubbing
+// finds messages that failed their checksum or do not match the stream index.
+type JSStreamCorruptionAdvisory struct {
+	TypedEvent
+	Stream   string `json:"stream"`
+	Server   string `json:"server"`
+	FirstSeq uint64 `json:"first_seq"`
+	LastSeq  uint64 `json:"last_seq"`
+	Error    string `json:"error"`
+	Repair   bool   `json:"repair,omitempty"`
+	Domain   string `json:"domain,omitempty"`
+}
+
+// JSStreamCorruptionAdvisoryType is the schema type for JSStreamCorruptionAdvisory
+const JSStreamCorruptionAdvisoryType = "io.nats.jetstream.advisory.v1.stream_corruption"
+
 // Clustering specific.
 
 // JSStreamLeaderElectedAdvisoryType is sent when the system elects a leader for a stream.
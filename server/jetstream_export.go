@@ -0,0 +1,517 @@
+// Copyright 2023 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/klauspost/compress/s2"
+	"github.com/nats-io/nuid"
+)
+
+// Stream exports are a portable format for the messages of a stream, independent of the
+// storage it uses and of the server version. An export is a sequence of JSON lines, the
+// first one being a StreamExportHeader and every following one a StoredMsg:
+//
+//	{"type":"io.nats.jetstream.stream_export","version":1,"created":...,"config":{...},"state":{...}}
+//	{"subject":"orders.new","seq":1,"hdrs":"TkFUUy8xLjAN...","data":"aGVsbG8=","time":"2023-06-01T10:00:00Z"}
+//	{"subject":"orders.paid","seq":2,"data":"aGVsbG8=","time":"2023-06-01T10:00:01Z"}
+//
+// Headers and payloads are base64 encoded and sequences are in ascending order, with gaps
+// for messages that were deleted. The whole export can be compressed with S2, which readers
+// detect since uncompressed exports always start with a '{'.
+const (
+	// StreamExportType identifies the header of a stream export.
+	StreamExportType = "io.nats.jetstream.stream_export"
+	// StreamExportVersion is the version of the stream exports we write.
+	StreamExportVersion = 1
+)
+
+// StreamExportHeader is the first record of a stream export.
+type StreamExportHeader struct {
+	Type    string       `json:"type"`
+	Version int          `json:"version"`
+	Created time.Time    `json:"created"`
+	Config  StreamConfig `json:"config"`
+	State   StreamState  `json:"state"`
+}
+
+// How long an import waits for the next chunk.
+const streamImportActivityInterval = 5 * time.Second
+
+var (
+	errNotStreamExport     = errors.New("not a stream export")
+	errStreamImportStalled = errors.New("stream import is stalled")
+)
+
+// writeStreamExport will write the messages of the store up to and including last after
+// the header. Returns the number of messages written and the number we skipped since they
+// could not be loaded.
+func writeStreamExport(w io.Writer, hdr *StreamExportHeader, store StreamStore, last uint64, compress bool) (exported, skipped uint64, err error) {
+	var zw *s2.Writer
+	if compress {
+		zw = s2.NewWriter(w)
+		w = zw
+	}
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+
+	hdr.Type, hdr.Version = StreamExportType, StreamExportVersion
+	if err := enc.Encode(hdr); err != nil {
+		return 0, 0, err
+	}
+
+	// We load each sequence on its own since loading the next message would
+	// silently skip over the ones we can not load.
+	var smv StoreMsg
+	for seq := hdr.State.FirstSeq; seq > 0 && seq <= last; seq++ {
+		sm, err := store.LoadMsg(seq, &smv)
+		if err != nil {
+			if err != ErrStoreMsgNotFound && err != errDeletedMsg {
+				skipped++
+			}
+			continue
+		}
+		if err := enc.Encode(&StoredMsg{
+			Subject:  sm.subj,
+			Sequence: seq,
+			Header:   sm.hdr,
+			Data:     sm.msg,
+			Time:     time.Unix(0, sm.ts).UTC(),
+		}); err != nil {
+			return exported, skipped, err
+		}
+		exported++
+	}
+
+	if err := bw.Flush(); err != nil {
+		return exported, skipped, err
+	}
+	if zw != nil {
+		err = zw.Close()
+	}
+	return exported, skipped, err
+}
+
+// streamExportReader reads the messages of a stream export.
+type streamExportReader struct {
+	hdr *StreamExportHeader
+	dec *json.Decoder
+}
+
+// Returns a reader for the export in r after checking its header.
+func newStreamExportReader(r io.Reader) (*streamExportReader, error) {
+	br := bufio.NewReader(r)
+	b, err := br.Peek(1)
+	if err != nil {
+		if err == io.EOF {
+			err = errNotStreamExport
+		}
+		return nil, err
+	}
+	if b[0] == '{' {
+		r = br
+	} else {
+		r = s2.NewReader(br)
+	}
+
+	dec := json.NewDecoder(r)
+	var hdr StreamExportHeader
+	if err := dec.Decode(&hdr); err != nil || hdr.Type != StreamExportType {
+		return nil, errNotStreamExport
+	}
+	if hdr.Version < 1 || hdr.Version > StreamExportVersion {
+		return nil, fmt.Errorf("unsupported stream export version %d", hdr.Version)
+	}
+	return &streamExportReader{hdr: &hdr, dec: dec}, nil
+}
+
+// Returns the next message of the export, io.EOF when there are no more.
+func (er *streamExportReader) next() (*StoredMsg, error) {
+	var sm StoredMsg
+	if err := er.dec.Decode(&sm); err != nil {
+		if err != io.EOF {
+			err = fmt.Errorf("invalid stream export record: %v", err)
+		}
+		return nil, err
+	}
+	return &sm, nil
+}
+
+// importStreamMsgs will store the messages of the export, keeping their sequences and
+// leaving gaps as needed unless we are renumbering them. The check is called after each
+// message is stored and can stop the import. Returns the number of messages stored.
+func importStreamMsgs(store StreamStore, er *streamExportReader, renumber bool, check func() error) (uint64, error) {
+	var state StreamState
+	store.FastState(&state)
+	lseq, empty := state.LastSeq, state.Msgs == 0
+
+	var n uint64
+	for {
+		sm, err := er.next()
+		if err == io.EOF {
+			return n, nil
+		}
+		if err != nil {
+			return n, err
+		}
+		seq := lseq + 1
+		if !renumber {
+			if sm.Sequence < seq {
+				return n, fmt.Errorf("message sequence %d is out of order", sm.Sequence)
+			}
+			if sm.Sequence > seq {
+				if empty {
+					// Nothing stored yet, so we can simply move our first sequence.
+					if _, err := store.Compact(sm.Sequence); err != nil {
+						return n, err
+					}
+				} else {
+					for ; seq < sm.Sequence; seq++ {
+						store.SkipMsg()
+					}
+				}
+			}
+			seq = sm.Sequence
+		}
+		if err := store.StoreRawMsg(sm.Subject, sm.Header, sm.Data, seq, sm.Time.UnixNano()); err != nil {
+			return n, err
+		}
+		lseq, empty = seq, false
+		n++
+		if check != nil {
+			if err := check(); err != nil {
+				return n, err
+			}
+		}
+	}
+}
+
+// Returns a fill function that stores the messages of the export, checking our limits as we go.
+// The export is read while we fill the new stream, so we must not hold its lock.
+func importMsgsFrom(er *streamExportReader, renumber bool) func(mset *stream) error {
+	return func(mset *stream) error {
+		_, err := importStreamMsgs(mset.store, er, renumber, func() error {
+			if mset.js.limitsExceeded(mset.stype) {
+				return NewJSInsufficientResourcesError()
+			}
+			if exceeded, apiErr := mset.jsa.limitsExceeded(mset.stype, mset.tier, mset.sdir); exceeded {
+				if apiErr == nil {
+					apiErr = NewJSAccountResourcesExceededError()
+				}
+				return apiErr
+			}
+			return nil
+		})
+		return err
+	}
+}
+
+// importStream creates a new stream with the messages of the export read from r.
+// The configuration defaults to the one in the export.
+func (a *Account) importStream(name string, req *JSApiStreamImportRequest, r io.Reader) (*stream, error) {
+	er, err := newStreamExportReader(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var cfg StreamConfig
+	if req.Config != nil {
+		cfg = *req.Config
+	} else {
+		cfg = er.hdr.Config
+		if cfg.Name != name {
+			cfg.Subjects = nil
+		}
+		cfg.Name = name
+		// We are not clustered and the messages are all we have.
+		cfg.Replicas = 1
+		cfg.Mirror, cfg.Sources, cfg.RePublish = nil, nil, nil
+		cfg.Template, cfg.Sealed = _EMPTY_, false
+		if req.Renumber {
+			cfg.FirstSeq = 0
+		}
+	}
+	if fseq := er.hdr.State.FirstSeq; !req.Renumber && fseq > 1 && cfg.FirstSeq == 0 {
+		cfg.FirstSeq = fseq
+	}
+	if _, err := a.lookupStream(name); err == nil {
+		return nil, NewJSStreamNameExistRestoreFailedError()
+	}
+
+	// Store the messages before the new stream is live so nothing can be stored in between.
+	return a.addStreamWithFill(&cfg, nil, nil, importMsgsFrom(er, req.Renumber))
+}
+
+// Process a request to export the messages of a stream.
+func (s *Server) jsStreamExportRequest(sub *subscription, c *client, _ *Account, subject, reply string, rmsg []byte) {
+	if c == nil || !s.JetStreamEnabled() {
+		return
+	}
+	ci, acc, _, msg, err := s.getRequestInfo(c, rmsg)
+	if err != nil {
+		s.Warnf(badAPIRequestT, msg)
+		return
+	}
+
+	smsg := string(msg)
+	stream := streamNameFromSubject(subject)
+
+	// If we are in clustered mode we need to be the stream leader to proceed.
+	if s.JetStreamIsClustered() && !acc.JetStreamIsStreamLeader(stream) {
+		return
+	}
+
+	var resp = JSApiStreamExportResponse{ApiResponse: ApiResponse{Type: JSApiStreamExportResponseType}}
+	if !acc.JetStreamEnabled() {
+		resp.Error = NewJSNotEnabledForAccountError()
+		s.sendAPIErrResponse(ci, acc, subject, reply, smsg, s.jsonResponse(&resp))
+		return
+	}
+	if isEmptyRequest(msg) {
+		resp.Error = NewJSBadRequestError()
+		s.sendAPIErrResponse(ci, acc, subject, reply, smsg, s.jsonResponse(&resp))
+		return
+	}
+
+	mset, err := acc.lookupStream(stream)
+	if err != nil {
+		resp.Error = NewJSStreamNotFoundError(Unless(err))
+		s.sendAPIErrResponse(ci, acc, subject, reply, smsg, s.jsonResponse(&resp))
+		return
+	}
+
+	var req JSApiStreamExportRequest
+	if err := json.Unmarshal(msg, &req); err != nil {
+		resp.Error = NewJSInvalidJSONError()
+		s.sendAPIErrResponse(ci, acc, subject, reply, smsg, s.jsonResponse(&resp))
+		return
+	}
+	if !IsValidSubject(req.DeliverSubject) {
+		resp.Error = NewJSSnapshotDeliverSubjectInvalidError()
+		s.sendAPIErrResponse(ci, acc, subject, reply, smsg, s.jsonResponse(&resp))
+		return
+	}
+
+	hdr := &StreamExportHeader{Created: mset.createdTime(), Config: mset.config()}
+	mset.store.FastState(&hdr.State)
+	resp.Config, resp.State = &hdr.Config, &hdr.State
+	s.sendAPIResponse(ci, acc, subject, reply, smsg, s.jsonResponse(resp))
+
+	go func() {
+		s.Noticef("Starting export for stream '%s > %s'", acc.Name, stream)
+		start := time.Now()
+
+		// The chunks are read from a pipe as we write the export.
+		pr, pw := io.Pipe()
+		go func() {
+			bw := bufio.NewWriterSize(pw, defaultSnapshotChunkSize)
+			exported, skipped, err := writeStreamExport(bw, hdr, mset.store, hdr.State.LastSeq, req.Compress)
+			if err == nil {
+				err = bw.Flush()
+			}
+			if skipped > 0 {
+				s.Warnf("Export for stream '%s > %s' skipped %d messages that could not be loaded", acc.Name, stream, skipped)
+			}
+			if err != nil && err != io.ErrClosedPipe {
+				s.Warnf("Export for stream '%s > %s' failed: %v", acc.Name, stream, err)
+			} else if err == nil {
+				s.Noticef("Completed export of %d messages for stream '%s > %s' in %v",
+					exported, acc.Name, stream, time.Since(start).Round(time.Millisecond))
+			}
+			pw.CloseWithError(err)
+		}()
+		s.streamChunks(acc, mset, pr, req.DeliverSubject, req.ChunkSize)
+	}()
+}
+
+// Process a request to create a stream from an export. The export is sent in chunks to the
+// deliver subject of our response, with an empty chunk as EOF. Each chunk is acked with an
+// empty response once we consumed it, and the EOF is answered with the new stream's info.
+// A failure is answered on the chunk we were processing instead.
+func (s *Server) jsStreamImportRequest(sub *subscription, c *client, _ *Account, subject, reply string, rmsg []byte) {
+	if c == nil || !s.JetStreamEnabled() {
+		return
+	}
+	ci, acc, _, msg, err := s.getRequestInfo(c, rmsg)
+	if err != nil {
+		s.Warnf(badAPIRequestT, msg)
+		return
+	}
+
+	var resp = JSApiStreamImportResponse{ApiResponse: ApiResponse{Type: JSApiStreamImportResponseType}}
+
+	// Only supported for non-clustered mode, like point in time restores.
+	if s.JetStreamIsClustered() {
+		if s.JetStreamIsLeader() {
+			resp.Error = NewJSStreamImportClusteredError()
+			s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+		}
+		return
+	}
+	if !acc.JetStreamEnabled() {
+		resp.Error = NewJSNotEnabledForAccountError()
+		s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+		return
+	}
+
+	var req JSApiStreamImportRequest
+	if !isEmptyRequest(msg) {
+		if err := json.Unmarshal(msg, &req); err != nil {
+			resp.Error = NewJSInvalidJSONError()
+			s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+			return
+		}
+	}
+
+	stream := streamNameFromSubject(subject)
+	if _, err := acc.lookupStream(stream); err == nil {
+		resp.Error = NewJSStreamNameExistRestoreFailedError()
+		s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+		return
+	}
+	// Check a configuration now instead of after receiving the export.
+	if req.Config != nil {
+		if req.Config.Name == _EMPTY_ {
+			req.Config.Name = stream
+		} else if req.Config.Name != stream {
+			resp.Error = NewJSStreamMismatchError()
+			s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+			return
+		}
+		if _, apiErr := s.checkStreamCfg(req.Config, acc); apiErr != nil {
+			resp.Error = apiErr
+			s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+			return
+		}
+	}
+
+	s.processStreamImport(ci, acc, stream, &req, subject, reply, string(msg))
+}
+
+// A chunk of an export received for an import.
+type importChunk struct {
+	data  []byte
+	reply string
+}
+
+func (s *Server) processStreamImport(ci *ClientInfo, acc *Account, stream string, req *JSApiStreamImportRequest, subject, reply, msg string) {
+	var resp = JSApiStreamImportResponse{ApiResponse: ApiResponse{Type: JSApiStreamImportResponseType}}
+
+	importSubj := fmt.Sprintf(jsImportDeliverT, stream, nuid.Next())
+	chunks := newIPQueue[*importChunk](s, fmt.Sprintf("[ACC:%s] stream '%s' import", acc.Name, stream))
+
+	processChunk := func(sub *subscription, c *client, _ *Account, subject, reply string, msg []byte) {
+		// Account client messages have \r\n on end.
+		if len(msg) >= LEN_CR_LF {
+			msg = msg[:len(msg)-LEN_CR_LF]
+		}
+		chunks.push(&importChunk{copyBytes(msg), reply})
+	}
+
+	sub, err := acc.subscribeInternal(importSubj, processChunk)
+	if err != nil {
+		chunks.unregister()
+		resp.Error = NewJSRestoreSubscribeFailedError(err, importSubj)
+		s.sendAPIErrResponse(ci, acc, subject, reply, msg, s.jsonResponse(&resp))
+		return
+	}
+
+	// Mark the subject so the end user knows where to send the chunks.
+	resp.DeliverSubject = importSubj
+	s.sendAPIResponse(ci, acc, subject, reply, msg, s.jsonResponse(resp))
+
+	s.startGoRoutine(func() {
+		defer s.grWG.Done()
+		defer func() {
+			sub.client.processUnsub(sub.sid)
+			chunks.unregister()
+		}()
+
+		s.Noticef("Starting import for stream '%s > %s'", acc.Name, stream)
+		start := time.Now()
+
+		ir := &streamImportReader{s: s, acc: acc, chunks: chunks}
+		mset, err := acc.importStream(stream, req, ir)
+
+		var resp = JSApiStreamCreateResponse{ApiResponse: ApiResponse{Type: JSApiStreamCreateResponseType}}
+		if err != nil {
+			var apiErr *ApiError
+			if errors.As(err, &apiErr) {
+				resp.Error = apiErr
+			} else {
+				resp.Error = NewJSStreamImportError(err, Unless(err))
+			}
+			s.Warnf("Import for stream '%s > %s' failed: %v", acc.Name, stream, err)
+		} else {
+			resp.StreamInfo = &StreamInfo{Created: mset.createdTime(), State: mset.state(), Config: mset.config()}
+			s.Noticef("Completed import of %s for stream '%s > %s' in %v",
+				friendlyBytes(int64(ir.total)), acc.Name, stream, time.Since(start).Round(time.Millisecond))
+		}
+		// Respond on the chunk we stopped at, the EOF when successful.
+		if ir.reply != _EMPTY_ {
+			s.sendInternalAccountMsg(acc, ir.reply, s.jsonResponse(&resp))
+		}
+	})
+}
+
+// streamImportReader reads the chunks of an import as they arrive. A chunk is acked once
+// we need the next one, which provides the flow control for the sender.
+type streamImportReader struct {
+	s      *Server
+	acc    *Account
+	chunks *ipQueue[*importChunk]
+	buf    []byte
+	reply  string
+	eof    bool
+	total  int
+}
+
+func (ir *streamImportReader) Read(p []byte) (int, error) {
+	for len(ir.buf) == 0 {
+		if ir.eof {
+			return 0, io.EOF
+		}
+		if ir.reply != _EMPTY_ {
+			ir.s.sendInternalAccountMsg(ir.acc, ir.reply, nil)
+			ir.reply = _EMPTY_
+		}
+		select {
+		case <-ir.chunks.ch:
+		case <-time.After(streamImportActivityInterval):
+			return 0, errStreamImportStalled
+		case <-ir.s.quitCh:
+			return 0, ErrServerNotRunning
+		}
+		c, ok := ir.chunks.popOne()
+		if !ok {
+			continue
+		}
+		// We require reply subjects for flow control and to communicate back failures.
+		if c.reply == _EMPTY_ {
+			return 0, errors.New("stream import requires reply subject for each chunk")
+		}
+		ir.reply = c.reply
+		ir.buf, ir.eof = c.data, len(c.data) == 0
+		ir.total += len(c.data)
+	}
+	n := copy(p, ir.buf)
+	ir.buf = ir.buf[n:]
+	return n, nil
+}
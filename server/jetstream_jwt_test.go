@@ -22,6 +22,7 @@ import (
 	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"reflect"
 	"strings"
 	"sync/atomic"
 	"testing"
@@ -530,7 +531,7 @@ func TestJetStreamJWTClusteredTiers(t *testing.T) {
 	require_True(t, info.Store == 4400 || info.Store == 4439)
 	require_True(t, info.Streams == 3)
 	require_True(t, info.Consumers == 3)
-	require_True(t, info.Limits == JetStreamAccountLimits{})
+	require_True(t, reflect.DeepEqual(info.Limits, JetStreamAccountLimits{}))
 	r1 := info.Tiers["R1"]
 	require_True(t, r1.Streams == 2)
 	require_True(t, r1.Consumers == 2)
@@ -538,7 +539,7 @@ func TestJetStreamJWTClusteredTiers(t *testing.T) {
 	// Alternative to checking both values is, prior to the info request, wait for another update
 	require_True(t, r1.Store == 1100 || r1.Store == 1139)
 	require_True(t, r1.Memory == 0)
-	require_True(t, r1.Limits == JetStreamAccountLimits{
+	require_True(t, reflect.DeepEqual(r1.Limits, JetStreamAccountLimits{
 		MaxMemory:            0,
 		MaxStore:             1100,
 		MaxStreams:           2,
@@ -547,13 +548,13 @@ func TestJetStreamJWTClusteredTiers(t *testing.T) {
 		MemoryMaxStreamBytes: -1,
 		StoreMaxStreamBytes:  -1,
 		MaxBytesRequired:     false,
-	})
+	}))
 	r3 := info.Tiers["R3"]
 	require_True(t, r3.Streams == 1)
 	require_True(t, r3.Consumers == 1)
 	require_True(t, r3.Store == 3300)
 	require_True(t, r3.Memory == 0)
-	require_True(t, r3.Limits == JetStreamAccountLimits{
+	require_True(t, reflect.DeepEqual(r3.Limits, JetStreamAccountLimits{
 		MaxMemory:            0,
 		MaxStore:             3300,
 		MaxStreams:           1,
@@ -562,7 +563,7 @@ func TestJetStreamJWTClusteredTiers(t *testing.T) {
 		MemoryMaxStreamBytes: -1,
 		StoreMaxStreamBytes:  -1,
 		MaxBytesRequired:     false,
-	})
+	}))
 }
 
 func TestJetStreamJWTClusteredTiersChange(t *testing.T) {
@@ -0,0 +1,457 @@
+// Copyright 2023 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"time"
+)
+
+// Default for how long consumer checkpoints are kept.
+const defaultCheckpointMaxAge = 24 * time.Hour
+
+// Name of the backup to select the most recent one.
+const latestBackup = "latest"
+
+// setupCheckpoints starts or stops recording our state based on the configuration of our stream.
+// Lock should not be held.
+func (o *consumer) setupCheckpoints() {
+	cp := o.checkpointConfig()
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	stopAndClearTimer(&o.cptmr)
+	if cp == nil || o.closed || !o.isLeader() {
+		return
+	}
+	// Pick up the ones from before a restart.
+	if o.cps == nil {
+		if store, ok := o.store.(*consumerFileStore); ok {
+			o.cps, _ = store.readCheckpoints()
+		}
+	}
+	o.cptmr = time.AfterFunc(cp.Interval, o.checkpoint)
+}
+
+// Returns the checkpoint configuration of our stream.
+// Lock should not be held.
+func (o *consumer) checkpointConfig() *ConsumerCheckpoints {
+	o.mu.RLock()
+	mset := o.mset
+	o.mu.RUnlock()
+	if mset == nil {
+		return nil
+	}
+	mset.mu.RLock()
+	defer mset.mu.RUnlock()
+	return mset.cfg.ConsumerCheckpoints
+}
+
+// checkpoint records our current state, removes the ones past their max age
+// and persists them when we are file based.
+func (o *consumer) checkpoint() {
+	cp := o.checkpointConfig()
+	if cp == nil {
+		return
+	}
+	maxAge := cp.MaxAge
+	if maxAge == 0 {
+		maxAge = defaultCheckpointMaxAge
+	}
+
+	o.mu.Lock()
+	if o.closed || o.cptmr == nil {
+		o.mu.Unlock()
+		return
+	}
+	o.cptmr.Reset(cp.Interval)
+
+	now := time.Now().UnixNano()
+	state := &ConsumerState{
+		Delivered: SequencePair{Consumer: o.dseq - 1, Stream: o.sseq - 1},
+		AckFloor:  SequencePair{Consumer: o.adflr, Stream: o.asflr},
+	}
+	if len(o.pending) > 0 {
+		state.Pending = make(map[uint64]*Pending, len(o.pending))
+		for seq, p := range o.pending {
+			state.Pending[seq] = &Pending{p.Sequence, p.Timestamp}
+		}
+	}
+	if len(o.rdc) > 0 {
+		state.Redelivered = make(map[uint64]uint64, len(o.rdc))
+		for seq, dc := range o.rdc {
+			state.Redelivered[seq] = dc
+		}
+	}
+
+	// Keep the newest checkpoint past the max age, it holds the state at the start of our window.
+	cutoff, first := now-int64(maxAge), 0
+	for i := 1; i < len(o.cps) && o.cps[i].ts <= cutoff; i++ {
+		first = i
+	}
+	// An unchanged state is covered by the previous checkpoint.
+	changed := len(o.cps) == 0 || !reflect.DeepEqual(o.cps[len(o.cps)-1].state, state)
+	if first == 0 && !changed {
+		o.mu.Unlock()
+		return
+	}
+	// We never modify in place, so the slice can be written out without the lock.
+	cps := make([]*consumerCheckpoint, 0, len(o.cps)-first+1)
+	cps = append(cps, o.cps[first:]...)
+	if changed {
+		cps = append(cps, &consumerCheckpoint{now, state})
+	}
+	o.cps = cps
+	store, ok := o.store.(*consumerFileStore)
+	o.mu.Unlock()
+
+	if ok {
+		if err := store.writeCheckpoints(cps); err != nil && err != ErrStoreClosed {
+			o.srv.Warnf("Error writing checkpoints for consumer '%s > %s > %s': %v", o.acc.Name, o.stream, o.name, err)
+		}
+	}
+}
+
+// Returns the state of the newest checkpoint at or before the time.
+func consumerStateAt(cps []*consumerCheckpoint, ts int64) *ConsumerState {
+	var state *ConsumerState
+	for _, cp := range cps {
+		if cp.ts > ts {
+			break
+		}
+		state = cp.state
+	}
+	return state
+}
+
+// Returns the last sequence stored at or before the time, zero if there is none.
+func lastSeqAtTime(store StreamStore, ts int64) uint64 {
+	var state StreamState
+	store.FastState(&state)
+	seq := store.GetSeqFromTime(time.Unix(0, ts+1))
+	if seq == 0 || seq > state.LastSeq {
+		return state.LastSeq
+	}
+	if seq <= state.FirstSeq {
+		return 0
+	}
+	return seq - 1
+}
+
+// Returns a fill function that copies the messages from the source store up to and including last,
+// keeping their sequences and timestamps. Messages are loaded one at a time so the lock of a live source
+// stream is never held for long.
+func copyMsgsFrom(src StreamStore, last uint64) func(mset *stream) error {
+	return func(mset *stream) error {
+		store := mset.store
+		var smv StoreMsg
+		var state StreamState
+		store.FastState(&state)
+		for seq := state.LastSeq + 1; seq <= last; seq++ {
+			sm, err := src.LoadMsg(seq, &smv)
+			if err == ErrStoreMsgNotFound || err == errDeletedMsg {
+				store.SkipMsg()
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			if err := store.StoreRawMsg(sm.subj, sm.hdr, sm.msg, seq, sm.ts); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// pitrSource is the stream to restore from, and the consumers to rewind.
+type pitrSource struct {
+	cfg       StreamConfig
+	store     StreamStore
+	consumers map[string]*pitrConsumer
+	backup    string
+}
+
+type pitrConsumer struct {
+	cfg ConsumerConfig
+	cps []*consumerCheckpoint
+}
+
+// Gathers the live stream and the consumers to rewind as the source.
+func (a *Account) livePointInTimeSource(stream string, consumers []string) (*pitrSource, error) {
+	mset, err := a.lookupStream(stream)
+	if err != nil {
+		return nil, NewJSStreamNotFoundError()
+	}
+	src := &pitrSource{cfg: mset.config(), store: mset.store, consumers: make(map[string]*pitrConsumer)}
+	for _, name := range consumers {
+		o := mset.lookupConsumer(name)
+		if o == nil {
+			return nil, NewJSConsumerNotFoundError()
+		}
+		o.mu.RLock()
+		src.consumers[name] = &pitrConsumer{cfg: o.cfg, cps: o.cps}
+		o.mu.RUnlock()
+	}
+	return src, nil
+}
+
+// Opens the stream of the backup in a temporary directory as the source, and truncates it to the time.
+// The returned function will stop the store and remove the directory.
+func (a *Account) backupPointInTimeSource(jsa *jsAccount, stream, id string, consumers []string, ts int64) (*pitrSource, func(), error) {
+	s := a.srv
+	if id == latestBackup {
+		id = _EMPTY_
+	}
+	file, err := s.findStreamBackup(a, stream, id)
+	if err != nil {
+		return nil, nil, err
+	}
+	sb, dfile, err := readStreamBackup(file)
+	if err != nil {
+		return nil, nil, err
+	}
+	f, err := os.Open(dfile)
+	if err != nil {
+		return nil, nil, err
+	}
+	sdir, err := a.extractSnapshot(jsa, f)
+	f.Close()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var fcfg FileStreamInfo
+	b, err := os.ReadFile(filepath.Join(sdir, JetStreamMetaFile))
+	if err == nil {
+		err = json.Unmarshal(b, &fcfg)
+	}
+	if err != nil {
+		os.RemoveAll(sdir)
+		return nil, nil, err
+	}
+
+	// Make sure nothing expires while we have it open.
+	cfg := fcfg.StreamConfig
+	cfg.MaxAge = 0
+	fsCfg := FileStoreConfig{StoreDir: sdir}
+	prf := s.jsKeyGen(a.Name)
+	if prf != nil {
+		fsCfg.Cipher = s.getOpts().JetStreamCipher
+	}
+	fs, err := newFileStoreWithCreated(fsCfg, cfg, fcfg.Created, prf, s.jsOldKeyGen(a.Name))
+	if err != nil {
+		os.RemoveAll(sdir)
+		return nil, nil, err
+	}
+	cleanup := func() {
+		fs.Stop()
+		os.RemoveAll(sdir)
+	}
+
+	src := &pitrSource{cfg: fcfg.StreamConfig, store: fs, consumers: make(map[string]*pitrConsumer), backup: sb.ID}
+	for _, name := range consumers {
+		var ccfg FileConsumerInfo
+		b, err := os.ReadFile(filepath.Join(sdir, consumerDir, name, JetStreamMetaFile))
+		if err != nil {
+			cleanup()
+			return nil, nil, NewJSConsumerNotFoundError()
+		}
+		if err := json.Unmarshal(b, &ccfg); err != nil {
+			cleanup()
+			return nil, nil, err
+		}
+		cs, err := fs.ConsumerStore(name, &ccfg.ConsumerConfig)
+		if err != nil {
+			cleanup()
+			return nil, nil, err
+		}
+		cps, err := cs.(*consumerFileStore).readCheckpoints()
+		if err != nil {
+			cleanup()
+			return nil, nil, err
+		}
+		src.consumers[name] = &pitrConsumer{cfg: ccfg.ConsumerConfig, cps: cps}
+	}
+
+	// Drop everything stored after the time.
+	if last := lastSeqAtTime(fs, ts); last == 0 {
+		_, err = fs.Purge()
+	} else if last < fs.State().LastSeq {
+		err = fs.Truncate(last)
+	}
+	if err != nil {
+		cleanup()
+		return nil, nil, err
+	}
+	return src, cleanup, nil
+}
+
+// restoreStreamToTime creates a new stream holding the messages the source stream had stored
+// at the time of the request, with their original sequences. The source is either the live
+// stream or one of its backups. Requested consumers are recreated on the new stream with the
+// state of their newest checkpoint at or before the time. The new stream has no max age.
+func (a *Account) restoreStreamToTime(stream string, req *JSApiStreamPointInTimeRequest) (*stream, *pitrSource, error) {
+	_, jsa, err := a.checkForJetStream()
+	if err != nil {
+		return nil, nil, err
+	}
+	name := req.Name
+	if name == _EMPTY_ {
+		name = stream
+	}
+	if _, err := a.lookupStream(name); err == nil {
+		return nil, nil, NewJSStreamNameExistRestoreFailedError()
+	}
+	ts := req.Time.UnixNano()
+
+	var src *pitrSource
+	if req.Backup != _EMPTY_ {
+		var cleanup func()
+		if src, cleanup, err = a.backupPointInTimeSource(jsa, stream, req.Backup, req.Consumers, ts); err != nil {
+			return nil, nil, err
+		}
+		defer cleanup()
+	} else if src, err = a.livePointInTimeSource(stream, req.Consumers); err != nil {
+		return nil, nil, err
+	}
+
+	// Make sure all consumers can be rewound before creating anything.
+	states := make(map[string]*ConsumerState, len(src.consumers))
+	for cname, pc := range src.consumers {
+		if states[cname] = consumerStateAt(pc.cps, ts); states[cname] == nil {
+			return nil, nil, NewJSConsumerNoCheckpointError(cname)
+		}
+	}
+
+	last := lastSeqAtTime(src.store, ts)
+	cfg := src.cfg
+	cfg.Name = name
+	if len(req.Subjects) > 0 {
+		cfg.Subjects = req.Subjects
+	} else if name != src.cfg.Name {
+		cfg.Subjects = nil
+	}
+	cfg.Mirror, cfg.Sources, cfg.RePublish = nil, nil, nil
+	cfg.Template, cfg.Sealed = _EMPTY_, false
+	// Messages from the past would expire right away, so the copy keeps them until told otherwise.
+	cfg.MaxAge = 0
+	if fseq := src.store.State().FirstSeq; fseq > 1 {
+		cfg.FirstSeq = fseq
+	}
+
+	// Copy the messages before the new stream is live so nothing can be stored in between.
+	mset, err := a.addStreamWithFill(&cfg, nil, nil, copyMsgsFrom(src.store, last))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for cname, pc := range src.consumers {
+		ccfg := pc.cfg
+		isEphemeral := !isDurableConsumer(&ccfg)
+		if isEphemeral {
+			ccfg.Durable = cname
+		}
+		o, err := mset.addConsumer(&ccfg)
+		if err == nil {
+			o.mu.Lock()
+			if err = o.setStoreState(states[cname]); err == nil {
+				o.streamNumPending()
+			}
+			o.mu.Unlock()
+		}
+		if err != nil {
+			mset.delete()
+			return nil, nil, fmt.Errorf("error restoring consumer [%q]: %v", cname, err)
+		}
+		if isEphemeral {
+			o.switchToEphemeral()
+		}
+	}
+	return mset, src, nil
+}
+
+// Request to create a new stream with the messages of a stream up to a point in time.
+func (s *Server) jsStreamPointInTimeRequest(sub *subscription, c *client, _ *Account, subject, reply string, rmsg []byte) {
+	if c == nil || !s.JetStreamEnabled() {
+		return
+	}
+	ci, acc, _, msg, err := s.getRequestInfo(c, rmsg)
+	if err != nil {
+		s.Warnf(badAPIRequestT, msg)
+		return
+	}
+
+	var resp = JSApiStreamPointInTimeResponse{ApiResponse: ApiResponse{Type: JSApiStreamPointInTimeResponseType}}
+
+	// Only supported for non-clustered mode, like restoring from backups.
+	if s.JetStreamIsClustered() {
+		if s.JetStreamIsLeader() {
+			resp.Error = NewJSStreamPointInTimeClusteredError()
+			s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+		}
+		return
+	}
+	if !acc.JetStreamEnabled() {
+		resp.Error = NewJSNotEnabledForAccountError()
+		s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+		return
+	}
+
+	var req JSApiStreamPointInTimeRequest
+	if err := json.Unmarshal(msg, &req); err != nil {
+		resp.Error = NewJSInvalidJSONError()
+		s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+		return
+	}
+	if req.Time.IsZero() {
+		resp.Error = NewJSBadRequestError()
+		s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+		return
+	}
+
+	stream := streamNameFromSubject(subject)
+
+	// Copying the messages can take a while.
+	go func() {
+		mset, src, err := acc.restoreStreamToTime(stream, &req)
+		if err != nil {
+			var apiErr *ApiError
+			if errors.As(err, &apiErr) {
+				resp.Error = apiErr
+			} else {
+				resp.Error = NewJSStreamPointInTimeError(err, Unless(err))
+			}
+			s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+			return
+		}
+		s.Noticef("Restored stream '%s > %s' to %v as '%s'", acc.Name, stream, req.Time, mset.name())
+		resp.Backup = src.backup
+		for cname := range src.consumers {
+			resp.Consumers = append(resp.Consumers, cname)
+		}
+		resp.StreamInfo = &StreamInfo{
+			Created: mset.createdTime(),
+			State:   mset.state(),
+			Config:  mset.config(),
+		}
+		s.sendAPIResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+	}()
+}
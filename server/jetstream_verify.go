@@ -0,0 +1,499 @@
+// Copyright 2023 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/minio/highwayhash"
+)
+
+const (
+	// Default number of sequences checksummed together.
+	defaultVerifyChunkSize = 10_000
+	// Maximum number of chunks we checksum, larger chunks are used for longer ranges
+	// so the checksums of the replicas fit into their responses.
+	maxVerifyChunks = 4096
+	// How long a replica waits to apply the range before checksumming.
+	verifyCatchupWait = 2 * time.Second
+	// How long the leader waits for the replicas.
+	verifyResponseWait = 10 * time.Second
+)
+
+// streamVerifyRequest is sent by the leader to all members of the stream group.
+// Members listed in Repair will reset and catch up from the leader instead.
+type streamVerifyRequest struct {
+	Start  uint64   `json:"start"`
+	End    uint64   `json:"end"`
+	Chunk  uint64   `json:"chunk"`
+	Repair []string `json:"repair,omitempty"`
+}
+
+// streamVerifyResult is the response of a member of the stream group.
+// First is the member's first sequence once it was done checksumming, messages
+// removed by limits or interest before that may have been checksummed or not.
+type streamVerifyResult struct {
+	Peer     string   `json:"peer"`
+	Checksum uint64   `json:"checksum"`
+	Chunks   []uint64 `json:"chunks,omitempty"`
+	First    uint64   `json:"first,omitempty"`
+	Behind   bool     `json:"behind,omitempty"`
+	Error    string   `json:"error,omitempty"`
+}
+
+// checksumRange computes a highwayhash checksum for each chunk of sequences in the range,
+// covering sequences, timestamps, subjects, headers and payloads, and one over all chunks.
+func (mset *stream) checksumRange(start, end, chunk uint64) (uint64, []uint64, error) {
+	mset.mu.RLock()
+	store, name := mset.store, mset.cfg.Name
+	mset.mu.RUnlock()
+	if store == nil {
+		return 0, nil, ErrStoreClosed
+	}
+
+	key := sha256.Sum256([]byte(name))
+	hh, err := highwayhash.New64(key[:])
+	if err != nil {
+		return 0, nil, err
+	}
+	total, _ := highwayhash.New64(key[:])
+
+	var smv StoreMsg
+	var b [binary.MaxVarintLen64]byte
+	var chunks []uint64
+	for first := start; first <= end; first += chunk {
+		last := first + chunk - 1
+		if last > end || last < first {
+			last = end
+		}
+		hh.Reset()
+		for seq := first; seq <= last; seq++ {
+			sm, err := store.LoadMsg(seq, &smv)
+			if err == ErrStoreMsgNotFound || err == errDeletedMsg {
+				continue
+			}
+			if err != nil {
+				return 0, nil, err
+			}
+			hh.Write(b[:binary.PutUvarint(b[:], seq)])
+			hh.Write(b[:binary.PutVarint(b[:], sm.ts)])
+			for _, field := range [][]byte{[]byte(sm.subj), sm.hdr, sm.msg} {
+				hh.Write(b[:binary.PutUvarint(b[:], uint64(len(field)))])
+				hh.Write(field)
+			}
+		}
+		sum := hh.Sum64()
+		chunks = append(chunks, sum)
+		binary.LittleEndian.PutUint64(b[:8], sum)
+		total.Write(b[:8])
+		if last == end {
+			break
+		}
+	}
+	return total.Sum64(), chunks, nil
+}
+
+// firstSeq returns the first sequence in our store.
+func (mset *stream) firstSeq() uint64 {
+	mset.mu.RLock()
+	store := mset.store
+	mset.mu.RUnlock()
+	if store == nil {
+		return 0
+	}
+	var state StreamState
+	store.FastState(&state)
+	return state.FirstSeq
+}
+
+func (mset *stream) handleClusterStreamVerifyRequest(_ *subscription, c *client, _ *Account, subject, reply string, msg []byte) {
+	var req streamVerifyRequest
+	if err := json.Unmarshal(msg, &req); err != nil {
+		return
+	}
+	go mset.processClusterStreamVerifyRequest(reply, &req)
+}
+
+// processClusterStreamVerifyRequest is run by all members of the stream group. Unless asked to
+// repair, members checksum the range once they have applied it and respond with the results.
+func (mset *stream) processClusterStreamVerifyRequest(reply string, req *streamVerifyRequest) {
+	mset.mu.RLock()
+	sysc, node := mset.sysc, mset.node
+	mset.mu.RUnlock()
+	// The leader sent this and already checksummed the range itself.
+	if node == nil || mset.isLeader() {
+		return
+	}
+	peer := node.ID()
+
+	for _, p := range req.Repair {
+		if p == peer {
+			mset.srv.Warnf("Replica of stream '%s > %s' does not match the leader, resetting", mset.accName(), mset.name())
+			mset.resetClusteredState(errReplicaMismatch)
+			return
+		}
+	}
+	if len(req.Repair) > 0 || req.Chunk == 0 || req.Start > req.End || (req.End-req.Start)/req.Chunk >= maxVerifyChunks {
+		return
+	}
+
+	result := &streamVerifyResult{Peer: peer}
+	// We may not have applied the whole range yet. Checksumming a partial range
+	// would look like a mismatch, so report that we are behind instead.
+	for deadline := time.Now().Add(verifyCatchupWait); mset.lastSeq() < req.End && time.Now().Before(deadline); {
+		time.Sleep(50 * time.Millisecond)
+	}
+	if last := mset.lastSeq(); last < req.End {
+		result.Behind = true
+		result.Error = fmt.Sprintf("replica is behind, at sequence %d of %d", last, req.End)
+	} else if sum, chunks, err := mset.checksumRange(req.Start, req.End, req.Chunk); err != nil {
+		result.Error = err.Error()
+	} else {
+		result.Checksum, result.Chunks, result.First = sum, chunks, mset.firstSeq()
+	}
+	sysc.sendInternalMsg(reply, _EMPTY_, nil, result)
+}
+
+// streamVerifyRound holds the checksums of one round of verification on all members.
+type streamVerifyRound struct {
+	sum    uint64
+	chunks []uint64
+	// Sequences before first may have been removed on some members but not
+	// others while checksumming, so chunks starting before it are not compared.
+	first  uint64
+	byPeer map[string]*streamVerifyResult
+}
+
+// verifyRound checksums the range on all members of the stream group, including us.
+func (mset *stream) verifyRound(start, end, chunk uint64) (*streamVerifyRound, *ApiError) {
+	sum, chunks, err := mset.checksumRange(start, end, chunk)
+	if err != nil {
+		return nil, NewJSStreamGeneralError(err, Unless(err))
+	}
+	round := &streamVerifyRound{sum: sum, chunks: chunks, byPeer: make(map[string]*streamVerifyResult)}
+
+	rg, node := mset.raftGroup(), mset.raftNode()
+	if rg == nil || node == nil || len(rg.Peers) <= 1 {
+		return round, nil
+	}
+
+	// Ask all members, we will ignore our own request.
+	s, ourID := mset.srv, node.ID()
+	s.mu.Lock()
+	if s.sys == nil {
+		s.mu.Unlock()
+		return nil, NewJSClusterNotAvailError()
+	}
+	inbox := s.newRespInbox()
+	results := make(chan *streamVerifyResult, len(rg.Peers))
+	s.sys.replies[inbox] = func(_ *subscription, _ *client, _ *Account, _, _ string, msg []byte) {
+		var result streamVerifyResult
+		if err := json.Unmarshal(msg, &result); err == nil {
+			select {
+			case results <- &result:
+			default:
+			}
+		}
+	}
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		if s.sys != nil && s.sys.replies != nil {
+			delete(s.sys.replies, inbox)
+		}
+		s.mu.Unlock()
+	}()
+
+	vsubj := fmt.Sprintf(clusterStreamVerifyT, mset.accName(), mset.name())
+	s.sendInternalMsgLocked(vsubj, inbox, nil, &streamVerifyRequest{Start: start, End: end, Chunk: chunk})
+
+	timeout := time.NewTimer(verifyResponseWait)
+	defer timeout.Stop()
+	for len(round.byPeer) < len(rg.Peers)-1 {
+		select {
+		case result := <-results:
+			if result.Peer != ourID && rg.isMember(result.Peer) {
+				round.byPeer[result.Peer] = result
+			}
+			continue
+		case <-timeout.C:
+		case <-s.quitCh:
+		}
+		break
+	}
+
+	// Pin the start of the compared range to what all members still hold.
+	round.first = start
+	if first := mset.firstSeq(); first > round.first {
+		round.first = first
+	}
+	for _, result := range round.byPeer {
+		if result.Error == _EMPTY_ && result.First > round.first {
+			round.first = result.First
+		}
+	}
+	return round, nil
+}
+
+// mismatches returns the ranges where the result of a member differs from ours.
+func (round *streamVerifyRound) mismatches(result *streamVerifyResult, start, end, chunk uint64) []*SequenceRange {
+	var mismatches []*SequenceRange
+	for i, csum := range round.chunks {
+		first := start + uint64(i)*chunk
+		if first < round.first {
+			continue
+		}
+		if i < len(result.Chunks) && result.Chunks[i] == csum {
+			continue
+		}
+		last := first + chunk - 1
+		if last > end || last < first {
+			last = end
+		}
+		// Merge adjacent ranges.
+		if n := len(mismatches); n > 0 && mismatches[n-1].Last+1 == first {
+			mismatches[n-1].Last = last
+		} else {
+			mismatches = append(mismatches, &SequenceRange{First: first, Last: last})
+		}
+	}
+	return mismatches
+}
+
+// comparedStart returns the first sequence of the first chunk we compared.
+func (round *streamVerifyRound) comparedStart(start, chunk uint64) uint64 {
+	if round.first <= start {
+		return start
+	}
+	return start + (round.first-start+chunk-1)/chunk*chunk
+}
+
+// verifyReplicas checksums the range on all members of the stream group and compares
+// the results of the replicas against ours. Should be called by the leader.
+func (mset *stream) verifyReplicas(req *JSApiStreamVerifyRequest) (*JSApiStreamVerifyResponse, *ApiError) {
+	state := mset.state()
+	start, end, chunk := req.StartSeq, req.EndSeq, req.ChunkSize
+	if start < state.FirstSeq {
+		start = state.FirstSeq
+	}
+	if end == 0 || end > state.LastSeq {
+		end = state.LastSeq
+	}
+	if start == 0 {
+		start = 1
+	}
+	if chunk == 0 {
+		chunk = defaultVerifyChunkSize
+	}
+	if req.EndSeq > 0 && req.StartSeq > req.EndSeq {
+		return nil, NewJSBadRequestError()
+	}
+	if end >= start {
+		if minChunk := (end-start)/maxVerifyChunks + 1; chunk < minChunk {
+			chunk = minChunk
+		}
+	}
+
+	// Only one verification per stream at a time.
+	mset.mu.Lock()
+	if mset.verifying {
+		mset.mu.Unlock()
+		return nil, NewJSStreamGeneralError(errors.New("stream verification already in progress"))
+	}
+	mset.verifying = true
+	mset.mu.Unlock()
+	defer func() {
+		mset.mu.Lock()
+		mset.verifying = false
+		mset.mu.Unlock()
+	}()
+
+	resp := &JSApiStreamVerifyResponse{
+		ApiResponse: ApiResponse{Type: JSApiStreamVerifyResponseType},
+		Stream:      mset.name(),
+		StartSeq:    start,
+		EndSeq:      end,
+		ChunkSize:   chunk,
+		Leader:      mset.srv.Name(),
+		Consistent:  true,
+	}
+	if start > end {
+		return resp, nil
+	}
+
+	round, apiErr := mset.verifyRound(start, end, chunk)
+	if apiErr != nil {
+		return nil, apiErr
+	}
+	resp.Checksum = fmt.Sprintf("%016x", round.sum)
+
+	rg, node := mset.raftGroup(), mset.raftNode()
+	if rg == nil || node == nil || len(rg.Peers) <= 1 {
+		return resp, nil
+	}
+	s, ourID := mset.srv, node.ID()
+
+	// Mismatches could still be caused by messages removed on one side only while
+	// checksumming, so before resetting any replica make sure a second round agrees.
+	var confirm *streamVerifyRound
+	if req.Repair {
+		for _, result := range round.byPeer {
+			if result.Error == _EMPTY_ && len(round.mismatches(result, start, end, chunk)) > 0 {
+				if confirm, apiErr = mset.verifyRound(start, end, chunk); apiErr != nil {
+					return nil, apiErr
+				}
+				break
+			}
+		}
+	}
+	resp.StartSeq = round.comparedStart(start, chunk)
+
+	var repair []string
+	for _, peer := range rg.Peers {
+		if peer == ourID {
+			continue
+		}
+		rc := &StreamReplicaCheck{Name: s.serverNameForNode(peer)}
+		resp.Replicas = append(resp.Replicas, rc)
+		result := round.byPeer[peer]
+		switch {
+		case result == nil:
+			rc.Error = "no response"
+		case result.Error != _EMPTY_:
+			rc.Error = result.Error
+		default:
+			rc.Checksum = fmt.Sprintf("%016x", result.Checksum)
+			rc.Mismatches = round.mismatches(result, start, end, chunk)
+		}
+		if rc.Error != _EMPTY_ || len(rc.Mismatches) > 0 {
+			resp.Consistent = false
+		}
+		// Only repair replicas that are caught up and still mismatch when checked again.
+		if confirm != nil && len(rc.Mismatches) > 0 {
+			if cr := confirm.byPeer[peer]; cr != nil && cr.Error == _EMPTY_ && len(confirm.mismatches(cr, start, end, chunk)) > 0 {
+				rc.Repairing = true
+				repair = append(repair, peer)
+			}
+		}
+	}
+
+	if len(repair) > 0 {
+		vsubj := fmt.Sprintf(clusterStreamVerifyT, mset.accName(), mset.name())
+		s.sendInternalMsgLocked(vsubj, _EMPTY_, nil, &streamVerifyRequest{Repair: repair})
+	}
+	return resp, nil
+}
+
+// Request to verify the replicas of a stream hold the same messages as the leader.
+func (s *Server) jsStreamVerifyRequest(sub *subscription, c *client, _ *Account, subject, reply string, rmsg []byte) {
+	if c == nil || !s.JetStreamEnabled() {
+		return
+	}
+	ci, acc, _, msg, err := s.getRequestInfo(c, rmsg)
+	if err != nil {
+		s.Warnf(badAPIRequestT, msg)
+		return
+	}
+
+	stream := streamNameFromSubject(subject)
+
+	var resp = JSApiStreamVerifyResponse{ApiResponse: ApiResponse{Type: JSApiStreamVerifyResponseType}}
+
+	// If we are in clustered mode we need to be the stream leader to proceed.
+	if s.JetStreamIsClustered() {
+		// Check to make sure the stream is assigned.
+		js, cc := s.getJetStreamCluster()
+		if js == nil || cc == nil {
+			return
+		}
+		if js.isLeaderless() {
+			resp.Error = NewJSClusterNotAvailError()
+			s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+			return
+		}
+
+		js.mu.RLock()
+		isLeader, sa := cc.isLeader(), js.streamAssignment(acc.Name, stream)
+		js.mu.RUnlock()
+
+		if isLeader && sa == nil {
+			// We can't find the stream, so mimic what would be the errors below.
+			if hasJS, doErr := acc.checkJetStream(); !hasJS {
+				if doErr {
+					resp.Error = NewJSNotEnabledForAccountError()
+					s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+				}
+				return
+			}
+			// No stream present.
+			resp.Error = NewJSStreamNotFoundError()
+			s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+			return
+		} else if sa == nil {
+			return
+		}
+
+		// Check to see if we are a member of the group and if the group has no leader.
+		if js.isGroupLeaderless(sa.Group) {
+			resp.Error = NewJSClusterNotAvailError()
+			s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+			return
+		}
+
+		// We have the stream assigned and a leader, so only the stream leader should answer.
+		if !acc.JetStreamIsStreamLeader(stream) {
+			return
+		}
+	}
+
+	if hasJS, doErr := acc.checkJetStream(); !hasJS {
+		if doErr {
+			resp.Error = NewJSNotEnabledForAccountError()
+			s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+		}
+		return
+	}
+
+	var req JSApiStreamVerifyRequest
+	if !isEmptyRequest(msg) {
+		if err := json.Unmarshal(msg, &req); err != nil {
+			resp.Error = NewJSInvalidJSONError()
+			s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+			return
+		}
+	}
+
+	mset, err := acc.lookupStream(stream)
+	if err != nil {
+		resp.Error = NewJSStreamNotFoundError(Unless(err))
+		s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+		return
+	}
+
+	// Checksumming and waiting on the replicas can take a while.
+	go func() {
+		vresp, apiErr := mset.verifyReplicas(&req)
+		if apiErr != nil {
+			resp.Error = apiErr
+			s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+			return
+		}
+		s.sendAPIResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(vresp))
+	}()
+}
@@ -0,0 +1,594 @@
+// Copyright 2023 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// jsonSchema is a compiled JSON schema used to validate messages on ingest.
+// We support the validation vocabulary that matters for message payloads:
+// type, enum, const, numeric and string bounds, pattern, object properties,
+// array items and the allOf/anyOf/oneOf/not combinators. Any other keyword,
+// including references, will fail compilation so messages are never accepted
+// against parts of a schema we do not check.
+type jsonSchema struct {
+	// Boolean schemas, true accepts everything, false nothing.
+	always *bool
+
+	types    []string
+	enum     []interface{}
+	constant interface{}
+	hasConst bool
+
+	minimum, maximum         *float64
+	exclMinimum, exclMaximum *float64
+	multipleOf               *float64
+
+	minLength, maxLength *int
+	pattern              *regexp.Regexp
+
+	properties    map[string]*jsonSchema
+	patternProps  map[*regexp.Regexp]*jsonSchema
+	additional    *jsonSchema
+	required      []string
+	minProperties *int
+	maxProperties *int
+
+	items       *jsonSchema
+	minItems    *int
+	maxItems    *int
+	uniqueItems bool
+
+	allOf []*jsonSchema
+	anyOf []*jsonSchema
+	oneOf []*jsonSchema
+	not   *jsonSchema
+}
+
+// jsonSchemaError describes why a value did not match, with a JSON pointer to the value.
+type jsonSchemaError struct {
+	path string
+	err  string
+}
+
+func (e *jsonSchemaError) Error() string {
+	return fmt.Sprintf("%s: %s", e.path, e.err)
+}
+
+// compileJSONSchema parses and compiles the JSON schema document.
+func compileJSONSchema(doc []byte) (*jsonSchema, error) {
+	var v interface{}
+	dec := json.NewDecoder(bytes.NewReader(doc))
+	dec.UseNumber()
+	if err := dec.Decode(&v); err != nil {
+		return nil, fmt.Errorf("invalid schema: %v", err)
+	}
+	return compileJSONSchemaValue(v, "#")
+}
+
+func compileJSONSchemaValue(v interface{}, loc string) (*jsonSchema, error) {
+	switch sv := v.(type) {
+	case bool:
+		return &jsonSchema{always: &sv}, nil
+	case map[string]interface{}:
+		return compileJSONSchemaObject(sv, loc)
+	}
+	return nil, fmt.Errorf("invalid schema at %s: must be an object or boolean", loc)
+}
+
+// jsonSchemaKeywords are the keywords we know how to compile. Annotations that
+// have no effect on validation are allowed as well.
+var jsonSchemaKeywords = map[string]bool{
+	"type": true, "enum": true, "const": true,
+	"minimum": true, "maximum": true, "exclusiveMinimum": true, "exclusiveMaximum": true, "multipleOf": true,
+	"minLength": true, "maxLength": true, "pattern": true,
+	"properties": true, "patternProperties": true, "additionalProperties": true,
+	"required": true, "minProperties": true, "maxProperties": true,
+	"items": true, "minItems": true, "maxItems": true, "uniqueItems": true,
+	"allOf": true, "anyOf": true, "oneOf": true, "not": true,
+	// Annotations.
+	"$schema": true, "$id": true, "$comment": true, "title": true, "description": true,
+	"default": true, "examples": true, "deprecated": true, "readOnly": true, "writeOnly": true,
+}
+
+func compileJSONSchemaObject(m map[string]interface{}, loc string) (*jsonSchema, error) {
+	sch := &jsonSchema{}
+	bad := func(kw string) error {
+		return fmt.Errorf("invalid schema at %s/%s", loc, kw)
+	}
+	number := func(kw string) (*float64, error) {
+		v, ok := m[kw]
+		if !ok {
+			return nil, nil
+		}
+		n, ok := v.(json.Number)
+		if !ok {
+			return nil, bad(kw)
+		}
+		f, err := n.Float64()
+		if err != nil {
+			return nil, bad(kw)
+		}
+		return &f, nil
+	}
+	count := func(kw string) (*int, error) {
+		f, err := number(kw)
+		if err != nil || f == nil {
+			return nil, err
+		}
+		if *f < 0 || *f != math.Trunc(*f) {
+			return nil, bad(kw)
+		}
+		i := int(*f)
+		return &i, nil
+	}
+	subSchemas := func(kw string) ([]*jsonSchema, error) {
+		v, ok := m[kw]
+		if !ok {
+			return nil, nil
+		}
+		a, ok := v.([]interface{})
+		if !ok || len(a) == 0 {
+			return nil, bad(kw)
+		}
+		schs := make([]*jsonSchema, 0, len(a))
+		for i, e := range a {
+			s, err := compileJSONSchemaValue(e, fmt.Sprintf("%s/%s/%d", loc, kw, i))
+			if err != nil {
+				return nil, err
+			}
+			schs = append(schs, s)
+		}
+		return schs, nil
+	}
+
+	// Report unsupported keywords in a stable order.
+	kws := make([]string, 0, len(m))
+	for kw := range m {
+		kws = append(kws, kw)
+	}
+	sort.Strings(kws)
+	for _, kw := range kws {
+		if !jsonSchemaKeywords[kw] {
+			return nil, fmt.Errorf("invalid schema at %s: %s is not supported", loc, kw)
+		}
+	}
+
+	var err error
+
+	if v, ok := m["type"]; ok {
+		switch tv := v.(type) {
+		case string:
+			sch.types = []string{tv}
+		case []interface{}:
+			for _, t := range tv {
+				ts, ok := t.(string)
+				if !ok {
+					return nil, bad("type")
+				}
+				sch.types = append(sch.types, ts)
+			}
+		default:
+			return nil, bad("type")
+		}
+		for _, t := range sch.types {
+			switch t {
+			case "null", "boolean", "object", "array", "number", "integer", "string":
+			default:
+				return nil, fmt.Errorf("invalid schema at %s/type: unknown type %q", loc, t)
+			}
+		}
+	}
+	if v, ok := m["enum"]; ok {
+		if sch.enum, ok = v.([]interface{}); !ok {
+			return nil, bad("enum")
+		}
+	}
+	if v, ok := m["const"]; ok {
+		sch.constant, sch.hasConst = v, true
+	}
+
+	if sch.minimum, err = number("minimum"); err != nil {
+		return nil, err
+	}
+	if sch.maximum, err = number("maximum"); err != nil {
+		return nil, err
+	}
+	if sch.exclMinimum, err = number("exclusiveMinimum"); err != nil {
+		return nil, err
+	}
+	if sch.exclMaximum, err = number("exclusiveMaximum"); err != nil {
+		return nil, err
+	}
+	if sch.multipleOf, err = number("multipleOf"); err != nil {
+		return nil, err
+	}
+	if sch.multipleOf != nil && *sch.multipleOf <= 0 {
+		return nil, bad("multipleOf")
+	}
+
+	if sch.minLength, err = count("minLength"); err != nil {
+		return nil, err
+	}
+	if sch.maxLength, err = count("maxLength"); err != nil {
+		return nil, err
+	}
+	if v, ok := m["pattern"]; ok {
+		p, ok := v.(string)
+		if !ok {
+			return nil, bad("pattern")
+		}
+		if sch.pattern, err = regexp.Compile(p); err != nil {
+			return nil, bad("pattern")
+		}
+	}
+
+	if v, ok := m["properties"]; ok {
+		props, ok := v.(map[string]interface{})
+		if !ok {
+			return nil, bad("properties")
+		}
+		sch.properties = make(map[string]*jsonSchema, len(props))
+		for name, pv := range props {
+			if sch.properties[name], err = compileJSONSchemaValue(pv, loc+"/properties/"+name); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if v, ok := m["patternProperties"]; ok {
+		props, ok := v.(map[string]interface{})
+		if !ok {
+			return nil, bad("patternProperties")
+		}
+		sch.patternProps = make(map[*regexp.Regexp]*jsonSchema, len(props))
+		for p, pv := range props {
+			re, err := regexp.Compile(p)
+			if err != nil {
+				return nil, bad("patternProperties")
+			}
+			if sch.patternProps[re], err = compileJSONSchemaValue(pv, loc+"/patternProperties/"+p); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if v, ok := m["additionalProperties"]; ok {
+		if sch.additional, err = compileJSONSchemaValue(v, loc+"/additionalProperties"); err != nil {
+			return nil, err
+		}
+	}
+	if v, ok := m["required"]; ok {
+		req, ok := v.([]interface{})
+		if !ok {
+			return nil, bad("required")
+		}
+		for _, r := range req {
+			rs, ok := r.(string)
+			if !ok {
+				return nil, bad("required")
+			}
+			sch.required = append(sch.required, rs)
+		}
+	}
+	if sch.minProperties, err = count("minProperties"); err != nil {
+		return nil, err
+	}
+	if sch.maxProperties, err = count("maxProperties"); err != nil {
+		return nil, err
+	}
+
+	if v, ok := m["items"]; ok {
+		if sch.items, err = compileJSONSchemaValue(v, loc+"/items"); err != nil {
+			return nil, err
+		}
+	}
+	if sch.minItems, err = count("minItems"); err != nil {
+		return nil, err
+	}
+	if sch.maxItems, err = count("maxItems"); err != nil {
+		return nil, err
+	}
+	if v, ok := m["uniqueItems"]; ok {
+		if sch.uniqueItems, ok = v.(bool); !ok {
+			return nil, bad("uniqueItems")
+		}
+	}
+
+	if sch.allOf, err = subSchemas("allOf"); err != nil {
+		return nil, err
+	}
+	if sch.anyOf, err = subSchemas("anyOf"); err != nil {
+		return nil, err
+	}
+	if sch.oneOf, err = subSchemas("oneOf"); err != nil {
+		return nil, err
+	}
+	if v, ok := m["not"]; ok {
+		if sch.not, err = compileJSONSchemaValue(v, loc+"/not"); err != nil {
+			return nil, err
+		}
+	}
+	return sch, nil
+}
+
+// validate will decode the JSON document and check it against the schema.
+// A returned error will be a *jsonSchemaError.
+func (sch *jsonSchema) validate(doc []byte) error {
+	var v interface{}
+	dec := json.NewDecoder(bytes.NewReader(doc))
+	dec.UseNumber()
+	if err := dec.Decode(&v); err != nil {
+		return &jsonSchemaError{"/", "invalid JSON"}
+	}
+	if dec.More() {
+		return &jsonSchemaError{"/", "invalid JSON"}
+	}
+	return sch.validateValue(v, _EMPTY_)
+}
+
+// Returns the JSON type name for a decoded value.
+func jsonTypeOf(v interface{}) string {
+	switch tv := v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case map[string]interface{}:
+		return "object"
+	case []interface{}:
+		return "array"
+	case string:
+		return "string"
+	case json.Number:
+		if _, err := tv.Int64(); err == nil {
+			return "integer"
+		}
+		if f, err := tv.Float64(); err == nil && f == math.Trunc(f) {
+			return "integer"
+		}
+		return "number"
+	}
+	return "unknown"
+}
+
+// Compares two decoded JSON values for equality, numbers by value.
+func jsonEqual(a, b interface{}) bool {
+	if an, ok := a.(json.Number); ok {
+		bn, ok := b.(json.Number)
+		if !ok {
+			return false
+		}
+		af, aerr := an.Float64()
+		bf, berr := bn.Float64()
+		return aerr == nil && berr == nil && af == bf
+	}
+	switch av := a.(type) {
+	case []interface{}:
+		bv, ok := b.([]interface{})
+		if !ok || len(av) != len(bv) {
+			return false
+		}
+		for i := range av {
+			if !jsonEqual(av[i], bv[i]) {
+				return false
+			}
+		}
+		return true
+	case map[string]interface{}:
+		bv, ok := b.(map[string]interface{})
+		if !ok || len(av) != len(bv) {
+			return false
+		}
+		for k, v := range av {
+			if !jsonEqual(v, bv[k]) {
+				return false
+			}
+		}
+		return true
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+// Escapes a property name for use in a JSON pointer.
+func jsonPointerEscape(s string) string {
+	return strings.ReplaceAll(strings.ReplaceAll(s, "~", "~0"), "/", "~1")
+}
+
+func (sch *jsonSchema) validateValue(v interface{}, path string) error {
+	fail := func(format string, args ...interface{}) error {
+		p := path
+		if p == _EMPTY_ {
+			p = "/"
+		}
+		return &jsonSchemaError{p, fmt.Sprintf(format, args...)}
+	}
+
+	if sch.always != nil {
+		if !*sch.always {
+			return fail("not allowed")
+		}
+		return nil
+	}
+
+	vt := jsonTypeOf(v)
+	if len(sch.types) > 0 {
+		var match bool
+		for _, t := range sch.types {
+			if t == vt || (t == "number" && vt == "integer") {
+				match = true
+				break
+			}
+		}
+		if !match {
+			return fail("expected %s, got %s", strings.Join(sch.types, " or "), vt)
+		}
+	}
+	if sch.enum != nil {
+		var match bool
+		for _, e := range sch.enum {
+			if jsonEqual(v, e) {
+				match = true
+				break
+			}
+		}
+		if !match {
+			return fail("value is not one of the allowed values")
+		}
+	}
+	if sch.hasConst && !jsonEqual(v, sch.constant) {
+		return fail("value does not match constant")
+	}
+
+	switch tv := v.(type) {
+	case json.Number:
+		f, err := tv.Float64()
+		if err != nil {
+			return fail("invalid number")
+		}
+		if sch.minimum != nil && f < *sch.minimum {
+			return fail("must be >= %v", *sch.minimum)
+		}
+		if sch.maximum != nil && f > *sch.maximum {
+			return fail("must be <= %v", *sch.maximum)
+		}
+		if sch.exclMinimum != nil && f <= *sch.exclMinimum {
+			return fail("must be > %v", *sch.exclMinimum)
+		}
+		if sch.exclMaximum != nil && f >= *sch.exclMaximum {
+			return fail("must be < %v", *sch.exclMaximum)
+		}
+		if sch.multipleOf != nil {
+			if q := f / *sch.multipleOf; q != math.Trunc(q) {
+				return fail("must be a multiple of %v", *sch.multipleOf)
+			}
+		}
+	case string:
+		l := utf8.RuneCountInString(tv)
+		if sch.minLength != nil && l < *sch.minLength {
+			return fail("length must be >= %d", *sch.minLength)
+		}
+		if sch.maxLength != nil && l > *sch.maxLength {
+			return fail("length must be <= %d", *sch.maxLength)
+		}
+		if sch.pattern != nil && !sch.pattern.MatchString(tv) {
+			return fail("does not match pattern %q", sch.pattern.String())
+		}
+	case map[string]interface{}:
+		for _, r := range sch.required {
+			if _, ok := tv[r]; !ok {
+				return fail("missing required property %q", r)
+			}
+		}
+		if sch.minProperties != nil && len(tv) < *sch.minProperties {
+			return fail("must have at least %d properties", *sch.minProperties)
+		}
+		if sch.maxProperties != nil && len(tv) > *sch.maxProperties {
+			return fail("must have at most %d properties", *sch.maxProperties)
+		}
+		// Walk in sorted order so reported errors are stable.
+		names := make([]string, 0, len(tv))
+		for name := range tv {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			ppath := path + "/" + jsonPointerEscape(name)
+			var matched bool
+			if ps, ok := sch.properties[name]; ok {
+				matched = true
+				if err := ps.validateValue(tv[name], ppath); err != nil {
+					return err
+				}
+			}
+			for re, ps := range sch.patternProps {
+				if re.MatchString(name) {
+					matched = true
+					if err := ps.validateValue(tv[name], ppath); err != nil {
+						return err
+					}
+				}
+			}
+			if !matched && sch.additional != nil {
+				if err := sch.additional.validateValue(tv[name], ppath); err != nil {
+					return err
+				}
+			}
+		}
+	case []interface{}:
+		if sch.minItems != nil && len(tv) < *sch.minItems {
+			return fail("must have at least %d items", *sch.minItems)
+		}
+		if sch.maxItems != nil && len(tv) > *sch.maxItems {
+			return fail("must have at most %d items", *sch.maxItems)
+		}
+		if sch.uniqueItems {
+			for i := range tv {
+				for j := i + 1; j < len(tv); j++ {
+					if jsonEqual(tv[i], tv[j]) {
+						return fail("items must be unique")
+					}
+				}
+			}
+		}
+		if sch.items != nil {
+			for i, e := range tv {
+				if err := sch.items.validateValue(e, path+"/"+strconv.Itoa(i)); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	for _, s := range sch.allOf {
+		if err := s.validateValue(v, path); err != nil {
+			return err
+		}
+	}
+	if len(sch.anyOf) > 0 {
+		var match bool
+		for _, s := range sch.anyOf {
+			if s.validateValue(v, path) == nil {
+				match = true
+				break
+			}
+		}
+		if !match {
+			return fail("does not match any of the allowed schemas")
+		}
+	}
+	if len(sch.oneOf) > 0 {
+		var matches int
+		for _, s := range sch.oneOf {
+			if s.validateValue(v, path) == nil {
+				matches++
+			}
+		}
+		if matches != 1 {
+			return fail("must match exactly one of the allowed schemas")
+		}
+	}
+	if sch.not != nil && sch.not.validateValue(v, path) == nil {
+		return fail("matches a disallowed schema")
+	}
+	return nil
+}
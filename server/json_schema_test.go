@@ -0,0 +1,130 @@
+// Copyright 2023 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"testing"
+)
+
+func TestJSONSchemaCompile(t *testing.T) {
+	for _, doc := range []string{
+		`true`,
+		`{}`,
+		`{"type": ["string", "null"]}`,
+		`{"type": "object", "properties": {"a": {"type": "integer", "minimum": 1}}, "required": ["a"]}`,
+		`{"items": {"type": "number"}, "minItems": 1, "uniqueItems": true}`,
+		`{"anyOf": [{"const": 1}, {"enum": ["a", "b"]}]}`,
+		`{"$schema": "https://json-schema.org/draft/2020-12/schema", "title": "t", "description": "d", "type": "string"}`,
+	} {
+		if _, err := compileJSONSchema([]byte(doc)); err != nil {
+			t.Fatalf("Unexpected error compiling %s: %v", doc, err)
+		}
+	}
+	for _, doc := range []string{
+		`not json`,
+		`1`,
+		`{"type": "blob"}`,
+		`{"minLength": -1}`,
+		`{"pattern": "("}`,
+		`{"required": "a"}`,
+		`{"allOf": []}`,
+		`{"$ref": "#/definitions/a"}`,
+		`{"type": "string", "format": "email"}`,
+		`{"if": {"type": "string"}, "then": {"minLength": 1}}`,
+		`{"contains": {"type": "string"}}`,
+		`{"prefixItems": [{"type": "string"}]}`,
+		`{"dependentRequired": {"a": ["b"]}}`,
+		`{"dependentSchemas": {"a": {"required": ["b"]}}}`,
+		`{"$defs": {"a": {"type": "string"}}}`,
+		`{"properties": {"a": {"type": "string", "format": "uuid"}}}`,
+	} {
+		if _, err := compileJSONSchema([]byte(doc)); err == nil {
+			t.Fatalf("Expected error compiling %s", doc)
+		}
+	}
+}
+
+func TestJSONSchemaValidate(t *testing.T) {
+	sch, err := compileJSONSchema([]byte(`{
+		"type": "object",
+		"properties": {
+			"id": {"type": "integer", "minimum": 1},
+			"name": {"type": "string", "minLength": 1, "maxLength": 8, "pattern": "^[a-z]+$"},
+			"tags": {"type": "array", "items": {"type": "string"}, "uniqueItems": true},
+			"a/b": {"const": true}
+		},
+		"required": ["id", "name"],
+		"additionalProperties": false
+	}`))
+	require_NoError(t, err)
+
+	for _, test := range []struct {
+		doc  string
+		path string
+	}{
+		{`{"id": 1, "name": "derek"}`, _EMPTY_},
+		{`{"id": 1, "name": "derek", "tags": ["a", "b"], "a/b": true}`, _EMPTY_},
+		{`{"id": 1, "name": "derek"} {}`, "/"},
+		{`[]`, "/"},
+		{`{"name": "derek"}`, "/"},
+		{`{"id": 0, "name": "derek"}`, "/id"},
+		{`{"id": 1.5, "name": "derek"}`, "/id"},
+		{`{"id": 1, "name": ""}`, "/name"},
+		{`{"id": 1, "name": "Derek"}`, "/name"},
+		{`{"id": 1, "name": "derekcollison"}`, "/name"},
+		{`{"id": 1, "name": "derek", "tags": ["a", 2]}`, "/tags/1"},
+		{`{"id": 1, "name": "derek", "tags": ["a", "a"]}`, "/tags"},
+		{`{"id": 1, "name": "derek", "a/b": false}`, "/a~1b"},
+		{`{"id": 1, "name": "derek", "extra": 1}`, "/extra"},
+	} {
+		err := sch.validate([]byte(test.doc))
+		if test.path == _EMPTY_ {
+			if err != nil {
+				t.Fatalf("Unexpected error for %s: %v", test.doc, err)
+			}
+			continue
+		}
+		se, ok := err.(*jsonSchemaError)
+		if !ok {
+			t.Fatalf("Expected a schema error for %s, got %v", test.doc, err)
+		}
+		if se.path != test.path {
+			t.Fatalf("Expected path %q for %s, got %q (%v)", test.path, test.doc, se.path, se)
+		}
+	}
+}
+
+func TestJSONSchemaCombinators(t *testing.T) {
+	sch, err := compileJSONSchema([]byte(`{
+		"oneOf": [
+			{"type": "integer", "multipleOf": 3},
+			{"type": "integer", "multipleOf": 5}
+		],
+		"not": {"const": 30}
+	}`))
+	require_NoError(t, err)
+
+	for doc, valid := range map[string]bool{
+		`3`:   true,
+		`10`:  true,
+		`15`:  false,
+		`7`:   false,
+		`30`:  false,
+		`"3"`: false,
+	} {
+		if err := sch.validate([]byte(doc)); (err == nil) != valid {
+			t.Fatalf("Expected valid=%v for %s, got %v", valid, doc, err)
+		}
+	}
+}
@@ -14,11 +14,23 @@
 package server
 
 import (
+	"bufio"
+	"bytes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"hash"
+	"io"
 	"math/rand"
+	"os"
+	"path/filepath"
 	"sort"
 	"sync"
 	"time"
+
+	"github.com/minio/highwayhash"
 )
 
 // TODO(dlc) - This is a fairly simplistic approach but should do for now.
@@ -28,11 +40,14 @@ type memStore struct {
 	state       StreamState
 	msgs        map[uint64]*StoreMsg
 	fss         map[string]*SimpleState
+	hidx        headerIndex
 	maxp        int64
 	scb         StorageUpdateHandler
 	ageChk      *time.Timer
 	consumers   int
 	receivedAny bool
+	// Consumer state recovered from a clean shutdown, applied when the consumer store is created.
+	cstates map[string]*ConsumerState
 }
 
 func newMemStore(cfg *StreamConfig) (*memStore, error) {
@@ -45,9 +60,17 @@ func newMemStore(cfg *StreamConfig) (*memStore, error) {
 	ms := &memStore{
 		msgs: make(map[uint64]*StoreMsg),
 		fss:  make(map[string]*SimpleState),
+		hidx: newHeaderIndex(cfg.IndexedHeaders),
 		maxp: cfg.MaxMsgsPer,
 		cfg:  *cfg,
 	}
+	// If the stream has an initial sequence number set our state to start there.
+	// Starting at 1 is the default, so nothing to do in that case.
+	if cfg.FirstSeq > 1 {
+		if _, err := ms.Compact(cfg.FirstSeq); err != nil {
+			return nil, err
+		}
+	}
 
 	return ms, nil
 }
@@ -62,6 +85,13 @@ func (ms *memStore) UpdateConfig(cfg *StreamConfig) error {
 
 	ms.mu.Lock()
 	ms.cfg = *cfg
+	// Rebuild our header index if the indexed headers changed.
+	if !ms.hidx.indexes(cfg.IndexedHeaders) {
+		ms.hidx = newHeaderIndex(cfg.IndexedHeaders)
+		for seq, sm := range ms.msgs {
+			ms.hidx.add(sm.hdr, seq)
+		}
+	}
 	// Limits checks and enforcement.
 	ms.enforceMsgLimit()
 	ms.enforceBytesLimit()
@@ -172,6 +202,11 @@ func (ms *memStore) storeRawMsg(subj string, hdr, msg []byte, seq uint64, ts int
 	ms.state.LastSeq = seq
 	ms.state.LastTime = now
 
+	// Track by indexed headers.
+	if ms.hidx != nil {
+		ms.hidx.add(sm.hdr, seq)
+	}
+
 	// Track per subject.
 	if len(subj) > 0 {
 		if ss != nil {
@@ -275,17 +310,24 @@ func (ms *memStore) GetSeqFromTime(t time.Time) uint64 {
 	if ts <= ms.msgs[ms.state.FirstSeq].ts {
 		return ms.state.FirstSeq
 	}
-	last := ms.msgs[ms.state.LastSeq].ts
-	if ts == last {
-		return ms.state.LastSeq
-	}
-	if ts > last {
-		return ms.state.LastSeq + 1
+	// Messages may have been removed in between, so look at the next one still present.
+	next := func(seq uint64) *StoreMsg {
+		for ; seq <= ms.state.LastSeq; seq++ {
+			if sm := ms.msgs[seq]; sm != nil {
+				return sm
+			}
+		}
+		return nil
 	}
-	index := sort.Search(len(ms.msgs), func(i int) bool {
-		return ms.msgs[uint64(i)+ms.state.FirstSeq].ts >= ts
+	n := int(ms.state.LastSeq - ms.state.FirstSeq + 1)
+	index := sort.Search(n, func(i int) bool {
+		sm := next(uint64(i) + ms.state.FirstSeq)
+		return sm == nil || sm.ts >= ts
 	})
-	return uint64(index) + ms.state.FirstSeq
+	if sm := next(uint64(index) + ms.state.FirstSeq); sm != nil {
+		return sm.seq
+	}
+	return ms.state.LastSeq + 1
 }
 
 // FilteredState will return the SimpleState associated with the filtered subject and a proposed starting sequence.
@@ -501,6 +543,16 @@ func (ms *memStore) SubjectsTotals(filterSubject string) map[string]uint64 {
 	return fst
 }
 
+// Returns the number of messages for a literal subject.
+func (ms *memStore) numMsgsForSubject(subj string) uint64 {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+	if ss := ms.fss[subj]; ss != nil {
+		return ss.Msgs
+	}
+	return 0
+}
+
 // NumPending will return the number of pending messages matching the filter subject starting at sequence.
 func (ms *memStore) NumPending(sseq uint64, filter string, lastPerSubject bool) (total, validThrough uint64) {
 	ms.mu.RLock()
@@ -673,6 +725,7 @@ func (ms *memStore) Purge() (uint64, error) {
 	ms.state.Msgs = 0
 	ms.msgs = make(map[uint64]*StoreMsg)
 	ms.fss = make(map[string]*SimpleState)
+	ms.hidx.reset()
 	ms.mu.Unlock()
 
 	if cb != nil {
@@ -709,6 +762,7 @@ func (ms *memStore) Compact(seq uint64) (uint64, error) {
 				purged++
 				delete(ms.msgs, seq)
 				ms.removeSeqPerSubject(sm.subj, seq)
+				ms.hidx.remove(sm.hdr, seq)
 			}
 		}
 		if purged > ms.state.Msgs {
@@ -730,6 +784,7 @@ func (ms *memStore) Compact(seq uint64) (uint64, error) {
 		ms.state.FirstTime = time.Time{}
 		ms.state.LastSeq = seq - 1
 		ms.msgs = make(map[uint64]*StoreMsg)
+		ms.hidx.reset()
 	}
 	ms.mu.Unlock()
 
@@ -761,9 +816,10 @@ func (ms *memStore) reset() error {
 	// Update msgs and bytes.
 	ms.state.Msgs = 0
 	ms.state.Bytes = 0
-	// Reset msgs and fss.
+	// Reset msgs, fss and our header index.
 	ms.msgs = make(map[uint64]*StoreMsg)
 	ms.fss = make(map[string]*SimpleState)
+	ms.hidx.reset()
 
 	ms.mu.Unlock()
 
@@ -796,6 +852,7 @@ func (ms *memStore) Truncate(seq uint64) error {
 			bytes += memStoreMsgSize(sm.subj, sm.hdr, sm.msg)
 			delete(ms.msgs, i)
 			ms.removeSeqPerSubject(sm.subj, i)
+			ms.hidx.remove(sm.hdr, i)
 		}
 	}
 	// Reset last.
@@ -955,6 +1012,27 @@ func (ms *memStore) LoadNextMsg(filter string, wc bool, start uint64, smp *Store
 	return nil, ms.state.LastSeq, ErrStoreEOF
 }
 
+// LoadNextMsgByHeader will find the next message starting at the start sequence
+// that has the value for the indexed header.
+func (ms *memStore) LoadNextMsgByHeader(name, value string, start uint64, smp *StoreMsg) (*StoreMsg, error) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	if _, ok := ms.hidx[name]; !ok {
+		return nil, ErrHeaderNotIndexed
+	}
+	for _, seq := range ms.hidx.seqs(name, value, start) {
+		if sm, ok := ms.msgs[seq]; ok {
+			if smp == nil {
+				smp = new(StoreMsg)
+			}
+			sm.copy(smp)
+			return smp, nil
+		}
+	}
+	return nil, ErrStoreMsgNotFound
+}
+
 // RemoveMsg will remove the message from this store.
 // Will return the number of bytes removed.
 func (ms *memStore) RemoveMsg(seq uint64) (bool, error) {
@@ -1054,6 +1132,9 @@ func (ms *memStore) removeMsg(seq uint64, secure bool) bool {
 	}
 	ms.updateFirstSeq(seq)
 
+	// Remove from our header index before we may overwrite the headers.
+	ms.hidx.remove(sm.hdr, seq)
+
 	if secure {
 		if len(sm.hdr) > 0 {
 			sm.hdr = make([]byte, len(sm.hdr))
@@ -1080,6 +1161,36 @@ func (ms *memStore) removeMsg(seq uint64, secure bool) bool {
 	return ok
 }
 
+// Remove a message that was moved to the file tier of a hybrid store.
+// The message is still held by the stream, so storage updates only report the bytes released.
+func (ms *memStore) removeMovedMsg(seq uint64) bool {
+	ms.mu.Lock()
+	sm, ok := ms.msgs[seq]
+	if !ok {
+		ms.mu.Unlock()
+		return false
+	}
+	ss := memStoreMsgSize(sm.subj, sm.hdr, sm.msg)
+	delete(ms.msgs, seq)
+	if ms.state.Msgs > 0 {
+		ms.state.Msgs--
+		if ss > ms.state.Bytes {
+			ss = ms.state.Bytes
+		}
+		ms.state.Bytes -= ss
+	}
+	ms.updateFirstSeq(seq)
+	ms.hidx.remove(sm.hdr, seq)
+	ms.removeSeqPerSubject(sm.subj, seq)
+	cb := ms.scb
+	ms.mu.Unlock()
+
+	if cb != nil {
+		cb(0, -int64(ss), 0, _EMPTY_)
+	}
+	return true
+}
+
 // Type returns the type of the underlying store.
 func (ms *memStore) Type() StorageType {
 	return MemoryStorage
@@ -1172,6 +1283,8 @@ type consumerMemStore struct {
 	cfg    ConsumerConfig
 	state  ConsumerState
 	closed bool
+	// Set if our state was recovered from a clean shutdown.
+	recovered bool
 }
 
 func (ms *memStore) ConsumerStore(name string, cfg *ConsumerConfig) (ConsumerStore, error) {
@@ -1185,6 +1298,16 @@ func (ms *memStore) ConsumerStore(name string, cfg *ConsumerConfig) (ConsumerSto
 		return nil, fmt.Errorf("bad consumer config")
 	}
 	o := &consumerMemStore{ms: ms, cfg: *cfg}
+	ms.mu.Lock()
+	state := ms.cstates[name]
+	delete(ms.cstates, name)
+	ms.mu.Unlock()
+	if state != nil {
+		if err := o.Update(state); err != nil {
+			return nil, err
+		}
+		o.recovered = true
+	}
 	ms.AddConsumer(o)
 	return o, nil
 }
@@ -1209,6 +1332,235 @@ func (ms *memStore) Snapshot(_ time.Duration, _, _ bool) (*SnapshotResult, error
 	return nil, fmt.Errorf("no impl")
 }
 
+const (
+	// File holding the messages persisted on a clean shutdown.
+	memStorePersistFile = "mem.dat"
+	// Magic and version for our persisted messages.
+	memStorePersistMagic   = uint8(33)
+	memStorePersistVersion = uint8(1)
+)
+
+var errBadPersistedState = errors.New("bad persisted memory state")
+
+// Hash used to checksum our persisted messages.
+func (ms *memStore) persistHash() (hash.Hash64, error) {
+	key := sha256.Sum256([]byte(ms.cfg.Name))
+	return highwayhash.New64(key[:])
+}
+
+// Persist will write all of our messages to dir, along with the encoded state
+// of any consumers, so that they can be reloaded with recoverPersisted.
+// Everything is encrypted with aek if set.
+func (ms *memStore) persist(dir string, cstates map[string][]byte, aek cipher.AEAD) error {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	if ms.msgs == nil {
+		return ErrStoreClosed
+	}
+	hh, err := ms.persistHash()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, defaultDirPerms); err != nil {
+		return err
+	}
+	// Write to a tmp file first so we never leave a partial file behind.
+	fn := filepath.Join(dir, memStorePersistFile)
+	tmp := fn + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	writeMsgs := func() error {
+		// When encrypting we need all of it at once.
+		var w io.Writer = f
+		var ebuf bytes.Buffer
+		if aek != nil {
+			w = &ebuf
+		}
+		bw := bufio.NewWriter(w)
+		var b [2 + 2*binary.MaxVarintLen64]byte
+		b[0], b[1] = memStorePersistMagic, memStorePersistVersion
+		n := 2 + binary.PutUvarint(b[2:], ms.state.FirstSeq)
+		n += binary.PutUvarint(b[n:], ms.state.LastSeq)
+		bw.Write(b[:n])
+		hh.Write(b[:n])
+		for seq := ms.state.FirstSeq; seq <= ms.state.LastSeq; seq++ {
+			sm := ms.msgs[seq]
+			if sm == nil {
+				continue
+			}
+			rec := encodeStreamMsg(sm.subj, _EMPTY_, sm.hdr, sm.msg, sm.seq, sm.ts)
+			n := binary.PutUvarint(b[:], uint64(len(rec)))
+			bw.Write(b[:n])
+			hh.Write(b[:n])
+			bw.Write(rec)
+			hh.Write(rec)
+		}
+		bw.Write(hh.Sum(nil))
+		if err := bw.Flush(); err != nil {
+			return err
+		}
+		if aek != nil {
+			if _, err := f.Write(sealPersisted(aek, ebuf.Bytes())); err != nil {
+				return err
+			}
+		}
+		return f.Sync()
+	}
+	err = writeMsgs()
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, fn)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	for name, buf := range cstates {
+		odir := filepath.Join(dir, consumerDir, name)
+		if err := os.MkdirAll(odir, defaultDirPerms); err != nil {
+			return err
+		}
+		if aek != nil {
+			buf = sealPersisted(aek, buf)
+		}
+		if err := os.WriteFile(filepath.Join(odir, consumerState), buf, defaultFilePerms); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Encrypt persisted state with aek, prefixed by the nonce.
+func sealPersisted(aek cipher.AEAD, buf []byte) []byte {
+	nonce := make([]byte, aek.NonceSize(), aek.NonceSize()+len(buf)+aek.Overhead())
+	rand.Read(nonce)
+	return aek.Seal(nonce, nonce, buf, nil)
+}
+
+// Decrypt persisted state encrypted with sealPersisted.
+func openPersisted(aek cipher.AEAD, buf []byte) ([]byte, error) {
+	ns := aek.NonceSize()
+	if len(buf) < ns {
+		return nil, errBadPersistedState
+	}
+	return aek.Open(nil, buf[:ns], buf[ns:], nil)
+}
+
+// Reload messages and consumer state written to dir by persist, decrypting with aek if set.
+// Consumer state is held until the consumer store is created.
+func (ms *memStore) recoverPersisted(dir string, aek cipher.AEAD) error {
+	buf, err := os.ReadFile(filepath.Join(dir, memStorePersistFile))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if aek != nil {
+		if buf, err = openPersisted(aek, buf); err != nil {
+			return err
+		}
+	}
+	hh, err := ms.persistHash()
+	if err != nil {
+		return err
+	}
+	if len(buf) < 2+8 || buf[0] != memStorePersistMagic || buf[1] != memStorePersistVersion {
+		return errBadPersistedState
+	}
+	buf, sum := buf[:len(buf)-8], buf[len(buf)-8:]
+	hh.Write(buf)
+	if !bytes.Equal(hh.Sum(nil), sum) {
+		return errBadPersistedState
+	}
+	bi := 2
+	first, n := binary.Uvarint(buf[bi:])
+	if n <= 0 {
+		return errBadPersistedState
+	}
+	bi += n
+	last, n := binary.Uvarint(buf[bi:])
+	if n <= 0 {
+		return errBadPersistedState
+	}
+	bi += n
+
+	if first > 1 {
+		ms.Compact(first)
+	}
+	for bi < len(buf) {
+		rl, n := binary.Uvarint(buf[bi:])
+		if n <= 0 || rl < 1 || uint64(len(buf)-bi-n) < rl {
+			return errBadPersistedState
+		}
+		bi += n
+		rec := buf[bi : bi+int(rl)]
+		bi += int(rl)
+		if entryOp(rec[0]) != streamMsgOp {
+			return errBadPersistedState
+		}
+		subj, _, hdr, msg, seq, ts, err := decodeStreamMsg(rec[1:])
+		if err != nil {
+			return errBadPersistedState
+		}
+		// Skip over any interior deletes.
+		ms.mu.Lock()
+		if seq > ms.state.LastSeq+1 {
+			ms.state.LastSeq = seq - 1
+		}
+		ms.mu.Unlock()
+		if err := ms.StoreRawMsg(subj, hdr, msg, seq, ts); err != nil {
+			return err
+		}
+	}
+	// Account for any trailing deletes.
+	ms.mu.Lock()
+	if last > ms.state.LastSeq {
+		ms.state.LastSeq = last
+		if ms.state.Msgs == 0 {
+			ms.state.FirstSeq = last + 1
+		}
+	}
+	ms.mu.Unlock()
+
+	// Now the state for our consumers.
+	ofis, _ := os.ReadDir(filepath.Join(dir, consumerDir))
+	for _, ofi := range ofis {
+		buf, err := os.ReadFile(filepath.Join(dir, consumerDir, ofi.Name(), consumerState))
+		if err != nil {
+			continue
+		}
+		if aek != nil {
+			if buf, err = openPersisted(aek, buf); err != nil {
+				return err
+			}
+		}
+		state, err := decodeConsumerState(buf)
+		if err != nil {
+			return err
+		}
+		ms.mu.Lock()
+		if ms.cstates == nil {
+			ms.cstates = make(map[string]*ConsumerState)
+		}
+		ms.cstates[ofi.Name()] = state
+		ms.mu.Unlock()
+	}
+	return nil
+}
+
+// Drop any recovered consumer state that was not claimed by a consumer.
+func (ms *memStore) clearPersisted() {
+	ms.mu.Lock()
+	ms.cstates = nil
+	ms.mu.Unlock()
+}
+
 func (o *consumerMemStore) Update(state *ConsumerState) error {
 	// Sanity checks.
 	if state.AckFloor.Consumer > state.Delivered.Consumer {
@@ -1267,7 +1619,9 @@ func (o *consumerMemStore) SetStarting(sseq uint64) error {
 
 // HasState returns if this store has a recorded state.
 func (o *consumerMemStore) HasState() bool {
-	return false
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.recovered
 }
 
 func (o *consumerMemStore) UpdateDelivered(dseq, sseq, dc uint64, ts int64) error {
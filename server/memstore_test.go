@@ -17,6 +17,8 @@ import (
 	"bytes"
 	"fmt"
 	"math/rand"
+	"os"
+	"path/filepath"
 	"reflect"
 	"testing"
 	"time"
@@ -201,6 +203,28 @@ func TestMemStoreTimeStamps(t *testing.T) {
 	}
 }
 
+func TestMemStoreGetSeqFromTimeWithDeletes(t *testing.T) {
+	ms, err := newMemStore(&StreamConfig{Storage: MemoryStorage})
+	require_NoError(t, err)
+
+	var tss []int64
+	for i := 0; i < 10; i++ {
+		time.Sleep(5 * time.Microsecond)
+		_, ts, err := ms.StoreMsg("foo", nil, []byte("Hello World"))
+		require_NoError(t, err)
+		tss = append(tss, ts)
+	}
+	// Remove interior messages and the last one.
+	for _, seq := range []uint64{4, 5, 10} {
+		_, err := ms.RemoveMsg(seq)
+		require_NoError(t, err)
+	}
+	require_True(t, ms.GetSeqFromTime(time.Unix(0, tss[0])) == 1)
+	require_True(t, ms.GetSeqFromTime(time.Unix(0, tss[2])) == 3)
+	require_True(t, ms.GetSeqFromTime(time.Unix(0, tss[3])) == 6)
+	require_True(t, ms.GetSeqFromTime(time.Unix(0, tss[8]+1)) == 11)
+}
+
 func TestMemStorePurge(t *testing.T) {
 	ms, err := newMemStore(&StreamConfig{Storage: MemoryStorage})
 	if err != nil {
@@ -721,3 +745,154 @@ func TestMemStoreNumPending(t *testing.T) {
 		}
 	}
 }
+
+func TestMemStoreInitialFirstSeq(t *testing.T) {
+	cfg := &StreamConfig{
+		Name:     "zzz",
+		Storage:  MemoryStorage,
+		FirstSeq: 1000,
+	}
+	ms, err := newMemStore(cfg)
+	require_NoError(t, err)
+
+	state := ms.State()
+	require_True(t, state.Msgs == 0)
+	require_True(t, state.FirstSeq == 1000)
+	require_True(t, state.LastSeq == 999)
+
+	seq, _, err := ms.StoreMsg("A", nil, []byte("OK"))
+	require_NoError(t, err)
+	require_True(t, seq == 1000)
+
+	seq, _, err = ms.StoreMsg("B", nil, []byte("OK"))
+	require_NoError(t, err)
+	require_True(t, seq == 1001)
+
+	state = ms.State()
+	require_True(t, state.Msgs == 2)
+	require_True(t, state.FirstSeq == 1000)
+	require_True(t, state.LastSeq == 1001)
+}
+
+func TestMemStorePersistAndRecover(t *testing.T) {
+	cfg := &StreamConfig{Name: "zzz", Subjects: []string{"foo.*"}, Storage: MemoryStorage}
+	ms, err := newMemStore(cfg)
+	require_NoError(t, err)
+
+	for i := 0; i < 20; i++ {
+		_, _, err := ms.StoreMsg(fmt.Sprintf("foo.%d", i%4), []byte("hdr"), []byte("OK"))
+		require_NoError(t, err)
+	}
+	// Leading, interior and trailing deletes.
+	_, err = ms.Compact(5)
+	require_NoError(t, err)
+	ms.RemoveMsg(10)
+	ms.RemoveMsg(20)
+
+	o, err := ms.ConsumerStore("dlc", &ConsumerConfig{AckPolicy: AckExplicit})
+	require_NoError(t, err)
+	require_NoError(t, o.UpdateDelivered(1, 5, 1, time.Now().UnixNano()))
+	require_NoError(t, o.UpdateDelivered(2, 6, 1, time.Now().UnixNano()))
+	require_NoError(t, o.UpdateAcks(1, 5))
+	buf, err := o.EncodedState()
+	require_NoError(t, err)
+
+	dir := t.TempDir()
+	require_NoError(t, ms.persist(dir, map[string][]byte{"dlc": buf}, nil))
+	before := ms.State()
+	ms.Stop()
+
+	ms, err = newMemStore(cfg)
+	require_NoError(t, err)
+	defer ms.Stop()
+	require_NoError(t, ms.recoverPersisted(dir, nil))
+
+	state := ms.State()
+	require_True(t, state.Msgs == before.Msgs && state.Bytes == before.Bytes)
+	require_True(t, state.FirstSeq == 5 && state.LastSeq == 20)
+	require_True(t, state.NumDeleted == before.NumDeleted)
+	sm, err := ms.LoadMsg(11, nil)
+	require_NoError(t, err)
+	require_True(t, sm.subj == "foo.2" && string(sm.hdr) == "hdr" && string(sm.msg) == "OK")
+	_, err = ms.LoadMsg(10, nil)
+	require_Error(t, err, ErrStoreMsgNotFound)
+
+	// New messages pick up after our last sequence.
+	seq, _, err := ms.StoreMsg("foo.1", nil, []byte("OK"))
+	require_NoError(t, err)
+	require_True(t, seq == 21)
+
+	o, err = ms.ConsumerStore("dlc", &ConsumerConfig{AckPolicy: AckExplicit})
+	require_NoError(t, err)
+	require_True(t, o.HasState())
+	ostate, err := o.State()
+	require_NoError(t, err)
+	require_True(t, ostate.Delivered.Stream == 6 && ostate.AckFloor.Stream == 5)
+	require_True(t, len(ostate.Pending) == 1)
+
+	// Corrupt state should be detected.
+	fn := filepath.Join(dir, memStorePersistFile)
+	buf, err = os.ReadFile(fn)
+	require_NoError(t, err)
+	buf[len(buf)/2] ^= 0xff
+	require_NoError(t, os.WriteFile(fn, buf, defaultFilePerms))
+	ms2, err := newMemStore(cfg)
+	require_NoError(t, err)
+	defer ms2.Stop()
+	require_Error(t, ms2.recoverPersisted(dir, nil), errBadPersistedState)
+}
+
+func TestMemStoreHeaderIndex(t *testing.T) {
+	cfg := &StreamConfig{Name: "zzz", Subjects: []string{"foo"}, Storage: MemoryStorage, IndexedHeaders: []string{"Order-Id"}}
+	ms, err := newMemStore(cfg)
+	require_NoError(t, err)
+	defer ms.Stop()
+
+	for i := 0; i < 100; i++ {
+		hdr := []byte(fmt.Sprintf("NATS/1.0\r\nOrder-Id: %d\r\n\r\n", i%25))
+		_, _, err := ms.StoreMsg("foo", hdr, []byte("OK"))
+		require_NoError(t, err)
+	}
+
+	checkLookup := func(value string, start, seq uint64) {
+		t.Helper()
+		sm, err := ms.LoadNextMsgByHeader("Order-Id", value, start, nil)
+		if seq == 0 {
+			require_Error(t, err, ErrStoreMsgNotFound)
+			return
+		}
+		require_NoError(t, err)
+		require_Equal(t, sm.seq, seq)
+	}
+	checkLookup("7", 0, 8)
+	checkLookup("7", 9, 33)
+	checkLookup("7", 84, 0)
+
+	_, err = ms.LoadNextMsgByHeader("Customer", "7", 0, nil)
+	require_Error(t, err, ErrHeaderNotIndexed)
+
+	_, err = ms.RemoveMsg(8)
+	require_NoError(t, err)
+	checkLookup("7", 0, 33)
+
+	_, err = ms.Compact(40)
+	require_NoError(t, err)
+	checkLookup("7", 0, 58)
+	require_NoError(t, ms.Truncate(75))
+	checkLookup("24", 51, 75)
+	checkLookup("7", 59, 0)
+
+	// Changing our indexed headers rebuilds the index.
+	cfg.IndexedHeaders = []string{"Customer"}
+	require_NoError(t, ms.UpdateConfig(cfg))
+	_, err = ms.LoadNextMsgByHeader("Order-Id", "7", 0, nil)
+	require_Error(t, err, ErrHeaderNotIndexed)
+
+	_, err = ms.Purge()
+	require_NoError(t, err)
+	_, _, err = ms.StoreMsg("foo", []byte("NATS/1.0\r\nCustomer: derek\r\n\r\n"), []byte("OK"))
+	require_NoError(t, err)
+	sm, err := ms.LoadNextMsgByHeader("Customer", "derek", 0, nil)
+	require_NoError(t, err)
+	require_Equal(t, sm.seq, 76)
+}
@@ -2701,6 +2701,12 @@ type StreamDetail struct {
 	Cluster            *ClusterInfo        `json:"cluster,omitempty"`
 	Config             *StreamConfig       `json:"config,omitempty"`
 	State              StreamState         `json:"state,omitempty"`
+	Reclaimable        uint64              `json:"reclaimable_bytes,omitempty"`
+	Scrub              *ScrubStats         `json:"scrub,omitempty"`
+	Archive            *ArchiveStats       `json:"archive,omitempty"`
+	KeyRotation        *KeyRotationInfo    `json:"key_rotation,omitempty"`
+	Sync               *SyncStats          `json:"sync_stats,omitempty"`
+	Cache              *CacheStats         `json:"cache_stats,omitempty"`
 	Consumer           []*ConsumerInfo     `json:"consumer_detail,omitempty"`
 	Mirror             *StreamSourceInfo   `json:"mirror,omitempty"`
 	Sources            []*StreamSourceInfo `json:"sources,omitempty"`
@@ -2794,13 +2800,19 @@ func (s *Server) accountDetail(jsa *jsAccount, optStreams, optConsumers, optCfg,
 				cfg = &c
 			}
 			sdet := StreamDetail{
-				Name:    stream.name(),
-				Created: stream.createdTime(),
-				State:   stream.state(),
-				Cluster: ci,
-				Config:  cfg,
-				Mirror:  stream.mirrorInfo(),
-				Sources: stream.sourcesInfo(),
+				Name:        stream.name(),
+				Created:     stream.createdTime(),
+				State:       stream.state(),
+				Reclaimable: stream.reclaimableBytes(),
+				Scrub:       stream.scrubStats(),
+				Archive:     stream.archiveStats(),
+				KeyRotation: stream.keyRotation(),
+				Sync:        stream.syncStats(),
+				Cache:       stream.cacheStats(),
+				Cluster:     ci,
+				Config:      cfg,
+				Mirror:      stream.mirrorInfo(),
+				Sources:     stream.sourcesInfo(),
 			}
 			if optRaft && rgroup != nil {
 				sdet.RaftGroup = rgroup.Name
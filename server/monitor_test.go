@@ -4445,6 +4445,152 @@ func TestMonitorJsz(t *testing.T) {
 	})
 }
 
+func TestMonitorJszReclaimableBytes(t *testing.T) {
+	cf := createConfFile(t, []byte(fmt.Sprintf(`
+		listen: 127.0.0.1:-1
+		jetstream: {
+			store_dir: %q
+			compact: {interval: "1h", threshold: 0.25, min_bytes: 1MB, rate: 10MB}
+		}
+	`, t.TempDir())))
+	s, opts := RunServerWithConfig(cf)
+	defer s.Shutdown()
+
+	require_True(t, opts.JetStreamCompact.Interval == time.Hour)
+	require_True(t, opts.JetStreamCompact.Threshold == 0.25)
+	require_True(t, opts.JetStreamCompact.MinBytes == 1024*1024)
+	require_True(t, opts.JetStreamCompact.Rate == 10*1024*1024)
+
+	nc, js := jsClientConnect(t, s)
+	defer nc.Close()
+
+	_, err := js.AddStream(&nats.StreamConfig{Name: "TEST", Subjects: []string{"foo"}})
+	require_NoError(t, err)
+	for i := 0; i < 10; i++ {
+		_, err := js.Publish("foo", []byte("Hello World"))
+		require_NoError(t, err)
+	}
+
+	reclaimable := func() uint64 {
+		t.Helper()
+		jsi, err := s.Jsz(&JSzOptions{Accounts: true, Streams: true})
+		require_NoError(t, err)
+		require_True(t, len(jsi.AccountDetails) == 1)
+		require_True(t, len(jsi.AccountDetails[0].Streams) == 1)
+		return jsi.AccountDetails[0].Streams[0].Reclaimable
+	}
+	require_True(t, reclaimable() == 0)
+
+	// An interior delete leaves a tombstone behind.
+	require_NoError(t, js.DeleteMsg("TEST", 5))
+	rl := fileStoreMsgSize("foo", nil, []byte("Hello World"))
+	require_True(t, reclaimable() == rl-emptyRecordLen)
+}
+
+func TestMonitorJszScrubStats(t *testing.T) {
+	cf := createConfFile(t, []byte(fmt.Sprintf(`
+		listen: 127.0.0.1:-1
+		jetstream: {
+			store_dir: %q
+			scrub: {interval: "10ms", rate: 10MB, repair: true}
+		}
+	`, t.TempDir())))
+	s, opts := RunServerWithConfig(cf)
+	defer s.Shutdown()
+
+	require_True(t, opts.JetStreamScrub.Interval == 10*time.Millisecond)
+	require_True(t, opts.JetStreamScrub.Rate == 10*1024*1024)
+	require_True(t, opts.JetStreamScrub.Repair)
+
+	nc, js := jsClientConnect(t, s)
+	defer nc.Close()
+
+	_, err := js.AddStream(&nats.StreamConfig{Name: "TEST", Subjects: []string{"foo"}})
+	require_NoError(t, err)
+	_, err = js.AddStream(&nats.StreamConfig{Name: "MEM", Subjects: []string{"bar"}, Storage: nats.MemoryStorage})
+	require_NoError(t, err)
+
+	checkFor(t, 2*time.Second, 20*time.Millisecond, func() error {
+		jsi, err := s.Jsz(&JSzOptions{Accounts: true, Streams: true})
+		require_NoError(t, err)
+		require_True(t, len(jsi.AccountDetails) == 1)
+		for _, sd := range jsi.AccountDetails[0].Streams {
+			switch sd.Name {
+			case "MEM":
+				require_True(t, sd.Scrub == nil)
+			case "TEST":
+				if sd.Scrub == nil || sd.Scrub.LastScrub.IsZero() {
+					return fmt.Errorf("stream not scrubbed yet")
+				}
+				require_True(t, sd.Scrub.Corrupt == 0)
+			}
+		}
+		return nil
+	})
+}
+
+func TestMonitorJszArchiveStats(t *testing.T) {
+	adir := t.TempDir()
+	cf := createConfFile(t, []byte(fmt.Sprintf(`
+		listen: 127.0.0.1:-1
+		jetstream: {
+			store_dir: %q
+			archive: {dir: %q, interval: "10ms", cache: 1MB}
+		}
+	`, t.TempDir(), adir)))
+	s, opts := RunServerWithConfig(cf)
+	defer s.Shutdown()
+
+	require_True(t, opts.JetStreamArchive.Dir == adir)
+	require_True(t, opts.JetStreamArchive.Interval == 10*time.Millisecond)
+	require_True(t, opts.JetStreamArchive.Cache == 1024*1024)
+
+	nc, js := jsClientConnect(t, s)
+	defer nc.Close()
+
+	req := []byte(fmt.Sprintf(`{"name":"TEST","subjects":["foo"],"storage":"file","max_bytes":100000,"archive_after":%d}`, time.Millisecond))
+	resp, err := nc.Request(fmt.Sprintf(JSApiStreamCreateT, "TEST"), req, time.Second)
+	require_NoError(t, err)
+	var scResp JSApiStreamCreateResponse
+	require_NoError(t, json.Unmarshal(resp.Data, &scResp))
+	require_True(t, scResp.Error == nil)
+	_, err = js.AddStream(&nats.StreamConfig{Name: "MEM", Subjects: []string{"bar"}, Storage: nats.MemoryStorage})
+	require_NoError(t, err)
+
+	msg := bytes.Repeat([]byte("Z"), 100)
+	for i := 0; i < 600; i++ {
+		_, err := js.Publish("foo", msg)
+		require_NoError(t, err)
+	}
+
+	archiveStats := func() map[string]*ArchiveStats {
+		t.Helper()
+		jsi, err := s.Jsz(&JSzOptions{Accounts: true, Streams: true})
+		require_NoError(t, err)
+		require_True(t, len(jsi.AccountDetails) == 1)
+		stats := make(map[string]*ArchiveStats)
+		for _, sd := range jsi.AccountDetails[0].Streams {
+			stats[sd.Name] = sd.Archive
+		}
+		return stats
+	}
+	checkFor(t, 2*time.Second, 20*time.Millisecond, func() error {
+		if stats := archiveStats()["TEST"]; stats == nil || stats.Blocks == 0 {
+			return fmt.Errorf("stream not archived yet")
+		}
+		return nil
+	})
+	require_True(t, archiveStats()["MEM"] == nil)
+
+	// Reading archived messages fetches their blocks.
+	m, err := js.GetMsg("TEST", 1)
+	require_NoError(t, err)
+	require_True(t, bytes.Equal(m.Data, msg))
+	stats := archiveStats()["TEST"]
+	require_True(t, stats.Fetches > 0)
+	require_True(t, stats.Bytes > 0)
+}
+
 func TestMonitorReloadTLSConfig(t *testing.T) {
 	template := `
 		listen: "127.0.0.1:-1"
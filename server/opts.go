@@ -17,6 +17,7 @@ import (
 	"context"
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
@@ -203,6 +204,32 @@ type JSLimitOpts struct {
 	Duplicates      time.Duration
 }
 
+// JSCompactOpts control background compaction of sparse file store blocks.
+// Compaction is off unless an interval is set, other zero values select the file store defaults.
+type JSCompactOpts struct {
+	Interval  time.Duration // How often to check, zero disables.
+	Threshold float64       // Live byte ratio below which a block is compacted.
+	MinBytes  int64         // Minimum reclaimable bytes in a block.
+	Rate      int64         // Bytes per second for the whole server, zero is unlimited.
+}
+
+// JSScrubOpts control background checksum scrubbing of file store blocks.
+// Zero values select the file store defaults.
+type JSScrubOpts struct {
+	Interval time.Duration // Pause between passes, negative disables.
+	Rate     int64         // Bytes per second for the whole server.
+	Repair   bool          // Replace corrupt messages with the leader's copies when clustered.
+}
+
+// JSArchiveOpts select where file store blocks are archived once older than
+// a stream's archive threshold. Either a directory or a registered backend.
+type JSArchiveOpts struct {
+	Dir      string        // Directory for the local block archive.
+	Backend  string        // Name of a block archive registered with RegisterBlockArchive.
+	Interval time.Duration // Pause between passes looking for blocks to archive.
+	Cache    int64         // Bytes of fetched blocks to keep locally, zero is a default.
+}
+
 // Options block for nats-server.
 // NOTE: This structure is no longer used for monitoring endpoints
 // and json tags are deprecated and may be removed in the future.
@@ -254,38 +281,46 @@ type Options struct {
 	JetStreamDomain       string        `json:"-"`
 	JetStreamExtHint      string        `json:"-"`
 	JetStreamKey          string        `json:"-"`
+	JetStreamOldKey       string        `json:"-"`
 	JetStreamCipher       StoreCipher   `json:"-"`
 	JetStreamUniqueTag    string
 	JetStreamLimits       JSLimitOpts
+	JetStreamCompact      JSCompactOpts
+	JetStreamScrub        JSScrubOpts
+	JetStreamArchive      JSArchiveOpts
 	JetStreamMaxCatchup   int64
-	StoreDir              string            `json:"-"`
-	JsAccDefaultDomain    map[string]string `json:"-"` // account to domain name mapping
-	Websocket             WebsocketOpts     `json:"-"`
-	MQTT                  MQTTOpts          `json:"-"`
-	ProfPort              int               `json:"-"`
-	PidFile               string            `json:"-"`
-	PortsFileDir          string            `json:"-"`
-	LogFile               string            `json:"-"`
-	LogSizeLimit          int64             `json:"-"`
-	Syslog                bool              `json:"-"`
-	RemoteSyslog          string            `json:"-"`
-	Routes                []*url.URL        `json:"-"`
-	RoutesStr             string            `json:"-"`
-	TLSTimeout            float64           `json:"tls_timeout"`
-	TLS                   bool              `json:"-"`
-	TLSVerify             bool              `json:"-"`
-	TLSMap                bool              `json:"-"`
-	TLSCert               string            `json:"-"`
-	TLSKey                string            `json:"-"`
-	TLSCaCert             string            `json:"-"`
-	TLSConfig             *tls.Config       `json:"-"`
-	TLSPinnedCerts        PinnedCertSet     `json:"-"`
-	TLSRateLimit          int64             `json:"-"`
-	AllowNonTLS           bool              `json:"-"`
-	WriteDeadline         time.Duration     `json:"-"`
-	MaxClosedClients      int               `json:"-"`
-	LameDuckDuration      time.Duration     `json:"-"`
-	LameDuckGracePeriod   time.Duration     `json:"-"`
+	JetStreamReadAhead    int64
+	JetStreamBackups      []*StreamBackupPolicy `json:"-"`
+	JetStreamRestore      []string              `json:"-"`
+	StoreDir              string                `json:"-"`
+	JetStreamStoreDirs    map[string]string     `json:"-"`
+	JsAccDefaultDomain    map[string]string     `json:"-"` // account to domain name mapping
+	Websocket             WebsocketOpts         `json:"-"`
+	MQTT                  MQTTOpts              `json:"-"`
+	ProfPort              int                   `json:"-"`
+	PidFile               string                `json:"-"`
+	PortsFileDir          string                `json:"-"`
+	LogFile               string                `json:"-"`
+	LogSizeLimit          int64                 `json:"-"`
+	Syslog                bool                  `json:"-"`
+	RemoteSyslog          string                `json:"-"`
+	Routes                []*url.URL            `json:"-"`
+	RoutesStr             string                `json:"-"`
+	TLSTimeout            float64               `json:"tls_timeout"`
+	TLS                   bool                  `json:"-"`
+	TLSVerify             bool                  `json:"-"`
+	TLSMap                bool                  `json:"-"`
+	TLSCert               string                `json:"-"`
+	TLSKey                string                `json:"-"`
+	TLSCaCert             string                `json:"-"`
+	TLSConfig             *tls.Config           `json:"-"`
+	TLSPinnedCerts        PinnedCertSet         `json:"-"`
+	TLSRateLimit          int64                 `json:"-"`
+	AllowNonTLS           bool                  `json:"-"`
+	WriteDeadline         time.Duration         `json:"-"`
+	MaxClosedClients      int                   `json:"-"`
+	LameDuckDuration      time.Duration         `json:"-"`
+	LameDuckGracePeriod   time.Duration         `json:"-"`
 
 	// MaxTracedMsgLen is the maximum printable length for traced messages.
 	MaxTracedMsgLen int `json:"-"`
@@ -1474,6 +1509,93 @@ func setupUsersAndNKeysDuplicateCheckMap(o *Options) map[string]struct{} {
 	return unames
 }
 
+// parseAutoStreams parses the templates for streams created on demand. The stream
+// config uses the same field names as the JetStream API, with durations as strings.
+func parseAutoStreams(tk token, v interface{}, errors *[]error, warnings *[]error) ([]*AutoStreamConfig, error) {
+	var lt token
+	defer convertPanicToErrorList(&lt, errors)
+
+	arr, ok := v.([]interface{})
+	if !ok {
+		return nil, &configErr{tk, fmt.Sprintf("Expected auto_streams to be an array, got %T", v)}
+	}
+	var ascs []*AutoStreamConfig
+	for _, e := range arr {
+		tk, e := unwrapValue(e, &lt)
+		m, ok := e.(map[string]interface{})
+		if !ok {
+			return nil, &configErr{tk, fmt.Sprintf("Expected auto stream entry to be a map, got %T", e)}
+		}
+		// Storage has no usable zero value, so default to file like the clients do.
+		asc := &AutoStreamConfig{Config: StreamConfig{Storage: FileStorage}}
+		for k, mv := range m {
+			tk, mv := unwrapValue(mv, &lt)
+			switch strings.ToLower(k) {
+			case "subject":
+				asc.Subject = mv.(string)
+			case "idle_ttl":
+				asc.IdleTTL = parseDuration(k, tk, mv, errors, warnings)
+			case "config", "stream":
+				b, err := json.Marshal(configValueToJSON(mv, jsonDurationFields))
+				if err == nil {
+					err = json.Unmarshal(b, &asc.Config)
+				}
+				if err != nil {
+					return nil, &configErr{tk, fmt.Sprintf("Error parsing auto stream config: %v", err)}
+				}
+			default:
+				if !tk.IsUsedVariable() {
+					*errors = append(*errors, &unknownConfigFieldErr{field: k, configErr: configErr{token: tk}})
+				}
+			}
+		}
+		if err := validateAutoStreamConfig(asc); err != nil {
+			return nil, &configErr{tk, err.Error()}
+		}
+		ascs = append(ascs, asc)
+	}
+	return ascs, nil
+}
+
+// Fields in the JetStream API that are durations in nanoseconds.
+var jsonDurationFields = map[string]struct{}{
+	"max_age":            {},
+	"duplicate_window":   {},
+	"ack_wait":           {},
+	"idle_heartbeat":     {},
+	"inactive_threshold": {},
+}
+
+// configValueToJSON removes the tokens from a parsed config value so it can be
+// marshaled to JSON. Duration fields given as strings are converted to nanoseconds.
+func configValueToJSON(v interface{}, durations map[string]struct{}) interface{} {
+	_, v = unwrapValue(v, nil)
+	switch vv := v.(type) {
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(vv))
+		for k, e := range vv {
+			e = configValueToJSON(e, durations)
+			if s, ok := e.(string); ok {
+				if _, isDur := durations[k]; isDur {
+					if d, err := time.ParseDuration(s); err == nil {
+						e = d
+					}
+				}
+			}
+			m[k] = e
+		}
+		return m
+	case []interface{}:
+		a := make([]interface{}, 0, len(vv))
+		for _, e := range vv {
+			a = append(a, configValueToJSON(e, durations))
+		}
+		return a
+	default:
+		return v
+	}
+}
+
 func parseDuration(field string, tk token, v interface{}, errors *[]error, warnings *[]error) time.Duration {
 	if wd, ok := v.(string); ok {
 		if dur, err := time.ParseDuration(wd); err != nil {
@@ -1788,7 +1910,7 @@ func parseGateway(v interface{}, o *Options, errors *[]error, warnings *[]error)
 	return nil
 }
 
-var dynamicJSAccountLimits = JetStreamAccountLimits{-1, -1, -1, -1, -1, -1, -1, false}
+var dynamicJSAccountLimits = JetStreamAccountLimits{-1, -1, -1, -1, -1, -1, -1, false, nil}
 var defaultJSAccountTiers = map[string]JetStreamAccountLimits{_EMPTY_: dynamicJSAccountLimits}
 
 // Parses jetstream account limits for an account. Simple setup with boolen is allowed, and we will
@@ -1814,7 +1936,7 @@ func parseJetStreamForAccount(v interface{}, acc *Account, errors *[]error, warn
 			return &configErr{tk, fmt.Sprintf("Expected 'enabled' or 'disabled' for string value, got '%s'", vv)}
 		}
 	case map[string]interface{}:
-		jsLimits := JetStreamAccountLimits{-1, -1, -1, -1, -1, -1, -1, false}
+		jsLimits := JetStreamAccountLimits{-1, -1, -1, -1, -1, -1, -1, false, nil}
 		for mk, mv := range vv {
 			tk, mv = unwrapValue(mv, &lt)
 			switch strings.ToLower(mk) {
@@ -1866,6 +1988,26 @@ func parseJetStreamForAccount(v interface{}, acc *Account, errors *[]error, warn
 					return &configErr{tk, fmt.Sprintf("Expected a parseable size for %q, got %v", mk, mv)}
 				}
 				jsLimits.MaxAckPending = int(vv)
+			case "store_dirs", "max_store_dirs":
+				m, ok := mv.(map[string]interface{})
+				if !ok {
+					return &configErr{tk, fmt.Sprintf("Expected a map for %q, got %v", mk, mv)}
+				}
+				jsLimits.StoreDirs = make(map[string]int64, len(m))
+				for name, dv := range m {
+					tk, dv := unwrapValue(dv, &lt)
+					max, err := getStorageSize(dv)
+					if err != nil {
+						return &configErr{tk, fmt.Sprintf("Expected a parseable size for store directory %q, got %v", name, dv)}
+					}
+					jsLimits.StoreDirs[name] = max
+				}
+			case "auto_streams":
+				ascs, err := parseAutoStreams(tk, mv, errors, warnings)
+				if err != nil {
+					return err
+				}
+				acc.jsAutoStreams = ascs
 			default:
 				if !tk.IsUsedVariable() {
 					err := &unknownConfigFieldErr{
@@ -1963,6 +2105,141 @@ func parseJetStreamLimits(v interface{}, opts *Options, errors *[]error, warning
 	return nil
 }
 
+func parseJetStreamCompact(v interface{}, opts *Options, errors *[]error, warnings *[]error) error {
+	var lt token
+	tk, v := unwrapValue(v, &lt)
+
+	co := JSCompactOpts{}
+
+	vv, ok := v.(map[string]interface{})
+	if !ok {
+		return &configErr{tk, fmt.Sprintf("Expected a map to define JetStream compaction, got %T", v)}
+	}
+	for mk, mv := range vv {
+		tk, mv = unwrapValue(mv, &lt)
+		switch strings.ToLower(mk) {
+		case "interval":
+			co.Interval = parseDuration(mk, tk, mv, errors, warnings)
+		case "threshold":
+			switch t := mv.(type) {
+			case float64:
+				co.Threshold = t
+			case int64:
+				co.Threshold = float64(t)
+			default:
+				*errors = append(*errors, &configErr{tk, fmt.Sprintf("Expected a number for compaction threshold, got %T", mv)})
+			}
+		case "min_bytes", "min_reclaimable":
+			s, err := getStorageSize(mv)
+			if err != nil {
+				return &configErr{tk, fmt.Sprintf("%s %s", strings.ToLower(mk), err)}
+			}
+			co.MinBytes = s
+		case "rate", "max_rate":
+			s, err := getStorageSize(mv)
+			if err != nil {
+				return &configErr{tk, fmt.Sprintf("%s %s", strings.ToLower(mk), err)}
+			}
+			co.Rate = s
+		default:
+			if !tk.IsUsedVariable() {
+				err := &unknownConfigFieldErr{
+					field: mk,
+					configErr: configErr{
+						token: tk,
+					},
+				}
+				*errors = append(*errors, err)
+				continue
+			}
+		}
+	}
+	opts.JetStreamCompact = co
+	return nil
+}
+
+func parseJetStreamScrub(v interface{}, opts *Options, errors *[]error, warnings *[]error) error {
+	var lt token
+	tk, v := unwrapValue(v, &lt)
+
+	so := JSScrubOpts{}
+
+	vv, ok := v.(map[string]interface{})
+	if !ok {
+		return &configErr{tk, fmt.Sprintf("Expected a map to define JetStream scrubbing, got %T", v)}
+	}
+	for mk, mv := range vv {
+		tk, mv = unwrapValue(mv, &lt)
+		switch strings.ToLower(mk) {
+		case "interval":
+			so.Interval = parseDuration(mk, tk, mv, errors, warnings)
+		case "rate", "max_rate":
+			s, err := getStorageSize(mv)
+			if err != nil {
+				return &configErr{tk, fmt.Sprintf("%s %s", strings.ToLower(mk), err)}
+			}
+			so.Rate = s
+		case "repair":
+			so.Repair = mv.(bool)
+		default:
+			if !tk.IsUsedVariable() {
+				err := &unknownConfigFieldErr{
+					field: mk,
+					configErr: configErr{
+						token: tk,
+					},
+				}
+				*errors = append(*errors, err)
+				continue
+			}
+		}
+	}
+	opts.JetStreamScrub = so
+	return nil
+}
+
+func parseJetStreamArchive(v interface{}, opts *Options, errors *[]error, warnings *[]error) error {
+	var lt token
+	tk, v := unwrapValue(v, &lt)
+
+	ao := JSArchiveOpts{}
+
+	vv, ok := v.(map[string]interface{})
+	if !ok {
+		return &configErr{tk, fmt.Sprintf("Expected a map to define JetStream archiving, got %T", v)}
+	}
+	for mk, mv := range vv {
+		tk, mv = unwrapValue(mv, &lt)
+		switch strings.ToLower(mk) {
+		case "dir", "store_dir":
+			ao.Dir = mv.(string)
+		case "backend":
+			ao.Backend = mv.(string)
+		case "interval":
+			ao.Interval = parseDuration(mk, tk, mv, errors, warnings)
+		case "cache", "cache_size":
+			s, err := getStorageSize(mv)
+			if err != nil {
+				return &configErr{tk, fmt.Sprintf("%s %s", strings.ToLower(mk), err)}
+			}
+			ao.Cache = s
+		default:
+			if !tk.IsUsedVariable() {
+				err := &unknownConfigFieldErr{
+					field: mk,
+					configErr: configErr{
+						token: tk,
+					},
+				}
+				*errors = append(*errors, err)
+				continue
+			}
+		}
+	}
+	opts.JetStreamArchive = ao
+	return nil
+}
+
 // Parse enablement of jetstream for a server.
 func parseJetStream(v interface{}, opts *Options, errors *[]error, warnings *[]error) error {
 	var lt token
@@ -1993,6 +2270,12 @@ func parseJetStream(v interface{}, opts *Options, errors *[]error, warnings *[]e
 					return &configErr{tk, "Duplicate 'store_dir' configuration"}
 				}
 				opts.StoreDir = mv.(string)
+			case "store_dirs", "storedirs":
+				dirs, err := parseJetStreamStoreDirs(tk, mv)
+				if err != nil {
+					return err
+				}
+				opts.JetStreamStoreDirs = dirs
 			case "max_memory_store", "max_mem_store", "max_mem":
 				s, err := getStorageSize(mv)
 				if err != nil {
@@ -2013,6 +2296,8 @@ func parseJetStream(v interface{}, opts *Options, errors *[]error, warnings *[]e
 				doEnable = mv.(bool)
 			case "key", "ek", "encryption_key":
 				opts.JetStreamKey = mv.(string)
+			case "prev_key", "prev_ek", "prev_encryption_key":
+				opts.JetStreamOldKey = mv.(string)
 			case "cipher":
 				switch strings.ToLower(mv.(string)) {
 				case "chacha", "chachapoly":
@@ -2028,6 +2313,18 @@ func parseJetStream(v interface{}, opts *Options, errors *[]error, warnings *[]e
 				if err := parseJetStreamLimits(tk, opts, errors, warnings); err != nil {
 					return err
 				}
+			case "compact", "compaction":
+				if err := parseJetStreamCompact(tk, opts, errors, warnings); err != nil {
+					return err
+				}
+			case "scrub", "scrubbing":
+				if err := parseJetStreamScrub(tk, opts, errors, warnings); err != nil {
+					return err
+				}
+			case "archive", "archiving":
+				if err := parseJetStreamArchive(tk, opts, errors, warnings); err != nil {
+					return err
+				}
 			case "unique_tag":
 				opts.JetStreamUniqueTag = strings.ToLower(strings.TrimSpace(mv.(string)))
 			case "max_outstanding_catchup":
@@ -2036,6 +2333,18 @@ func parseJetStream(v interface{}, opts *Options, errors *[]error, warnings *[]e
 					return &configErr{tk, fmt.Sprintf("%s %s", strings.ToLower(mk), err)}
 				}
 				opts.JetStreamMaxCatchup = s
+			case "max_read_ahead", "read_ahead":
+				s, err := getStorageSize(mv)
+				if err != nil {
+					return &configErr{tk, fmt.Sprintf("%s %s", strings.ToLower(mk), err)}
+				}
+				opts.JetStreamReadAhead = s
+			case "backups", "backup":
+				policies, err := parseJetStreamBackups(tk, mv, errors, warnings)
+				if err != nil {
+					return err
+				}
+				opts.JetStreamBackups = policies
 			default:
 				if !tk.IsUsedVariable() {
 					err := &unknownConfigFieldErr{
@@ -2057,6 +2366,92 @@ func parseJetStream(v interface{}, opts *Options, errors *[]error, warnings *[]e
 	return nil
 }
 
+// parseJetStreamStoreDirs parses the named store directories streams can be placed in.
+func parseJetStreamStoreDirs(tk token, v interface{}) (map[string]string, error) {
+	var lt token
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, &configErr{tk, fmt.Sprintf("Expected store_dirs to be a map, got %T", v)}
+	}
+	dirs := make(map[string]string, len(m))
+	for name, mv := range m {
+		tk, mv := unwrapValue(mv, &lt)
+		if !isValidName(name) {
+			return nil, &configErr{tk, fmt.Sprintf("Invalid store directory name %q", name)}
+		}
+		dir, ok := mv.(string)
+		if !ok || dir == _EMPTY_ {
+			return nil, &configErr{tk, fmt.Sprintf("Expected a directory for store directory %q, got %v", name, mv)}
+		}
+		dirs[name] = dir
+	}
+	return dirs, nil
+}
+
+// parseJetStreamBackups parses the policies for scheduled stream backups.
+func parseJetStreamBackups(tk token, v interface{}, errors *[]error, warnings *[]error) ([]*StreamBackupPolicy, error) {
+	var lt token
+	defer convertPanicToErrorList(&lt, errors)
+
+	// Allow a single policy as well.
+	if m, ok := v.(map[string]interface{}); ok {
+		v = []interface{}{m}
+	}
+	arr, ok := v.([]interface{})
+	if !ok {
+		return nil, &configErr{tk, fmt.Sprintf("Expected backups to be an array or map, got %T", v)}
+	}
+	var policies []*StreamBackupPolicy
+	for _, e := range arr {
+		tk, e := unwrapValue(e, &lt)
+		m, ok := e.(map[string]interface{})
+		if !ok {
+			return nil, &configErr{tk, fmt.Sprintf("Expected backup policy to be a map, got %T", e)}
+		}
+		p := &StreamBackupPolicy{Streams: "*"}
+		for k, mv := range m {
+			tk, mv := unwrapValue(mv, &lt)
+			switch strings.ToLower(k) {
+			case "account":
+				p.Account = mv.(string)
+			case "streams", "stream":
+				p.Streams = mv.(string)
+			case "schedule", "interval":
+				p.Schedule = mv.(string)
+				d, err := parseBackupSchedule(p.Schedule)
+				if err != nil {
+					return nil, &configErr{tk, err.Error()}
+				}
+				p.Interval = d
+			case "dir", "directory":
+				p.Dir = mv.(string)
+			case "retain", "keep":
+				p.Retain = int(mv.(int64))
+			case "consumers":
+				p.NoConsumers = !mv.(bool)
+			default:
+				if !tk.IsUsedVariable() {
+					*errors = append(*errors, &unknownConfigFieldErr{field: k, configErr: configErr{token: tk}})
+				}
+			}
+		}
+		if p.Dir == _EMPTY_ {
+			return nil, &configErr{tk, "Backup policy requires a directory"}
+		}
+		if p.Interval == 0 {
+			return nil, &configErr{tk, "Backup policy requires a schedule"}
+		}
+		if p.Retain < 0 {
+			return nil, &configErr{tk, "Backup policy retain can not be negative"}
+		}
+		if _, err := filepath.Match(p.Streams, _EMPTY_); err != nil {
+			return nil, &configErr{tk, fmt.Sprintf("Backup policy streams pattern %q is not valid", p.Streams)}
+		}
+		policies = append(policies, p)
+	}
+	return policies, nil
+}
+
 // parseLeafNodes will parse the leaf node config.
 func parseLeafNodes(v interface{}, opts *Options, errors *[]error, warnings *[]error) error {
 	var lt token
@@ -4525,6 +4920,9 @@ func MergeOptions(fileOpts, flagOpts *Options) *Options {
 	if flagOpts.JetStream {
 		fileOpts.JetStream = flagOpts.JetStream
 	}
+	if len(flagOpts.JetStreamRestore) > 0 {
+		opts.JetStreamRestore = flagOpts.JetStreamRestore
+	}
 	return &opts
 }
 
@@ -4853,6 +5251,10 @@ func ConfigureOptions(fs *flag.FlagSet, args []string, printVersion, printHelp,
 	fs.BoolVar(&opts.JetStream, "jetstream", false, "Enable JetStream.")
 	fs.StringVar(&opts.StoreDir, "sd", "", "Storage directory.")
 	fs.StringVar(&opts.StoreDir, "store_dir", "", "Storage directory.")
+	fs.Func("js_restore", "Restore a stream from a backup file on startup, can be repeated.", func(v string) error {
+		opts.JetStreamRestore = append(opts.JetStreamRestore, v)
+		return nil
+	})
 
 	// The flags definition above set "default" values to some of the options.
 	// Calling Parse() here will override the default options with any value
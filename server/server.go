@@ -1865,6 +1865,7 @@ func (s *Server) Start() {
 		}
 		cfg := &JetStreamConfig{
 			StoreDir:   opts.StoreDir,
+			StoreDirs:  opts.JetStreamStoreDirs,
 			MaxMemory:  opts.JetStreamMaxMemory,
 			MaxStore:   opts.JetStreamMaxStore,
 			Domain:     opts.JetStreamDomain,
@@ -20,6 +20,7 @@ import (
 	"fmt"
 	"io"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -33,8 +34,81 @@ const (
 	MemoryStorage = StorageType(33)
 	// Any is for internals.
 	AnyStorage = StorageType(44)
+	// HybridStorage stores new messages in memory and moves the oldest to disk once the memory tier is full.
+	// The memory tier counts against memory limits and is moved to disk on a clean shutdown.
+	HybridStorage = StorageType(55)
 )
 
+// Storage types handed out to registered storage backends start here.
+const firstBackendStorage = StorageType(100)
+
+// StorageBackend allows embedders to provide their own stream storage. A backend is
+// registered by name with RegisterStorageBackend, and streams select it by using the
+// returned StorageType, or the name as the storage type in their JSON config.
+//
+// The server keeps the stream and consumer metadata files within dir itself so that
+// streams can be recovered on restart. Snapshots are restored by extracting them into
+// dir, so the reader of a snapshot should be an S2 compressed tar archive of dir.
+type StorageBackend interface {
+	// NewStreamStore should create, or recover, the store for a stream in dir.
+	// This is also used for the raft log of clustered assets using the backend.
+	NewStreamStore(dir string, cfg StreamConfig) (StreamStore, error)
+}
+
+// Registered storage backends.
+var (
+	sbMu    sync.RWMutex
+	sbTypes = make(map[StorageType]*storageBackend)
+	sbNames = make(map[string]StorageType)
+)
+
+type storageBackend struct {
+	name    string
+	backend StorageBackend
+}
+
+// RegisterStorageBackend registers a custom storage backend under the given name and returns
+// the StorageType that selects it. This should be done before starting any servers, and all
+// servers in a cluster need the backend registered under the same name.
+func RegisterStorageBackend(name string, backend StorageBackend) (StorageType, error) {
+	name = strings.ToLower(name)
+	if name == _EMPTY_ || backend == nil {
+		return 0, errors.New("storage backend requires a name and a backend")
+	}
+	switch name {
+	case memoryStorageString, fileStorageString, anyStorageString, hybridStorageString:
+		return 0, fmt.Errorf("storage backend name %q is reserved", name)
+	}
+
+	sbMu.Lock()
+	defer sbMu.Unlock()
+	if _, ok := sbNames[name]; ok {
+		return 0, fmt.Errorf("storage backend %q already registered", name)
+	}
+	st := firstBackendStorage + StorageType(len(sbNames))
+	sbNames[name] = st
+	sbTypes[st] = &storageBackend{name, backend}
+	return st, nil
+}
+
+// Returns the registered storage backend for this storage type, nil if not one.
+func (st StorageType) backend() *storageBackend {
+	if st < firstBackendStorage {
+		return nil
+	}
+	sbMu.RLock()
+	defer sbMu.RUnlock()
+	return sbTypes[st]
+}
+
+// Hybrid storage and storage backends are accounted for against the file storage limits.
+func (st StorageType) limitsType() StorageType {
+	if st == HybridStorage || st.backend() != nil {
+		return FileStorage
+	}
+	return st
+}
+
 var (
 	// ErrStoreClosed is returned when the store has been closed
 	ErrStoreClosed = errors.New("store is closed")
@@ -61,6 +135,8 @@ var (
 	ErrInvalidSequence = errors.New("invalid sequence")
 	// ErrSequenceMismatch is returned when storing a raw message and the expected sequence is wrong.
 	ErrSequenceMismatch = errors.New("expected sequence does not match store")
+	// ErrHeaderNotIndexed is returned when looking up messages by a header the stream does not index.
+	ErrHeaderNotIndexed = errors.New("header not indexed")
 )
 
 // StoreMsg is the stored message format for messages that are retained by the Store layer.
@@ -73,6 +149,34 @@ type StoreMsg struct {
 	ts   int64
 }
 
+// Set will fill in the message, copying the header and message into our own buffer.
+// This allows storage backends to return messages from their load functions.
+func (sm *StoreMsg) Set(subj string, hdr, msg []byte, seq uint64, ts int64) {
+	if sm.buf != nil {
+		sm.buf = sm.buf[:0]
+	}
+	sm.buf = append(sm.buf, hdr...)
+	sm.buf = append(sm.buf, msg...)
+	// We set cap on header in case someone wants to expand it.
+	sm.hdr, sm.msg = sm.buf[:len(hdr):len(hdr)], sm.buf[len(hdr):]
+	sm.subj, sm.seq, sm.ts = subj, seq, ts
+}
+
+// Subject returns the subject of the message.
+func (sm *StoreMsg) Subject() string { return sm.subj }
+
+// Header returns the header of the message if present.
+func (sm *StoreMsg) Header() []byte { return sm.hdr }
+
+// Data returns the message payload.
+func (sm *StoreMsg) Data() []byte { return sm.msg }
+
+// Sequence returns the stream sequence of the message.
+func (sm *StoreMsg) Sequence() uint64 { return sm.seq }
+
+// Timestamp returns the time the message was stored in unix nanoseconds.
+func (sm *StoreMsg) Timestamp() int64 { return sm.ts }
+
 // Used to call back into the upper layers to report on changes in storage resources.
 // For the cases where its a single message we will also supply sequence number and subject.
 type StorageUpdateHandler func(msgs, bytes int64, seq uint64, subj string)
@@ -133,6 +237,20 @@ const (
 	DiscardNew
 )
 
+// SyncPolicy determines when a file based stream syncs its writes to disk. The default,
+// SyncInterval, syncs periodically in the background. SyncAlways will sync every write before
+// it is acknowledged. SyncBatch will sync writes within the stream's SyncMaxLatency.
+type SyncPolicy int
+
+const (
+	// SyncInterval will sync to disk periodically in the background.
+	SyncInterval SyncPolicy = iota
+	// SyncAlways will sync each write to disk before it is acknowledged.
+	SyncAlways
+	// SyncBatch will sync writes to disk in batches within a maximum latency.
+	SyncBatch
+)
+
 // StreamState is information about the given stream.
 type StreamState struct {
 	Msgs        uint64            `json:"messages"`
@@ -159,6 +277,20 @@ type SimpleState struct {
 	firstNeedsUpdate bool
 }
 
+// StorageTiers reports the usage of each storage tier for hybrid streams.
+// The memory tier holds the most recent messages, and the file tier those spilled from it.
+type StorageTiers struct {
+	Memory TierState `json:"memory"`
+	File   TierState `json:"file"`
+}
+
+// TierState is the usage for a single storage tier.
+type TierState struct {
+	Msgs     uint64 `json:"messages"`
+	Bytes    uint64 `json:"bytes"`
+	FirstSeq uint64 `json:"first_seq"`
+}
+
 // LostStreamData indicates msgs that have been lost.
 type LostStreamData struct {
 	Msgs  []uint64 `json:"msgs"`
@@ -171,6 +303,21 @@ type SnapshotResult struct {
 	State  StreamState
 }
 
+// HeaderIndexedStore is implemented by stream stores that can look up messages by the
+// values of the headers in the stream's IndexedHeaders.
+type HeaderIndexedStore interface {
+	LoadNextMsgByHeader(name, value string, start uint64, sm *StoreMsg) (*StoreMsg, error)
+}
+
+// Load the next message with the value for an indexed header, if the store supports it.
+func loadNextMsgByHeader(store StreamStore, name, value string, start uint64, sm *StoreMsg) (*StoreMsg, error) {
+	his, ok := store.(HeaderIndexedStore)
+	if !ok {
+		return nil, ErrHeaderNotIndexed
+	}
+	return his.LoadNextMsgByHeader(name, value, start, sm)
+}
+
 // ConsumerStore stores state on consumers for streams.
 type ConsumerStore interface {
 	SetStarting(sseq uint64) error
@@ -208,6 +355,16 @@ type ConsumerState struct {
 	Redelivered map[uint64]uint64 `json:"redelivered,omitempty"`
 }
 
+// EncodeConsumerState encodes the consumer state in the format expected from a ConsumerStore's EncodedState.
+func EncodeConsumerState(state *ConsumerState) []byte {
+	return encodeConsumerState(state)
+}
+
+// DecodeConsumerState decodes consumer state that was encoded with EncodeConsumerState.
+func DecodeConsumerState(buf []byte) (*ConsumerState, error) {
+	return decodeConsumerState(buf)
+}
+
 // Encode consumer state.
 func encodeConsumerState(state *ConsumerState) []byte {
 	var hdr [seqsHdrSize]byte
@@ -271,6 +428,58 @@ func encodeConsumerState(state *ConsumerState) []byte {
 	return buf[:n]
 }
 
+// consumerCheckpoint is a recorded consumer state, used for point in time restores.
+type consumerCheckpoint struct {
+	ts    int64
+	state *ConsumerState
+}
+
+// Encode consumer checkpoints, each checkpoint holds an encoded consumer state.
+func encodeConsumerCheckpoints(cps []*consumerCheckpoint) []byte {
+	buf := make([]byte, hdrLen, 256)
+	buf[0], buf[1] = magic, 1
+	buf = binary.AppendUvarint(buf, uint64(len(cps)))
+	for _, cp := range cps {
+		state := encodeConsumerState(cp.state)
+		buf = binary.AppendVarint(buf, cp.ts)
+		buf = binary.AppendUvarint(buf, uint64(len(state)))
+		buf = append(buf, state...)
+	}
+	return buf
+}
+
+// Decode consumer checkpoints.
+func decodeConsumerCheckpoints(buf []byte) ([]*consumerCheckpoint, error) {
+	if len(buf) < hdrLen || buf[0] != magic || buf[1] != 1 {
+		return nil, errCorruptState
+	}
+	buf = buf[hdrLen:]
+	num, n := binary.Uvarint(buf)
+	if n <= 0 {
+		return nil, errCorruptState
+	}
+	buf = buf[n:]
+	var cps []*consumerCheckpoint
+	for i := uint64(0); i < num; i++ {
+		ts, n := binary.Varint(buf)
+		if n <= 0 {
+			return nil, errCorruptState
+		}
+		buf = buf[n:]
+		sz, n := binary.Uvarint(buf)
+		if n <= 0 || uint64(len(buf)-n) < sz {
+			return nil, errCorruptState
+		}
+		state, err := decodeConsumerState(buf[n : n+int(sz)])
+		if err != nil {
+			return nil, err
+		}
+		cps = append(cps, &consumerCheckpoint{ts, state})
+		buf = buf[n+int(sz):]
+	}
+	return cps, nil
+}
+
 // Represents a pending message for explicit ack or ack all.
 // Sequence is the original consumer sequence.
 type Pending struct {
@@ -368,10 +577,57 @@ func (dp *DiscardPolicy) UnmarshalJSON(data []byte) error {
 	return nil
 }
 
+const (
+	syncIntervalString = "interval"
+	syncAlwaysString   = "always"
+	syncBatchString    = "batch"
+)
+
+func (sp SyncPolicy) String() string {
+	switch sp {
+	case SyncInterval:
+		return "Interval"
+	case SyncAlways:
+		return "Always"
+	case SyncBatch:
+		return "Batch"
+	default:
+		return "Unknown Sync Policy"
+	}
+}
+
+func (sp SyncPolicy) MarshalJSON() ([]byte, error) {
+	switch sp {
+	case SyncInterval:
+		return json.Marshal(syncIntervalString)
+	case SyncAlways:
+		return json.Marshal(syncAlwaysString)
+	case SyncBatch:
+		return json.Marshal(syncBatchString)
+	default:
+		return nil, fmt.Errorf("can not marshal %v", sp)
+	}
+}
+
+func (sp *SyncPolicy) UnmarshalJSON(data []byte) error {
+	switch strings.ToLower(string(data)) {
+	case jsonString(syncIntervalString):
+		*sp = SyncInterval
+	case jsonString(syncAlwaysString):
+		*sp = SyncAlways
+	case jsonString(syncBatchString):
+		*sp = SyncBatch
+	default:
+		return fmt.Errorf("can not unmarshal %q", data)
+	}
+	return nil
+}
+
 const (
 	memoryStorageString = "memory"
 	fileStorageString   = "file"
 	anyStorageString    = "any"
+	hybridStorageString = "hybrid"
 )
 
 func (st StorageType) String() string {
@@ -382,7 +638,12 @@ func (st StorageType) String() string {
 		return "File"
 	case AnyStorage:
 		return "Any"
+	case HybridStorage:
+		return "Hybrid"
 	default:
+		if sb := st.backend(); sb != nil {
+			return sb.name
+		}
 		return "Unknown Storage Type"
 	}
 }
@@ -395,7 +656,12 @@ func (st StorageType) MarshalJSON() ([]byte, error) {
 		return json.Marshal(fileStorageString)
 	case AnyStorage:
 		return json.Marshal(anyStorageString)
+	case HybridStorage:
+		return json.Marshal(hybridStorageString)
 	default:
+		if sb := st.backend(); sb != nil {
+			return json.Marshal(sb.name)
+		}
 		return nil, fmt.Errorf("can not marshal %v", st)
 	}
 }
@@ -408,7 +674,19 @@ func (st *StorageType) UnmarshalJSON(data []byte) error {
 		*st = FileStorage
 	case jsonString(anyStorageString):
 		*st = AnyStorage
+	case jsonString(hybridStorageString):
+		*st = HybridStorage
 	default:
+		var name string
+		if err := json.Unmarshal(data, &name); err == nil {
+			sbMu.RLock()
+			bst, ok := sbNames[strings.ToLower(name)]
+			sbMu.RUnlock()
+			if ok {
+				*st = bst
+				return nil
+			}
+		}
 		return fmt.Errorf("can not unmarshal %q", data)
 	}
 	return nil
@@ -532,6 +810,8 @@ func isOutOfSpaceErr(err error) bool {
 // For when our upper layer catchup detects its missing messages from the beginning of the stream.
 var errFirstSequenceMismatch = errors.New("first sequence mismatch")
 
+var errReplicaMismatch = errors.New("replica checksum mismatch")
+
 func isClusterResetErr(err error) bool {
 	return err == errLastSeqMismatch || err == ErrStoreEOF || err == errFirstSequenceMismatch
 }
@@ -16,6 +16,8 @@ package server
 import (
 	"archive/tar"
 	"bytes"
+	"crypto/cipher"
+	"crypto/sha256"
 	"encoding/binary"
 	"encoding/json"
 	"errors"
@@ -24,6 +26,7 @@ import (
 	"math"
 	"math/rand"
 	"os"
+	"path"
 	"path/filepath"
 	"reflect"
 	"strconv"
@@ -32,6 +35,7 @@ import (
 	"time"
 
 	"github.com/klauspost/compress/s2"
+	"github.com/minio/highwayhash"
 	"github.com/nats-io/nuid"
 )
 
@@ -54,6 +58,7 @@ type StreamConfig struct {
 	NoAck        bool            `json:"no_ack,omitempty"`
 	Template     string          `json:"template_owner,omitempty"`
 	Duplicates   time.Duration   `json:"duplicate_window,omitempty"`
+	MaxMsgIds    int64           `json:"max_msg_ids,omitempty"`
 	Placement    *Placement      `json:"placement,omitempty"`
 	Mirror       *StreamSource   `json:"mirror,omitempty"`
 	Sources      []*StreamSource `json:"sources,omitempty"`
@@ -69,6 +74,45 @@ type StreamConfig struct {
 	// Allow KV like semantics to also discard new on a per subject basis
 	DiscardNewPer bool `json:"discard_new_per_subject,omitempty"`
 
+	// Schemas messages need to be valid against when published on matching subjects.
+	Schemas []*StreamSchema `json:"schemas,omitempty"`
+
+	// FirstSeq is the initial sequence number for the first message stored in a new stream.
+	// Can only be changed on an empty stream.
+	FirstSeq uint64 `json:"first_seq,omitempty"`
+
+	// ConsumerCheckpoints periodically records the state of the consumers,
+	// which allows point in time restores to rewind them.
+	ConsumerCheckpoints *ConsumerCheckpoints `json:"consumer_checkpoints,omitempty"`
+
+	// Sync determines when writes are synced to disk for file based streams.
+	// SyncMaxLatency is the longest a write will remain unsynced with SyncBatch.
+	Sync           SyncPolicy    `json:"sync,omitempty"`
+	SyncMaxLatency time.Duration `json:"sync_max_latency,omitempty"`
+
+	// MemoryTierBytes is how many bytes of the most recent messages hybrid streams keep in memory.
+	MemoryTierBytes int64 `json:"memory_tier_bytes,omitempty"`
+
+	// StoreDir is the named store directory for file based streams.
+	// Defaults to the JetStream store directory.
+	StoreDir string `json:"store_dir,omitempty"`
+
+	// ArchiveAfter is how old the messages of sealed blocks of file based streams need
+	// to be for the blocks to be offloaded to the server's block archive.
+	ArchiveAfter time.Duration `json:"archive_after,omitempty"`
+
+	// IndexedHeaders are message headers whose values are indexed by the store,
+	// allowing messages to be looked up by these values without a full scan.
+	IndexedHeaders []string `json:"indexed_headers,omitempty"`
+
+	// PersistOnShutdown will have memory based streams write their messages and consumer
+	// state to the store directory on a clean shutdown, and reload them on startup.
+	PersistOnShutdown bool `json:"persist_on_shutdown,omitempty"`
+
+	// AutoStream is the subject of the auto stream template the stream was created from.
+	// Only these streams are deleted again when idle.
+	AutoStream string `json:"auto_stream,omitempty"`
+
 	// Optional qualifiers. These can not be modified after set to true.
 
 	// Sealed will seal a stream so no messages can get out or in.
@@ -83,10 +127,40 @@ type StreamConfig struct {
 }
 
 // RePublish is for republishing messages once committed to a stream.
+// The destination can use any of the subject mapping functions.
+// If an account is set the messages will be republished into that account,
+// which needs to import the destination from the stream's account.
 type RePublish struct {
 	Source      string `json:"src,omitempty"`
 	Destination string `json:"dest"`
 	HeadersOnly bool   `json:"headers_only,omitempty"`
+	Account     string `json:"account,omitempty"`
+}
+
+// StreamSchema selects the JSON schema that messages published on matching subjects
+// need to be valid against. The schema is either inline, or stored in a KeyValue bucket
+// of the stream's account. Versions are selected with the Nats-Schema-Version header,
+// and are stored in the bucket under "<key>.<version>".
+type StreamSchema struct {
+	Subject  string                     `json:"subject"`
+	Schema   json.RawMessage            `json:"schema,omitempty"`
+	Versions map[string]json.RawMessage `json:"versions,omitempty"`
+	Bucket   string                     `json:"bucket,omitempty"`
+	Key      string                     `json:"key,omitempty"`
+}
+
+// ConsumerCheckpoints controls how often consumer states are recorded and for how long they are kept.
+// MaxAge defaults to 24 hours.
+type ConsumerCheckpoints struct {
+	Interval time.Duration `json:"interval"`
+	MaxAge   time.Duration `json:"max_age,omitempty"`
+}
+
+// StreamSchemaStats are the schema validation metrics for a stream.
+type StreamSchemaStats struct {
+	Validated   uint64 `json:"validated"`
+	Failed      uint64 `json:"failed"`
+	Unavailable uint64 `json:"unavailable"`
 }
 
 // JSPubAckResponse is a formal response to a publish operation.
@@ -123,6 +197,13 @@ type StreamInfo struct {
 	Mirror     *StreamSourceInfo   `json:"mirror,omitempty"`
 	Sources    []*StreamSourceInfo `json:"sources,omitempty"`
 	Alternates []StreamAlternate   `json:"alternates,omitempty"`
+	Schema     *StreamSchemaStats  `json:"schema_validation,omitempty"`
+	Tiers      *StorageTiers       `json:"tiers,omitempty"`
+	// RePublishError is why messages can not currently be republished.
+	RePublishError string `json:"republish_error,omitempty"`
+	// RePublishDropped is how many messages were not republished since the
+	// account we republish into could not be resolved.
+	RePublishDropped uint64 `json:"republish_dropped,omitempty"`
 }
 
 type StreamAlternate struct {
@@ -204,10 +285,19 @@ type stream struct {
 	created   time.Time
 	stype     StorageType
 	tier      string
+	sdir      string
+	moving    string
+	verifying bool
 	ddmap     map[string]*ddentry
 	ddarr     []*ddentry
 	ddindex   int
 	ddtmr     *time.Timer
+	ddfn      string
+	ddwtmr    *time.Timer
+	ddchg     bool
+	ddgen     uint64
+	ddwmu     sync.Mutex
+	ddwgen    uint64
 	qch       chan struct{}
 	active    bool
 	ddloaded  bool
@@ -222,15 +312,25 @@ type stream struct {
 	// Indicates we have direct consumers.
 	directs int
 
+	// For schema validation on ingest.
+	sv *schemaValidator
+
 	// For republishing.
-	tr *transform
+	tr    *transform
+	rpacc *Account
+	rpsi  *streamImport
+	rpq   *jsOutQ
+	rpErr error
+	rptmr *time.Timer
+	rpdrp uint64
 
 	// For processing consumers without main stream lock.
-	clsMu sync.RWMutex
-	cList []*consumer
-	sch   chan struct{}
-	sigq  *ipQueue[*cMsg]
-	csl   *Sublist
+	clsMu   sync.RWMutex
+	cList   []*consumer
+	cpaused bool
+	sch     chan struct{}
+	sigq    *ipQueue[*cMsg]
+	csl     *Sublist
 
 	// For non limits policy streams when they process an ack before the actual msg.
 	// Can happen in stretch clusters, multi-cloud, or during catchup for a restarted server.
@@ -243,6 +343,7 @@ type stream struct {
 	catchup    bool
 	syncSub    *subscription
 	infoSub    *subscription
+	verifySub  *subscription
 	clMu       sync.Mutex
 	clseq      uint64
 	clfs       uint64
@@ -300,6 +401,7 @@ const (
 	JSMsgRollup           = "Nats-Rollup"
 	JSMsgSize             = "Nats-Msg-Size"
 	JSResponseType        = "Nats-Response-Type"
+	JSSchemaVersion       = "Nats-Schema-Version"
 )
 
 // Headers for republished messages and direct gets.
@@ -309,6 +411,8 @@ const (
 	JSTimeStamp    = "Nats-Time-Stamp"
 	JSSubject      = "Nats-Subject"
 	JSLastSequence = "Nats-Last-Sequence"
+	JSDomain       = "Nats-Domain"
+	JSCluster      = "Nats-Cluster"
 )
 
 // Rollups, can be subject only or all messages.
@@ -344,6 +448,14 @@ func (a *Account) addStreamWithStore(config *StreamConfig, fsConfig *FileStoreCo
 }
 
 func (a *Account) addStreamWithAssignment(config *StreamConfig, fsConfig *FileStoreConfig, sa *streamAssignment) (*stream, error) {
+	return a.addStreamWithFill(config, fsConfig, sa, nil)
+}
+
+// addStreamWithFill adds a stream and, if fill is not nil, calls it with the new stream
+// before the stream is subscribed to its subjects or registered with the account.
+// Nothing else stores messages until then, so restores and imports can load
+// messages into its store without holding the stream lock.
+func (a *Account) addStreamWithFill(config *StreamConfig, fsConfig *FileStoreConfig, sa *streamAssignment, fill func(mset *stream) error) (*stream, error) {
 	s, jsa, err := a.checkForJetStream()
 	if err != nil {
 		return nil, err
@@ -380,6 +492,13 @@ func (a *Account) addStreamWithAssignment(config *StreamConfig, fsConfig *FileSt
 		}()
 	}
 
+	// Resolve the account we republish into if not our own. This can fail while
+	// accounts are still being resolved, in which case we retry when republishing.
+	rpacc, rpsi, rpErr := s.republishImport(a, cfg.RePublish)
+	if rpErr != nil {
+		s.Warnf("Stream '%s > %s' can not republish yet: %v", a.Name, cfg.Name, rpErr)
+	}
+
 	js, isClustered := jsa.jetStreamAndClustered()
 	jsa.mu.Lock()
 	if mset, ok := jsa.streams[cfg.Name]; ok {
@@ -398,9 +517,11 @@ func (a *Account) addStreamWithAssignment(config *StreamConfig, fsConfig *FileSt
 	jsa.usageMu.RLock()
 	selected, tier, hasTier := jsa.selectLimits(&cfg)
 	jsa.usageMu.RUnlock()
-	reserved := int64(0)
+	reserved, mreserved, sdreserved := int64(0), int64(0), int64(0)
 	if !isClustered {
 		reserved = jsa.tieredReservation(tier, &cfg)
+		mreserved = jsa.tieredReservation(tier, memoryTierConfig(&cfg))
+		sdreserved = jsa.storeDirReservation(tier, &cfg)
 	}
 	jsa.mu.Unlock()
 
@@ -410,11 +531,24 @@ func (a *Account) addStreamWithAssignment(config *StreamConfig, fsConfig *FileSt
 	js.mu.RLock()
 	if isClustered {
 		_, reserved = tieredStreamAndReservationCount(js.cluster.streams[a.Name], tier, &cfg)
+		_, mreserved = tieredStreamAndReservationCount(js.cluster.streams[a.Name], tier, memoryTierConfig(&cfg))
+		sdreserved = storeDirReservationCount(js.cluster.streams[a.Name], tier, &cfg)
 	}
 	if err := js.checkAllLimits(&selected, &cfg, reserved, 0); err != nil {
 		js.mu.RUnlock()
 		return nil, err
 	}
+	// The memory tier of hybrid streams is held in memory, so check it against memory limits.
+	if cfg.Storage == HybridStorage {
+		if err := js.checkAllLimits(&selected, memoryTierConfig(&cfg), mreserved, 0); err != nil {
+			js.mu.RUnlock()
+			return nil, err
+		}
+	}
+	if err := checkStoreDirLimits(&selected, &cfg, sdreserved); err != nil {
+		js.mu.RUnlock()
+		return nil, err
+	}
 	js.mu.RUnlock()
 	jsa.mu.Lock()
 	// Check for template ownership if present.
@@ -444,6 +578,18 @@ func (a *Account) addStreamWithAssignment(config *StreamConfig, fsConfig *FileSt
 		return nil, fmt.Errorf("no applicable tier found")
 	}
 
+	// Reserve our subjects until we are registered, which could take a while
+	// when filling the stream, so no overlapping stream can be added meanwhile.
+	if jsa.reserved == nil {
+		jsa.reserved = make(map[string][]string)
+	}
+	jsa.reserved[cfg.Name] = cfg.Subjects
+	defer func() {
+		jsa.mu.Lock()
+		delete(jsa.reserved, cfg.Name)
+		jsa.mu.Unlock()
+	}()
+
 	// Setup the internal clients.
 	c := s.createInternalJetStreamClient()
 	ic := s.createInternalJetStreamClient()
@@ -459,6 +605,7 @@ func (a *Account) addStreamWithAssignment(config *StreamConfig, fsConfig *FileSt
 		sysc:      ic,
 		tier:      tier,
 		stype:     cfg.Storage,
+		sdir:      cfg.StoreDir,
 		consumers: make(map[string]*consumer),
 		msgs:      newIPQueue[*inMsg](s, qpfx+"messages"),
 		gets:      newIPQueue[*directGetReq](s, qpfx+"direct gets"),
@@ -476,6 +623,16 @@ func (a *Account) addStreamWithAssignment(config *StreamConfig, fsConfig *FileSt
 		mset.ackq = newIPQueue[uint64](s, qpfx+"acks")
 	}
 
+	// Check for schemas to validate against on ingest.
+	if len(cfg.Schemas) > 0 {
+		sv, err := newSchemaValidator(a, cfg.Schemas)
+		if err != nil {
+			jsa.mu.Unlock()
+			return nil, NewJSStreamInvalidConfigError(err)
+		}
+		mset.sv = sv
+	}
+
 	// Check for RePublish.
 	if cfg.RePublish != nil {
 		// Empty same as all.
@@ -489,8 +646,14 @@ func (a *Account) addStreamWithAssignment(config *StreamConfig, fsConfig *FileSt
 		}
 		// Assign our transform for republishing.
 		mset.tr = tr
+		// Republishing into another account uses its own send queue.
+		if rp := cfg.RePublish; rp.Account != _EMPTY_ && rp.Account != a.Name {
+			mset.rpacc, mset.rpsi, mset.rpErr = rpacc, rpsi, rpErr
+			mset.rpq = &jsOutQ{newIPQueue[*jsPubMsg](s, qpfx+"republish sendQ")}
+			mset.rptmr = time.AfterFunc(republishRetryInterval, mset.resolveRepublish)
+		}
 	}
-	storeDir := filepath.Join(jsa.storeDir, streamsDir, cfg.Name)
+	storeDir := js.streamStoreDir(a.Name, &cfg)
 	jsa.mu.Unlock()
 
 	// Bind to the user account.
@@ -504,13 +667,25 @@ func (a *Account) addStreamWithAssignment(config *StreamConfig, fsConfig *FileSt
 		fsCfg = &FileStoreConfig{}
 		// If we are file based and not explicitly configured
 		// we may be able to auto-tune based on max msgs or bytes.
-		if cfg.Storage == FileStorage {
+		if cfg.Storage == FileStorage || cfg.Storage == HybridStorage {
 			mset.autoTuneFileStorageBlockSize(fsCfg)
 		}
 	}
 	fsCfg.StoreDir = storeDir
 	fsCfg.AsyncFlush = false
 	fsCfg.SyncInterval = 2 * time.Minute
+	co := s.getOpts().JetStreamCompact
+	fsCfg.CompactInterval = co.Interval
+	fsCfg.CompactThreshold = co.Threshold
+	fsCfg.CompactMinBytes = uint64(co.MinBytes)
+	fsCfg.CompactLimiter = js.cmpLimiter
+	so := s.getOpts().JetStreamScrub
+	fsCfg.ScrubInterval = so.Interval
+	fsCfg.ScrubLimiter = js.scrubLimiter
+	fsCfg.Archive = js.archive
+	fsCfg.ArchivePrefix = path.Join(s.Name(), a.Name, cfg.Name)
+	fsCfg.ArchiveInterval = s.getOpts().JetStreamArchive.Interval
+	fsCfg.ReadAhead = js.readAhead
 
 	if err := mset.setupStore(fsCfg); err != nil {
 		mset.stop(true, false)
@@ -526,6 +701,14 @@ func (a *Account) addStreamWithAssignment(config *StreamConfig, fsConfig *FileSt
 	end := len(mset.pubAck)
 	mset.pubAck = mset.pubAck[:end:end]
 
+	// Load any messages we were asked to before we can receive new ones.
+	if fill != nil {
+		if err := fill(mset); err != nil {
+			mset.stop(true, false)
+			return nil, err
+		}
+	}
+
 	// Set our known last sequence.
 	var state StreamState
 	mset.store.FastState(&state)
@@ -535,8 +718,8 @@ func (a *Account) addStreamWithAssignment(config *StreamConfig, fsConfig *FileSt
 	mset.lseq = state.LastSeq
 	mset.mu.Unlock()
 
-	// If no msgs (new stream), set dedupe state loaded to true.
-	if state.Msgs == 0 {
+	// If no msgs (new stream) and nothing persisted, set dedupe state loaded to true.
+	if state.Msgs == 0 && !mset.hasDedupeState() {
 		mset.ddloaded = true
 	}
 
@@ -579,6 +762,7 @@ func (a *Account) addStreamWithAssignment(config *StreamConfig, fsConfig *FileSt
 	// Register with our account last.
 	jsa.mu.Lock()
 	jsa.streams[cfg.Name] = mset
+	delete(jsa.reserved, cfg.Name)
 	jsa.mu.Unlock()
 
 	return mset, nil
@@ -635,6 +819,10 @@ func (mset *stream) setStreamAssignment(sa *streamAssignment) {
 		// Note below the way we subscribe here is so that we can send requests to ourselves.
 		mset.infoSub, _ = mset.srv.systemSubscribe(isubj, _EMPTY_, false, mset.sysc, mset.handleClusterStreamInfoRequest)
 	}
+	if mset.verifySub == nil {
+		vsubj := fmt.Sprintf(clusterStreamVerifyT, mset.jsa.acc(), mset.cfg.Name)
+		mset.verifySub, _ = mset.srv.systemSubscribe(vsubj, _EMPTY_, false, mset.sysc, mset.handleClusterStreamVerifyRequest)
+	}
 
 	// Trigger update chan.
 	select {
@@ -805,15 +993,20 @@ func (mset *stream) rebuildDedupe() {
 
 	mset.ddloaded = true
 
+	var state StreamState
+	mset.store.FastState(&state)
+
 	// We have some messages. Lookup starting sequence by duplicate time window.
 	sseq := mset.store.GetSeqFromTime(time.Now().Add(-mset.cfg.Duplicates))
+	// If we persisted our state we only need to scan messages stored since.
+	if lseq, ok := mset.recoverDedupeState(state.LastSeq); ok && lseq >= sseq {
+		sseq = lseq + 1
+	}
 	if sseq == 0 {
 		return
 	}
 
 	var smv StoreMsg
-	var state StreamState
-	mset.store.FastState(&state)
 
 	for seq := sseq; seq <= state.LastSeq; seq++ {
 		sm, err := mset.store.LoadMsg(seq, &smv)
@@ -955,7 +1148,8 @@ func (mset *stream) setCreatedTime(created time.Time) {
 	mset.mu.Unlock()
 }
 
-// subjectsOverlap to see if these subjects overlap with existing subjects.
+// subjectsOverlap to see if these subjects overlap with existing subjects,
+// including those reserved by streams that are still being added.
 // Use only for non-clustered JetStream
 // RLock minimum should be held.
 func (jsa *jsAccount) subjectsOverlap(subjects []string, self *stream) bool {
@@ -971,12 +1165,28 @@ func (jsa *jsAccount) subjectsOverlap(subjects []string, self *stream) bool {
 			}
 		}
 	}
+	// Also check streams that are still being added.
+	for _, rsubjs := range jsa.reserved {
+		for _, subj := range rsubjs {
+			for _, tsubj := range subjects {
+				if SubjectsCollide(tsubj, subj) {
+					return true
+				}
+			}
+		}
+	}
 	return false
 }
 
 // StreamDefaultDuplicatesWindow default duplicates window.
 const StreamDefaultDuplicatesWindow = 2 * time.Minute
 
+// StreamDefaultSyncMaxLatency default maximum latency for batched syncs.
+const StreamDefaultSyncMaxLatency = 10 * time.Millisecond
+
+// StreamDefaultMemoryTierBytes default size of the memory tier for hybrid streams.
+const StreamDefaultMemoryTierBytes = 64 * 1024 * 1024
+
 func (s *Server) checkStreamCfg(config *StreamConfig, acc *Account) (StreamConfig, *ApiError) {
 	lim := &s.getOpts().JetStreamLimits
 
@@ -999,6 +1209,59 @@ func (s *Server) checkStreamCfg(config *StreamConfig, acc *Account) (StreamConfi
 	if cfg.Storage == 0 {
 		cfg.Storage = FileStorage
 	}
+	switch cfg.Storage {
+	case FileStorage, MemoryStorage:
+	case HybridStorage:
+		if cfg.MemoryTierBytes < 0 {
+			return StreamConfig{}, NewJSStreamInvalidConfigError(fmt.Errorf("memory tier bytes can not be negative"))
+		} else if cfg.MemoryTierBytes == 0 {
+			cfg.MemoryTierBytes = StreamDefaultMemoryTierBytes
+		}
+	default:
+		if cfg.Storage.backend() == nil {
+			return StreamConfig{}, NewJSStreamInvalidConfigError(fmt.Errorf("unknown storage type"))
+		}
+		// Storage backends are responsible for their own data, so we can not honor encryption.
+		if s.getOpts().JetStreamKey != _EMPTY_ {
+			return StreamConfig{}, NewJSStreamInvalidConfigError(fmt.Errorf("storage backends do not support encryption"))
+		}
+	}
+	if cfg.MemoryTierBytes != 0 && cfg.Storage != HybridStorage {
+		return StreamConfig{}, NewJSStreamInvalidConfigError(fmt.Errorf("memory tier bytes requires hybrid storage"))
+	}
+	if cfg.PersistOnShutdown && cfg.Storage != MemoryStorage {
+		return StreamConfig{}, NewJSStreamInvalidConfigError(fmt.Errorf("persist on shutdown requires memory storage"))
+	}
+	if cfg.StoreDir != _EMPTY_ {
+		if cfg.Storage != FileStorage && cfg.Storage != HybridStorage {
+			return StreamConfig{}, NewJSStreamInvalidConfigError(fmt.Errorf("store directory requires file storage"))
+		}
+		if js := s.getJetStream(); js == nil || js.config.StoreDirs[cfg.StoreDir] == _EMPTY_ {
+			return StreamConfig{}, NewJSStreamInvalidConfigError(fmt.Errorf("unknown store directory %q", cfg.StoreDir))
+		}
+	}
+	if cfg.ArchiveAfter < 0 {
+		return StreamConfig{}, NewJSStreamInvalidConfigError(fmt.Errorf("archive after can not be negative"))
+	} else if cfg.ArchiveAfter > 0 {
+		if cfg.Storage != FileStorage && cfg.Storage != HybridStorage {
+			return StreamConfig{}, NewJSStreamInvalidConfigError(fmt.Errorf("archive after requires file storage"))
+		}
+		if js := s.getJetStream(); js == nil || js.archive == nil {
+			return StreamConfig{}, NewJSStreamInvalidConfigError(fmt.Errorf("archive after requires a block archive to be configured"))
+		}
+	}
+	if len(cfg.IndexedHeaders) > 0 {
+		seen := make(map[string]struct{}, len(cfg.IndexedHeaders))
+		for _, hn := range cfg.IndexedHeaders {
+			if hn == _EMPTY_ || strings.ContainsAny(hn, ": \t\r\n") {
+				return StreamConfig{}, NewJSStreamInvalidConfigError(fmt.Errorf("indexed header %q is not a valid header name", hn))
+			}
+			if _, ok := seen[hn]; ok {
+				return StreamConfig{}, NewJSStreamInvalidConfigError(fmt.Errorf("duplicate indexed header %q", hn))
+			}
+			seen[hn] = struct{}{}
+		}
+	}
 	if cfg.Replicas == 0 {
 		cfg.Replicas = 1
 	}
@@ -1051,11 +1314,33 @@ func (s *Server) checkStreamCfg(config *StreamConfig, acc *Account) (StreamConfi
 	if cfg.Duplicates > 0 && cfg.Duplicates < 100*time.Millisecond {
 		return StreamConfig{}, NewJSStreamInvalidConfigError(fmt.Errorf("duplicates window needs to be >= 100ms"))
 	}
+	if cfg.MaxMsgIds < 0 {
+		return StreamConfig{}, NewJSStreamInvalidConfigError(fmt.Errorf("max msg ids can not be negative"))
+	}
 
 	if cfg.DenyPurge && cfg.AllowRollup {
 		return StreamConfig{}, NewJSStreamInvalidConfigError(fmt.Errorf("roll-ups require the purge permission"))
 	}
 
+	// Check our sync policy, which only applies to file based streams.
+	switch cfg.Sync {
+	case SyncInterval, SyncAlways:
+		if cfg.SyncMaxLatency != 0 {
+			return StreamConfig{}, NewJSStreamInvalidConfigError(fmt.Errorf("sync max latency requires the batch sync policy"))
+		}
+	case SyncBatch:
+		if cfg.SyncMaxLatency < 0 {
+			return StreamConfig{}, NewJSStreamInvalidConfigError(fmt.Errorf("sync max latency can not be negative"))
+		} else if cfg.SyncMaxLatency == 0 {
+			cfg.SyncMaxLatency = StreamDefaultSyncMaxLatency
+		}
+	default:
+		return StreamConfig{}, NewJSStreamInvalidConfigError(fmt.Errorf("unknown sync policy"))
+	}
+	if cfg.Sync != SyncInterval && cfg.Storage != FileStorage && cfg.Storage != HybridStorage {
+		return StreamConfig{}, NewJSStreamInvalidConfigError(fmt.Errorf("sync policy requires file storage"))
+	}
+
 	// Check for new discard new per subject, we require the discard policy to also be new.
 	if cfg.DiscardNewPer {
 		if cfg.Discard != DiscardNew {
@@ -1120,6 +1405,9 @@ func (s *Server) checkStreamCfg(config *StreamConfig, acc *Account) (StreamConfi
 		if len(cfg.Sources) > 0 {
 			return StreamConfig{}, NewJSMirrorWithSourcesError()
 		}
+		if cfg.FirstSeq > 0 {
+			return StreamConfig{}, NewJSMirrorWithFirstSeqError()
+		}
 		// Do not perform checks if External is provided, as it could lead to
 		// checking against itself (if sourced stream name is the same on different JetStream)
 		if cfg.Mirror.External == nil {
@@ -1313,6 +1601,20 @@ func (s *Server) checkStreamCfg(config *StreamConfig, acc *Account) (StreamConfi
 		}
 	}
 
+	// Check schemas, inline ones need to compile.
+	if len(cfg.Schemas) > 0 {
+		if cfg.Mirror != nil {
+			return StreamConfig{}, NewJSStreamInvalidConfigError(fmt.Errorf("stream configuration for schemas can not be used with a mirror"))
+		}
+		if _, err := newSchemaValidator(acc, cfg.Schemas); err != nil {
+			return StreamConfig{}, NewJSStreamInvalidConfigError(err)
+		}
+	}
+
+	if cp := cfg.ConsumerCheckpoints; cp != nil && (cp.Interval <= 0 || cp.MaxAge < 0) {
+		return StreamConfig{}, NewJSStreamInvalidConfigError(fmt.Errorf("consumer checkpoints require a positive interval"))
+	}
+
 	// If we have a republish directive check if we can create a transform here.
 	if cfg.RePublish != nil {
 		// Check to make sure source is a valid subset of the subjects we have.
@@ -1331,15 +1633,23 @@ func (s *Server) checkStreamCfg(config *StreamConfig, acc *Account) (StreamConfi
 		if !srcValid {
 			return StreamConfig{}, NewJSStreamInvalidConfigError(fmt.Errorf("stream configuration for republish source is not valid subset of subjects"))
 		}
-		var formsCycle bool
-		for _, subj := range cfg.Subjects {
-			if SubjectsCollide(cfg.RePublish.Destination, subj) {
-				formsCycle = true
-				break
+		if err := ValidateMappingDestination(cfg.RePublish.Destination); err != nil {
+			return StreamConfig{}, NewJSStreamInvalidConfigError(fmt.Errorf("stream configuration for republish destination not valid: %v", err))
+		}
+		// Only our own account can form a cycle, and for that we need to consider
+		// everything the mapping functions in the destination could produce.
+		if cfg.RePublish.Account == _EMPTY_ || cfg.RePublish.Account == acc.Name {
+			var formsCycle bool
+			dest := mappingDestinationToFilter(cfg.RePublish.Destination)
+			for _, subj := range cfg.Subjects {
+				if SubjectsCollide(dest, subj) {
+					formsCycle = true
+					break
+				}
+			}
+			if formsCycle {
+				return StreamConfig{}, NewJSStreamInvalidConfigError(fmt.Errorf("stream configuration for republish destination forms a cycle"))
 			}
-		}
-		if formsCycle {
-			return StreamConfig{}, NewJSStreamInvalidConfigError(fmt.Errorf("stream configuration for republish destination forms a cycle"))
 		}
 		if _, err := newTransform(cfg.RePublish.Source, cfg.RePublish.Destination); err != nil {
 			return StreamConfig{}, NewJSStreamInvalidConfigError(fmt.Errorf("stream configuration for republish not valid"))
@@ -1349,6 +1659,91 @@ func (s *Server) checkStreamCfg(config *StreamConfig, acc *Account) (StreamConfi
 	return cfg, nil
 }
 
+// republishImport returns the account and its stream import to use when a stream
+// in acc republishes into another account. Returns nil values when republishing
+// stays within acc.
+func (s *Server) republishImport(acc *Account, rp *RePublish) (*Account, *streamImport, error) {
+	if rp == nil || rp.Account == _EMPTY_ || rp.Account == acc.Name {
+		return nil, nil, nil
+	}
+	racc, err := s.LookupAccount(rp.Account)
+	if err != nil {
+		return nil, nil, fmt.Errorf("republish account %q not found", rp.Account)
+	}
+	si := racc.streamImportCovering(acc, mappingDestinationToFilter(rp.Destination))
+	if si == nil {
+		return nil, nil, fmt.Errorf("republish account %q does not import %q from account %q", rp.Account, rp.Destination, acc.Name)
+	}
+	return racc, si, nil
+}
+
+// How often we resolve the account we republish into again. This retries failed
+// resolutions and also notices revoked exports or imports and account updates.
+const republishRetryInterval = 5 * time.Second
+
+// resolveRepublish resolves the account we republish into and its stream import
+// again. This runs from our republish timer and not our internal loop since
+// resolving the account could involve a fetch from the account resolver.
+func (mset *stream) resolveRepublish() {
+	mset.mu.RLock()
+	if mset.closed {
+		mset.mu.RUnlock()
+		return
+	}
+	s, acc, rp := mset.srv, mset.acc, mset.cfg.RePublish
+	mset.mu.RUnlock()
+
+	racc, si, err := s.republishImport(acc, rp)
+
+	mset.mu.Lock()
+	defer mset.mu.Unlock()
+	if mset.closed || mset.rptmr == nil {
+		return
+	}
+	mset.rptmr.Reset(republishRetryInterval)
+	if err != nil {
+		if mset.rpErr == nil || mset.rpErr.Error() != err.Error() {
+			s.Warnf("Stream '%s > %s' can not republish: %v", acc.Name, mset.cfg.Name, err)
+		}
+		mset.rpacc, mset.rpsi, mset.rpErr = nil, nil, err
+		return
+	}
+	if mset.rpErr != nil {
+		s.Noticef("Stream '%s > %s' resumed republishing into account %q", acc.Name, mset.cfg.Name, racc.Name)
+	}
+	mset.rpacc, mset.rpsi, mset.rpErr = racc, si, nil
+}
+
+// republishTarget returns the account we republish into and its stream import
+// as last resolved. Returns nil values while unresolved, in which case the n
+// messages we were about to republish are counted as dropped.
+func (mset *stream) republishTarget(n int) (*Account, *streamImport) {
+	mset.mu.Lock()
+	defer mset.mu.Unlock()
+	if mset.rpsi == nil {
+		mset.rpdrp += uint64(n)
+	}
+	return mset.rpacc, mset.rpsi
+}
+
+// republishError returns why we can not republish, empty if we can.
+func (mset *stream) republishError() string {
+	mset.mu.RLock()
+	defer mset.mu.RUnlock()
+	if mset.rpErr == nil {
+		return _EMPTY_
+	}
+	return mset.rpErr.Error()
+}
+
+// republishDropped returns how many messages we did not republish since
+// the account we republish into could not be resolved.
+func (mset *stream) republishDropped() uint64 {
+	mset.mu.RLock()
+	defer mset.mu.RUnlock()
+	return mset.rpdrp
+}
+
 // Config returns the stream's configuration.
 func (mset *stream) config() StreamConfig {
 	mset.mu.RLock()
@@ -1359,13 +1754,237 @@ func (mset *stream) config() StreamConfig {
 func (mset *stream) fileStoreConfig() (FileStoreConfig, error) {
 	mset.mu.Lock()
 	defer mset.mu.Unlock()
-	fs, ok := mset.store.(*fileStore)
-	if !ok {
+	fs := mset.backingFileStore()
+	if fs == nil {
 		return FileStoreConfig{}, ErrStoreWrongType
 	}
 	return fs.fileStoreConfig(), nil
 }
 
+// Returns the file store for file based streams, which hybrid streams have as well.
+// Will return nil for other storage types.
+// Lock should be held.
+func (mset *stream) backingFileStore() *fileStore {
+	switch store := mset.store.(type) {
+	case *fileStore:
+		return store
+	case *hybridStore:
+		return store.fileStore
+	}
+	return nil
+}
+
+// storageTiers returns the usage of each storage tier for hybrid streams, nil otherwise.
+func (mset *stream) storageTiers() *StorageTiers {
+	mset.mu.RLock()
+	hs, ok := mset.store.(*hybridStore)
+	mset.mu.RUnlock()
+	if !ok {
+		return nil
+	}
+	return hs.tiers()
+}
+
+// reclaimableBytes returns the bytes background compaction can reclaim
+// from our file store. Memory based streams will always return 0.
+func (mset *stream) reclaimableBytes() uint64 {
+	mset.mu.RLock()
+	fs := mset.backingFileStore()
+	mset.mu.RUnlock()
+	if fs == nil {
+		return 0
+	}
+	return fs.reclaimableBytes()
+}
+
+// scrubStats returns the background scrubbing results of our file store.
+// Memory based streams will always return nil.
+func (mset *stream) scrubStats() *ScrubStats {
+	mset.mu.RLock()
+	fs := mset.backingFileStore()
+	mset.mu.RUnlock()
+	if fs == nil {
+		return nil
+	}
+	stats := fs.scrubStats()
+	return &stats
+}
+
+// archiveStats returns the blocks our file store offloaded to its block archive.
+// Streams without a block archive will return nil.
+func (mset *stream) archiveStats() *ArchiveStats {
+	mset.mu.RLock()
+	fs := mset.backingFileStore()
+	mset.mu.RUnlock()
+	if fs == nil {
+		return nil
+	}
+	return fs.archiveStats()
+}
+
+// syncStats returns the disk syncs done by our file store and the time spent in them.
+// Memory based streams will always return nil.
+func (mset *stream) syncStats() *SyncStats {
+	mset.mu.RLock()
+	fs := mset.backingFileStore()
+	mset.mu.RUnlock()
+	if fs == nil {
+		return nil
+	}
+	stats := fs.syncStats()
+	return &stats
+}
+
+// cacheStats returns the hits and misses of our file store's block caches.
+// Memory based streams will always return nil.
+func (mset *stream) cacheStats() *CacheStats {
+	mset.mu.RLock()
+	fs := mset.backingFileStore()
+	mset.mu.RUnlock()
+	if fs == nil {
+		return nil
+	}
+	stats := fs.cacheStats()
+	return &stats
+}
+
+// keyRotation returns the progress re-encrypting our file store after a key rotation.
+// Will return nil if nothing needed to be re-encrypted.
+func (mset *stream) keyRotation() *KeyRotationInfo {
+	mset.mu.RLock()
+	fs := mset.backingFileStore()
+	mset.mu.RUnlock()
+	if fs == nil {
+		return nil
+	}
+	return fs.keyRotation()
+}
+
+// storeCorruption is called by our file store when scrubbing found corrupt messages.
+// We report these and, if configured, replace them with the leader's copies.
+// Lock should not be held.
+func (mset *stream) storeCorruption(first, last uint64, err error) {
+	s := mset.srv
+	repair := s.getOpts().JetStreamScrub.Repair
+
+	mset.mu.RLock()
+	name, outq := mset.cfg.Name, mset.outq
+	repair = repair && mset.isClustered()
+	mset.mu.RUnlock()
+
+	s.Errorf("JetStream stream '%s > %s' has corrupt messages [%d-%d]: %v", mset.accName(), name, first, last, err)
+
+	if outq != nil {
+		m := JSStreamCorruptionAdvisory{
+			TypedEvent: TypedEvent{
+				Type: JSStreamCorruptionAdvisoryType,
+				ID:   nuid.Next(),
+				Time: time.Now().UTC(),
+			},
+			Stream:   name,
+			Server:   s.Name(),
+			FirstSeq: first,
+			LastSeq:  last,
+			Error:    err.Error(),
+			Repair:   repair,
+			Domain:   s.getOpts().JetStreamDomain,
+		}
+		if j, err := json.Marshal(m); err == nil {
+			outq.sendMsg(JSAdvisoryStreamCorruptionPre+"."+name, j)
+		}
+	}
+
+	if repair {
+		go mset.repairCorruptMsgs(first, last)
+	}
+}
+
+const (
+	// How long we wait for a healthy leader to repair corrupt messages from.
+	repairLeaderWait = 10 * time.Second
+	// How long we wait for the leader's copy of a message.
+	repairFetchTimeout = 2 * time.Second
+)
+
+// Replace the messages scrubbing found corrupt with copies from our leader. Only these
+// messages are rewritten, everything else we have stays as it is. If we are the leader
+// ourselves we step down first so a healthy replica takes over.
+// Lock should not be held.
+func (mset *stream) repairCorruptMsgs(first, last uint64) {
+	s := mset.srv
+	mset.mu.RLock()
+	node, name, outq, qch := mset.node, mset.cfg.Name, mset.outq, mset.qch
+	fs := mset.backingFileStore()
+	mset.mu.RUnlock()
+	if node == nil || fs == nil || outq == nil {
+		return
+	}
+
+	if node.Leader() {
+		node.StepDown()
+	}
+	for deadline := time.Now().Add(repairLeaderWait); node.Leader() || node.GroupLeader() == _EMPTY_; {
+		if time.Now().After(deadline) {
+			s.Warnf("JetStream stream '%s > %s' could not repair corrupt messages [%d-%d]: no leader to repair from", mset.accName(), name, first, last)
+			return
+		}
+		select {
+		case <-qch:
+			return
+		case <-time.After(250 * time.Millisecond):
+		}
+	}
+
+	respCh := make(chan []byte, 1)
+	reply := infoReplySubject()
+	sub, err := mset.subscribeInternalUnlocked(reply, func(sub *subscription, c *client, _ *Account, subject, reply string, rmsg []byte) {
+		_, msg := c.msgParts(rmsg)
+		select {
+		case respCh <- copyBytes(msg):
+		default:
+		}
+	})
+	if err != nil {
+		s.Warnf("JetStream stream '%s > %s' could not repair corrupt messages [%d-%d]: %v", mset.accName(), name, first, last, err)
+		return
+	}
+	defer mset.unsubscribeUnlocked(sub)
+
+	// Messages the leader does not have are stored as deleted.
+	subj := fmt.Sprintf(JSApiMsgGetT, name)
+	msgs := make(map[uint64]*StoreMsg)
+	for seq := first; seq <= last; seq++ {
+		req, _ := json.Marshal(&JSApiMsgGetRequest{Seq: seq})
+		outq.send(newJSPubMsg(subj, _EMPTY_, reply, nil, req, nil, 0))
+
+		var resp JSApiMsgGetResponse
+		select {
+		case msg := <-respCh:
+			err = json.Unmarshal(msg, &resp)
+		case <-time.After(repairFetchTimeout):
+			err = errors.New("timeout fetching message from leader")
+		case <-qch:
+			return
+		}
+		if err == nil && resp.Error != nil && resp.Error.ErrCode != uint16(JSNoMessageFoundErr) {
+			err = resp.Error
+		}
+		if err != nil {
+			s.Warnf("JetStream stream '%s > %s' could not repair corrupt messages [%d-%d]: %v", mset.accName(), name, first, last, err)
+			return
+		}
+		if sm := resp.Message; sm != nil && sm.Sequence == seq {
+			msgs[seq] = &StoreMsg{subj: sm.Subject, hdr: sm.Header, msg: sm.Data, seq: seq, ts: sm.Time.UnixNano()}
+		}
+	}
+
+	if err := fs.repairMsgs(first, last, msgs); err != nil {
+		s.Warnf("JetStream stream '%s > %s' could not repair corrupt messages [%d-%d]: %v", mset.accName(), name, first, last, err)
+		return
+	}
+	s.Noticef("JetStream stream '%s > %s' repaired corrupt messages [%d-%d] from its leader", mset.accName(), name, first, last)
+}
+
 // Do not hold jsAccount or jetStream lock
 func (jsa *jsAccount) configUpdateCheck(old, new *StreamConfig, s *Server) (*StreamConfig, error) {
 	cfg, apiErr := s.checkStreamCfg(new, jsa.acc())
@@ -1473,9 +2092,11 @@ func (jsa *jsAccount) configUpdateCheck(old, new *StreamConfig, s *Server) (*Str
 		selected, tier, hasTier = jsa.selectLimits(old)
 	}
 	jsa.usageMu.RUnlock()
-	reserved := int64(0)
+	reserved, mreserved, sdreserved := int64(0), int64(0), int64(0)
 	if !isClustered {
 		reserved = jsa.tieredReservation(tier, &cfg)
+		mreserved = jsa.tieredReservation(tier, memoryTierConfig(&cfg))
+		sdreserved = jsa.storeDirReservation(tier, &cfg)
 	}
 	jsa.mu.RUnlock()
 	if !hasTier {
@@ -1485,18 +2106,52 @@ func (jsa *jsAccount) configUpdateCheck(old, new *StreamConfig, s *Server) (*Str
 	defer js.mu.RUnlock()
 	if isClustered {
 		_, reserved = tieredStreamAndReservationCount(js.cluster.streams[acc.Name], tier, &cfg)
+		_, mreserved = tieredStreamAndReservationCount(js.cluster.streams[acc.Name], tier, memoryTierConfig(&cfg))
+		sdreserved = storeDirReservationCount(js.cluster.streams[acc.Name], tier, &cfg)
 	}
 	// reservation does not account for this stream, hence add the old value
 	reserved += int64(old.Replicas) * old.MaxBytes
 	if err := js.checkAllLimits(&selected, &cfg, reserved, maxBytesOffset); err != nil {
 		return nil, err
 	}
+	// The memory tier of hybrid streams is checked against memory limits the same way.
+	if cfg.Storage == HybridStorage {
+		mcfg := memoryTierConfig(&cfg)
+		if mcfg.MaxBytes -= old.MemoryTierBytes; mcfg.MaxBytes < 0 {
+			mcfg.MaxBytes = 0
+		}
+		mreserved += int64(old.Replicas) * old.MemoryTierBytes
+		memOffset := int64(0)
+		if excessRep := cfg.Replicas - old.Replicas; excessRep > 0 {
+			memOffset = old.MemoryTierBytes * int64(excessRep)
+		}
+		if err := js.checkAllLimits(&selected, mcfg, mreserved, memOffset); err != nil {
+			return nil, err
+		}
+	}
 	// Restore the user configured MaxBytes.
 	cfg.MaxBytes = newMaxBytes
+	// Our store directory reservation does not account for this stream either.
+	if err := checkStoreDirLimits(&selected, &cfg, sdreserved); err != nil {
+		return nil, err
+	}
 	return &cfg, nil
 }
 
-// Update will allow certain configuration properties of an existing stream to be updated.
+// Returns true if the update sets a new first sequence.
+func firstSeqChanged(old, new *StreamConfig) bool {
+	return new.FirstSeq > 0 && new.FirstSeq != old.FirstSeq
+}
+
+// A new first sequence can only be set on an empty stream and can not move us backwards.
+func checkFirstSeqUpdate(cfg *StreamConfig, state *StreamState) error {
+	if state.Msgs > 0 || cfg.FirstSeq <= state.LastSeq {
+		return NewJSStreamInvalidConfigError(fmt.Errorf("stream configuration update can only change first sequence on an empty stream"))
+	}
+	return nil
+}
+
+// Update will allow certain configuration properties of an existing stream to be updated.
 func (mset *stream) update(config *StreamConfig) error {
 	return mset.updateWithAdvisory(config, true)
 }
@@ -1510,7 +2165,7 @@ func (mset *stream) updateWithAdvisory(config *StreamConfig, sendAdvisory bool)
 
 	mset.mu.RLock()
 	ocfg := mset.cfg
-	s := mset.srv
+	s, store := mset.srv, mset.store
 	mset.mu.RUnlock()
 
 	cfg, err := mset.jsa.configUpdateCheck(&ocfg, config, s)
@@ -1518,6 +2173,15 @@ func (mset *stream) updateWithAdvisory(config *StreamConfig, sendAdvisory bool)
 		return NewJSStreamInvalidConfigError(err, Unless(err))
 	}
 
+	newFirstSeq := firstSeqChanged(&ocfg, cfg)
+	if newFirstSeq {
+		var state StreamState
+		store.FastState(&state)
+		if err := checkFirstSeqUpdate(cfg, &state); err != nil {
+			return err
+		}
+	}
+
 	jsa.mu.RLock()
 	if jsa.subjectsOverlap(cfg.Subjects, mset) {
 		jsa.mu.RUnlock()
@@ -1525,6 +2189,16 @@ func (mset *stream) updateWithAdvisory(config *StreamConfig, sendAdvisory bool)
 	}
 	jsa.mu.RUnlock()
 
+	// Check if we are moving to a different store directory.
+	// We keep our current one until our storage has been moved.
+	var moveTo string
+	if cfg.StoreDir != ocfg.StoreDir {
+		if err := mset.checkStoreDirMove(cfg); err != nil {
+			return NewJSStreamGeneralError(err, Unless(err))
+		}
+		moveTo = cfg.StoreDir
+	}
+
 	mset.mu.Lock()
 	if mset.isLeader() {
 		// Now check for subject interest differences.
@@ -1631,13 +2305,38 @@ func (mset *stream) updateWithAdvisory(config *StreamConfig, sendAdvisory bool)
 			_, reported, _ := mset.store.Utilization()
 			jsa.updateUsage(mset.tier, mset.stype, -int64(reported))
 			jsa.updateUsage(targetTier, mset.stype, int64(reported))
+			// The memory tier of hybrid streams is accounted as memory.
+			if hs, ok := mset.store.(*hybridStore); ok {
+				_, hot, _ := hs.ms.Utilization()
+				jsa.updateUsage(mset.tier, MemoryStorage, -int64(hot))
+				jsa.updateUsage(targetTier, MemoryStorage, int64(hot))
+			}
+			// As is the usage of our named store directory.
+			if mset.sdir != _EMPTY_ {
+				jsa.updateStoreDirUsage(mset.tier, mset.sdir, -int64(reported))
+				jsa.updateStoreDirUsage(targetTier, mset.sdir, int64(reported))
+			}
 			mset.tier = targetTier
 		}
 		// else in case the new tier does not exist (say on move), keep the old tier around
 		// a subsequent update to an existing tier will then move from existing past tier to existing new tier
 	}
 
+	// Check for schema changes, stats are kept across updates.
+	if !reflect.DeepEqual(cfg.Schemas, ocfg.Schemas) {
+		if len(cfg.Schemas) == 0 {
+			mset.sv = nil
+		} else if sv, err := newSchemaValidator(mset.acc, cfg.Schemas); err == nil {
+			if mset.sv != nil {
+				sv.stats = mset.sv.statsz()
+			}
+			mset.sv = sv
+		}
+	}
+
 	// Now update config and store's version of our config.
+	// Our store directory only changes once our storage has been moved.
+	cfg.StoreDir = mset.cfg.StoreDir
 	mset.cfg = *cfg
 
 	// If we are the leader never suppress update advisory, simply send.
@@ -1661,10 +2360,41 @@ func (mset *stream) updateWithAdvisory(config *StreamConfig, sendAdvisory bool)
 				Storage:  ocfg.Storage,
 			})
 		}
+		// Same for the memory tier of hybrid streams.
+		if tierDiff := cfg.MemoryTierBytes - ocfg.MemoryTierBytes; tierDiff > 0 {
+			js.reserveStreamResources(&StreamConfig{
+				MemoryTierBytes: tierDiff,
+				Storage:         cfg.Storage,
+			})
+		} else if tierDiff < 0 {
+			js.releaseStreamResources(&StreamConfig{
+				MemoryTierBytes: -tierDiff,
+				Storage:         ocfg.Storage,
+			})
+		}
 	}
 
 	mset.store.UpdateConfig(cfg)
 
+	// Now that our config is updated, move our storage in the background.
+	if moveTo != _EMPTY_ {
+		mset.moveStoreDir(moveTo)
+	}
+
+	// Consumers pick up checkpoint changes right away.
+	if !reflect.DeepEqual(cfg.ConsumerCheckpoints, ocfg.ConsumerCheckpoints) {
+		for _, o := range mset.getConsumers() {
+			o.setupCheckpoints()
+		}
+	}
+
+	// Move our empty stream up to the new first sequence.
+	if newFirstSeq {
+		if _, err := mset.purge(&JSApiStreamPurgeRequest{Sequence: cfg.FirstSeq}); err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
@@ -3346,68 +4076,546 @@ func (mset *stream) unsubscribeUnlocked(sub *subscription) {
 
 func (mset *stream) setupStore(fsCfg *FileStoreConfig) error {
 	mset.mu.Lock()
+	defer mset.mu.Unlock()
 	mset.created = time.Now().UTC()
+	return mset.openStore(fsCfg)
+}
 
+// Open the store for our stream, using our created time.
+// Lock should be held.
+func (mset *stream) openStore(fsCfg *FileStoreConfig) error {
+	// Streams with a store directory persist their duplicate detection state there.
+	mset.ddfn = _EMPTY_
+	if mset.cfg.Storage != MemoryStorage {
+		mset.ddfn = filepath.Join(fsCfg.StoreDir, dedupeStateFile)
+	}
 	switch mset.cfg.Storage {
 	case MemoryStorage:
 		ms, err := newMemStore(&mset.cfg)
 		if err != nil {
-			mset.mu.Unlock()
 			return err
 		}
 		mset.store = ms
-	case FileStorage:
+	case FileStorage, HybridStorage:
 		s := mset.srv
 		prf := s.jsKeyGen(mset.acc.Name)
 		if prf != nil {
 			// We are encrypted here, fill in correct cipher selection.
 			fsCfg.Cipher = s.getOpts().JetStreamCipher
 		}
-		fs, err := newFileStoreWithCreated(*fsCfg, mset.cfg, mset.created, prf)
+		fs, err := newFileStoreWithCreated(*fsCfg, mset.cfg, mset.created, prf, s.jsOldKeyGen(mset.acc.Name))
 		if err != nil {
-			mset.mu.Unlock()
 			return err
 		}
 		mset.store = fs
 		// Register our server.
 		fs.registerServer(s)
+		fs.registerCorruptionHandler(mset.storeCorruption)
+		// Hybrid streams keep their most recent messages in memory as well.
+		if mset.cfg.Storage == HybridStorage {
+			hs, err := newHybridStore(fs, &mset.cfg)
+			if err != nil {
+				fs.Stop()
+				return err
+			}
+			mset.store = hs
+		}
+	default:
+		sb := mset.cfg.Storage.backend()
+		if sb == nil {
+			return fmt.Errorf("unknown storage type %v", mset.cfg.Storage)
+		}
+		bs, err := newBackendStore(sb, fsCfg.StoreDir, mset.cfg, mset.created)
+		if err != nil {
+			return err
+		}
+		mset.store = bs
 	}
 	// This will fire the callback but we do not require the lock since md will be 0 here.
-	mset.store.RegisterStorageUpdates(mset.storeUpdates)
+	// Our store directory changes when we move our storage to another one, but our old store
+	// may still report updates after it was stopped, so each store reports to its own.
+	sdir := mset.sdir
+	mset.store.RegisterStorageUpdates(func(md, bd int64, seq uint64, subj string) {
+		mset.storeUpdates(sdir, md, bd, seq, subj)
+	})
+	// The memory tier of hybrid streams starts empty and is accounted as memory.
+	if hs, ok := mset.store.(*hybridStore); ok {
+		hs.registerMemoryTierUpdates(mset.memoryTierUpdates)
+	}
+	// Reload anything we persisted on a clean shutdown, this will be accounted for by our callback.
+	if ms, ok := mset.store.(*memStore); ok && mset.cfg.PersistOnShutdown {
+		aek, err := mset.persistedStateKey(fsCfg.StoreDir)
+		if err == nil {
+			err = ms.recoverPersisted(fsCfg.StoreDir, aek)
+		}
+		if err != nil {
+			mset.srv.Warnf("Error recovering persisted state for stream '%s > %s': %v", mset.acc.Name, mset.cfg.Name, err)
+		}
+	}
+	return nil
+}
+
+// Check if we can move our storage to the store directory in cfg.
+func (mset *stream) checkStoreDirMove(cfg *StreamConfig) error {
+	mset.mu.RLock()
+	defer mset.mu.RUnlock()
+
+	if mset.backingFileStore() == nil {
+		return fmt.Errorf("stream storage does not support store directories")
+	}
+	if mset.moving != _EMPTY_ {
+		if mset.moving == cfg.StoreDir {
+			return nil
+		}
+		return fmt.Errorf("stream storage is already moving to %q", mset.moving)
+	}
+	ndir := mset.js.streamStoreDir(mset.acc.Name, cfg)
+	if _, err := os.Stat(ndir); err == nil {
+		return fmt.Errorf("directory %q already exists", ndir)
+	}
+	return nil
+}
+
+// Move our storage to the named store directory. This is done in the background, since storage
+// that can not simply be renamed, for instance when moving across devices, is copied while the
+// stream stays live. Our config keeps the current store directory until we are done.
+func (mset *stream) moveStoreDir(name string) {
+	mset.mu.Lock()
+	defer mset.mu.Unlock()
+
+	fs := mset.backingFileStore()
+	if fs == nil || mset.moving != _EMPTY_ || mset.cfg.StoreDir == name {
+		return
+	}
+	odir := fs.fileStoreConfig().StoreDir
+	ndir := mset.js.streamStoreDir(mset.acc.Name, &StreamConfig{Name: mset.cfg.Name, StoreDir: name})
+	if err := os.MkdirAll(filepath.Dir(ndir), defaultDirPerms); err != nil {
+		mset.srv.Warnf("Error moving storage for stream '%s > %s' to %q: %v", mset.acc.Name, mset.cfg.Name, ndir, err)
+		return
+	}
+	mset.moving = name
+	go mset.moveStore(fs, name, odir, ndir)
+}
+
+// Moves our storage from odir to ndir for the named store directory.
+func (mset *stream) moveStore(fs *fileStore, name, odir, ndir string) {
+	err := mset.swapStoreDir(fs, name, odir, ndir)
+
+	mset.mu.Lock()
+	mset.moving = _EMPTY_
+	acc, sname := mset.acc.Name, mset.cfg.Name
 	mset.mu.Unlock()
 
+	if err != nil {
+		mset.srv.Warnf("Error moving storage for stream '%s > %s' to %q: %v", acc, sname, ndir, err)
+	} else {
+		mset.srv.Noticef("Moved storage for stream '%s > %s' to %q", acc, sname, ndir)
+	}
+}
+
+// When copying storage, we copy what changed while we copied again while we stay live,
+// until a pass copies less than this or we did this many passes.
+const (
+	storeMoveSyncThreshold = 8 * 1024 * 1024
+	storeMoveSyncPasses    = 8
+)
+
+// Copy our storage to ndir while we stay live, unless we can simply rename it. Then our consumers are paused
+// and our store is stopped to copy what changed since, after which we reopen our store in the new location.
+// The copy is staged outside of the streams directory, so an interrupted copy is not recovered as a stream.
+func (mset *stream) swapStoreDir(fs *fileStore, name, odir, ndir string) error {
+	var staging string
+	var start time.Time
+	rename := canRenameDir(odir, ndir)
+	if !rename {
+		staging = filepath.Join(filepath.Dir(filepath.Dir(ndir)), ".move-"+filepath.Base(ndir))
+		os.RemoveAll(staging)
+		// Each pass copies what changed since the previous one started, so we only
+		// have to copy a small delta once our store is stopped.
+		for i := 0; i < storeMoveSyncPasses; i++ {
+			pstart := time.Now()
+			n, err := syncDir(odir, staging, start)
+			if err != nil {
+				os.RemoveAll(staging)
+				return fmt.Errorf("error copying stream storage: %v", err)
+			}
+			start = pstart
+			if i > 0 && n < storeMoveSyncThreshold {
+				break
+			}
+		}
+	}
+
+	mset.mu.Lock()
+	defer mset.mu.Unlock()
+
+	if mset.closed || mset.backingFileStore() != fs {
+		os.RemoveAll(staging)
+		return fmt.Errorf("stream storage changed while moving")
+	}
+
+	// Pause our consumers, so they do not use their stores while we swap them.
+	// They can not process storage updates either, and will recalculate num pending once resumed.
+	consumers := mset.getConsumers()
+	for _, o := range consumers {
+		o.mu.Lock()
+	}
+	mset.clsMu.Lock()
+	mset.cpaused = true
+	mset.clsMu.Unlock()
+	defer func() {
+		mset.clsMu.Lock()
+		mset.cpaused = false
+		mset.clsMu.Unlock()
+		for _, o := range consumers {
+			o.mu.Unlock()
+		}
+	}()
+
+	fcfg := fs.fileStoreConfig()
+	// This will remove our usage and stop all of our consumer stores.
+	mset.store.Stop()
+	var err error
+	if rename {
+		err = os.Rename(odir, ndir)
+	} else if _, err = syncDir(odir, staging, start); err == nil {
+		if err = os.Rename(staging, ndir); err == nil {
+			os.RemoveAll(odir)
+		}
+	}
+	if err != nil {
+		os.RemoveAll(staging)
+	} else {
+		mset.sdir, mset.cfg.StoreDir = name, name
+		fcfg.StoreDir = ndir
+	}
+	// Reopen our store in whatever location we ended up in.
+	if serr := mset.openStore(&fcfg); serr != nil {
+		return serr
+	}
+	// Record our new store directory in our metadata.
+	if err == nil {
+		if uerr := mset.store.UpdateConfig(&mset.cfg); uerr != nil {
+			mset.srv.Warnf("Error updating stream '%s > %s' metadata: %v", mset.acc.Name, mset.cfg.Name, uerr)
+		}
+	}
+	// Now reopen our consumer stores with their current state.
+	for _, o := range consumers {
+		if ostore, oerr := mset.store.ConsumerStore(o.name, &o.cfg); oerr != nil {
+			mset.srv.Warnf("Error reopening consumer store for '%s > %s > %s': %v", mset.acc.Name, mset.cfg.Name, o.name, oerr)
+		} else {
+			o.store = ostore
+			o.writeStoreStateUnlocked()
+		}
+		o.streamNumPending()
+	}
+	if err != nil {
+		return fmt.Errorf("error moving stream storage: %v", err)
+	}
 	return nil
 }
 
+// Check if src can be renamed to dst by renaming an empty directory next to src.
+func canRenameDir(src, dst string) bool {
+	probe, err := os.MkdirTemp(filepath.Dir(src), ".move-")
+	if err != nil {
+		return false
+	}
+	defer os.RemoveAll(probe)
+	if err := os.Rename(probe, dst); err != nil {
+		return false
+	}
+	os.Remove(dst)
+	return true
+}
+
+// Copy the contents of src to dst, skipping files already in dst with the same size and
+// modification time as long as they were not modified after since. Anything in dst that
+// is no longer in src is removed. Files removed from src while we walk it are ignored.
+// Returns the number of bytes copied.
+func syncDir(src, dst string, since time.Time) (uint64, error) {
+	var copied uint64
+	seen := make(map[string]struct{})
+	err := filepath.WalkDir(src, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		seen[rel] = struct{}{}
+		target := filepath.Join(dst, rel)
+		if d.IsDir() {
+			return os.MkdirAll(target, defaultDirPerms)
+		}
+		fi, err := d.Info()
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		mtime := fi.ModTime()
+		if ti, err := os.Stat(target); err == nil && ti.Size() == fi.Size() && ti.ModTime().Equal(mtime) && mtime.Before(since) {
+			return nil
+		}
+		if err := copyFileSync(path, target); err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		copied += uint64(fi.Size())
+		return os.Chtimes(target, mtime, mtime)
+	})
+	if err != nil {
+		return copied, err
+	}
+	// Now remove anything that is no longer in src.
+	var stale []string
+	filepath.WalkDir(dst, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if rel, err := filepath.Rel(dst, path); err == nil {
+			if _, ok := seen[rel]; !ok {
+				stale = append(stale, path)
+				if d.IsDir() {
+					return filepath.SkipDir
+				}
+			}
+		}
+		return nil
+	})
+	for _, path := range stale {
+		if err := os.RemoveAll(path); err != nil {
+			return copied, err
+		}
+	}
+	return copied, nil
+}
+
+// Move a directory, copying its contents if it can not simply be renamed,
+// for instance when moving across devices.
+func moveDir(src, dst string) error {
+	if _, err := os.Stat(dst); err == nil {
+		return fmt.Errorf("directory %q already exists", dst)
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), defaultDirPerms); err != nil {
+		return err
+	}
+	if err := os.Rename(src, dst); err == nil {
+		return nil
+	}
+	err := filepath.WalkDir(src, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		if d.IsDir() {
+			return os.MkdirAll(target, defaultDirPerms)
+		}
+		return copyFileSync(path, target)
+	})
+	if err != nil {
+		os.RemoveAll(dst)
+		return err
+	}
+	return os.RemoveAll(src)
+}
+
+// Copy a file and sync it to disk.
+func copyFileSync(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, defaultFilePerms)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(out, in); err == nil {
+		err = out.Sync()
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
 // Called for any updates to the underlying stream. We pass through the bytes to the
 // jetstream account. We do local processing for stream pending for consumers, but only
-// for removals.
+// for removals. Bytes are charged to the named store directory sdir of the store as well.
 // Lock should not be held.
-func (mset *stream) storeUpdates(md, bd int64, seq uint64, subj string) {
+func (mset *stream) storeUpdates(sdir string, md, bd int64, seq uint64, subj string) {
 	// If we have a single negative update then we will process our consumers for stream pending.
 	// Purge and Store handled separately inside individual calls.
+	// Consumers paused while we swap our store will re-calculate num pending once resumed.
 	if md == -1 && seq > 0 && subj != _EMPTY_ {
 		// We use our consumer list mutex here instead of the main stream lock since it may be held already.
 		mset.clsMu.RLock()
 		// TODO(dlc) - Do sublist like signaling so we do not have to match?
-		for _, o := range mset.cList {
-			o.decStreamPending(seq, subj)
+		if !mset.cpaused {
+			for _, o := range mset.cList {
+				o.decStreamPending(seq, subj)
+			}
 		}
 		mset.clsMu.RUnlock()
 	} else if md < 0 {
 		// Batch decrements we need to force consumers to re-calculate num pending.
 		mset.clsMu.RLock()
-		for _, o := range mset.cList {
-			o.streamNumPendingLocked()
+		if !mset.cpaused {
+			for _, o := range mset.cList {
+				o.streamNumPendingLocked()
+			}
 		}
 		mset.clsMu.RUnlock()
 	}
 
 	if mset.jsa != nil {
 		mset.jsa.updateUsage(mset.tier, mset.stype, bd)
+		if sdir != _EMPTY_ {
+			mset.jsa.updateStoreDirUsage(mset.tier, sdir, bd)
+		}
 	}
 }
 
+// Called for storage updates of the memory tier of hybrid streams, which counts against memory limits.
+func (mset *stream) memoryTierUpdates(_, bd int64, _ uint64, _ string) {
+	if mset.jsa != nil {
+		mset.jsa.updateUsage(mset.tier, MemoryStorage, bd)
+	}
+}
+
+// Write out a memory based stream and its consumers on a clean shutdown if configured to do so.
+// They are written to our store directory with the same metadata as file based streams,
+// so they will be recovered on startup.
+func (mset *stream) persistOnShutdown(obs []*consumer) error {
+	mset.mu.RLock()
+	ms, ok := mset.store.(*memStore)
+	cfg, created, jsa, s, acc := mset.cfg, mset.created, mset.jsa, mset.srv, mset.acc.Name
+	mset.mu.RUnlock()
+
+	if !ok || !cfg.PersistOnShutdown || jsa == nil {
+		return nil
+	}
+	dir := filepath.Join(jsa.storeDir, streamsDir, cfg.Name)
+	// Make sure nothing stale is left from a previous run.
+	os.RemoveAll(dir)
+
+	// If we are encrypted, everything is encrypted with keys written the same way file stores do,
+	// so our metadata is decrypted when recovered.
+	prf, sc := s.jsKeyGen(acc), s.getOpts().JetStreamCipher
+	genKey := func(dir, context string) (cipher.AEAD, error) {
+		if prf == nil {
+			return nil, nil
+		}
+		aek, ekey, err := genMetaKey(sc, prf, context)
+		if err != nil {
+			return nil, err
+		}
+		if err := os.MkdirAll(dir, defaultDirPerms); err != nil {
+			return nil, err
+		}
+		return aek, os.WriteFile(filepath.Join(dir, JetStreamMetaFileKey), ekey, defaultFilePerms)
+	}
+	aek, err := genKey(dir, cfg.Name)
+	if err != nil {
+		return err
+	}
+
+	cstates := make(map[string][]byte, len(obs))
+	cinfos := make(map[string]*FileConsumerInfo, len(obs))
+	for _, o := range obs {
+		o.mu.RLock()
+		oname, ocfg, ocreated, store := o.name, o.cfg, o.created, o.store
+		o.mu.RUnlock()
+		if store == nil {
+			continue
+		}
+		buf, err := store.EncodedState()
+		if err != nil {
+			return err
+		}
+		cstates[oname] = buf
+		cinfos[oname] = &FileConsumerInfo{Name: oname, Created: ocreated, ConsumerConfig: ocfg}
+	}
+	if err := ms.persist(dir, cstates, aek); err != nil {
+		return err
+	}
+	for oname, csi := range cinfos {
+		odir := filepath.Join(dir, consumerDir, oname)
+		oaek, err := genKey(odir, cfg.Name+tsep+oname)
+		if err != nil {
+			return err
+		}
+		if err := writeMetaFileWithKey(odir, cfg.Name+"/"+oname, csi, oaek); err != nil {
+			return err
+		}
+	}
+	// Write our metadata last, we will not be recovered without it.
+	return writeMetaFileWithKey(dir, cfg.Name, &FileStreamInfo{Created: created, StreamConfig: cfg}, aek)
+}
+
+// Returns the key to decrypt the state persisted on shutdown in dir, nil if it is not encrypted.
+// Lock should be held.
+func (mset *stream) persistedStateKey(dir string) (cipher.AEAD, error) {
+	ekey, err := os.ReadFile(filepath.Join(dir, JetStreamMetaFileKey))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if len(ekey) < minMetaKeySize {
+		return nil, errBadKeySize
+	}
+	s, acc := mset.srv, mset.acc.Name
+	prf := s.jsKeyGen(acc)
+	if prf == nil {
+		return nil, errNoEncryption
+	}
+	// We could be converting ciphers, or rotating our key.
+	sc, osc := s.getOpts().JetStreamCipher, ChaCha
+	if sc == ChaCha {
+		osc = AES
+	}
+	for _, c := range []StoreCipher{sc, osc} {
+		for _, kg := range []keyGen{prf, s.jsOldKeyGen(acc)} {
+			if kg == nil {
+				continue
+			}
+			if seed, err := openMetaKey(c, kg, ekey, mset.cfg.Name); err == nil {
+				return genEncryptionKey(c, seed)
+			}
+		}
+	}
+	return nil, errors.New("could not decrypt persisted state key")
+}
+
+// Once recovered, remove anything persisted on shutdown for a memory based stream.
+// It is only valid for the next startup after a clean shutdown.
+func (mset *stream) removePersisted() {
+	mset.mu.RLock()
+	ms, ok := mset.store.(*memStore)
+	name, jsa := mset.cfg.Name, mset.jsa
+	mset.mu.RUnlock()
+
+	if !ok || jsa == nil {
+		return
+	}
+	ms.clearPersisted()
+	os.RemoveAll(filepath.Join(jsa.storeDir, streamsDir, name))
+}
+
 // NumMsgIds returns the number of message ids being tracked for duplicate suppression.
 func (mset *stream) numMsgIds() int {
 	mset.mu.Lock()
@@ -3443,6 +4651,7 @@ func (mset *stream) purgeMsgIds() {
 	for i, dde := range mset.ddarr[mset.ddindex:] {
 		if now-dde.ts >= window {
 			delete(mset.ddmap, dde.id)
+			mset.ddchg = true
 		} else {
 			mset.ddindex += i
 			// Check if we should garbage collect here if we are 1/3 total size.
@@ -3483,17 +4692,269 @@ func (mset *stream) storeMsgId(dde *ddentry) {
 	mset.storeMsgIdLocked(dde)
 }
 
-// storeMsgIdLocked will store the message id for duplicate detection.
-// Lock should he held.
-func (mset *stream) storeMsgIdLocked(dde *ddentry) {
-	if mset.ddmap == nil {
-		mset.ddmap = make(map[string]*ddentry)
+// storeMsgIdLocked will store the message id for duplicate detection.
+// Lock should he held.
+func (mset *stream) storeMsgIdLocked(dde *ddentry) {
+	if mset.ddmap == nil {
+		mset.ddmap = make(map[string]*ddentry)
+	}
+	mset.ddmap[dde.id] = dde
+	mset.ddarr = append(mset.ddarr, dde)
+	if mset.ddtmr == nil {
+		mset.ddtmr = time.AfterFunc(mset.cfg.Duplicates, mset.purgeMsgIds)
+	}
+	// Drop our oldest ids if we are tracking more than allowed.
+	if max := mset.cfg.MaxMsgIds; max > 0 && int64(len(mset.ddmap)) > max {
+		for int64(len(mset.ddmap)) > max && mset.ddindex < len(mset.ddarr) {
+			odde := mset.ddarr[mset.ddindex]
+			if mset.ddmap[odde.id] == odde {
+				delete(mset.ddmap, odde.id)
+			}
+			mset.ddindex++
+		}
+		// Check if we should garbage collect here if we are 1/3 total size.
+		if cap(mset.ddarr) > 3*(len(mset.ddarr)-mset.ddindex) {
+			mset.ddarr = append([]*ddentry(nil), mset.ddarr[mset.ddindex:]...)
+			mset.ddindex = 0
+		}
+	}
+	// Checkpoint our state in case we do not get to write it on a clean shutdown.
+	mset.ddchg = true
+	if mset.ddfn != _EMPTY_ && mset.ddwtmr == nil {
+		mset.ddwtmr = time.AfterFunc(dedupeCheckpointInterval, mset.checkpointDedupeState)
+	}
+}
+
+const (
+	// File holding our duplicate detection state.
+	dedupeStateFile = "dedupe.dat"
+	// Magic and version for our duplicate detection state.
+	dedupeStateMagic   = uint8(44)
+	dedupeStateVersion = uint8(1)
+)
+
+// How often we write out our duplicate detection state when it changed.
+var dedupeCheckpointInterval = 2 * time.Minute
+
+var errBadDedupeState = errors.New("bad duplicate detection state")
+
+// Returns if we have persisted duplicate detection state.
+// Lock should be held.
+func (mset *stream) hasDedupeState() bool {
+	if mset.ddfn == _EMPTY_ {
+		return false
+	}
+	_, err := os.Stat(mset.ddfn)
+	return err == nil
+}
+
+// A point in time copy of our duplicate detection state.
+// Entries are never changed once added, so we can share them.
+type dedupeSnapshot struct {
+	name string
+	fn   string
+	gen  uint64
+	lseq uint64
+	ddes []*ddentry
+	fs   *fileStore
+}
+
+// Take a snapshot of our duplicate detection state so it can be
+// encoded and written out without holding our lock.
+// Lock should be held.
+func (mset *stream) snapshotDedupeState() *dedupeSnapshot {
+	if mset.ddfn == _EMPTY_ {
+		return nil
+	}
+	ddes := make([]*ddentry, 0, len(mset.ddmap))
+	for _, dde := range mset.ddarr[mset.ddindex:] {
+		if mset.ddmap[dde.id] == dde {
+			ddes = append(ddes, dde)
+		}
+	}
+	mset.ddgen++
+	mset.ddchg = false
+	return &dedupeSnapshot{
+		name: mset.cfg.Name,
+		fn:   mset.ddfn,
+		gen:  mset.ddgen,
+		lseq: mset.lseq,
+		ddes: ddes,
+		fs:   mset.backingFileStore(),
+	}
+}
+
+// Encode our duplicate detection state as
+// magic version last_seq num_ids [id_len id seq ts...] checksum
+func (dds *dedupeSnapshot) encode() ([]byte, error) {
+	key := sha256.Sum256([]byte(dds.name))
+	hh, err := highwayhash.New64(key[:])
+	if err != nil {
+		return nil, err
+	}
+	buf := []byte{dedupeStateMagic, dedupeStateVersion}
+	buf = binary.AppendUvarint(buf, dds.lseq)
+	buf = binary.AppendUvarint(buf, uint64(len(dds.ddes)))
+	for _, dde := range dds.ddes {
+		buf = binary.AppendUvarint(buf, uint64(len(dde.id)))
+		buf = append(buf, dde.id...)
+		buf = binary.AppendUvarint(buf, dde.seq)
+		buf = binary.AppendVarint(buf, dde.ts)
+	}
+	hh.Write(buf)
+	return hh.Sum(buf), nil
+}
+
+// Write out a snapshot of our duplicate detection state. We write to a tmp file
+// first so we never leave a partial file behind, and never replace a newer snapshot
+// with an older one.
+// Lock should not be held, except on stop where no other writers can follow.
+func (mset *stream) writeDedupeState(dds *dedupeSnapshot) error {
+	if dds == nil {
+		return nil
+	}
+	buf, err := dds.encode()
+	if err != nil {
+		return err
+	}
+	if dds.fs != nil {
+		buf = dds.fs.encryptState(buf)
+	}
+
+	mset.ddwmu.Lock()
+	defer mset.ddwmu.Unlock()
+	if dds.gen <= mset.ddwgen {
+		return nil
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(dds.fn), dedupeStateFile+".*")
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(buf); err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), dds.fn)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	mset.ddwgen = dds.gen
+	return nil
+}
+
+// Write out our duplicate detection state if it changed.
+// This is called from a timer.
+func (mset *stream) checkpointDedupeState() {
+	mset.mu.Lock()
+	mset.ddwtmr = nil
+	if mset.closed || !mset.ddchg {
+		mset.mu.Unlock()
+		return
+	}
+	dds := mset.snapshotDedupeState()
+	mset.mu.Unlock()
+
+	if err := mset.writeDedupeState(dds); err != nil {
+		mset.srv.Warnf("Error writing duplicate detection state for stream '%s > %s': %v", mset.acc.Name, dds.name, err)
+	}
+}
+
+// Recover the message ids we persisted that are still within our duplicate window,
+// and returns the last sequence of the stream when they were written. Ids past the
+// last sequence in our store are ignored since those messages were lost.
+// Lock should be held.
+func (mset *stream) recoverDedupeState(last uint64) (uint64, bool) {
+	if mset.ddfn == _EMPTY_ {
+		return 0, false
+	}
+	buf, err := os.ReadFile(mset.ddfn)
+	if err != nil {
+		return 0, false
+	}
+	if fs := mset.backingFileStore(); fs != nil {
+		if buf, err = fs.decryptState(buf); err != nil {
+			mset.srv.Warnf("Error decrypting duplicate detection state for stream '%s > %s': %v", mset.acc.Name, mset.cfg.Name, err)
+			return 0, false
+		}
+	}
+	if len(buf) < 2+checksumSize || buf[0] != dedupeStateMagic || buf[1] != dedupeStateVersion {
+		return 0, false
+	}
+	key := sha256.Sum256([]byte(mset.cfg.Name))
+	hh, err := highwayhash.New64(key[:])
+	if err != nil {
+		return 0, false
+	}
+	hi := len(buf) - checksumSize
+	hh.Write(buf[:hi])
+	if !bytes.Equal(hh.Sum(nil), buf[hi:]) {
+		mset.srv.Warnf("Duplicate detection state for stream '%s > %s' is corrupt", mset.acc.Name, mset.cfg.Name)
+		return 0, false
+	}
+
+	bi := 2
+	readU64 := func() uint64 {
+		if bi < 0 {
+			return 0
+		}
+		num, n := binary.Uvarint(buf[bi:hi])
+		if n <= 0 {
+			bi = -1
+			return 0
+		}
+		bi += n
+		return num
+	}
+	readI64 := func() int64 {
+		if bi < 0 {
+			return 0
+		}
+		num, n := binary.Varint(buf[bi:hi])
+		if n <= 0 {
+			bi = -1
+			return 0
+		}
+		bi += n
+		return num
+	}
+
+	lseq, num := readU64(), readU64()
+	if bi < 0 || lseq > last {
+		return 0, false
 	}
-	mset.ddmap[dde.id] = dde
-	mset.ddarr = append(mset.ddarr, dde)
-	if mset.ddtmr == nil {
-		mset.ddtmr = time.AfterFunc(mset.cfg.Duplicates, mset.purgeMsgIds)
+	window := time.Now().Add(-mset.cfg.Duplicates).UnixNano()
+	var ddes []*ddentry
+	for ; num > 0; num-- {
+		l := readU64()
+		if bi < 0 || uint64(hi-bi) < l {
+			return 0, false
+		}
+		id := string(buf[bi : bi+int(l)])
+		bi += int(l)
+		seq, ts := readU64(), readI64()
+		if bi < 0 {
+			return 0, false
+		}
+		if ts > window && seq <= lseq {
+			ddes = append(ddes, &ddentry{id, seq, ts})
+		}
+	}
+	if bi != hi {
+		return 0, false
 	}
+	for _, dde := range ddes {
+		mset.storeMsgIdLocked(dde)
+		if dde.seq == last {
+			mset.lmsgId = dde.id
+		}
+	}
+	return lseq, true
 }
 
 // Fast lookup of msgId.
@@ -3605,7 +5066,7 @@ func (mset *stream) processDirectGetRequest(_ *subscription, c *client, _ *Accou
 		return
 	}
 	// Check if nothing set.
-	if req.Seq == 0 && req.LastFor == _EMPTY_ && req.NextFor == _EMPTY_ {
+	if req.Seq == 0 && req.LastFor == _EMPTY_ && req.NextFor == _EMPTY_ && req.Header == _EMPTY_ {
 		hdr := []byte("NATS/1.0 408 Empty Request\r\n\r\n")
 		mset.outq.send(newJSPubMsg(reply, _EMPTY_, _EMPTY_, hdr, nil, nil, 0))
 		return
@@ -3621,6 +5082,11 @@ func (mset *stream) processDirectGetRequest(_ *subscription, c *client, _ *Accou
 		mset.outq.send(newJSPubMsg(reply, _EMPTY_, _EMPTY_, hdr, nil, nil, 0))
 		return
 	}
+	if req.Header != _EMPTY_ && (req.LastFor != _EMPTY_ || req.NextFor != _EMPTY_) || req.Header == _EMPTY_ && req.Value != _EMPTY_ {
+		hdr := []byte("NATS/1.0 408 Bad Request\r\n\r\n")
+		mset.outq.send(newJSPubMsg(reply, _EMPTY_, _EMPTY_, hdr, nil, nil, 0))
+		return
+	}
 
 	inlineOk := c.kind != ROUTER && c.kind != GATEWAY && c.kind != LEAF
 	if !inlineOk {
@@ -3686,13 +5152,20 @@ func (mset *stream) getDirectRequest(req *JSApiMsgGetRequest, reply string) {
 	store, name := mset.store, mset.cfg.Name
 	mset.mu.RUnlock()
 
-	if req.Seq > 0 && req.NextFor == _EMPTY_ {
+	if req.Header != _EMPTY_ {
+		sm, err = loadNextMsgByHeader(store, req.Header, req.Value, req.Seq, &svp)
+	} else if req.Seq > 0 && req.NextFor == _EMPTY_ {
 		sm, err = store.LoadMsg(req.Seq, &svp)
 	} else if req.NextFor != _EMPTY_ {
 		sm, _, err = store.LoadNextMsg(req.NextFor, subjectHasWildcard(req.NextFor), req.Seq, &svp)
 	} else {
 		sm, err = store.LoadLastMsg(req.LastFor, &svp)
 	}
+	if err == ErrHeaderNotIndexed {
+		hdr := []byte("NATS/1.0 408 Header Not Indexed\r\n\r\n")
+		mset.outq.send(newJSPubMsg(reply, _EMPTY_, _EMPTY_, hdr, nil, nil, 0))
+		return
+	}
 	if err != nil {
 		hdr := []byte("NATS/1.0 404 Message Not Found\r\n\r\n")
 		mset.outq.send(newJSPubMsg(reply, _EMPTY_, _EMPTY_, hdr, nil, nil, 0))
@@ -4088,7 +5561,7 @@ func (mset *stream) processJetStreamMsg(subject, reply string, hdr, msg []byte,
 		return err
 	}
 
-	if exceeded, apiErr := jsa.limitsExceeded(stype, tierName); exceeded {
+	if exceeded, apiErr := jsa.limitsExceeded(stype, tierName, mset.sdir); exceeded {
 		s.RateLimitWarnf("JetStream resource limits exceeded for account: %q", accName)
 		if canRespond {
 			resp.PubAck = &PubAck{Stream: name}
@@ -4149,7 +5622,19 @@ func (mset *stream) processJetStreamMsg(subject, reply string, hdr, msg []byte,
 				hdr = genHeader(hdr, JSMsgSize, strconv.Itoa(len(msg)))
 			}
 		}
-		mset.outq.send(newJSPubMsg(tsubj, _EMPTY_, _EMPTY_, copyBytes(hdr), rpMsg, nil, seq))
+		// Let receivers know where this was republished from.
+		if domain := s.getOpts().JetStreamDomain; domain != _EMPTY_ {
+			hdr = genHeader(hdr, JSDomain, domain)
+		}
+		if cn := s.cachedClusterName(); cn != _EMPTY_ {
+			hdr = genHeader(hdr, JSCluster, cn)
+		}
+		// If we republish into another account, our internal loop delivers as its import would.
+		if mset.rpq != nil {
+			mset.rpq.send(newJSPubMsg(tsubj, _EMPTY_, _EMPTY_, copyBytes(hdr), rpMsg, nil, seq))
+		} else {
+			mset.outq.send(newJSPubMsg(tsubj, _EMPTY_, _EMPTY_, copyBytes(hdr), rpMsg, nil, seq))
+		}
 	}
 
 	// Send response here.
@@ -4390,7 +5875,23 @@ func (mset *stream) internalLoop() {
 	if mset.ackq != nil {
 		ackq, amch = mset.ackq, mset.ackq.ch
 	}
+
+	// For republishing into another account.
+	var (
+		rpch  chan struct{}
+		rpq   *jsOutQ
+		rpc   *client
+		rpcac *Account
+	)
+	if mset.rpq != nil {
+		rpq, rpch = mset.rpq, mset.rpq.ch
+	}
 	mset.mu.RUnlock()
+	defer func() {
+		if rpc != nil {
+			rpc.closeConnection(ClientClosed)
+		}
+	}()
 
 	// Raw scratch buffer.
 	// This should be rarely used now so can be smaller.
@@ -4405,52 +5906,58 @@ func (mset *stream) internalLoop() {
 		hdb   [10]byte
 	)
 
-	for {
-		select {
-		case <-outq.ch:
-			pms := outq.pop()
-			for _, pm := range pms {
-				c.pa.subject = append(dsubj[:0], pm.dsubj...)
-				c.pa.deliver = append(subj[:0], pm.subj...)
-				c.pa.size = len(pm.msg) + len(pm.hdr)
-				c.pa.szb = append(szb[:0], strconv.Itoa(c.pa.size)...)
-				if len(pm.reply) > 0 {
-					c.pa.reply = append(rply[:0], pm.reply...)
-				} else {
-					c.pa.reply = nil
-				}
+	// Sends the message through the given client, returns if it was delivered.
+	send := func(c *client, pm *jsPubMsg) bool {
+		c.pa.subject = append(dsubj[:0], pm.dsubj...)
+		c.pa.deliver = append(subj[:0], pm.subj...)
+		c.pa.size = len(pm.msg) + len(pm.hdr)
+		c.pa.szb = append(szb[:0], strconv.Itoa(c.pa.size)...)
+		if len(pm.reply) > 0 {
+			c.pa.reply = append(rply[:0], pm.reply...)
+		} else {
+			c.pa.reply = nil
+		}
 
-				// If we have an underlying buf that is the wire contents for hdr + msg, else construct on the fly.
-				var msg []byte
-				if len(pm.buf) > 0 {
-					msg = pm.buf
-				} else {
-					if len(pm.hdr) > 0 {
-						msg = pm.hdr
-						if len(pm.msg) > 0 {
-							msg = _r[:0]
-							msg = append(msg, pm.hdr...)
-							msg = append(msg, pm.msg...)
-						}
-					} else if len(pm.msg) > 0 {
-						// We own this now from a low level buffer perspective so can use directly here.
-						msg = pm.msg
-					}
+		// If we have an underlying buf that is the wire contents for hdr + msg, else construct on the fly.
+		var msg []byte
+		if len(pm.buf) > 0 {
+			msg = pm.buf
+		} else {
+			if len(pm.hdr) > 0 {
+				msg = pm.hdr
+				if len(pm.msg) > 0 {
+					msg = _r[:0]
+					msg = append(msg, pm.hdr...)
+					msg = append(msg, pm.msg...)
 				}
+			} else if len(pm.msg) > 0 {
+				// We own this now from a low level buffer perspective so can use directly here.
+				msg = pm.msg
+			}
+		}
 
-				if len(pm.hdr) > 0 {
-					c.pa.hdr = len(pm.hdr)
-					c.pa.hdb = []byte(strconv.Itoa(c.pa.hdr))
-					c.pa.hdb = append(hdb[:0], strconv.Itoa(c.pa.hdr)...)
-				} else {
-					c.pa.hdr = -1
-					c.pa.hdb = nil
-				}
+		if len(pm.hdr) > 0 {
+			c.pa.hdr = len(pm.hdr)
+			c.pa.hdb = []byte(strconv.Itoa(c.pa.hdr))
+			c.pa.hdb = append(hdb[:0], strconv.Itoa(c.pa.hdr)...)
+		} else {
+			c.pa.hdr = -1
+			c.pa.hdb = nil
+		}
+
+		msg = append(msg, _CRLF_...)
 
-				msg = append(msg, _CRLF_...)
+		didDeliver, _ := c.processInboundClientMsg(msg)
+		c.pa.szb, c.pa.subject, c.pa.deliver = nil, nil, nil
+		return didDeliver
+	}
 
-				didDeliver, _ := c.processInboundClientMsg(msg)
-				c.pa.szb, c.pa.subject, c.pa.deliver = nil, nil, nil
+	for {
+		select {
+		case <-outq.ch:
+			pms := outq.pop()
+			for _, pm := range pms {
+				didDeliver := send(c, pm)
 
 				// Check to see if this is a delivery for a consumer and
 				// we failed to deliver the message. If so alert the consumer.
@@ -4462,11 +5969,38 @@ func (mset *stream) internalLoop() {
 			// TODO: Move in the for-loop?
 			c.flushClients(0)
 			outq.recycle(&pms)
+		case <-rpch:
+			pms := rpq.pop()
+			// Messages are dropped while we can not resolve the account we republish into.
+			if racc, si := mset.republishTarget(len(pms)); si != nil {
+				if rpc == nil || rpcac != racc {
+					if rpc != nil {
+						rpc.closeConnection(ClientClosed)
+					}
+					rpc, rpcac = s.createInternalJetStreamClient(), racc
+					rpc.registerWithAccount(racc)
+				}
+				for _, pm := range pms {
+					pm.dsubj = si.mapSubject(pm.dsubj)
+					send(rpc, pm)
+				}
+				rpc.flushClients(0)
+			}
+			for _, pm := range pms {
+				pm.returnToPool()
+			}
+			rpq.recycle(&pms)
 		case <-msgs.ch:
 			// This can possibly change now so needs to be checked here.
 			isClustered := mset.IsClustered()
 			ims := msgs.pop()
 			for _, im := range ims {
+				// Validate inbound messages against any schemas before storing or proposing.
+				// Messages from our sources do not come through here, they were validated
+				// by their origin stream, if at all.
+				if mset.checkSchema(im.subj, im.rply, im.hdr, im.msg) != nil {
+					continue
+				}
 				// If we are clustered we need to propose this message to the underlying raft group.
 				if isClustered {
 					mset.processClusteredInboundMsg(im.subj, im.rply, im.hdr, im.msg)
@@ -4584,6 +6118,13 @@ func (mset *stream) stop(deleteFlag, advisory bool) error {
 	mset.mu.Unlock()
 
 	isShuttingDown := js.isShuttingDown()
+	// Memory based streams can persist their state on a clean shutdown.
+	// We do this before stopping the consumers to capture their state.
+	if !deleteFlag && isShuttingDown {
+		if err := mset.persistOnShutdown(obs); err != nil {
+			mset.srv.Warnf("Error persisting stream '%s > %s' on shutdown: %v", accName, name, err)
+		}
+	}
 	for _, o := range obs {
 		if !o.isClosed() {
 			// Third flag says do not broadcast a signal.
@@ -4607,6 +6148,10 @@ func (mset *stream) stop(deleteFlag, advisory bool) error {
 		mset.srv.sysUnsubscribe(mset.infoSub)
 		mset.infoSub = nil
 	}
+	if mset.verifySub != nil {
+		mset.srv.sysUnsubscribe(mset.verifySub)
+		mset.verifySub = nil
+	}
 
 	// Send stream delete advisory after the consumers.
 	if deleteFlag && advisory {
@@ -4626,6 +6171,23 @@ func (mset *stream) stop(deleteFlag, advisory bool) error {
 		return nil
 	}
 
+	// Write out our duplicate detection state on a clean stop.
+	if mset.ddwtmr != nil {
+		mset.ddwtmr.Stop()
+		mset.ddwtmr = nil
+	}
+	if !deleteFlag && mset.ddchg {
+		if err := mset.writeDedupeState(mset.snapshotDedupeState()); err != nil {
+			mset.srv.Warnf("Error writing duplicate detection state for stream '%s > %s': %v", mset.acc.Name, mset.cfg.Name, err)
+		}
+	}
+
+	// Cleanup republish timer if running.
+	if mset.rptmr != nil {
+		mset.rptmr.Stop()
+		mset.rptmr = nil
+	}
+
 	// Cleanup duplicate timer if running.
 	if mset.ddtmr != nil {
 		mset.ddtmr.Stop()
@@ -4644,6 +6206,7 @@ func (mset *stream) stop(deleteFlag, advisory bool) error {
 		mset.msgs.unregister()
 		mset.ackq.unregister()
 		mset.outq.unregister()
+		mset.rpq.unregister()
 		mset.sigq.unregister()
 	}
 
@@ -5139,62 +6702,12 @@ func (a *Account) RestoreStream(ncfg *StreamConfig, r io.Reader) (*stream, error
 		return nil, apiErr
 	}
 
-	sd := filepath.Join(jsa.storeDir, snapsDir)
-	if _, err := os.Stat(sd); os.IsNotExist(err) {
-		if err := os.MkdirAll(sd, defaultDirPerms); err != nil {
-			return nil, fmt.Errorf("could not create snapshots directory - %v", err)
-		}
-	}
-	sdir, err := os.MkdirTemp(sd, "snap-")
+	sdir, err := a.extractSnapshot(jsa, r)
 	if err != nil {
 		return nil, err
 	}
-	if _, err := os.Stat(sdir); os.IsNotExist(err) {
-		if err := os.MkdirAll(sdir, defaultDirPerms); err != nil {
-			return nil, fmt.Errorf("could not create snapshots directory - %v", err)
-		}
-	}
 	defer os.RemoveAll(sdir)
 
-	logAndReturnError := func() error {
-		a.mu.RLock()
-		err := fmt.Errorf("unexpected content (account=%s)", a.Name)
-		if a.srv != nil {
-			a.srv.Errorf("Stream restore failed due to %v", err)
-		}
-		a.mu.RUnlock()
-		return err
-	}
-	sdirCheck := filepath.Clean(sdir) + string(os.PathSeparator)
-
-	tr := tar.NewReader(s2.NewReader(r))
-	for {
-		hdr, err := tr.Next()
-		if err == io.EOF {
-			break // End of snapshot
-		}
-		if err != nil {
-			return nil, err
-		}
-		if hdr.Typeflag != tar.TypeReg {
-			return nil, logAndReturnError()
-		}
-		fpath := filepath.Join(sdir, filepath.Clean(hdr.Name))
-		if !strings.HasPrefix(fpath, sdirCheck) {
-			return nil, logAndReturnError()
-		}
-		os.MkdirAll(filepath.Dir(fpath), defaultDirPerms)
-		fd, err := os.OpenFile(fpath, os.O_CREATE|os.O_RDWR, 0600)
-		if err != nil {
-			return nil, err
-		}
-		_, err = io.Copy(fd, tr)
-		fd.Close()
-		if err != nil {
-			return nil, err
-		}
-	}
-
 	// Check metadata.
 	// The cfg passed in will be the new identity for the stream.
 	var fcfg FileStreamInfo
@@ -5215,18 +6728,14 @@ func (a *Account) RestoreStream(ncfg *StreamConfig, r io.Reader) (*stream, error
 	if _, err := a.lookupStream(cfg.Name); err == nil {
 		return nil, NewJSStreamNameExistRestoreFailedError()
 	}
-	// Move into the correct place here.
-	ndir := filepath.Join(jsa.storeDir, streamsDir, cfg.Name)
+	// Move into the correct place here, which could be a named store directory.
+	ndir := jsa.js.streamStoreDir(a.Name, &cfg)
 	// Remove old one if for some reason it is still here.
 	if _, err := os.Stat(ndir); err == nil {
 		os.RemoveAll(ndir)
 	}
-	// Make sure our destination streams directory exists.
-	if err := os.MkdirAll(filepath.Join(jsa.storeDir, streamsDir), defaultDirPerms); err != nil {
-		return nil, err
-	}
-	// Move into new location.
-	if err := os.Rename(sdir, ndir); err != nil {
+	// Move into new location, this will create our destination streams directory.
+	if err := moveDir(sdir, ndir); err != nil {
 		return nil, err
 	}
 
@@ -5303,6 +6812,73 @@ func (a *Account) RestoreStream(ncfg *StreamConfig, r io.Reader) (*stream, error
 	return mset, nil
 }
 
+// extractSnapshot extracts the snapshot into a new directory in the snapshots directory
+// of the account. The caller is responsible for removing it.
+func (a *Account) extractSnapshot(jsa *jsAccount, r io.Reader) (string, error) {
+	sd := filepath.Join(jsa.storeDir, snapsDir)
+	if _, err := os.Stat(sd); os.IsNotExist(err) {
+		if err := os.MkdirAll(sd, defaultDirPerms); err != nil {
+			return _EMPTY_, fmt.Errorf("could not create snapshots directory - %v", err)
+		}
+	}
+	sdir, err := os.MkdirTemp(sd, "snap-")
+	if err != nil {
+		return _EMPTY_, err
+	}
+	if _, err := os.Stat(sdir); os.IsNotExist(err) {
+		if err := os.MkdirAll(sdir, defaultDirPerms); err != nil {
+			return _EMPTY_, fmt.Errorf("could not create snapshots directory - %v", err)
+		}
+	}
+	var ok bool
+	defer func() {
+		if !ok {
+			os.RemoveAll(sdir)
+		}
+	}()
+
+	logAndReturnError := func() error {
+		a.mu.RLock()
+		err := fmt.Errorf("unexpected content (account=%s)", a.Name)
+		if a.srv != nil {
+			a.srv.Errorf("Stream restore failed due to %v", err)
+		}
+		a.mu.RUnlock()
+		return err
+	}
+	sdirCheck := filepath.Clean(sdir) + string(os.PathSeparator)
+
+	tr := tar.NewReader(s2.NewReader(r))
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break // End of snapshot
+		}
+		if err != nil {
+			return _EMPTY_, err
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			return _EMPTY_, logAndReturnError()
+		}
+		fpath := filepath.Join(sdir, filepath.Clean(hdr.Name))
+		if !strings.HasPrefix(fpath, sdirCheck) {
+			return _EMPTY_, logAndReturnError()
+		}
+		os.MkdirAll(filepath.Dir(fpath), defaultDirPerms)
+		fd, err := os.OpenFile(fpath, os.O_CREATE|os.O_RDWR, 0600)
+		if err != nil {
+			return _EMPTY_, err
+		}
+		_, err = io.Copy(fd, tr)
+		fd.Close()
+		if err != nil {
+			return _EMPTY_, err
+		}
+	}
+	ok = true
+	return sdir, nil
+}
+
 // This is to check for dangling messages on interest retention streams.
 // Issue https://github.com/nats-io/nats-server/issues/3612
 func (mset *stream) checkForOrphanMsgs() {
@@ -5358,3 +6934,215 @@ func (mset *stream) clearMonitorRunning() {
 	defer mset.mu.Unlock()
 	mset.inMonitor = false
 }
+
+// schemaValidator checks inbound messages against the schemas configured for a stream.
+type schemaValidator struct {
+	mu      sync.Mutex
+	acc     *Account
+	schemas []*streamSchema
+	stats   StreamSchemaStats
+}
+
+// streamSchema is a compiled StreamSchema.
+type streamSchema struct {
+	subject  string
+	bucket   string
+	key      string
+	inline   *jsonSchema
+	versions map[string]*jsonSchema
+	// Schemas loaded from the KV bucket by subject, recompiled when the entry changes.
+	kv map[string]*kvSchema
+}
+
+type kvSchema struct {
+	seq uint64
+	sch *jsonSchema
+	err error
+}
+
+// Prefixes for KeyValue streams and subjects.
+const (
+	kvStreamPrefix  = "KV_"
+	kvSubjectPrefix = "$KV."
+	kvOpHeader      = "KV-Operation"
+)
+
+// newSchemaValidator will check the schema configs and compile any inline schemas.
+func newSchemaValidator(acc *Account, cfgs []*StreamSchema) (*schemaValidator, error) {
+	sv := &schemaValidator{acc: acc}
+	for _, cfg := range cfgs {
+		if cfg == nil || !IsValidSubject(cfg.Subject) {
+			return nil, fmt.Errorf("stream configuration for schema subject is not valid")
+		}
+		isKV := cfg.Bucket != _EMPTY_ || cfg.Key != _EMPTY_
+		isInline := len(cfg.Schema) > 0 || len(cfg.Versions) > 0
+		if isKV == isInline {
+			return nil, fmt.Errorf("stream configuration for schema on %q requires either an inline schema or a bucket and key", cfg.Subject)
+		}
+		ss := &streamSchema{subject: cfg.Subject, bucket: cfg.Bucket, key: cfg.Key}
+		if isKV {
+			if !isValidName(cfg.Bucket) || !IsValidLiteralSubject(cfg.Key) {
+				return nil, fmt.Errorf("stream configuration for schema on %q has an invalid bucket or key", cfg.Subject)
+			}
+			ss.kv = make(map[string]*kvSchema)
+		}
+		if len(cfg.Schema) > 0 {
+			sch, err := compileJSONSchema(cfg.Schema)
+			if err != nil {
+				return nil, fmt.Errorf("stream configuration for schema on %q not valid: %v", cfg.Subject, err)
+			}
+			ss.inline = sch
+		}
+		for version, doc := range cfg.Versions {
+			sch, err := compileJSONSchema(doc)
+			if err != nil {
+				return nil, fmt.Errorf("stream configuration for schema on %q version %q not valid: %v", cfg.Subject, version, err)
+			}
+			if ss.versions == nil {
+				ss.versions = make(map[string]*jsonSchema)
+			}
+			ss.versions[version] = sch
+		}
+		sv.schemas = append(sv.schemas, ss)
+	}
+	return sv, nil
+}
+
+// statsz returns a copy of the validation metrics.
+func (sv *schemaValidator) statsz() StreamSchemaStats {
+	sv.mu.Lock()
+	defer sv.mu.Unlock()
+	return sv.stats
+}
+
+// check will validate the message against the first schema matching subject.
+// Will return nil if the message is valid or no schema applies.
+// Should not be called with the stream lock held since KV based schemas lookup the bucket's stream.
+func (sv *schemaValidator) check(subject string, hdr, msg []byte) *ApiError {
+	sv.mu.Lock()
+	defer sv.mu.Unlock()
+
+	var ss *streamSchema
+	for _, s := range sv.schemas {
+		if subjectIsSubsetMatch(subject, s.subject) {
+			ss = s
+			break
+		}
+	}
+	if ss == nil {
+		return nil
+	}
+
+	var version string
+	if len(hdr) > 0 {
+		version = string(getHeader(JSSchemaVersion, hdr))
+	}
+	sch, err := ss.lookup(sv.acc, version)
+	if err != nil {
+		sv.stats.Unavailable++
+		return NewJSStreamSchemaUnavailableError(err, subject)
+	}
+	if err := sch.validate(msg); err != nil {
+		sv.stats.Failed++
+		if se, ok := err.(*jsonSchemaError); ok {
+			return NewJSStreamSchemaValidationError(errors.New(se.err), se.path)
+		}
+		return NewJSStreamSchemaValidationError(err, "/")
+	}
+	sv.stats.Validated++
+	return nil
+}
+
+// lookup returns the compiled schema for the version, which can be empty.
+// Lock should be held.
+func (ss *streamSchema) lookup(acc *Account, version string) (*jsonSchema, error) {
+	if ss.kv == nil {
+		if version == _EMPTY_ {
+			if ss.inline == nil {
+				return nil, errors.New("no default version")
+			}
+			return ss.inline, nil
+		}
+		if sch := ss.versions[version]; sch != nil {
+			return sch, nil
+		}
+		return nil, fmt.Errorf("unknown version %q", version)
+	}
+
+	if acc == nil {
+		return nil, errors.New("no account")
+	}
+	key := ss.key
+	if version != _EMPTY_ {
+		if !IsValidLiteralSubject(version) || strings.Contains(version, tsep) {
+			return nil, fmt.Errorf("invalid version %q", version)
+		}
+		key = fmt.Sprintf("%s.%s", ss.key, version)
+	}
+	kv, err := acc.lookupStream(kvStreamPrefix + ss.bucket)
+	if err != nil {
+		return nil, fmt.Errorf("bucket %q not found", ss.bucket)
+	}
+	kv.mu.RLock()
+	store := kv.store
+	kv.mu.RUnlock()
+	if store == nil {
+		return nil, fmt.Errorf("bucket %q not found", ss.bucket)
+	}
+
+	var smv StoreMsg
+	sm, err := store.LoadLastMsg(kvSubjectPrefix+ss.bucket+tsep+key, &smv)
+	if err != nil || sm == nil {
+		delete(ss.kv, key)
+		return nil, fmt.Errorf("key %q not found", key)
+	}
+	if op := getHeader(kvOpHeader, sm.hdr); len(op) > 0 {
+		delete(ss.kv, key)
+		return nil, fmt.Errorf("key %q not found", key)
+	}
+	// Only recompile when the entry has changed.
+	if ks := ss.kv[key]; ks != nil && ks.seq == sm.seq {
+		return ks.sch, ks.err
+	}
+	ks := &kvSchema{seq: sm.seq}
+	if ks.sch, ks.err = compileJSONSchema(sm.msg); ks.err != nil {
+		ks.err = fmt.Errorf("key %q not valid: %v", key, ks.err)
+	}
+	ss.kv[key] = ks
+	return ks.sch, ks.err
+}
+
+// schemaStats returns the schema validation metrics if we have any schemas.
+func (mset *stream) schemaStats() *StreamSchemaStats {
+	mset.mu.RLock()
+	sv := mset.sv
+	mset.mu.RUnlock()
+	if sv == nil {
+		return nil
+	}
+	stats := sv.statsz()
+	return &stats
+}
+
+// checkSchema will validate an inbound message against our schemas and respond
+// on failure. Returns the error if the message should not be stored.
+// Lock should not be held.
+func (mset *stream) checkSchema(subject, reply string, hdr, msg []byte) error {
+	mset.mu.RLock()
+	sv, name, outq := mset.sv, mset.cfg.Name, mset.outq
+	canRespond := !mset.cfg.NoAck && len(reply) > 0
+	mset.mu.RUnlock()
+
+	if sv == nil {
+		return nil
+	}
+	apiErr := sv.check(subject, hdr, msg)
+	if apiErr == nil {
+		return nil
+	}
+	if canRespond && outq != nil {
+		b, _ := json.Marshal(&JSPubAckResponse{PubAck: &PubAck{Stream: name}, Error: apiErr})
+		outq.sendMsg(reply, b)
+	}
+	return apiErr
+}
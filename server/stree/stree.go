@@ -0,0 +1,461 @@
+// Copyright 2023 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package stree provides a compact subject tree, a radix tree keyed by
+// subjects that supports matching with NATS wildcards.
+package stree
+
+import (
+	"strings"
+	"sync"
+)
+
+const (
+	_EMPTY_ = ""
+	tsep    = '.'
+	pwc     = '*'
+	fwc     = '>'
+)
+
+// SubjectTree is a radix tree of subjects to values of type T.
+// Common prefixes are stored once and values are held inline in their parent,
+// which keeps the per subject overhead low for large numbers of similar subjects.
+// Filters with wildcards only visit the parts of the tree that can match.
+// It is not safe for concurrent use.
+type SubjectTree[T any] struct {
+	root node[T]
+	size int
+}
+
+// NewSubjectTree returns an empty subject tree.
+func NewSubjectTree[T any]() *SubjectTree[T] {
+	return &SubjectTree[T]{}
+}
+
+// node holds the bytes shared by all subjects below it in prefix.
+// Children are keyed by their next byte, the child path continues after it.
+type node[T any] struct {
+	prefix string
+	// Value of the subject that ends here, e.g. foo when we also have foo.bar.
+	end  *T
+	keys []byte
+	kids []child[T]
+}
+
+// child is either an interior node or a leaf holding the rest of a subject and its value.
+type child[T any] struct {
+	node   *node[T]
+	suffix string
+	value  T
+}
+
+// Returns the index of the child keyed by b, or where it would be inserted.
+func (n *node[T]) index(b byte) (int, bool) {
+	for i, k := range n.keys {
+		if k >= b {
+			return i, k == b
+		}
+	}
+	return len(n.keys), false
+}
+
+// Insert a child at i. Grows exactly to keep memory tight,
+// nodes rarely have more than a few dozen children.
+func (n *node[T]) insertChild(i int, b byte, c child[T]) {
+	if len(n.kids) == cap(n.kids) {
+		keys := make([]byte, len(n.keys), len(n.keys)+1)
+		copy(keys, n.keys)
+		kids := make([]child[T], len(n.kids), len(n.kids)+1)
+		copy(kids, n.kids)
+		n.keys, n.kids = keys, kids
+	}
+	n.keys = append(n.keys, 0)
+	copy(n.keys[i+1:], n.keys[i:])
+	n.keys[i] = b
+	n.kids = append(n.kids, child[T]{})
+	copy(n.kids[i+1:], n.kids[i:])
+	n.kids[i] = c
+}
+
+func (n *node[T]) removeChild(i int) {
+	n.keys = append(n.keys[:i], n.keys[i+1:]...)
+	copy(n.kids[i:], n.kids[i+1:])
+	n.kids[len(n.kids)-1] = child[T]{}
+	n.kids = n.kids[:len(n.kids)-1]
+}
+
+// Size returns the number of subjects in the tree.
+func (t *SubjectTree[T]) Size() int {
+	if t == nil {
+		return 0
+	}
+	return t.size
+}
+
+// Empty removes all subjects.
+func (t *SubjectTree[T]) Empty() *SubjectTree[T] {
+	if t == nil {
+		return NewSubjectTree[T]()
+	}
+	t.root, t.size = node[T]{}, 0
+	return t
+}
+
+func commonPrefixLen(a, b string) int {
+	i := 0
+	for i < len(a) && i < len(b) && a[i] == b[i] {
+		i++
+	}
+	return i
+}
+
+func hasPrefix(s, prefix string) bool {
+	return len(s) >= len(prefix) && s[:len(prefix)] == prefix
+}
+
+// Insert stores value for subject. If the subject was already present the
+// previous value is returned along with true.
+func (t *SubjectTree[T]) Insert(subject string, value T) (*T, bool) {
+	n := &t.root
+	for {
+		// Split if we only share part of our prefix.
+		if cp := commonPrefixLen(n.prefix, subject); cp < len(n.prefix) {
+			m := &node[T]{prefix: n.prefix[cp+1:], end: n.end, keys: n.keys, kids: n.kids}
+			*n = node[T]{
+				prefix: n.prefix[:cp],
+				keys:   []byte{n.prefix[cp]},
+				kids:   []child[T]{{node: m}},
+			}
+		}
+		subject = subject[len(n.prefix):]
+		if len(subject) == 0 {
+			if n.end != nil {
+				old := *n.end
+				*n.end = value
+				return &old, true
+			}
+			n.end = &value
+			t.size++
+			return nil, false
+		}
+		i, ok := n.index(subject[0])
+		rest := subject[1:]
+		if !ok {
+			// Copy so we do not hold on to the caller's subject.
+			n.insertChild(i, subject[0], child[T]{suffix: strings.Clone(rest), value: value})
+			t.size++
+			return nil, false
+		}
+		c := &n.kids[i]
+		if c.node != nil {
+			n, subject = c.node, rest
+			continue
+		}
+		if c.suffix == rest {
+			old := c.value
+			c.value = value
+			return &old, true
+		}
+		// Turn this leaf into an interior node holding both.
+		cp := commonPrefixLen(c.suffix, rest)
+		m := &node[T]{prefix: c.suffix[:cp]}
+		ov, os := c.value, c.suffix[cp:]
+		if len(os) == 0 {
+			m.end = &ov
+		} else {
+			m.insertChild(0, os[0], child[T]{suffix: os[1:], value: ov})
+		}
+		*c = child[T]{node: m}
+		n, subject = m, rest
+	}
+}
+
+// Find returns the value for subject. Subject can not contain wildcards.
+// The returned value can be updated in place, but is only valid until the
+// tree is next modified.
+func (t *SubjectTree[T]) Find(subject string) (*T, bool) {
+	if t == nil {
+		return nil, false
+	}
+	for n := &t.root; ; {
+		if !hasPrefix(subject, n.prefix) {
+			return nil, false
+		}
+		subject = subject[len(n.prefix):]
+		if len(subject) == 0 {
+			return n.end, n.end != nil
+		}
+		i, ok := n.index(subject[0])
+		if !ok {
+			return nil, false
+		}
+		c, rest := &n.kids[i], subject[1:]
+		if c.node == nil {
+			if c.suffix == rest {
+				return &c.value, true
+			}
+			return nil, false
+		}
+		n, subject = c.node, rest
+	}
+}
+
+// Delete removes subject and returns its value.
+func (t *SubjectTree[T]) Delete(subject string) (*T, bool) {
+	if t == nil {
+		return nil, false
+	}
+	v, ok := t.root.delete(subject)
+	if ok {
+		t.size--
+	}
+	return v, ok
+}
+
+func (n *node[T]) delete(subject string) (*T, bool) {
+	if !hasPrefix(subject, n.prefix) {
+		return nil, false
+	}
+	subject = subject[len(n.prefix):]
+	if len(subject) == 0 {
+		v := n.end
+		n.end = nil
+		return v, v != nil
+	}
+	i, ok := n.index(subject[0])
+	if !ok {
+		return nil, false
+	}
+	c, rest := &n.kids[i], subject[1:]
+	if c.node == nil {
+		if c.suffix != rest {
+			return nil, false
+		}
+		v := c.value
+		n.removeChild(i)
+		return &v, true
+	}
+	v, ok := c.node.delete(rest)
+	if !ok {
+		return nil, false
+	}
+	// Collapse the child if no longer needed.
+	switch m := c.node; {
+	case len(m.kids) == 0 && m.end == nil:
+		n.removeChild(i)
+	case len(m.kids) == 0:
+		*c = child[T]{suffix: m.prefix, value: *m.end}
+	case len(m.kids) == 1 && m.end == nil:
+		gc := m.kids[0]
+		if gc.node != nil {
+			gc.node.prefix = m.prefix + string(m.keys[:1]) + gc.node.prefix
+			*c = child[T]{node: gc.node}
+		} else {
+			*c = child[T]{suffix: m.prefix + string(m.keys[:1]) + gc.suffix, value: gc.value}
+		}
+	}
+	return v, true
+}
+
+// Iter walks all subjects in lexical order. The subject passed to cb is
+// only valid for the duration of the call. Returning false stops the walk.
+// The tree can not be modified from cb.
+func (t *SubjectTree[T]) Iter(cb func(subject []byte, val *T) bool) {
+	if t == nil {
+		return
+	}
+	bp := subjectBufPool.Get().(*[]byte)
+	t.root.iter((*bp)[:0], cb)
+	subjectBufPool.Put(bp)
+}
+
+// Buffers to build the subjects passed to callbacks, these would escape if on the stack.
+var subjectBufPool = sync.Pool{
+	New: func() any {
+		b := make([]byte, 0, 256)
+		return &b
+	},
+}
+
+func (n *node[T]) iter(pre []byte, cb func(subject []byte, val *T) bool) bool {
+	pre = append(pre, n.prefix...)
+	if n.end != nil && !cb(pre, n.end) {
+		return false
+	}
+	for i := range n.kids {
+		c, cpre := &n.kids[i], append(pre, n.keys[i])
+		if c.node != nil {
+			if !c.node.iter(cpre, cb) {
+				return false
+			}
+		} else if !cb(append(cpre, c.suffix...), &c.value) {
+			return false
+		}
+	}
+	return true
+}
+
+// Match calls cb for every subject that matches filter, which can contain
+// wildcards. The subject passed to cb is only valid for the duration of the call.
+// Returning false stops the walk. The tree can not be modified from cb.
+func (t *SubjectTree[T]) Match(filter string, cb func(subject []byte, val *T) bool) {
+	if t == nil || len(filter) == 0 {
+		return
+	}
+	var _tokens [32]string
+	tokens, wc := tokenize(_tokens[:0], filter)
+	bp := subjectBufPool.Get().(*[]byte)
+	if !wc {
+		if v, ok := t.Find(filter); ok {
+			cb(append((*bp)[:0], filter...), v)
+		}
+	} else {
+		t.root.match(matcher{tokens: tokens}, (*bp)[:0], cb)
+	}
+	subjectBufPool.Put(bp)
+}
+
+// Splits filter into tokens appended to tts without allocating for typical filters.
+// Also returns if the filter has any wildcards.
+func tokenize(tts []string, filter string) ([]string, bool) {
+	var wc bool
+	start := 0
+	for i := 0; i <= len(filter); i++ {
+		if i == len(filter) || filter[i] == tsep {
+			tk := filter[start:i]
+			wc = wc || isPwc(tk) || isFwc(tk)
+			tts = append(tts, tk)
+			start = i + 1
+		}
+	}
+	return tts, wc
+}
+
+// matcher tracks our position in a tokenized filter as subject bytes are fed to it.
+type matcher struct {
+	tokens []string
+	ti     int // Current token.
+	ci     int // Bytes of the subject consumed for the current token.
+}
+
+func (m *matcher) token() (string, bool) {
+	if m.ti < len(m.tokens) {
+		return m.tokens[m.ti], true
+	}
+	return _EMPTY_, false
+}
+
+func isPwc(tk string) bool { return len(tk) == 1 && tk[0] == pwc }
+func isFwc(tk string) bool { return len(tk) == 1 && tk[0] == fwc }
+
+// Feed a single subject byte, returns false if the subject can no longer match.
+func (m *matcher) feed(b byte) bool {
+	tk, ok := m.token()
+	switch {
+	case !ok:
+		return false
+	case isFwc(tk):
+		m.ci++
+	case isPwc(tk):
+		if b != tsep {
+			m.ci++
+		} else if m.ci == 0 || m.ti+1 >= len(m.tokens) {
+			return false
+		} else {
+			m.ti, m.ci = m.ti+1, 0
+		}
+	case m.ci < len(tk):
+		if tk[m.ci] != b {
+			return false
+		}
+		m.ci++
+	default:
+		if b != tsep || m.ti+1 >= len(m.tokens) {
+			return false
+		}
+		m.ti, m.ci = m.ti+1, 0
+	}
+	return true
+}
+
+func (m *matcher) feedAll(p string) bool {
+	for i := 0; i < len(p); i++ {
+		if !m.feed(p[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// Returns true if the subject fed so far matches.
+func (m *matcher) matched() bool {
+	if m.ti != len(m.tokens)-1 {
+		return false
+	}
+	if tk, _ := m.token(); isFwc(tk) || isPwc(tk) {
+		return m.ci > 0
+	} else {
+		return m.ci == len(tk)
+	}
+}
+
+// Returns the only byte the next subject byte can be, if any.
+func (m *matcher) next() (byte, bool) {
+	tk, ok := m.token()
+	switch {
+	case !ok, isFwc(tk), isPwc(tk):
+		return 0, false
+	case m.ci < len(tk):
+		return tk[m.ci], true
+	default:
+		return tsep, true
+	}
+}
+
+// Returns false if the walk was stopped.
+func (n *node[T]) match(m matcher, pre []byte, cb func(subject []byte, val *T) bool) bool {
+	if !m.feedAll(n.prefix) {
+		return true
+	}
+	pre = append(pre, n.prefix...)
+	if n.end != nil && m.matched() && !cb(pre, n.end) {
+		return false
+	}
+	// If the next byte is known only descend into that child.
+	if b, ok := m.next(); ok {
+		if i, ok := n.index(b); ok {
+			return n.matchChild(i, m, pre, cb)
+		}
+		return true
+	}
+	for i := range n.kids {
+		if !n.matchChild(i, m, pre, cb) {
+			return false
+		}
+	}
+	return true
+}
+
+func (n *node[T]) matchChild(i int, m matcher, pre []byte, cb func(subject []byte, val *T) bool) bool {
+	if !m.feed(n.keys[i]) {
+		return true
+	}
+	c, pre := &n.kids[i], append(pre, n.keys[i])
+	if c.node != nil {
+		return c.node.match(m, pre, cb)
+	}
+	if m.feedAll(c.suffix) && m.matched() {
+		return cb(append(pre, c.suffix...), &c.value)
+	}
+	return true
+}
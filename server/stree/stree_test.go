@@ -0,0 +1,381 @@
+// Copyright 2023 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stree
+
+import (
+	"fmt"
+	"math/rand"
+	"runtime"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// Reference matching, tokens compared one by one.
+func isMatch(subj, filter string) bool {
+	st, ft := strings.Split(subj, "."), strings.Split(filter, ".")
+	for i, f := range ft {
+		if f == ">" {
+			return len(st) > i
+		}
+		if i >= len(st) || (f != "*" && f != st[i]) {
+			return false
+		}
+	}
+	return len(st) == len(ft)
+}
+
+func matches(st *SubjectTree[int], filter string) []string {
+	var subjs []string
+	st.Match(filter, func(subj []byte, _ *int) bool {
+		subjs = append(subjs, string(subj))
+		return true
+	})
+	sort.Strings(subjs)
+	return subjs
+}
+
+func TestSubjectTreeInsertFindDelete(t *testing.T) {
+	st := NewSubjectTree[int]()
+	subjs := []string{"foo", "foo.bar", "foo.baz", "foo.bar.baz", "fo", "bar", "foo.b", "f"}
+	for i, subj := range subjs {
+		if old, updated := st.Insert(subj, i); updated || old != nil {
+			t.Fatalf("Expected new insert for %q", subj)
+		}
+	}
+	if st.Size() != len(subjs) {
+		t.Fatalf("Expected size %d, got %d", len(subjs), st.Size())
+	}
+	for i, subj := range subjs {
+		v, ok := st.Find(subj)
+		if !ok || *v != i {
+			t.Fatalf("Expected to find %q with %d, got %v %v", subj, i, ok, v)
+		}
+	}
+	for _, subj := range []string{"fooo", "foo.ba", "", "foo.bar.baz.x", "b"} {
+		if _, ok := st.Find(subj); ok {
+			t.Fatalf("Did not expect to find %q", subj)
+		}
+	}
+	// Update in place and through insert.
+	v, _ := st.Find("foo.bar")
+	*v = 22
+	if old, updated := st.Insert("foo.bar", 33); !updated || *old != 22 {
+		t.Fatalf("Expected update with old value 22, got %v %v", updated, old)
+	}
+	if st.Size() != len(subjs) {
+		t.Fatalf("Expected size %d, got %d", len(subjs), st.Size())
+	}
+	// Delete all in a random order, checking the rest each time.
+	left := map[string]bool{}
+	for _, subj := range subjs {
+		left[subj] = true
+	}
+	for _, i := range rand.Perm(len(subjs)) {
+		subj := subjs[i]
+		if _, ok := st.Delete(subj); !ok {
+			t.Fatalf("Expected to delete %q", subj)
+		}
+		if _, ok := st.Delete(subj); ok {
+			t.Fatalf("Did not expect to delete %q twice", subj)
+		}
+		delete(left, subj)
+		for subj := range left {
+			if _, ok := st.Find(subj); !ok {
+				t.Fatalf("Expected to still find %q", subj)
+			}
+		}
+		if st.Size() != len(left) {
+			t.Fatalf("Expected size %d, got %d", len(left), st.Size())
+		}
+	}
+	if st.root.end != nil || len(st.root.kids) != 0 {
+		t.Fatalf("Expected empty tree")
+	}
+}
+
+func TestSubjectTreeIter(t *testing.T) {
+	st := NewSubjectTree[int]()
+	subjs := []string{"foo.bar", "foo", "a.b.c", "foo.bar.baz", "zzz", "foo.baz"}
+	for i, subj := range subjs {
+		st.Insert(subj, i)
+	}
+	var got []string
+	st.Iter(func(subj []byte, _ *int) bool {
+		got = append(got, string(subj))
+		return true
+	})
+	sort.Strings(subjs)
+	if fmt.Sprint(got) != fmt.Sprint(subjs) {
+		t.Fatalf("Expected %v in order, got %v", subjs, got)
+	}
+	// Stop early.
+	n := 0
+	st.Iter(func(_ []byte, _ *int) bool {
+		n++
+		return n < 2
+	})
+	if n != 2 {
+		t.Fatalf("Expected to stop after 2, got %d", n)
+	}
+}
+
+func TestSubjectTreeMatch(t *testing.T) {
+	st := NewSubjectTree[int]()
+	var subjs []string
+	for _, a := range []string{"foo", "fo", "foo.baz", "bar"} {
+		for _, c := range []string{"", ".1", ".12", ".2", ".1.x", ".22.x.y", ".bar", ".bar.baz"} {
+			subjs = append(subjs, a+c)
+		}
+	}
+	for i, subj := range subjs {
+		st.Insert(subj, i)
+	}
+	for _, filter := range []string{
+		">", "*", "*.*", "foo", "foo.*", "foo.>", "*.bar", "*.*.>", "foo.*.x", "*.1.*", "fo.>",
+		"foo.bar.>", "foo.bar.*", "*.22.x.*", "*.*.*.*", "foo.1", "fo.*.x", "f*", "foo.b", "*.bar.>",
+	} {
+		var expected []string
+		for _, subj := range subjs {
+			if isMatch(subj, filter) {
+				expected = append(expected, subj)
+			}
+		}
+		sort.Strings(expected)
+		if got := matches(st, filter); fmt.Sprint(got) != fmt.Sprint(expected) {
+			t.Fatalf("Filter %q: expected %v, got %v", filter, expected, got)
+		}
+	}
+}
+
+func TestSubjectTreeMatchStop(t *testing.T) {
+	st := NewSubjectTree[int]()
+	for i := 0; i < 10; i++ {
+		st.Insert(fmt.Sprintf("foo.%d", i), i)
+	}
+	n := 0
+	st.Match("foo.*", func(_ []byte, _ *int) bool {
+		n++
+		return n < 3
+	})
+	if n != 3 {
+		t.Fatalf("Expected to stop after 3, got %d", n)
+	}
+}
+
+func TestSubjectTreeMatchAllocs(t *testing.T) {
+	st := NewSubjectTree[int]()
+	for i := 0; i < 100; i++ {
+		st.Insert(fmt.Sprintf("foo.%d.bar", i), i)
+	}
+	var n int
+	cb := func(_ []byte, _ *int) bool {
+		n++
+		return true
+	}
+	for _, filter := range []string{"foo.22.bar", "foo.*.bar", "foo.>"} {
+		if allocs := testing.AllocsPerRun(100, func() { st.Match(filter, cb) }); allocs > 0 {
+			t.Fatalf("Expected no allocations matching %q, got %v", filter, allocs)
+		}
+	}
+	if allocs := testing.AllocsPerRun(100, func() { st.Iter(cb) }); allocs > 0 {
+		t.Fatalf("Expected no allocations iterating, got %v", allocs)
+	}
+}
+
+func TestSubjectTreeRandom(t *testing.T) {
+	st := NewSubjectTree[int]()
+	ref := map[string]int{}
+	tokens := []string{"a", "ab", "b", "ba", "abc", "\xc3\xa9"}
+	genSubj := func() string {
+		n := rand.Intn(4) + 1
+		var sb strings.Builder
+		for i := 0; i < n; i++ {
+			if i > 0 {
+				sb.WriteByte('.')
+			}
+			sb.WriteString(tokens[rand.Intn(len(tokens))])
+		}
+		return sb.String()
+	}
+	for i := 0; i < 10_000; i++ {
+		subj := genSubj()
+		if rand.Intn(3) == 0 {
+			_, ok := st.Delete(subj)
+			if _, rok := ref[subj]; ok != rok {
+				t.Fatalf("Delete of %q mismatch", subj)
+			}
+			delete(ref, subj)
+		} else {
+			st.Insert(subj, i)
+			ref[subj] = i
+		}
+		if st.Size() != len(ref) {
+			t.Fatalf("Expected size %d, got %d", len(ref), st.Size())
+		}
+	}
+	for subj, i := range ref {
+		if v, ok := st.Find(subj); !ok || *v != i {
+			t.Fatalf("Expected %q to be %d", subj, i)
+		}
+	}
+	for _, filter := range []string{">", "a.>", "*.b", "ab.*.>", "*.*", "b.*.a.*"} {
+		var expected []string
+		for subj := range ref {
+			if isMatch(subj, filter) {
+				expected = append(expected, subj)
+			}
+		}
+		sort.Strings(expected)
+		if got := matches(st, filter); fmt.Sprint(got) != fmt.Sprint(expected) {
+			t.Fatalf("Filter %q: expected %d matches, got %d", filter, len(expected), len(got))
+		}
+	}
+}
+
+// Number of subjects for the benchmarks below.
+// These mimic KV buckets keyed by device ID.
+const benchSubjects = 10_000_000
+
+func benchSubject(i int) string {
+	return fmt.Sprintf("$KV.devices.dev-%08d", i)
+}
+
+// Matches what the filestore tracks per subject.
+type benchPSI struct {
+	total      uint64
+	fblk, lblk uint32
+}
+
+func heapInUse() uint64 {
+	var ms runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&ms)
+	return ms.HeapAlloc
+}
+
+func BenchmarkSubjectTreeMemory(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		start := heapInUse()
+		st := NewSubjectTree[benchPSI]()
+		for i := 0; i < benchSubjects; i++ {
+			st.Insert(benchSubject(i), benchPSI{total: 1})
+		}
+		b.ReportMetric(float64(heapInUse()-start)/benchSubjects, "heap-bytes/subject")
+		runtime.KeepAlive(st)
+	}
+}
+
+func BenchmarkSubjectMapMemory(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		start := heapInUse()
+		m := make(map[string]*benchPSI)
+		for i := 0; i < benchSubjects; i++ {
+			m[benchSubject(i)] = &benchPSI{total: 1}
+		}
+		b.ReportMetric(float64(heapInUse()-start)/benchSubjects, "heap-bytes/subject")
+		runtime.KeepAlive(m)
+	}
+}
+
+var (
+	benchTree *SubjectTree[benchPSI]
+	benchMap  map[string]*benchPSI
+)
+
+func loadBenchTree() *SubjectTree[benchPSI] {
+	if benchTree == nil {
+		benchTree = NewSubjectTree[benchPSI]()
+		for i := 0; i < benchSubjects; i++ {
+			benchTree.Insert(benchSubject(i), benchPSI{total: 1})
+		}
+	}
+	return benchTree
+}
+
+func loadBenchMap() map[string]*benchPSI {
+	if benchMap == nil {
+		benchMap = make(map[string]*benchPSI)
+		for i := 0; i < benchSubjects; i++ {
+			benchMap[benchSubject(i)] = &benchPSI{total: 1}
+		}
+	}
+	return benchMap
+}
+
+// Filters selecting a single subject under a wildcard, which requires a
+// scan of every subject with a map.
+func BenchmarkSubjectTreeWildcardMatchSparse(b *testing.B) {
+	st := loadBenchTree()
+	filter := "$KV.devices.dev-00001234.*"
+	st.Insert("$KV.devices.dev-00001234.x", benchPSI{})
+	defer st.Delete("$KV.devices.dev-00001234.x")
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var n int
+		st.Match(filter, func(_ []byte, _ *benchPSI) bool {
+			n++
+			return true
+		})
+		if n != 1 {
+			b.Fatalf("Expected 1 match, got %d", n)
+		}
+	}
+}
+
+func BenchmarkSubjectMapWildcardMatchSparse(b *testing.B) {
+	m := loadBenchMap()
+	m["$KV.devices.dev-00001234.x"] = &benchPSI{}
+	defer delete(m, "$KV.devices.dev-00001234.x")
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var n int
+		for subj := range m {
+			if isMatch(subj, "$KV.devices.dev-00001234.*") {
+				n++
+			}
+		}
+		if n != 1 {
+			b.Fatalf("Expected 1 match, got %d", n)
+		}
+	}
+}
+
+func BenchmarkSubjectTreeFind(b *testing.B) {
+	st := loadBenchTree()
+	subjs := make([]string, 1024)
+	for i := range subjs {
+		subjs[i] = benchSubject(rand.Intn(benchSubjects))
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, ok := st.Find(subjs[i%len(subjs)]); !ok {
+			b.Fatalf("Expected to find subject")
+		}
+	}
+}
+
+func BenchmarkSubjectMapFind(b *testing.B) {
+	m := loadBenchMap()
+	subjs := make([]string, 1024)
+	for i := range subjs {
+		subjs[i] = benchSubject(rand.Intn(benchSubjects))
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, ok := m[subjs[i%len(subjs)]]; !ok {
+			b.Fatalf("Expected to find subject")
+		}
+	}
+}